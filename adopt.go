@@ -0,0 +1,77 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//AdoptionRequestDirectory is where administrators place files to confirm
+//that a drive with an unexpected filesystem (see core.Drive.NeedsAdoption)
+//shall be mounted below /srv/node. The file name is the swift-id or drive ID
+//of the drive in question.
+const AdoptionRequestDirectory = "/run/swift-storage/adopt"
+
+//AdoptDriveEvent is an Event that is emitted by CollectRequestFiles for
+//AdoptionRequestDirectory.
+type AdoptDriveEvent struct {
+	//Name is the swift-id or the drive ID of the drive in question.
+	Name string
+}
+
+//LogMessage implements the Event interface.
+func (e AdoptDriveEvent) LogMessage() string {
+	return "adoption requested for " + e.Name
+}
+
+//EventType implements the Event interface.
+func (e AdoptDriveEvent) EventType() string {
+	return "drive-adoption-requested"
+}
+
+//Handle implements the Event interface.
+func (e AdoptDriveEvent) Handle(c *Converger) {
+	err := c.adoptDrive(e.Name)
+	if err != nil {
+		util.LogError(err.Error())
+	}
+}
+
+//Confirms the unexpected filesystem on the drive with the given swift-id or
+//drive ID.
+func (c *Converger) adoptDrive(name string) error {
+	for _, drive := range c.Drives {
+		if drive.DriveID != name && (drive.Assignment == nil || drive.Assignment.SwiftID != name) {
+			continue
+		}
+		if !drive.NeedsAdoption() {
+			util.LogInfo("%s does not need to be adopted", drive.DevicePath)
+			return nil
+		}
+		util.LogInfo("adopting filesystem %s on %s (previously expected filesystem %s)",
+			drive.FilesystemUUID, drive.DevicePath, drive.ExpectedFilesystemUUID)
+		drive.Adopt()
+		//the next Converge() will mount the drive below /srv/node
+		return nil
+	}
+	return fmt.Errorf("cannot adopt %s: no such drive", name)
+}
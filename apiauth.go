@@ -0,0 +1,111 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sapcc/go-bits/secrets"
+)
+
+//APIRole describes which HTTP endpoints an API token may use.
+type APIRole string
+
+const (
+	//ReadOnlyRole allows all GET and HEAD requests (metrics, status, health
+	//checks).
+	ReadOnlyRole APIRole = "read-only"
+	//AdminRole additionally allows all requests that change something (e.g.
+	//POST /api/v1/converge or /api/v1/prepare-reboot).
+	AdminRole APIRole = "admin"
+)
+
+//APIToken appears in type Configuration.
+type APIToken struct {
+	Role  APIRole              `yaml:"role"`
+	Token secrets.AuthPassword `yaml:"token"`
+}
+
+//Validate checks the API token configuration.
+func (t APIToken) Validate() error {
+	if t.Role != ReadOnlyRole && t.Role != AdminRole {
+		return fmt.Errorf(`role must be "read-only" or "admin", but is %q`, t.Role)
+	}
+	if t.Token == "" {
+		return fmt.Errorf("token may not be empty")
+	}
+	return nil
+}
+
+//Returns the role of the given token, or an empty string if it is not one of
+//the configured tokens.
+func roleForToken(token string) APIRole {
+	var result APIRole
+	for _, t := range Config.APITokens {
+		//compare all tokens in constant time, so that timing does not reveal
+		//which token almost matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 && result != AdminRole {
+			result = t.Role
+		}
+	}
+	return result
+}
+
+//AuthorizeAPIRequests wraps the given handler such that each request needs a
+//bearer token with a sufficient role: requests that only read (GET, HEAD)
+//need any of the configured tokens, and all others need an admin token. The
+//profiling endpoints below /debug/pprof/ need an admin token as well, since
+//they are expensive and can reveal secrets (e.g. in the command line). If no
+//tokens are configured, no token is needed for requests that only read, but
+//all requests that need an admin token are rejected.
+func AuthorizeAPIRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		needsAdmin := (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+			strings.HasPrefix(r.URL.Path, "/debug/pprof/")
+
+		if len(Config.APITokens) == 0 {
+			if needsAdmin {
+				http.Error(w, "forbidden: this request needs an admin token, but no api-tokens are configured", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		token := ""
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimPrefix(header, "Bearer ")
+		}
+		role := roleForToken(token)
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if needsAdmin && role != AdminRole {
+			http.Error(w, "forbidden: this request needs an admin token", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeAPIRequests(t *testing.T) {
+	handler := AuthorizeAPIRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tokens := []APIToken{
+		{Role: ReadOnlyRole, Token: "monitoring"},
+		{Role: AdminRole, Token: "admin"},
+	}
+
+	testCases := []struct {
+		Tokens   []APIToken
+		Method   string
+		Path     string
+		Token    string
+		Expected int
+	}{
+		//without tokens, only requests that read are allowed
+		{nil, http.MethodGet, "/api/v1/status", "", http.StatusNoContent},
+		{nil, http.MethodPost, "/api/v1/converge", "", http.StatusForbidden},
+		{nil, http.MethodPost, "/api/v1/bulk", "", http.StatusForbidden},
+		{nil, http.MethodGet, "/debug/pprof/cmdline", "", http.StatusForbidden},
+		//with tokens, roles decide
+		{tokens, http.MethodGet, "/api/v1/status", "", http.StatusUnauthorized},
+		{tokens, http.MethodGet, "/api/v1/status", "wrong", http.StatusUnauthorized},
+		{tokens, http.MethodGet, "/api/v1/status", "monitoring", http.StatusNoContent},
+		{tokens, http.MethodPost, "/api/v1/converge", "monitoring", http.StatusForbidden},
+		{tokens, http.MethodGet, "/debug/pprof/profile", "monitoring", http.StatusForbidden},
+		{tokens, http.MethodPost, "/api/v1/converge", "admin", http.StatusNoContent},
+		{tokens, http.MethodGet, "/debug/pprof/profile", "admin", http.StatusNoContent},
+	}
+
+	defer func(tokens []APIToken) { Config.APITokens = tokens }(Config.APITokens)
+	for _, tc := range testCases {
+		Config.APITokens = tc.Tokens
+		req := httptest.NewRequest(tc.Method, tc.Path, nil)
+		if tc.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.Token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.Expected {
+			t.Errorf("%s %s with %d tokens and token %q: expected status %d, got %d",
+				tc.Method, tc.Path, len(tc.Tokens), tc.Token, tc.Expected, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sapcc/go-bits/secrets"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//BarbicanKeySource appears in type Configuration. It references an encryption
+//key that is stored as a secret in OpenStack Barbican. To authenticate with
+//Keystone, either the user credentials or an application credential must be
+//given.
+type BarbicanKeySource struct {
+	AuthURL                     string               `yaml:"auth-url"`
+	RegionName                  string               `yaml:"region-name"`
+	UserName                    string               `yaml:"user-name"`
+	UserDomainName              string               `yaml:"user-domain-name"`
+	ProjectName                 string               `yaml:"project-name"`
+	ProjectDomainName           string               `yaml:"project-domain-name"`
+	Password                    secrets.AuthPassword `yaml:"password"`
+	ApplicationCredentialID     string               `yaml:"application-credential-id"`
+	ApplicationCredentialSecret secrets.AuthPassword `yaml:"application-credential-secret"`
+	//SecretID is the UUID of the secret, or its full secret reference URL.
+	SecretID string `yaml:"secret-id"`
+}
+
+//Validate checks the key source configuration.
+func (b BarbicanKeySource) Validate() error {
+	u, err := url.Parse(b.AuthURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid auth-url %q: expected a URL like https://keystone.example.com/v3", b.AuthURL)
+	}
+	if b.SecretID == "" {
+		return errors.New("secret-id must be given")
+	}
+	useAppCred := b.ApplicationCredentialID != "" || b.ApplicationCredentialSecret != ""
+	useUser := b.UserName != "" || b.Password != ""
+	switch {
+	case useAppCred && useUser:
+		return errors.New("user credentials cannot be combined with an application credential")
+	case useAppCred && (b.ApplicationCredentialID == "" || b.ApplicationCredentialSecret == ""):
+		return errors.New("application-credential-id and application-credential-secret must be given together")
+	case useAppCred:
+		return nil
+	case !useUser:
+		return errors.New("either user credentials or an application credential must be given")
+	case b.UserName == "" || b.Password == "" || b.UserDomainName == "" || b.ProjectName == "" || b.ProjectDomainName == "":
+		return errors.New("user-name, user-domain-name, project-name, project-domain-name and password must be given together")
+	}
+	return nil
+}
+
+//Describes the key source in log messages.
+func (b BarbicanKeySource) String() string {
+	return "Barbican secret " + b.SecretID
+}
+
+//Fetch reads the encryption key from Barbican.
+func (b BarbicanKeySource) Fetch(client *http.Client) (string, error) {
+	token, endpointURL, err := b.authenticate(client)
+	if err != nil {
+		return "", fmt.Errorf("Keystone authentication failed: %s", err.Error())
+	}
+	defer b.revokeToken(client, token)
+
+	secretURL := b.SecretID
+	if !strings.Contains(secretURL, "://") {
+		if endpointURL == "" {
+			return "", errors.New("no endpoint for Barbican found in the Keystone catalog")
+		}
+		endpointURL = strings.TrimSuffix(endpointURL, "/")
+		if !strings.HasSuffix(endpointURL, "/v1") {
+			endpointURL += "/v1"
+		}
+		secretURL = endpointURL + "/secrets/" + b.SecretID
+	}
+
+	payload, _, err := b.request(client, http.MethodGet, secretURL+"/payload", token, nil)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(payload))
+	if value == "" {
+		return "", errors.New("secret payload is empty")
+	}
+	return value, nil
+}
+
+//Obtains a Keystone token, and finds the Barbican endpoint in the Keystone
+//catalog. The token is scoped to the project (if user credentials are given)
+//or to the application credential's project.
+func (b BarbicanKeySource) authenticate(client *http.Client) (token, endpointURL string, err error) {
+	type name struct {
+		Name string `json:"name"`
+	}
+	identity := map[string]interface{}{}
+	var scope interface{}
+	if b.ApplicationCredentialID != "" {
+		identity["methods"] = []string{"application_credential"}
+		identity["application_credential"] = map[string]string{
+			"id":     b.ApplicationCredentialID,
+			"secret": string(b.ApplicationCredentialSecret),
+		}
+	} else {
+		identity["methods"] = []string{"password"}
+		identity["password"] = map[string]interface{}{
+			"user": map[string]interface{}{
+				"name":     b.UserName,
+				"domain":   name{b.UserDomainName},
+				"password": string(b.Password),
+			},
+		}
+		scope = map[string]interface{}{
+			"project": map[string]interface{}{
+				"name":   b.ProjectName,
+				"domain": name{b.ProjectDomainName},
+			},
+		}
+	}
+	auth := map[string]interface{}{"identity": identity}
+	if scope != nil {
+		auth["scope"] = scope
+	}
+
+	tokensURL := strings.TrimSuffix(b.AuthURL, "/") + "/auth/tokens"
+	respBody, respHeader, err := b.request(client, http.MethodPost, tokensURL, "", map[string]interface{}{"auth": auth})
+	if err != nil {
+		return "", "", err
+	}
+	token = respHeader.Get("X-Subject-Token")
+	if token == "" {
+		return "", "", errors.New("no token received")
+	}
+
+	var data struct {
+		Token struct {
+			Catalog []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					RegionID  string `json:"region_id"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	err = json.Unmarshal(respBody, &data)
+	if err != nil {
+		return token, "", err
+	}
+	for _, service := range data.Token.Catalog {
+		if service.Type != "key-manager" {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface == "public" && (b.RegionName == "" || endpoint.RegionID == b.RegionName) {
+				return token, endpoint.URL, nil
+			}
+		}
+	}
+	return token, "", nil
+}
+
+//Revokes the token after use. Failures are not fatal since the token expires
+//by itself.
+func (b BarbicanKeySource) revokeToken(client *http.Client, token string) {
+	tokensURL := strings.TrimSuffix(b.AuthURL, "/") + "/auth/tokens"
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, tokensURL, nil)
+	if err == nil {
+		req.Header.Set("X-Auth-Token", token)
+		req.Header.Set("X-Subject-Token", token)
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = errors.New(resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		util.LogError("cannot revoke Keystone token obtained for %s: %s", b.String(), err.Error())
+	}
+}
+
+//Sends a request to Keystone or Barbican. The body (if not nil) is encoded as
+//JSON.
+func (b BarbicanKeySource) request(client *http.Client, method, reqURL, token string, body interface{}) ([]byte, http.Header, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("%s %s returned %s", method, req.URL.Path, resp.Status)
+	}
+	return respBody, resp.Header, nil
+}
@@ -0,0 +1,105 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+)
+
+//convergenceBudget limits the amount of work that a single Converge() does
+//for drives that still need to be set up (see Config.ConvergenceBudget).
+//Drives that do not fit into the budget are deferred to the next convergence,
+//so that the converger can handle pending events (e.g. hotplugged drives) in
+//between. Drives that are already mounted or broken are always processed
+//since this does not involve any heavy operations. The budget also keeps
+//track of the drives that were skipped because of device locks.
+type convergenceBudget struct {
+	startedAt time.Time
+	mutex     sync.Mutex //since drives may be processed concurrently
+	formats   int
+	deferred  map[string]bool
+	//drives that were skipped because another process holds their lock (see
+	//Config.DeviceLocking)
+	locked map[string]bool
+}
+
+func budgetConfigured() bool {
+	return Config.ConvergenceBudget.MaxDuration > 0 || Config.ConvergenceBudget.MaxFormats > 0
+}
+
+func newConvergenceBudget() *convergenceBudget {
+	return &convergenceBudget{startedAt: time.Now(), deferred: make(map[string]bool), locked: make(map[string]bool)}
+}
+
+//Admit decides whether the given drive may be set up in this convergence.
+//Since this is checked before the setup of each drive starts, drives that
+//are already being set up concurrently may exceed the budget somewhat.
+func (b *convergenceBudget) Admit(drive *core.Drive) bool {
+	if !budgetConfigured() || drive.Broken || drive.MountedPath() != "" {
+		return true
+	}
+
+	cfg := Config.ConvergenceBudget
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	exhausted := (cfg.MaxDuration > 0 && time.Since(b.startedAt) >= cfg.MaxDuration) ||
+		(cfg.MaxFormats > 0 && b.formats >= cfg.MaxFormats)
+	if exhausted {
+		b.deferred[drive.DriveID] = true
+	}
+	return !exhausted
+}
+
+//Record counts the work that was done for the given drive, given the value of
+//drive.FormattedAt from before its setup.
+func (b *convergenceBudget) Record(drive *core.Drive, formattedAtBefore time.Time) {
+	if drive.FormattedAt.Equal(formattedAtBefore) {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.formats++
+}
+
+//RecordLocked records that the given drive was not set up because another
+//process holds its lock.
+func (b *convergenceBudget) RecordLocked(drive *core.Drive) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.locked[drive.DriveID] = true
+}
+
+//LockedCount returns how many drives were not set up because another process
+//holds their lock.
+func (b *convergenceBudget) LockedCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.locked)
+}
+
+//DeferredCount returns how many drives were deferred to the next convergence.
+func (b *convergenceBudget) DeferredCount() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.deferred)
+}
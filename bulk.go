@@ -0,0 +1,356 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	std_os "os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//BulkOperation appears in type BulkRequest. It applies one action to a set of
+//drives, which are given by swift-id or drive ID (or, for "quarantine" and
+//"release-quarantine", by the serial number or device name that appears in
+//StatusReport.QuarantinedDrives).
+type BulkOperation struct {
+	Action string   `json:"action"`
+	Drives []string `json:"drives"`
+}
+
+//BulkRequest is the request body for POST /api/v1/bulk.
+type BulkRequest struct {
+	Operations []BulkOperation `json:"operations"`
+	//DryRun only checks whether each item could be executed.
+	DryRun bool `json:"dry_run"`
+}
+
+//BulkItemResult describes the outcome of one action on one drive. The
+//response for POST /api/v1/bulk contains one for each drive in each
+//BulkOperation, in the order of the request.
+type BulkItemResult struct {
+	Action string `json:"action"`
+	Drive  string `json:"drive"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+//BulkResponse is the response body of POST /api/v1/bulk.
+type BulkResponse struct {
+	SchemaVersion int              `json:"schema_version"`
+	DryRun        bool             `json:"dry_run"`
+	Results       []BulkItemResult `json:"results"`
+	//Pending is set (with status 202 and no Results) if the converger did not
+	//get to the request in time. The operations will still be executed, and
+	//their results are logged.
+	Pending bool `json:"pending,omitempty"`
+}
+
+//bulkAction is an action that can appear in a BulkOperation. Each of them
+//does the same as the respective request file (or the deletion of a
+//quarantine flag file).
+type bulkAction struct {
+	//Enabled returns an error if the action is not available with the current
+	//configuration.
+	Enabled func() error
+	//Check returns an error if the action cannot be executed on the given drive.
+	Check func(c *Converger, name string) error
+	//Execute returns an error if the action failed on the given drive.
+	Execute func(c *Converger, name string) error
+}
+
+var bulkActions = map[string]bulkAction{
+	"evacuate": {
+		Enabled: func() error {
+			if !Config.Evacuation.Enabled {
+				return errors.New("evacuation.enabled is not set")
+			}
+			return nil
+		},
+		Check: func(c *Converger, name string) error {
+			_, err := c.findActiveDrive(name)
+			return err
+		},
+		Execute: (*Converger).evacuateDrive,
+	},
+	"migrate-filesystem": {
+		Enabled: func() error {
+			if !Config.Migration.Enabled {
+				return errors.New("migration.enabled is not set")
+			}
+			return nil
+		},
+		Check: func(c *Converger, name string) error {
+			_, err := c.findActiveDrive(name)
+			return err
+		},
+		Execute: (*Converger).migrateFilesystem,
+	},
+	"encrypt-filesystem": {
+		Enabled: func() error {
+			if !Config.EncryptionMigration.Enabled {
+				return errors.New("encryption-migration.enabled is not set")
+			}
+			return nil
+		},
+		Check: func(c *Converger, name string) error {
+			_, err := c.findEncryptableDrive(name)
+			return err
+		},
+		Execute: (*Converger).encryptFilesystem,
+	},
+	"adopt": {
+		Enabled: func() error {
+			if !Config.VerifyFilesystemUUID {
+				return errors.New("verify-filesystem-uuid is not set")
+			}
+			return nil
+		},
+		Check: func(c *Converger, name string) error {
+			for _, drive := range c.Drives {
+				if drive.DriveID == name || (drive.Assignment != nil && drive.Assignment.SwiftID == name) {
+					return nil
+				}
+			}
+			return errors.New("no such drive")
+		},
+		Execute: (*Converger).adoptDrive,
+	},
+	"export-read-only": {
+		Enabled: readOnlyExportEnabled,
+		Check: func(c *Converger, name string) error {
+			_, _, err := c.findBrokenDrive(name)
+			return err
+		},
+		Execute: (*Converger).exportDrive,
+	},
+	"unexport": {
+		Enabled: readOnlyExportEnabled,
+		Check: func(c *Converger, name string) error {
+			drive, _, err := c.findBrokenDrive(name)
+			if err == nil && drive.Export == nil {
+				err = errors.New("drive is not exported")
+			}
+			return err
+		},
+		Execute: (*Converger).unexportDrive,
+	},
+	"quarantine": {
+		Enabled: quarantineEnabled,
+		Check: func(c *Converger, name string) error {
+			_, err := c.findQuarantinableDrive(name)
+			return err
+		},
+		Execute: (*Converger).quarantineDrive,
+	},
+	"release-quarantine": {
+		Enabled: quarantineEnabled,
+		Check: func(c *Converger, name string) error {
+			if _, exists := c.flaps.quarantined[name]; !exists {
+				return errors.New("drive is not quarantined")
+			}
+			return nil
+		},
+		//the drive is released by the next Converge() since the flag file is gone
+		Execute: func(c *Converger, name string) error {
+			flagPath := filepath.Join(QuarantineDirectory, name)
+			err := std_os.Remove(strings.TrimPrefix(flagPath, "/"))
+			if err != nil && !std_os.IsNotExist(err) {
+				return fmt.Errorf("cannot release %s from quarantine: %s", name, err.Error())
+			}
+			return nil
+		},
+	},
+}
+
+func quarantineEnabled() error {
+	if Config.Flapping.MaxFlaps == 0 {
+		return errors.New("flapping.max-flaps is not set")
+	}
+	return nil
+}
+
+func readOnlyExportEnabled() error {
+	if !Config.ReadOnlyExport.Enabled {
+		return errors.New("read-only-export.enabled is not set")
+	}
+	return nil
+}
+
+//How many items (i.e. drives across all operations) one bulk request may
+//contain, and how long the API waits for the converger to execute them.
+const (
+	bulkMaxItems = 1000
+	bulkTimeout  = 5 * time.Minute
+)
+
+//Validates the structure of the given request, without looking at the drives.
+func (r BulkRequest) validate() (problems []string) {
+	if len(r.Operations) == 0 {
+		return []string{"no operations given"}
+	}
+	seen := make(map[string]bool)
+	items := 0
+	for idx, op := range r.Operations {
+		action, exists := bulkActions[op.Action]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("operations[%d]: unknown action %q", idx, op.Action))
+			continue
+		}
+		if err := action.Enabled(); err != nil {
+			problems = append(problems, fmt.Sprintf("operations[%d]: action %q is not available: %s", idx, op.Action, err.Error()))
+		}
+		if len(op.Drives) == 0 {
+			problems = append(problems, fmt.Sprintf("operations[%d]: no drives given", idx))
+		}
+		for _, name := range op.Drives {
+			key := op.Action + "/" + name
+			switch {
+			case name == "":
+				problems = append(problems, fmt.Sprintf("operations[%d]: empty drive name", idx))
+			case seen[key]:
+				problems = append(problems, fmt.Sprintf("operations[%d]: drive %q appears more than once for action %q", idx, name, op.Action))
+			}
+			seen[key] = true
+		}
+		items += len(op.Drives)
+	}
+	if items > bulkMaxItems {
+		problems = append(problems, fmt.Sprintf("too many items: %d (at most %d are allowed)", items, bulkMaxItems))
+	}
+	return problems
+}
+
+//BulkOperationEvent is an Event that is emitted by CollectBulkRequests for
+//each request to POST /api/v1/bulk.
+type BulkOperationEvent struct {
+	Request     BulkRequest
+	RequestedBy string
+	//receives the results once the event has been handled
+	results chan []BulkItemResult
+}
+
+//LogMessage implements the Event interface.
+func (e BulkOperationEvent) LogMessage() string {
+	if e.Request.DryRun {
+		return "bulk operations (dry run) requested by " + e.RequestedBy
+	}
+	return "bulk operations requested by " + e.RequestedBy
+}
+
+//EventType implements the Event interface.
+func (e BulkOperationEvent) EventType() string {
+	return "bulk-operations-requested"
+}
+
+//Handle implements the Event interface.
+func (e BulkOperationEvent) Handle(c *Converger) {
+	var results []BulkItemResult
+	for _, op := range e.Request.Operations {
+		action := bulkActions[op.Action]
+		for _, name := range op.Drives {
+			result := BulkItemResult{Action: op.Action, Drive: name}
+			err := action.Check(c, name)
+			if err == nil && !e.Request.DryRun {
+				err = action.Execute(c, name)
+				if err != nil {
+					util.LogError(err.Error())
+				}
+			}
+			if err == nil {
+				result.OK = true
+			} else {
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+	}
+	e.results <- results
+}
+
+var bulkRequests = make(chan BulkOperationEvent, 1)
+
+//CollectBulkRequests is a collector job that forwards requests from the bulk
+//API into the converger queue.
+func CollectBulkRequests(queue chan []Event) {
+	for e := range bulkRequests {
+		queue <- []Event{e}
+	}
+}
+
+//handleBulkRequest answers requests to POST /api/v1/bulk. Structural problems
+//with the request (e.g. unknown actions) are rejected with 400 before anything
+//is executed. Otherwise, the items are checked and executed on the converger
+//thread, and the response contains a BulkItemResult for each of them.
+func handleBulkRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BulkRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "malformed request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if problems := req.validate(); len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+		return
+	}
+
+	e := BulkOperationEvent{Request: req, RequestedBy: "API client " + r.RemoteAddr, results: make(chan []BulkItemResult, 1)}
+	timer := time.NewTimer(bulkTimeout)
+	defer timer.Stop()
+	select {
+	case bulkRequests <- e:
+	case <-timer.C:
+		http.Error(w, "another request is pending", http.StatusServiceUnavailable)
+		return
+	}
+	response := BulkResponse{SchemaVersion: SchemaVersion, DryRun: req.DryRun}
+	status := http.StatusOK
+	select {
+	case response.Results = <-e.results:
+	case <-timer.C:
+		//the request is still queued and will be executed eventually
+		response.Results = []BulkItemResult{}
+		response.Pending = true
+		status = http.StatusAccepted
+	}
+
+	buf, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
@@ -0,0 +1,62 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import "testing"
+
+func TestBulkQuarantine(t *testing.T) {
+	c, leave := enterFlappingTest(t, 0, 3)
+	defer leave()
+	flappingTestEvent.Handle(c)
+
+	req := BulkRequest{Operations: []BulkOperation{{Action: "quarantine", Drives: []string{"SERIAL1", "SERIAL2"}}}}
+	if problems := req.validate(); len(problems) > 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	e := BulkOperationEvent{Request: req, results: make(chan []BulkItemResult, 1)}
+	e.Handle(c)
+	results := <-e.results
+	if len(results) != 2 || !results[0].OK || results[1].Error != "no such drive" {
+		t.Errorf("unexpected results: %#v", results)
+	}
+	if len(c.Drives) != 0 {
+		t.Errorf("expected the quarantined drive to be removed, but there are %d drives", len(c.Drives))
+	}
+	if q := c.flaps.QuarantinedDrives(); len(q) != 1 || q[0] != "SERIAL1" {
+		t.Errorf("expected SERIAL1 to be quarantined, got %v", q)
+	}
+
+	//releasing the drive sets it up again
+	e = BulkOperationEvent{
+		Request: BulkRequest{Operations: []BulkOperation{{Action: "release-quarantine", Drives: []string{"SERIAL1"}}}},
+		results: make(chan []BulkItemResult, 1),
+	}
+	e.Handle(c)
+	if results := <-e.results; !results[0].OK {
+		t.Errorf("unexpected results: %#v", results)
+	}
+	c.flaps.Process(c)
+	if len(c.Drives) != 1 || c.Drives[0].DevicePath != "/dev/sda" {
+		t.Errorf("expected /dev/sda to be set up again after its release, got %d drives", len(c.Drives))
+	}
+	if q := c.flaps.QuarantinedDrives(); len(q) != 0 {
+		t.Errorf("expected no quarantined drives, got %v", q)
+	}
+}
@@ -0,0 +1,117 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//ConfiguredDriveSettings returns the DriveSettings described by the
+//configuration for the drive with the given paths (usually the path where it
+//was found and its device path), including the matching DriveOverrides.
+func ConfiguredDriveSettings(paths ...string) state.DriveSettings {
+	settings := state.DriveSettings{
+		MountOptions:  Config.MountOptions,
+		FormatOptions: Config.FormatOptions,
+	}
+	matches := matchingDriveOverrides(paths...)
+	//apply in reverse order, so that the override with the highest precedence
+	//is applied last
+	for idx := len(matches) - 1; idx >= 0; idx-- {
+		o := Config.DriveOverrides.Rules[matches[idx]]
+		if o.MountOptions != nil {
+			settings.MountOptions = o.MountOptions
+		}
+		if o.FormatOptions != nil {
+			settings.FormatOptions = o.FormatOptions
+		}
+	}
+	return settings
+}
+
+//Counts how many drives in the persistent state already use the configured
+//settings. When --canary is given, these count against the canary limit.
+//
+//Format options only take effect when a filesystem is created, so the canary
+//only concerns the mount options. (Existing filesystems are switched over to
+//changed format options one at a time by the filesystem migration anyway.)
+func (c *Converger) countCanaries() int {
+	if *canaryFlag < 0 {
+		return 0
+	}
+	count := 0
+	for _, driveID := range c.State.DriveIDs() {
+		ds := c.State.Drives[driveID]
+		if usesConfiguredSettings(ds, ConfiguredDriveSettings(ds.FoundAtPath, ds.DevicePath)) {
+			count++
+		}
+	}
+	return count
+}
+
+//Whether the settings recorded for a drive match the given configured
+//settings. This is used both for counting the canaries at startup and for
+//deciding about newly found drives, so that both agree.
+func usesConfiguredSettings(ds *state.DriveState, configured state.DriveSettings) bool {
+	return ds.Settings != nil && ds.Settings.EqualMountOptions(configured)
+}
+
+//Decides which settings shall be used for a newly found drive. Normally,
+//this is just the configured settings. But when --canary is given, only the
+//given number of drives are switched over from the settings that were
+//previously recorded for them to the configured settings.
+func (c *Converger) chooseDriveSettings(driveID, foundAtPath, devicePath string) state.DriveSettings {
+	configured := ConfiguredDriveSettings(foundAtPath, devicePath)
+	if *canaryFlag < 0 {
+		return configured
+	}
+	ds, exists := c.State.Drives[driveID]
+	if !exists || ds.Settings == nil || usesConfiguredSettings(ds, configured) {
+		//drive has never been set up, or already uses the configured settings
+		return configured
+	}
+
+	if c.canaryCount < *canaryFlag {
+		c.canaryCount++
+		util.LogInfo("canary: applying changed settings to %s (canary %d of %d)", devicePath, c.canaryCount, *canaryFlag)
+		return configured
+	}
+	util.LogInfo("canary: keeping previous settings for %s", devicePath)
+	return state.DriveSettings{
+		MountOptions:  ds.Settings.MountOptions,
+		FormatOptions: configured.FormatOptions,
+	}
+}
+
+//Reports when the filesystem of a newly found drive was created with other
+//format options than the configured ones. Nothing can be done about that
+//except for recreating the filesystem through a filesystem migration.
+func (c *Converger) reportFormatOptionsMismatch(drive *core.Drive) {
+	ds, exists := c.State.Drives[drive.DriveID]
+	if !exists || ds.Settings == nil || len(ds.Settings.FormatOptions) == 0 {
+		return //filesystem was not created with any known format options
+	}
+	if !ds.Settings.EqualFormatOptions(state.DriveSettings{FormatOptions: drive.FormatOptions}) {
+		util.LogInfo("filesystem on %s was created with format options %v instead of the configured %v, which only affect new filesystems",
+			drive.DevicePath, ds.Settings.FormatOptions, drive.FormatOptions)
+	}
+}
@@ -0,0 +1,333 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	std_os "os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//The binaries that we execute inside the chroot in any case.
+var requiredChrootBinaries = []string{
+	"chgrp", "chown", "dmsetup", "ln", "lsblk", "mkdir", "mkfs.xfs", "modprobe",
+	"mount", "nsenter", "sfdisk", "touch", "udevadm", "umount",
+}
+
+//The binaries that we execute outside of the chroot (i.e. from our own
+//container image, if any) in any case.
+var requiredContainerBinaries = []string{"file"}
+
+//The directories that are searched for binaries inside the chroot.
+var chrootBinaryDirs = []string{"usr/local/sbin", "usr/local/bin", "usr/sbin", "usr/bin", "sbin", "bin"}
+
+//Maps runtime.GOARCH to the ELF machine type of binaries that we can execute.
+var elfMachineForArch = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"386":     elf.EM_386,
+	"arm64":   elf.EM_AARCH64,
+	"arm":     elf.EM_ARM,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+	"riscv64": elf.EM_RISCV,
+}
+
+//VerifyChroot checks that the chroot (our working directory) and the
+//additional chroots (if any) contain all binaries that we are going to execute
+//in there, and that they match our architecture. If a checksum manifest is
+//configured, all files listed in it are verified, too. Since a half-synced
+//chroot would otherwise produce confusing failures halfway through the setup,
+//we refuse to run if any problem is found.
+func VerifyChroot() {
+	if Config.ChrootVerification.Skip {
+		return
+	}
+
+	binaries := append([]string(nil), requiredChrootBinaries...)
+	if len(EncryptionKeys()) > 0 {
+		binaries = append(binaries, "cryptsetup")
+	}
+	for _, key := range Config.Keys {
+		if key.TPM2 != nil {
+			binaries = append(binaries, "tpm2_unseal")
+			break
+		}
+	}
+	if Config.Bcache.CacheDevice != "" {
+		binaries = append(binaries, "make-bcache", "bcache-super-show")
+	}
+	if len(Config.Hooks) > 0 {
+		binaries = append(binaries, "env")
+	}
+	for _, p := range Config.BlockDeviceProviders() {
+		binaries = append(binaries, p.Binaries()...)
+	}
+	if Config.RebootPreparation.Enabled {
+		binaries = append(binaries, "sync")
+	}
+	if Config.SELinuxRelabel {
+		binaries = append(binaries, "restorecon")
+	}
+	if len(Config.VerityVolumes) > 0 {
+		binaries = append(binaries, "veritysetup")
+	}
+	if Config.WipeSignatures {
+		binaries = append(binaries, "blockdev", "dd")
+	}
+	binaries = append(binaries, Config.ChrootVerification.Binaries...)
+
+	//commands that are routed into additional chroots are checked in there;
+	//for commands that are executed in the host mount namespace, that chroot is
+	//on the host's root filesystem (which we can see through PID 1)
+	var (
+		mainBinaries []string
+		problems     []string
+	)
+	routed := make(map[string]bool)
+	for purpose, cfg := range Config.Chroots {
+		var chrootCommands, hostCommands []string
+		for _, cmdName := range cfg.Commands {
+			routed[cmdName] = true
+			if command.EntersHostMountNamespace(cmdName) {
+				hostCommands = append(hostCommands, cmdName)
+			} else {
+				chrootCommands = append(chrootCommands, cmdName)
+			}
+		}
+		for _, problem := range verifyChrootBinaries(strings.TrimPrefix(cfg.Path, "/"), chrootCommands) {
+			problems = append(problems, fmt.Sprintf("in %s chroot %s: %s", purpose, cfg.Path, problem))
+		}
+		hostRoot := filepath.Join("proc/1/root", strings.TrimPrefix(cfg.Path, "/"))
+		for _, problem := range verifyChrootBinaries(hostRoot, hostCommands) {
+			problems = append(problems, fmt.Sprintf("in %s chroot %s (on the host): %s", purpose, cfg.Path, problem))
+		}
+	}
+	for _, binary := range binaries {
+		if !routed[binary] {
+			mainBinaries = append(mainBinaries, binary)
+		}
+	}
+
+	containerBinaries := append([]string(nil), requiredContainerBinaries...)
+	if Config.LifecycleStatistics.PowerOnHours {
+		containerBinaries = append(containerBinaries, "smartctl")
+	}
+	for _, problem := range verifyContainerBinaries(containerBinaries) {
+		problems = append(problems, "outside chroot: "+problem)
+	}
+
+	if Config.ChrootPath != "" {
+		problems = append(problems, verifyChrootBinaries(".", mainBinaries)...)
+		if path := Config.ChrootVerification.Manifest; path != "" {
+			problems = append(problems, verifyChrootManifest(".", path)...)
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			util.LogError("chroot verification: %s", problem)
+		}
+		util.LogFatal("chroot verification failed with %d problems (see above)", len(problems))
+	}
+}
+
+//Checks that each of the given binaries (given by name, or by absolute path)
+//exists below the root directory, is executable and, if it is an ELF binary,
+//matches our architecture.
+func verifyChrootBinaries(root string, binaries []string) (problems []string) {
+	for _, binary := range binaries {
+		candidates := []string{strings.TrimPrefix(binary, "/")}
+		if !strings.Contains(binary, "/") {
+			candidates = nil
+			for _, dir := range chrootBinaryDirs {
+				candidates = append(candidates, filepath.Join(dir, binary))
+			}
+		}
+
+		found := false
+		for _, candidate := range candidates {
+			path, err := resolveInChroot(root, candidate)
+			if err != nil {
+				continue
+			}
+			fi, err := std_os.Stat(filepath.Join(root, path))
+			if err != nil || fi.IsDir() {
+				continue
+			}
+			found = true
+
+			displayPath := "/" + candidate
+			if fi.Mode()&0111 == 0 {
+				problems = append(problems, fmt.Sprintf("%s is not executable", displayPath))
+			} else if problem := checkBinaryArchitecture(filepath.Join(root, path)); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s %s", displayPath, problem))
+			}
+			break
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("required binary %s not found", binary))
+		}
+	}
+	return problems
+}
+
+//Like verifyChrootBinaries, but for binaries that are executed outside of the
+//chroot, and are thus searched in our own $PATH.
+func verifyContainerBinaries(binaries []string) (problems []string) {
+	for _, binary := range binaries {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("required binary %s not found", binary))
+			continue
+		}
+		if problem := checkBinaryArchitecture(path); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s %s", path, problem))
+		}
+	}
+	return problems
+}
+
+//Returns a description of the problem if the file at the given path is an
+//ELF binary for a different architecture than ours. Scripts and other
+//non-ELF files are not checked.
+func checkBinaryArchitecture(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	expected, known := elfMachineForArch[runtime.GOARCH]
+	if known && f.Machine != expected {
+		return fmt.Sprintf("is built for %s, but this machine is %s", f.Machine.String(), runtime.GOARCH)
+	}
+	return ""
+}
+
+//Checks all files listed in the given checksum manifest. The manifest is read
+//from outside the chroot, and has the format of sha256sum(1) output, with
+//each line containing a checksum and a path inside the chroot.
+func verifyChrootManifest(root, manifestPath string) (problems []string) {
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read checksum manifest: %s", err.Error())}
+	}
+
+	for idx, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			problems = append(problems, fmt.Sprintf("%s:%d: malformed line", manifestPath, idx+1))
+			continue
+		}
+		expected := strings.ToLower(fields[0])
+		path := strings.TrimPrefix(fields[1], "*") //sha256sum marks binary mode with '*'
+		displayPath := "/" + strings.TrimPrefix(path, "/")
+
+		resolved, err := resolveInChroot(root, strings.TrimPrefix(path, "/"))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", displayPath, err.Error()))
+			continue
+		}
+		actual, err := sha256OfFile(filepath.Join(root, resolved))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", displayPath, err.Error()))
+			continue
+		}
+		if actual != expected {
+			problems = append(problems, fmt.Sprintf("%s has checksum %s, but manifest expects %s", displayPath, actual, expected))
+		}
+	}
+	return problems
+}
+
+func sha256OfFile(path string) (string, error) {
+	f, err := std_os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//Resolves all symlinks in the given path (relative to the root directory)
+//like the kernel would inside a chroot at that root directory, i.e. absolute
+//link targets are interpreted relative to the root directory. Returns the
+//resolved path relative to the root directory.
+func resolveInChroot(root, path string) (string, error) {
+	components := strings.Split(filepath.Clean(path), "/")
+	resolved := ""
+	for hops := 0; len(components) > 0; {
+		component := components[0]
+		components = components[1:]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		fi, err := std_os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&std_os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > 40 {
+			return "", fmt.Errorf("too many levels of symbolic links in /%s", path)
+		}
+		target, err := std_os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = ""
+		}
+		components = append(strings.Split(strings.TrimPrefix(target, "/"), "/"), components...)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,126 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//When a storm of events arrives (e.g. udev events and kernel errors after a
+//controller reset), the converger would otherwise converge once per batch.
+//With event coalescing, it keeps collecting batches from the queue until no
+//new batch has arrived for the settle time (or until the max delay or the max
+//number of events is reached), and handles all of them in one iteration, with
+//redundant events removed (see dedupEvents). Queries are answered right away
+//since they only observe the state.
+func collectEventStorm(queue chan []Event, events []Event, c *Converger) []Event {
+	cfg := Config.EventCoalescing
+	received := len(events)
+	deadline := time.After(cfg.MaxDelay)
+	for received < cfg.MaxEvents {
+		select {
+		case batch := <-queue:
+			if isQueryOnly(batch) {
+				for _, event := range batch {
+					event.Handle(c)
+				}
+				continue
+			}
+			events = append(events, batch...)
+			received += len(batch)
+			continue
+		case <-time.After(cfg.SettleTime):
+		case <-deadline:
+		}
+		break
+	}
+
+	events = dedupEvents(events)
+	if len(events) < received {
+		util.LogInfo("coalesced %d events into %d", received, len(events))
+	}
+	return events
+}
+
+//Removes redundant events from the given list: An event for a device is
+//redundant if it repeats the previous event for the same device (e.g. a device
+//that was reported as added again and again). For kernel errors, any previous
+//kernel error for the same device counts, regardless of the log line.
+//Consistency checks are redundant if there is any other event. Other events
+//are never removed.
+func dedupEvents(events []Event) []Event {
+	hasOtherEvents := false
+	for _, event := range events {
+		if _, ok := event.(WakeupEvent); !ok {
+			hasOtherEvents = true
+			break
+		}
+	}
+
+	result := make([]Event, 0, len(events))
+	var (
+		lastEventForDevice = make(map[string]Event)
+		seenWakeup         = false
+	)
+	for _, event := range events {
+		if _, ok := event.(WakeupEvent); ok {
+			if seenWakeup || hasOtherEvents {
+				continue
+			}
+			seenWakeup = true
+		}
+		if devicePath := devicePathOfEvent(event); devicePath != "" {
+			if isRepeatedEvent(lastEventForDevice[devicePath], event) {
+				continue
+			}
+			lastEventForDevice[devicePath] = event
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+//Returns the device path of events that concern one device, or "" for all
+//other events.
+func devicePathOfEvent(event Event) string {
+	switch e := event.(type) {
+	case DriveAddedEvent:
+		return e.DevicePath
+	case DriveRemovedEvent:
+		return e.DevicePath
+	case DriveReinstatedEvent:
+		return e.DevicePath
+	case DriveErrorEvent:
+		return e.DevicePath
+	default:
+		return ""
+	}
+}
+
+func isRepeatedEvent(previous, event Event) bool {
+	_, previousIsError := previous.(DriveErrorEvent)
+	_, isError := event.(DriveErrorEvent)
+	if previousIsError && isError {
+		return true
+	}
+	return previous == event
+}
@@ -21,6 +21,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
@@ -40,9 +46,10 @@ type Event interface {
 
 //DriveAddedEvent is an Event that fires when a new drive is found.
 type DriveAddedEvent struct {
-	DevicePath   string
-	FoundAtPath  string //the DevicePath before symlinks were expanded
-	SerialNumber string //may be empty if it cannot be determined
+	DevicePath        string
+	FoundAtPath       string //the DevicePath before symlinks were expanded
+	SerialNumber      string //may be empty if it cannot be determined
+	BackingDevicePath string //only set for stacked devices (see os.Drive)
 }
 
 //LogMessage implements the Event interface.
@@ -78,7 +85,21 @@ func (e DriveRemovedEvent) EventType() string {
 func CollectDriveEvents(osi os.Interface, queue chan []Event) {
 	added := make(chan []os.Drive)
 	removed := make(chan []string)
-	trigger := util.StandardTrigger(5*time.Second, "run/swift-storage/check-drives", true)
+	//besides the regular schedule, drives are also checked when an immediate
+	//convergence is requested (see RequestConvergence)
+	trigger := make(chan struct{}, 1)
+	go func(scheduled <-chan struct{}) {
+		for {
+			select {
+			case <-scheduled:
+			case <-driveCheckRequests:
+			}
+			select {
+			case trigger <- struct{}{}:
+			default: //a check is already pending
+			}
+		}
+	}(util.StandardTrigger(5*time.Second, "run/swift-storage/check-drives", true))
 	go osi.CollectDrives(Config.DriveGlobs, trigger, added, removed)
 
 	for {
@@ -87,9 +108,10 @@ func CollectDriveEvents(osi os.Interface, queue chan []Event) {
 			events := make([]Event, len(drives))
 			for idx, drive := range drives {
 				events[idx] = DriveAddedEvent{
-					DevicePath:   drive.DevicePath,
-					FoundAtPath:  drive.FoundAtPath,
-					SerialNumber: drive.SerialNumber,
+					DevicePath:        drive.DevicePath,
+					FoundAtPath:       drive.FoundAtPath,
+					SerialNumber:      drive.SerialNumber,
+					BackingDevicePath: drive.BackingDevicePath,
 				}
 			}
 			queue <- events
@@ -163,14 +185,77 @@ func CollectReinstatements(queue chan []Event) {
 	}
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// request file collector
+
+//CollectRequestFiles watches the given directory and issues an event (as
+//constructed by newEvent from the file name) for each file that an
+//administrator creates in there. The file is removed once the request has been
+//picked up.
+func CollectRequestFiles(dirPath string, queue chan []Event, newEvent func(name string) Event) {
+	//make path relative to working directory to account for chrootPath
+	dirPath = strings.TrimPrefix(dirPath, "/")
+
+	interval := util.GetJobInterval(5*time.Second, 1*time.Second)
+	for {
+		fis, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			util.LogError(err.Error())
+		}
+
+		var events []Event
+		for _, fi := range fis {
+			err := std_os.Remove(filepath.Join(dirPath, fi.Name()))
+			if err != nil {
+				util.LogError(err.Error())
+				continue
+			}
+			events = append(events, newEvent(fi.Name()))
+		}
+
+		//wake up the converger thread
+		if len(events) > 0 {
+			queue <- events
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+//WatchHotplugEvents is a collector job that triggers an immediate check for
+//new or removed drives whenever udev reports that a block device was added or
+//removed (see Config.HotplugEvents).
+func WatchHotplugEvents(osi os.Interface) {
+	devicePaths := make(chan string)
+	go osi.CollectBlockDeviceEvents(devicePaths)
+
+	for devicePath := range devicePaths {
+		//swapping a drive produces a burst of events (e.g. for each partition),
+		//which shall only cause one check
+		burstEnd := time.After(time.Second)
+		for done := false; !done; {
+			select {
+			case <-devicePaths:
+			case <-burstEnd:
+				done = true
+			}
+		}
+		util.LogDebug("checking for drives after hotplug event for %s", devicePath)
+		select {
+		case driveCheckRequests <- struct{}{}:
+		default:
+		}
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // wakeup scheduler
 
-//ScheduleWakeups is a collector job that pushes a no-op event every 30 seconds
-//to invoke the consistency checks that the converger executes during each of
-//its event loop iterations.
+//ScheduleWakeups is a collector job that pushes a no-op event once per
+//Config.ConvergeInterval (30 seconds by default) to invoke the consistency
+//checks that the converger executes during each of its event loop iterations.
 func ScheduleWakeups(queue chan []Event) {
-	trigger := util.StandardTrigger(30*time.Second, "run/swift-storage/wakeup", false)
+	trigger := util.StandardTrigger(Config.ConvergeInterval, "run/swift-storage/wakeup", false)
 	for range trigger {
 		queue <- []Event{WakeupEvent{}}
 	}
@@ -201,6 +286,69 @@ func (e WakeupEvent) Handle(c *Converger) {
 	//do nothing
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// convergence requests
+
+var (
+	convergenceRequests = make(chan string, 1)
+	driveCheckRequests  = make(chan struct{}, 1)
+)
+
+//RequestConvergence asks for an immediate check for new or removed drives and
+//a convergence pass, instead of waiting for the next scheduled one. If a
+//request is already pending, this one is merged into it. This function does
+//not block.
+func RequestConvergence(reason string) {
+	select {
+	case convergenceRequests <- reason:
+	default:
+	}
+}
+
+//CollectConvergenceRequests is a collector job that issues a
+//ConvergenceRequestedEvent whenever RequestConvergence() is called, or when
+//SIGUSR2 is received.
+func CollectConvergenceRequests(queue chan []Event) {
+	signals := make(chan std_os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			RequestConvergence("SIGUSR2 received")
+		}
+	}()
+
+	for reason := range convergenceRequests {
+		//look for swapped drives first (any resulting drive events will also
+		//trigger a convergence)
+		select {
+		case driveCheckRequests <- struct{}{}:
+		default:
+		}
+		queue <- []Event{ConvergenceRequestedEvent{Reason: reason}}
+	}
+}
+
+//ConvergenceRequestedEvent is sent by the CollectConvergenceRequests
+//collector.
+type ConvergenceRequestedEvent struct {
+	Reason string
+}
+
+//LogMessage implements the Event interface.
+func (e ConvergenceRequestedEvent) LogMessage() string {
+	return "immediate convergence requested: " + e.Reason
+}
+
+//EventType implements the Event interface.
+func (e ConvergenceRequestedEvent) EventType() string {
+	return "convergence-requested"
+}
+
+//Handle implements the Event interface.
+func (e ConvergenceRequestedEvent) Handle(c *Converger) {
+	//do nothing (the converger always converges after handling events)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // kernel log collector
 
@@ -20,45 +20,382 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"os"
+	std_os "os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/sapcc/go-bits/secrets"
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 	yaml "gopkg.in/yaml.v2"
 )
 
 //Configuration represents the content of the config file.
 type Configuration struct {
-	ChrootPath string   `yaml:"chroot"`
-	DriveGlobs []string `yaml:"drives"`
-	Owner      struct {
+	ChrootPath string      `yaml:"chroot"`
+	DriveGlobs []string    `yaml:"drives"`
+	ImageFiles []ImageFile `yaml:"image-files"`
+	//VerityVolumes are mounted read-only next to the drives.
+	VerityVolumes []VerityVolume `yaml:"verity-volumes"`
+	//StoragePolicies group drives by swift-id, each group having its own ready
+	//marker.
+	StoragePolicies []StoragePolicy `yaml:"storage-policies"`
+	Owner           struct {
 		User  string `yaml:"user"`
 		Group string `yaml:"group"`
 	} `yaml:"chown"`
+	Chroots map[string]struct {
+		Path     string   `yaml:"path"`
+		Commands []string `yaml:"commands"`
+	} `yaml:"chroots"`
+	ChrootVerification struct {
+		Skip     bool     `yaml:"skip"`
+		Binaries []string `yaml:"binaries"`
+		Manifest string   `yaml:"manifest"`
+	} `yaml:"chroot-verification"`
 	Keys []struct {
 		//this is a struct to later support the addition of a Method field to
 		//specify the key derivation method
 		Secret secrets.AuthPassword `yaml:"secret"`
+		//Vault or Barbican can be given instead of Secret; the Secret is then
+		//filled by FetchRemoteKeys()
+		Vault    *VaultKeySource    `yaml:"vault"`
+		Barbican *BarbicanKeySource `yaml:"barbican"`
+		//TPM2 can be given instead of Secret; the Secret is then filled by
+		//UnsealTPM2Keys()
+		TPM2 *TPM2KeySource `yaml:"tpm2"`
+		//KeyFile can be given instead of Secret; it is then given to cryptsetup
+		//with --key-file
+		KeyFile         string `yaml:"keyfile"`
+		KeyFileInChroot bool   `yaml:"keyfile-in-chroot"`
+		//FD or Credential can be given instead of Secret; the Secret is then
+		//filled by ReadInheritedKeys()
+		FD         *int   `yaml:"fd"`
+		Credential string `yaml:"credential"`
 	} `yaml:"keys"`
-	SwiftIDPool          []string `yaml:"swift-id-pool"`
-	MetricsListenAddress string   `yaml:"metrics-listen-address"`
+	SwiftIDPool            []string      `yaml:"swift-id-pool"`
+	SwiftIDChecksums       bool          `yaml:"swift-id-checksums"`
+	VerifyFilesystemUUID   bool          `yaml:"verify-filesystem-uuid"`
+	MetricsListenAddress   string        `yaml:"metrics-listen-address"`
+	MetricsListenAddresses []string      `yaml:"metrics-listen-addresses"`
+	APITokens              []APIToken    `yaml:"api-tokens"`
+	EnablePprof            bool          `yaml:"enable-pprof"`
+	ConvergeInterval       time.Duration `yaml:"converge-interval"`
+	HotplugEvents          bool          `yaml:"hotplug-events"`
+	SELinuxRelabel         bool          `yaml:"selinux-relabel"`
+	WipeSignatures         bool          `yaml:"wipe-signatures"`
+	LogFormat              string        `yaml:"log-format"`
+	LogLevel               string        `yaml:"log-level"`
+	LogSink                struct {
+		Type       string `yaml:"type"`
+		SocketPath string `yaml:"socket-path"`
+	} `yaml:"log-sink"`
+	StatePath      string `yaml:"state-file"`
+	StateDumpPath  string `yaml:"state-dump-file"`
+	ExpectedDrives struct {
+		Count       int           `yaml:"count"`
+		GracePeriod time.Duration `yaml:"grace-period"`
+	} `yaml:"expected-drives"`
+	Bcache          BcacheConfiguration `yaml:"bcache"`
+	XFSLogDevices   map[string]string   `yaml:"xfs-log-devices"`
+	MountOptions    []string            `yaml:"mount-options"`
+	FormatOptions   []string            `yaml:"format-options"`
+	HashDeviceNames bool                `yaml:"hashed-device-names"`
+	Recovery        bool                `yaml:"recovery"`
+	Migration       struct {
+		Enabled      bool     `yaml:"enabled"`
+		IgnorePaths  []string `yaml:"ignore-paths"`
+		CheckCommand []string `yaml:"check-command"`
+	} `yaml:"filesystem-migration"`
+	EncryptionMigration struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"encryption-migration"`
+	ZFS struct {
+		Zvols bool `yaml:"zvols"`
+	} `yaml:"zfs"`
+	ReadOnlyExport struct {
+		Enabled bool   `yaml:"enabled"`
+		Path    string `yaml:"path"`
+	} `yaml:"read-only-export"`
+	DriveOverrides struct {
+		//Precedence is one of the constants like FirstMatchPrecedence.
+		Precedence string          `yaml:"precedence"`
+		Rules      []DriveOverride `yaml:"rules"`
+	} `yaml:"drive-overrides"`
+	Evacuation struct {
+		Enabled       bool          `yaml:"enabled"`
+		MarkerFile    string        `yaml:"marker-file"`
+		StartCommand  []string      `yaml:"start-command"`
+		CheckCommand  []string      `yaml:"check-command"`
+		IgnorePaths   []string      `yaml:"ignore-paths"`
+		CheckInterval time.Duration `yaml:"check-interval"`
+	} `yaml:"evacuation"`
+	BulkAPI struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"bulk-api"`
+	RebootPreparation struct {
+		Enabled     bool     `yaml:"enabled"`
+		StopCommand []string `yaml:"stop-command"`
+		Unmount     bool     `yaml:"unmount"`
+	} `yaml:"reboot-preparation"`
+	LUKS struct {
+		Format                os.LUKSFormatOptions `yaml:"format"`
+		ConvertToLUKS2        bool                 `yaml:"convert-to-luks2"`
+		HeaderBackupDirectory string               `yaml:"header-backup-directory"`
+		HeaderDirectory       string               `yaml:"header-directory"`
+		HeaderBackups         struct {
+			Enabled   bool          `yaml:"enabled"`
+			Interval  time.Duration `yaml:"interval"`
+			Retention time.Duration `yaml:"retention"`
+		} `yaml:"header-backups"`
+		FreeRetiredKeyslots bool `yaml:"free-retired-keyslots"`
+		ReconcileKeyslots   bool `yaml:"reconcile-keyslots"`
+		VerifyHeaders       bool `yaml:"verify-headers"`
+		//RetiredKeys are removed from the LUKS containers by --rotate-keys.
+		RetiredKeys []struct {
+			Secret          secrets.AuthPassword `yaml:"secret"`
+			KeyFile         string               `yaml:"keyfile"`
+			KeyFileInChroot bool                 `yaml:"keyfile-in-chroot"`
+		} `yaml:"retired-keys"`
+	} `yaml:"luks"`
+	Topology struct {
+		ApplyIRQAffinity bool `yaml:"apply-irq-affinity"`
+	} `yaml:"topology"`
+	StorageServices struct {
+		Multipath     bool          `yaml:"multipath"`
+		ISCSISessions int           `yaml:"iscsi-sessions"`
+		Timeout       time.Duration `yaml:"timeout"`
+	} `yaml:"storage-services"`
+	Flapping struct {
+		GracePeriod time.Duration `yaml:"grace-period"`
+		MaxFlaps    int           `yaml:"max-flaps"`
+		Window      time.Duration `yaml:"window"`
+	} `yaml:"flapping"`
+	Firmware struct {
+		BadVersions []BadFirmwareRule `yaml:"bad-versions"`
+	} `yaml:"firmware"`
+	Retention struct {
+		ForgetDrivesAfter time.Duration `yaml:"forget-drives-after"`
+		DriveLogSize      int64         `yaml:"drive-log-size"`
+		StateSnapshots    int           `yaml:"state-snapshots"`
+	} `yaml:"retention"`
+	DeviceLocking struct {
+		Enabled bool          `yaml:"enabled"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"device-locking"`
+	EventCoalescing struct {
+		Enabled    bool          `yaml:"enabled"`
+		SettleTime time.Duration `yaml:"settle-time"`
+		MaxDelay   time.Duration `yaml:"max-delay"`
+		MaxEvents  int           `yaml:"max-events"`
+	} `yaml:"event-coalescing"`
+	FailurePolicy struct {
+		Mode            string `yaml:"mode"`
+		MaxBrokenDrives int    `yaml:"max-broken-drives"`
+	} `yaml:"failure-policy"`
+	OptionalDrives    OptionalDrivesConfiguration `yaml:"optional-drives"`
+	PlainCryptPools   []PlainCryptPool            `yaml:"plain-dm-crypt"`
+	ConvergenceBudget struct {
+		MaxDuration time.Duration `yaml:"max-duration"`
+		MaxFormats  int           `yaml:"max-formats"`
+	} `yaml:"convergence-budget"`
+	LifecycleStatistics struct {
+		PowerOnHours    bool          `yaml:"power-on-hours"`
+		RefreshInterval time.Duration `yaml:"refresh-interval"`
+	} `yaml:"lifecycle-statistics"`
+	Concurrency struct {
+		Drives            int    `yaml:"drives"`
+		LightOperations   int    `yaml:"light-operations"`
+		HeavyOperations   int    `yaml:"heavy-operations"`
+		Nice              int    `yaml:"nice"`
+		IONiceClass       string `yaml:"ionice-class"`
+		NiceAllOperations bool   `yaml:"nice-all-operations"`
+		Cgroup            struct {
+			Path   string            `yaml:"path"`
+			Limits map[string]string `yaml:"limits"`
+		} `yaml:"cgroup"`
+	} `yaml:"concurrency"`
+	Profiling struct {
+		Report     bool   `yaml:"report"`
+		CPUProfile string `yaml:"cpu-profile"`
+		Trace      string `yaml:"trace"`
+		Timeline   string `yaml:"timeline"`
+	} `yaml:"profiling"`
+	LogRedaction []string                    `yaml:"log-redaction"`
+	Profiles     map[string]ProfileOverrides `yaml:"profiles"`
+	Retry        struct {
+		Count    int           `yaml:"count"`
+		Backoff  time.Duration `yaml:"backoff"`
+		Patterns []string      `yaml:"patterns"`
+	} `yaml:"retry"`
+	DriveManifest DriveManifestConfiguration `yaml:"drive-manifest"`
+	Network       NetworkConfiguration       `yaml:"network"`
+	Hooks         core.Hooks                 `yaml:"hooks"`
+	Labels        map[string]string          `yaml:"labels"`
+	Helpers       []Helper                   `yaml:"helpers"`
+	Plugins       []struct {
+		Name    string        `yaml:"name"`
+		Command []string      `yaml:"command"`
+		Env     []string      `yaml:"env"`
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"plugins"`
+}
+
+//BcacheConfiguration appears in type Configuration.
+type BcacheConfiguration struct {
+	CacheDevice string   `yaml:"cache-device"`
+	DriveGlobs  []string `yaml:"drives"`
+}
+
+//Matches returns whether a drive found at the given paths shall be set up with
+//a bcache device. If no globs are configured, this applies to all drives.
+func (bc BcacheConfiguration) Matches(paths ...string) bool {
+	if len(bc.DriveGlobs) == 0 {
+		return true
+	}
+	for _, pattern := range bc.DriveGlobs {
+		for _, path := range paths {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//OptionalDrivesConfiguration selects the drives whose failure does not affect
+//readiness or exit status (see core.DriveOptions.Optional).
+type OptionalDrivesConfiguration struct {
+	DriveGlobs    []string `yaml:"drives"`
+	SerialNumbers []string `yaml:"serial-numbers"`
+}
+
+//Matches returns whether the drive with the given serial number, found at the
+//given paths, is optional. Unlike for BcacheConfiguration, no drives are
+//optional if nothing is configured.
+func (oc OptionalDrivesConfiguration) Matches(serialNumber string, paths ...string) bool {
+	for _, s := range oc.SerialNumbers {
+		if serialNumber != "" && s == serialNumber {
+			return true
+		}
+	}
+	for _, pattern := range oc.DriveGlobs {
+		for _, path := range paths {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Label keys must be valid Prometheus label names (except for the reserved
+//"__" prefix), and lowercase so that they map to distinct environment
+//variables for hooks.
+var labelKeyRx = regexp.MustCompile(`^(?:[a-z]|_[a-z0-9])[a-z0-9_]*$`)
+
+//PlainCryptPool appears in type Configuration. It describes a group of drives
+//that are encrypted with plain dm-crypt (without a LUKS header).
+type PlainCryptPool struct {
+	DriveGlobs           []string `yaml:"drives"`
+	os.PlainCryptOptions `yaml:",inline"`
+}
+
+//Matches returns whether the drive found at the given paths belongs to this
+//pool.
+func (pp PlainCryptPool) Matches(paths ...string) bool {
+	for _, pattern := range pp.DriveGlobs {
+		for _, path := range paths {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func applyLogFormat(format string) {
+	switch format {
+	case "text":
+		util.LogAsJSON = false
+	case "json":
+		util.LogAsJSON = true
+	default:
+		util.LogFatal("invalid log format %q (expected \"text\" or \"json\")", format)
+	}
+}
+
+func applyLogLevel(level string) {
+	err := util.SetLogLevel(level)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
 }
 
 //Config is the global Configuration instance that's filled by main() at
 //program start.
 var Config Configuration
 
-func init() {
-	//expect one argument (config file name)
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <config-file>\n", os.Args[0])
-		os.Exit(1)
+//Command-line flags.
+var (
+	ageIdentityFlag = flag.String("age-identity", "", "decrypt the configuration file (if encrypted with age or SOPS) with the age identity from this file")
+	profileFlag     = flag.String("profile", "", "use this configuration profile (instead of selecting one by hostname)")
+	canaryFlag      = flag.Int("canary", -1, "apply changed mount options to only this many drives")
+	recoveryFlag    = flag.Bool("recovery", false, "open and mount all drives read-only, and never format anything")
+	historyFlag     = flag.String("history", "", "print the recorded history of the drive with this device path, drive ID or swift-id, and exit")
+	fleetReportFlag = flag.Bool("fleet-report", false, "print drive lifecycle statistics per model and firmware revision, and exit")
+	diffFlag        = flag.String("diff", "", "print the differences between the desired and actual state of the drives as \"text\" or \"json\", and exit")
+	topFlag         = flag.Bool("top", false, "show a continuously updated view of the drives managed by the running autopilot")
+	rotateKeysFlag  = flag.Bool("rotate-keys", false, "add the first of the configured keys to all open LUKS containers, remove the luks.retired-keys from them, and exit")
+	evaluateFlag    = flag.String("evaluate", "", "print the actions that would be taken on a node with the drive inventory from this JSON file, and exit")
+	logFormatFlag   = flag.String("log-format", "", "write logs as \"text\" or \"json\" (overrides the log-format option)")
+	logLevelFlag    = flag.String("log-level", "", "log messages of this level and above: \"debug\", \"info\" or \"error\" (overrides the log-level option)")
+	debugFlag       = flag.Bool("debug", false, "log debug messages, including every command execution (same as --log-level debug)")
+	rollbackFlag    = flag.Int("state-rollback", 0, "replace the state file with its n-th most recent snapshot (see retention.state-snapshots), and exit")
+	onceFlag        = flag.Bool("once", false, "exit once storage has been marked as ready (or right away if everything is already converged)")
+)
+
+//Parses the command line and reads the configuration file into Config. This
+//is the first thing that main() does. (It is not done in init(), so that the
+//tests of this package can run without a configuration file.)
+func loadConfiguration() {
+	flag.Usage = func() {
+		fmt.Fprintf(std_os.Stderr, "Usage: %s [options] <config-file>\n", std_os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	//when given on the command line, the log format also applies to errors in
+	//the configuration file
+	if *logFormatFlag != "" {
+		applyLogFormat(*logFormatFlag)
+	}
+	if *debugFlag {
+		*logLevelFlag = "debug"
+	}
+	if *logLevelFlag != "" {
+		applyLogLevel(*logLevelFlag)
+	}
+
+	//expect one argument (config file name), or more with --fleet-report
+	//(additional state files)
+	if flag.NArg() != 1 && !(*fleetReportFlag && flag.NArg() > 1) {
+		flag.Usage()
+		std_os.Exit(1)
 	}
 
 	//read config file
-	configBytes, err := ioutil.ReadFile(os.Args[1])
+	configBytes, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		util.LogFatal("read configuration file: %s", err.Error())
+	}
+	configBytes, err = decryptConfiguration(configBytes, *ageIdentityFlag)
 	if err != nil {
 		util.LogFatal("read configuration file: %s", err.Error())
 	}
@@ -66,6 +403,434 @@ func init() {
 	if err != nil {
 		util.LogFatal("parse configuration: %s", err.Error())
 	}
+	err = Config.ApplyProfile(*profileFlag)
+	if err != nil {
+		util.LogFatal("parse configuration: %s", err.Error())
+	}
+	if *logFormatFlag == "" && Config.LogFormat != "" {
+		applyLogFormat(Config.LogFormat)
+	}
+	if *logLevelFlag == "" && Config.LogLevel != "" {
+		applyLogLevel(Config.LogLevel)
+	}
+
+	//in recovery mode, nothing may be written to the drives
+	if *recoveryFlag {
+		Config.Recovery = true
+	}
+	if Config.Recovery {
+		util.LogInfo("recovery mode: all drives will be opened and mounted read-only")
+		Config.Migration.Enabled = false
+		Config.Evacuation.Enabled = false
+		Config.EncryptionMigration.Enabled = false
+		Config.LUKS.ConvertToLUKS2 = false
+		Config.LUKS.FreeRetiredKeyslots = false
+		Config.LUKS.ReconcileKeyslots = false
+	}
+
+	if Config.StatePath == "" {
+		Config.StatePath = "/var/lib/swift-drive-autopilot/state.json"
+	}
+	if Config.Evacuation.Enabled {
+		if Config.Evacuation.MarkerFile == "" {
+			Config.Evacuation.MarkerFile = "evacuating"
+		}
+		if strings.Contains(Config.Evacuation.MarkerFile, "/") {
+			util.LogFatal("parse configuration: evacuation.marker-file must be a plain file name")
+		}
+		if Config.Evacuation.CheckInterval == 0 {
+			Config.Evacuation.CheckInterval = 5 * time.Minute
+		}
+	}
+	if Config.EncryptionMigration.Enabled && Config.LUKS.HeaderDirectory == "" {
+		//with the header on the drive itself, the filesystem would have to be
+		//shrunk first to make room for it
+		util.LogFatal("parse configuration: encryption-migration requires luks.header-directory")
+	}
+	if Config.ReadOnlyExport.Enabled {
+		if Config.ReadOnlyExport.Path == "" {
+			Config.ReadOnlyExport.Path = "/srv/node-recovery"
+		}
+		path := filepath.Clean(Config.ReadOnlyExport.Path)
+		if !strings.HasPrefix(path, "/") || path == "/srv/node" || strings.HasPrefix(path, "/srv/node/") {
+			util.LogFatal("parse configuration: read-only-export.path must be an absolute path outside of /srv/node")
+		}
+		Config.ReadOnlyExport.Path = path
+	}
+	//multipath and iSCSI drives cannot be discovered before the respective
+	//services are ready, so wait for them even if not explicitly configured
+	for _, glob := range Config.DriveGlobs {
+		if strings.Contains(glob, "/dev/mapper/mpath") || strings.Contains(glob, "dm-uuid-mpath-") {
+			Config.StorageServices.Multipath = true
+		}
+		if strings.Contains(glob, "-iscsi-") && Config.StorageServices.ISCSISessions == 0 {
+			Config.StorageServices.ISCSISessions = 1
+		}
+	}
+	switch Config.LogSink.Type {
+	case "", "stdout":
+	case "journald":
+		if Config.LogSink.SocketPath == "" {
+			Config.LogSink.SocketPath = "/run/systemd/journal/socket"
+		}
+	case "syslog":
+		if Config.LogSink.SocketPath == "" {
+			Config.LogSink.SocketPath = "/dev/log"
+		}
+	default:
+		util.LogFatal("parse configuration: invalid log-sink.type %q (expected \"stdout\", \"journald\" or \"syslog\")", Config.LogSink.Type)
+	}
+	if Config.ConvergeInterval < 0 {
+		util.LogFatal("parse configuration: converge-interval may not be negative")
+	}
+	if Config.ConvergenceBudget.MaxDuration < 0 || Config.ConvergenceBudget.MaxFormats < 0 {
+		util.LogFatal("parse configuration: convergence-budget may not contain negative values")
+	}
+	switch Config.FailurePolicy.Mode {
+	case "", BestEffortPolicy, FailFastPolicy:
+		if Config.FailurePolicy.MaxBrokenDrives != 0 {
+			util.LogFatal("parse configuration: failure-policy.max-broken-drives can only be given with mode %q", ThresholdPolicy)
+		}
+	case ThresholdPolicy:
+		if Config.FailurePolicy.MaxBrokenDrives <= 0 {
+			util.LogFatal("parse configuration: failure-policy mode %q needs a positive max-broken-drives", ThresholdPolicy)
+		}
+	default:
+		util.LogFatal("parse configuration: failure-policy.mode must be %q, %q or %q, but is %q",
+			BestEffortPolicy, FailFastPolicy, ThresholdPolicy, Config.FailurePolicy.Mode)
+	}
+	if Config.DeviceLocking.Timeout == 0 {
+		Config.DeviceLocking.Timeout = 5 * time.Second
+	}
+	if Config.ConvergeInterval == 0 {
+		Config.ConvergeInterval = 30 * time.Second
+	}
+	if Config.StorageServices.Timeout == 0 {
+		Config.StorageServices.Timeout = 2 * time.Minute
+	}
+	if Config.Flapping.MaxFlaps > 0 && Config.Flapping.Window == 0 {
+		Config.Flapping.Window = 10 * time.Minute
+	}
+	if Config.Retention.ForgetDrivesAfter == 0 {
+		Config.Retention.ForgetDrivesAfter = 90 * 24 * time.Hour
+	}
+	if Config.LifecycleStatistics.RefreshInterval == 0 {
+		Config.LifecycleStatistics.RefreshInterval = 24 * time.Hour
+	}
+	if Config.Retention.StateSnapshots < 0 {
+		util.LogFatal("parse configuration: retention.state-snapshots may not be negative")
+	}
+	if Config.Retention.DriveLogSize < 0 {
+		util.LogFatal("parse configuration: retention.drive-log-size may not be negative")
+	}
+	if Config.Retention.DriveLogSize > 0 {
+		util.DriveLogMaxSize = Config.Retention.DriveLogSize
+	}
+	if Config.LUKS.HeaderBackupDirectory == "" {
+		Config.LUKS.HeaderBackupDirectory = "/var/lib/swift-drive-autopilot/luks-header-backups"
+	}
+	if Config.LUKS.HeaderBackups.Interval < 0 || Config.LUKS.HeaderBackups.Retention < 0 {
+		util.LogFatal("parse configuration: luks.header-backups may not contain negative durations")
+	}
+	if Config.LUKS.HeaderBackups.Interval == 0 {
+		Config.LUKS.HeaderBackups.Interval = 24 * time.Hour
+	}
+	if Config.LUKS.HeaderBackups.Retention == 0 {
+		Config.LUKS.HeaderBackups.Retention = 30 * 24 * time.Hour
+	}
+
+	if c := &Config.EventCoalescing; c.Enabled {
+		if c.SettleTime < 0 || c.MaxDelay < 0 || c.MaxEvents < 0 {
+			util.LogFatal("parse configuration: event-coalescing may not contain negative values")
+		}
+		if c.SettleTime == 0 {
+			c.SettleTime = 2 * time.Second
+		}
+		if c.MaxDelay == 0 {
+			c.MaxDelay = 30 * time.Second
+		}
+		if c.MaxEvents == 0 {
+			c.MaxEvents = 1000
+		}
+		if c.SettleTime > c.MaxDelay {
+			util.LogFatal("parse configuration: event-coalescing.settle-time may not be longer than event-coalescing.max-delay")
+		}
+	}
+
+	policyNames := make(map[string]bool)
+	for idx := range Config.StoragePolicies {
+		p := &Config.StoragePolicies[idx]
+		if msg := p.Validate(); msg != "" {
+			util.LogFatal("parse configuration: invalid entry #%d in storage-policies: %s", idx+1, msg)
+		}
+		if policyNames[p.Name] {
+			util.LogFatal("parse configuration: duplicate storage policy name %q", p.Name)
+		}
+		policyNames[p.Name] = true
+	}
+
+	helperNames := make(map[string]bool)
+	for idx := range Config.Helpers {
+		h := &Config.Helpers[idx]
+		if msg := h.Validate(); msg != "" {
+			util.LogFatal("parse configuration: invalid entry #%d in helpers: %s", idx+1, msg)
+		}
+		if helperNames[h.Name] {
+			util.LogFatal("parse configuration: duplicate helper name %q", h.Name)
+		}
+		helperNames[h.Name] = true
+	}
+
+	for idx := range Config.ImageFiles {
+		if msg := Config.ImageFiles[idx].Validate(); msg != "" {
+			util.LogFatal("parse configuration: invalid entry #%d in image-files: %s", idx+1, msg)
+		}
+	}
+
+	verityNames := make(map[string]bool)
+	for idx := range Config.VerityVolumes {
+		v := &Config.VerityVolumes[idx]
+		if msg := v.Validate(); msg != "" {
+			util.LogFatal("parse configuration: invalid entry #%d in verity-volumes: %s", idx+1, msg)
+		}
+		if verityNames[v.Name] {
+			util.LogFatal("parse configuration: duplicate name %q in verity-volumes", v.Name)
+		}
+		verityNames[v.Name] = true
+	}
+
+	for _, pattern := range Config.Bcache.DriveGlobs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			util.LogFatal("parse configuration: invalid glob %q in bcache.drives: %s", pattern, err.Error())
+		}
+	}
+
+	for idx, o := range Config.DriveOverrides.Rules {
+		if msg := o.Validate(); msg != "" {
+			util.LogFatal("parse configuration: invalid entry #%d in drive-overrides.rules: %s", idx+1, msg)
+		}
+	}
+	switch Config.DriveOverrides.Precedence {
+	case "":
+		Config.DriveOverrides.Precedence = FirstMatchPrecedence
+	case FirstMatchPrecedence, MostSpecificPrecedence, ErrorPrecedence:
+	default:
+		util.LogFatal("parse configuration: invalid drive-overrides.precedence %q (expected %q, %q or %q)",
+			Config.DriveOverrides.Precedence, FirstMatchPrecedence, MostSpecificPrecedence, ErrorPrecedence)
+	}
+	reportOverlappingDriveOverrides()
+
+	for idx, pool := range Config.PlainCryptPools {
+		if len(pool.DriveGlobs) == 0 {
+			util.LogFatal("parse configuration: missing value for drives in entry #%d in plain-dm-crypt", idx+1)
+		}
+		for _, pattern := range pool.DriveGlobs {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				util.LogFatal("parse configuration: invalid glob %q in entry #%d in plain-dm-crypt: %s", pattern, idx+1, err.Error())
+			}
+		}
+		if err := pool.PlainCryptOptions.Validate(); err != nil {
+			util.LogFatal("parse configuration: invalid entry #%d in plain-dm-crypt: %s", idx+1, err.Error())
+		}
+	}
+
+	for _, pattern := range Config.OptionalDrives.DriveGlobs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			util.LogFatal("parse configuration: invalid glob %q in optional-drives.drives: %s", pattern, err.Error())
+		}
+	}
+
+	for idx, rule := range Config.Firmware.BadVersions {
+		if err := rule.Validate(); err != nil {
+			util.LogFatal("parse configuration: invalid rule #%d in firmware.bad-versions: %s", idx+1, err.Error())
+		}
+	}
+
+	if err := Config.Hooks.Validate(); err != nil {
+		util.LogFatal("parse configuration: invalid hooks: %s", err.Error())
+	}
+
+	for key := range Config.Labels {
+		if !labelKeyRx.MatchString(key) {
+			util.LogFatal("parse configuration: invalid label %q (must consist of lowercase letters, digits and underscores, and may not start with a digit or \"__\")", key)
+		}
+	}
+	util.LogLabels = Config.Labels
+
+	if err := Config.DriveManifest.Validate(); err != nil {
+		util.LogFatal("parse configuration: invalid drive-manifest: %s", err.Error())
+	}
+
+	keyFDs := make(map[int]bool)
+	for idx, key := range Config.Keys {
+		sources := 0
+		if key.Secret != "" {
+			sources++
+		}
+		if key.Vault != nil {
+			sources++
+			if err := key.Vault.Validate(); err != nil {
+				util.LogFatal("parse configuration: invalid vault reference in entry #%d in keys: %s", idx+1, err.Error())
+			}
+		}
+		if key.Barbican != nil {
+			sources++
+			if err := key.Barbican.Validate(); err != nil {
+				util.LogFatal("parse configuration: invalid barbican reference in entry #%d in keys: %s", idx+1, err.Error())
+			}
+		}
+		if key.TPM2 != nil {
+			sources++
+			if err := key.TPM2.Validate(); err != nil {
+				util.LogFatal("parse configuration: invalid tpm2 reference in entry #%d in keys: %s", idx+1, err.Error())
+			}
+		}
+		if key.KeyFile != "" {
+			sources++
+			if !strings.HasPrefix(key.KeyFile, "/") {
+				util.LogFatal("parse configuration: keyfile in entry #%d in keys must be an absolute path", idx+1)
+			}
+		} else if key.KeyFileInChroot {
+			util.LogFatal("parse configuration: entry #%d in keys has keyfile-in-chroot, but no keyfile", idx+1)
+		}
+		if key.FD != nil {
+			sources++
+			switch {
+			case *key.FD < 3:
+				util.LogFatal("parse configuration: fd in entry #%d in keys must be 3 or higher", idx+1)
+			case keyFDs[*key.FD]:
+				util.LogFatal("parse configuration: fd %d appears in multiple entries in keys", *key.FD)
+			}
+			keyFDs[*key.FD] = true
+		}
+		if key.Credential != "" {
+			sources++
+			if strings.Contains(key.Credential, "/") {
+				util.LogFatal("parse configuration: credential in entry #%d in keys must be a name, not a path", idx+1)
+			}
+		}
+		if sources > 1 {
+			util.LogFatal("parse configuration: entry #%d in keys must have only one of secret, vault, barbican, tpm2, keyfile, fd and credential", idx+1)
+		}
+	}
+
+	if err := Config.LUKS.Format.Validate(); err != nil {
+		util.LogFatal("parse configuration: invalid luks.format: %s", err.Error())
+	}
+	if Config.LUKS.HeaderDirectory != "" && !strings.HasPrefix(Config.LUKS.HeaderDirectory, "/") {
+		util.LogFatal("parse configuration: luks.header-directory must be an absolute path")
+	}
+	if Config.LUKS.HeaderDirectory != "" && filepath.Clean(Config.LUKS.HeaderDirectory) == filepath.Clean(Config.LUKS.HeaderBackupDirectory) {
+		util.LogFatal("parse configuration: luks.header-directory and luks.header-backup-directory must be different directories")
+	}
+	if Config.LUKS.ConvertToLUKS2 && Config.LUKS.Format.Type == "luks1" {
+		util.LogFatal("parse configuration: luks.convert-to-luks2 cannot be combined with luks.format.type luks1")
+	}
+
+	for idx, key := range Config.LUKS.RetiredKeys {
+		switch {
+		case (key.Secret == "") == (key.KeyFile == ""):
+			util.LogFatal("parse configuration: entry #%d in luks.retired-keys must have either secret or keyfile", idx+1)
+		case key.KeyFile != "" && !strings.HasPrefix(key.KeyFile, "/"):
+			util.LogFatal("parse configuration: keyfile in entry #%d in luks.retired-keys must be an absolute path", idx+1)
+		case key.KeyFile == "" && key.KeyFileInChroot:
+			util.LogFatal("parse configuration: entry #%d in luks.retired-keys has keyfile-in-chroot, but no keyfile", idx+1)
+		}
+		for _, k := range Config.Keys {
+			if (key.Secret != "" && key.Secret == k.Secret) || (key.KeyFile != "" && key.KeyFile == k.KeyFile) {
+				util.LogFatal("parse configuration: entry #%d in luks.retired-keys also appears in keys", idx+1)
+			}
+		}
+	}
+
+	if err := Config.Network.Validate(); err != nil {
+		util.LogFatal("parse configuration: invalid network settings: %s", err.Error())
+	}
+	if Config.Network.Disabled {
+		if features := Config.networkDependentFeatures(); len(features) > 0 {
+			util.LogFatal("parse configuration: network is disabled, but the following features need network access: %s",
+				strings.Join(features, ", "))
+		}
+		util.LogInfo("network is disabled: no listeners will be opened and no outbound connections will be made")
+	}
+	Config.Network.ApplyToEnvironment()
+
+	for idx, t := range Config.APITokens {
+		if err := t.Validate(); err != nil {
+			util.LogFatal("parse configuration: invalid entry #%d in api-tokens: %s", idx+1, err.Error())
+		}
+	}
+
+	//setup log redaction (the encryption keys and API tokens are always
+	//redacted)
+	for _, key := range Config.Keys {
+		util.AddRedactedSecret(string(key.Secret))
+		if b := key.Barbican; b != nil {
+			util.AddRedactedSecret(string(b.Password))
+			util.AddRedactedSecret(string(b.ApplicationCredentialSecret))
+		}
+	}
+	for _, key := range Config.LUKS.RetiredKeys {
+		util.AddRedactedSecret(string(key.Secret))
+	}
+	for _, t := range Config.APITokens {
+		util.AddRedactedSecret(string(t.Token))
+	}
+	for _, pattern := range Config.LogRedaction {
+		rx, err := regexp.Compile(pattern)
+		if err != nil {
+			util.LogFatal("parse configuration: invalid log redaction pattern %q: %s", pattern, err.Error())
+		}
+		util.AddRedactionPattern(rx)
+	}
+
+	//setup routing of commands into additional chroots
+	routes := make(map[string]string)
+	for purpose, cfg := range Config.Chroots {
+		if !strings.HasPrefix(cfg.Path, "/") {
+			util.LogFatal("parse configuration: chroots.%s.path must be an absolute path", purpose)
+		}
+		for _, cmdName := range cfg.Commands {
+			if _, exists := routes[cmdName]; exists {
+				util.LogFatal("parse configuration: command %q is routed into more than one chroot", cmdName)
+			}
+			routes[cmdName] = cfg.Path
+		}
+	}
+	command.SetChrootRoutes(routes)
+
+	//setup throttling for commands
+	throttle := command.Throttle{
+		MaxLightOperations: Config.Concurrency.LightOperations,
+		MaxHeavyOperations: Config.Concurrency.HeavyOperations,
+		Nice:               Config.Concurrency.Nice,
+		IONiceClass:        Config.Concurrency.IONiceClass,
+		NiceAllOperations:  Config.Concurrency.NiceAllOperations,
+		CgroupPath:         Config.Concurrency.Cgroup.Path,
+	}
+	if err := throttle.Validate(); err != nil {
+		util.LogFatal("parse configuration: invalid concurrency settings: %s", err.Error())
+	}
+	if Config.Concurrency.Drives < 0 {
+		util.LogFatal("parse configuration: invalid concurrency settings: concurrency limits may not be negative")
+	}
+	if len(Config.Concurrency.Cgroup.Limits) > 0 && Config.Concurrency.Cgroup.Path == "" {
+		util.LogFatal("parse configuration: invalid concurrency settings: cgroup.limits given without cgroup.path")
+	}
+	command.SetThrottle(throttle)
+
+	//setup retry policy for commands
+	command.DefaultRetryPolicy = command.RetryPolicy{
+		Count:   Config.Retry.Count,
+		Backoff: Config.Retry.Backoff,
+	}
+	for _, pattern := range Config.Retry.Patterns {
+		rx, err := regexp.Compile(pattern)
+		if err != nil {
+			util.LogFatal("parse configuration: invalid retry pattern %q: %s", pattern, err.Error())
+		}
+		command.DefaultRetryPolicy.Patterns = append(command.DefaultRetryPolicy.Patterns, rx)
+	}
 
 	//if there are multiple "spare" entries in the SwiftIDPool, disambiguate
 	//them into "spare/0", "spare/1", and so on
@@ -0,0 +1,85 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	std_os "os"
+	"os/exec"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//How an age-encrypted file starts (in binary and in ASCII-armored form).
+var ageHeaders = []string{"age-encryption.org/v1\n", "-----BEGIN AGE ENCRYPTED FILE-----"}
+
+//Returns the plaintext of the given configuration file contents if they are
+//encrypted with SOPS or age, or the contents unchanged otherwise. Decryption
+//is done by sops(1) or age(1) from our $PATH (i.e. outside of the chroot),
+//which read the ciphertext from stdin and write the plaintext to stdout, so
+//the plaintext is never written to disk.
+func decryptConfiguration(buf []byte, ageIdentityPath string) ([]byte, error) {
+	trimmed := bytes.TrimLeft(buf, " \t\r\n")
+	for _, header := range ageHeaders {
+		if bytes.HasPrefix(trimmed, []byte(header)) {
+			if ageIdentityPath == "" {
+				return nil, errors.New("configuration is encrypted with age, but no --age-identity was given")
+			}
+			return runDecryptionCommand(buf, nil, "age", "--decrypt", "--identity", ageIdentityPath)
+		}
+	}
+
+	//SOPS leaves the document structure intact, and adds its metadata in a
+	//top-level "sops" key
+	var doc struct {
+		SOPS *struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	if yaml.Unmarshal(buf, &doc) != nil || doc.SOPS == nil || doc.SOPS.MAC == "" {
+		return buf, nil
+	}
+	var env []string
+	if ageIdentityPath != "" {
+		env = append(env, "SOPS_AGE_KEY_FILE="+ageIdentityPath)
+	}
+	return runDecryptionCommand(buf, env, "sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", "/dev/stdin")
+}
+
+func runDecryptionCommand(ciphertext []byte, env []string, cmd ...string) ([]byte, error) {
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Env = append(std_os.Environ(), env...)
+	c.Stdin = bytes.NewReader(ciphertext)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("cannot decrypt with %s: %s", cmd[0], msg)
+	}
+	return stdout.Bytes(), nil
+}
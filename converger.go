@@ -22,31 +22,105 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	std_os "os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
 	"github.com/sapcc/swift-drive-autopilot/pkg/core"
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
 //Converger contains the internal state of the converger thread.
+//
+//The converger thread is the single owner of this state (including all
+//core.Drive instances). Other goroutines (collectors, signal handlers, HTTP
+//handlers) must never access it directly. Instead, they either send an Event
+//into the queue (which the converger will handle), or read the snapshot that
+//the converger publishes after each convergence (see PublishStatus), or use
+//QueryConverger() to run a read-only function on the converger thread.
+//
+//The only exception is forEachDrive(), which may hand out each drive to its
+//own goroutine while the converger thread waits for all of them to complete.
+//During that time, each drive (and only its own drive) may be modified by its
+//goroutine, and everything else in the Converger must not be modified at all.
 type Converger struct {
 	//long-lived state
-	Drives []*core.Drive
-	OS     os.Interface
+	Drives    []*core.Drive
+	OS        os.Interface
+	State     *state.State
+	StartedAt time.Time
+	//IsReady is set once flag-ready has been written.
+	IsReady bool
+
+	//whether a DriveAddedEvent has been handled yet (for --once)
+	drivesDiscovered bool
+	//whether we already logged that readiness is delayed because of missing drives
+	loggedReadinessDelay bool
+	//how many drives are running with the configured DriveSettings while others
+	//use different settings (only tracked if --canary is given)
+	canaryCount int
+	//which storage policies are ready (see UpdateStoragePolicies)
+	readyPolicies map[string]bool
+	//set while a reboot is being prepared (see PrepareRebootEvent)
+	rebootPreparation *RebootPreparationStatus
+	//progress of drive evacuations by drive ID (only drives that are being
+	//evacuated have an entry)
+	evacuations map[string]EvacuationStatus
+	//debouncing and quarantine of flapping drives
+	flaps flapTracker
+	//when the power-on hours of each drive were last read from SMART (see
+	//recordLifecycleData)
+	powerOnHoursCheckedAt map[string]time.Time
+	//which drives are being encrypted in place right now, by drive ID (see
+	//startEncryption)
+	runningEncryptions map[string]bool
+	//timer for retrying the setup of locked drives (see
+	//scheduleLockedDriveRetry)
+	lockedDriveRetry *time.Timer
 }
 
 //RunConverger runs the converger thread. This function does not return.
 func RunConverger(queue chan []Event, osi os.Interface) {
-	c := &Converger{OS: osi}
+	s, err := state.Load(Config.StatePath)
+	if err != nil {
+		util.LogFatal("cannot load state from %s: %s", Config.StatePath, err.Error())
+	}
+	//holding the lock until we exit keeps --rollback from replacing the state
+	//file underneath us
+	err = s.Lock(Config.StatePath)
+	if err != nil {
+		util.LogFatal("cannot lock state file %s: %s", Config.StatePath, err.Error())
+	}
+	s.KeepSnapshots = Config.Retention.StateSnapshots
+	c := &Converger{OS: osi, State: s, StartedAt: time.Now(), readyPolicies: make(map[string]bool)}
+	c.canaryCount = c.countCanaries()
 
 	for {
 		//wait for processable events
+		setConvergerActivity("waiting for events")
 		events := <-queue
 
+		//queries from other goroutines only observe the state, so they do not
+		//warrant a convergence
+		if isQueryOnly(events) {
+			for _, event := range events {
+				event.Handle(c)
+			}
+			continue
+		}
+		if Config.EventCoalescing.Enabled {
+			setConvergerActivity("coalescing events")
+			events = collectEventStorm(queue, events, c)
+		}
+		setConvergerActivity("refreshing mount points and LUKS mappings")
+
 		//initialize short-lived state for this event loop iteration
 		osi.RefreshMountPoints()
 		osi.RefreshLUKSMappings()
@@ -57,9 +131,17 @@ func RunConverger(queue chan []Event, osi os.Interface) {
 				util.LogInfo("event received: " + msg)
 			}
 			eventCounter.With(prometheus.Labels{"type": event.EventType()}).Add(1)
+			setConvergerActivity("handling event: " + event.EventType())
 			event.Handle(c)
 		}
 
+		//while a reboot is being prepared, the drives must stay as they are
+		if c.rebootPreparation != nil {
+			c.PublishStatus()
+			continue
+		}
+
+		setConvergerActivity("converging")
 		c.Converge()
 	}
 }
@@ -67,26 +149,302 @@ func RunConverger(queue chan []Event, osi os.Interface) {
 //Converge moves towards the desired state of all drives after a set of events
 //has been received and handled by the converger.
 func (c *Converger) Converge() {
-	for _, drive := range c.Drives {
-		drive.Converge(c.OS)
+	c.RecreateRuntimeDirectories()
+
+	//drives that were held back by the flap detection may be set up now
+	c.flaps.Process(c)
+
+	//process drives in a stable order, so that logs from different runs (and
+	//different nodes) can be compared line by line
+	sort.SliceStable(c.Drives, func(i, j int) bool {
+		return c.Drives[i].DevicePath < c.Drives[j].DevicePath
+	})
+
+	budget := newConvergenceBudget()
+	failures := c.newFailureTracker()
+	c.forEachDrive(func(drive *core.Drive) {
+		if failures.Admit() && budget.Admit(drive) {
+			c.convergeDrive(drive, budget)
+			failures.Record(drive)
+		}
+	})
+	if failures.Exceeded() {
+		c.abortSetup(failures)
+	}
+
+	//swift-id assignments cannot be decided safely while some drives have not
+	//been looked at, so those wait until all deferred drives have been set up
+	deferred := budget.DeferredCount()
+	if deferred > 0 {
+		util.LogInfo("convergence budget exhausted: deferring the setup of %d drives to the next convergence", deferred)
+		RequestConvergence("setup of deferred drives")
+		c.UpdateState()
+		c.PublishStatus()
+		return
+	}
+
+	//drives that are locked by other processes are left out of this
+	//convergence (UpdateDriveAssignments does not auto-assign swift-ids while
+	//they are), and are retried a bit later
+	if locked := budget.LockedCount(); locked > 0 {
+		util.LogInfo("waiting for %d drives that are locked by other processes", locked)
+		c.scheduleLockedDriveRetry()
 	}
 	core.UpdateDriveAssignments(c.Drives, Config.SwiftIDPool, c.OS)
 
-	for _, drive := range c.Drives {
-		if !drive.Broken {
-			drive.Converge(c.OS) //to reflect updated drive assignments
+	c.forEachDrive(func(drive *core.Drive) {
+		if !drive.Broken && !drive.LockedElsewhere {
+			c.convergeDrive(drive, nil) //to reflect updated drive assignments
 			mountPath := drive.MountPath()
-			if filepath.Dir(mountPath) == "/srv/node" {
+			if filepath.Dir(mountPath) == "/srv/node" && !Config.Recovery {
 				c.OS.Chown(mountPath, Config.Owner.User, Config.Owner.Group)
 			}
 		}
-	}
+	})
 
 	c.CheckForUnexpectedMounts()
 	c.WriteDriveAudit()
+	c.UpdateState()
+
+	//mark storage as ready for consumption by Swift (but not in recovery mode,
+	//where Swift shall not touch the drives)
+	wasReady := c.IsReady
+	if Config.Recovery {
+		c.PublishStatus()
+		c.exitIfOnce()
+		return
+	}
+	c.UpdateStoragePolicies()
+	if c.CheckReadiness() {
+		command.Command{ExitOnError: true}.Run("touch", "/run/swift-storage/state/flag-ready")
+		if !wasReady {
+			for _, driveID := range c.MissingManifestDriveIDs() {
+				util.LogError("drive %s is listed in the drive manifest, but was not found", driveID)
+			}
+			c.writeReadinessReport()
+			FinishBootProfiling(c.StartedAt)
+		}
+	}
+	c.PublishStatus()
+	c.exitIfOnce()
+}
 
-	//mark storage as ready for consumption by Swift
-	command.Command{ExitOnError: true}.Run("touch", "/run/swift-storage/state/flag-ready")
+//With --once, the process exits after the first convergence that has seen the
+//drives and marked storage as ready (or, in recovery mode, after the first
+//convergence that has seen the drives).
+func (c *Converger) exitIfOnce() {
+	if !*onceFlag || !c.drivesDiscovered || !(c.IsReady || Config.Recovery) {
+		return
+	}
+	util.LogInfo("converged once, exiting")
+	StopHelpers()
+	std_os.Exit(0)
+}
+
+//Sets up the drive (or tears it down if it is broken). If device locking is
+//configured, this happens while holding the lock on the physical drive, and
+//drives that are locked by other processes are skipped. The budget, if given,
+//tracks the work done and the drives that were skipped.
+func (c *Converger) convergeDrive(drive *core.Drive, budget *convergenceBudget) {
+	formattedAt := drive.FormattedAt
+	err := configuredSafeguards().Converge(c.OS, drive)
+	if err != nil {
+		util.LogInfo("skipping %s for now: %s", drive.DevicePath, err.Error())
+		if budget != nil && drive.LockedElsewhere {
+			budget.RecordLocked(drive)
+		}
+		return
+	}
+	if budget != nil {
+		budget.Record(drive, formattedAt)
+	}
+}
+
+//How long to wait before retrying the setup of drives that are locked by other
+//processes.
+const lockedDriveRetryInterval = 30 * time.Second
+
+//Requests another convergence after lockedDriveRetryInterval (or postpones the
+//one that is already scheduled).
+func (c *Converger) scheduleLockedDriveRetry() {
+	if c.lockedDriveRetry == nil {
+		c.lockedDriveRetry = time.AfterFunc(lockedDriveRetryInterval, func() {
+			RequestConvergence("retry of locked drives")
+		})
+		return
+	}
+	c.lockedDriveRetry.Reset(lockedDriveRetryInterval)
+}
+
+//Takes the advisory lock on the physical drive if Config.DeviceLocking is
+//enabled. The returned function releases the lock.
+func (c *Converger) lockDrive(drive *core.Drive) (unlock func(), err error) {
+	return configuredSafeguards().Lock(c.OS, drive)
+}
+
+//Returns the safeguards that apply to all drives according to the
+//configuration (see core.Safeguards).
+func configuredSafeguards() core.Safeguards {
+	s := core.Safeguards{ExpectedDriveIDs: expectedDriveIDs}
+	if Config.DeviceLocking.Enabled {
+		s.DeviceLockTimeout = Config.DeviceLocking.Timeout
+	}
+	return s
+}
+
+//newDrive initializes a Drive instance (see core.NewDrive) and protects it
+//with the configured safeguards. All drives managed by the converger shall be
+//constructed through this, including those that are rebuilt after being
+//reinstated or encrypted.
+func (c *Converger) newDrive(devicePath, backingDevicePath, serialNumber string, opts core.DriveOptions) *core.Drive {
+	drive := core.NewDrive(devicePath, backingDevicePath, serialNumber, opts, c.OS)
+	var expectedFilesystemUUID string
+	if ds, exists := c.State.Drives[drive.DriveID]; exists && Config.VerifyFilesystemUUID {
+		expectedFilesystemUUID = ds.FilesystemUUID
+	}
+	configuredSafeguards().Protect(drive, expectedFilesystemUUID)
+	return drive
+}
+
+//forEachDrive calls the action once for each drive. Unless concurrency is
+//configured, this happens sequentially in the order of c.Drives. Otherwise
+//up to Config.Concurrency.Drives drives are processed at the same time, and
+//the log output for each drive is collected in a work unit and written in one
+//piece once the drive is done.
+func (c *Converger) forEachDrive(action func(drive *core.Drive)) {
+	if Config.Concurrency.Drives <= 1 {
+		for _, drive := range c.Drives {
+			action(drive)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, Config.Concurrency.Drives)
+	for _, drive := range c.Drives {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(drive *core.Drive) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			util.BeginWorkUnit(drive.DriveID)
+			defer util.EndWorkUnit(drive.DriveID)
+			action(drive)
+		}(drive)
+	}
+	wg.Wait()
+}
+
+//UpdateState records all currently known drives in the persistent state.
+func (c *Converger) UpdateState() {
+	for _, drive := range c.Drives {
+		ds := c.State.Drive(drive.DriveID)
+		ds.DevicePath = drive.DevicePath
+		//format options are only known for filesystems that we created
+		settings := state.DriveSettings{MountOptions: drive.MountOptions}
+		if !drive.FormattedAt.IsZero() {
+			settings.FormatOptions = drive.FormatOptions
+		} else if ds.Settings != nil {
+			settings.FormatOptions = ds.Settings.FormatOptions
+		}
+		ds.Settings = &settings
+		if a := drive.Assignment; a != nil && a.Error == "" && a.SwiftID != "" {
+			ds.SwiftID = a.SwiftID
+			util.SetDriveLogSwiftID(drive.DriveID, a.SwiftID)
+		}
+		if drive.ExpectedFilesystemUUID != "" {
+			ds.FilesystemUUID = drive.ExpectedFilesystemUUID
+		}
+		if !drive.MountedAt.IsZero() {
+			ds.RecordMount(drive.MountedPath(), drive.MountedAt)
+		}
+		if !drive.BrokenAt.IsZero() {
+			ds.RecordBroken(drive.BrokenAt)
+		}
+		c.recordLifecycleData(drive, ds)
+	}
+
+	c.forgetMissingDrives()
+
+	err := c.State.Save(Config.StatePath)
+	if err != nil {
+		util.LogError("cannot save state to %s: %s", Config.StatePath, err.Error())
+	}
+}
+
+//Tracks how long each drive from the persistent state has been missing, and
+//forgets those that have been missing for longer than configured, so that the
+//state (and the per-drive logs) do not grow without bounds on nodes where
+//drives are replaced regularly.
+func (c *Converger) forgetMissingDrives() {
+	isPresent := make(map[string]bool, len(c.Drives))
+	for _, drive := range c.Drives {
+		isPresent[drive.DriveID] = true
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, driveID := range c.State.DriveIDs() {
+		ds := c.State.Drives[driveID]
+		switch {
+		case isPresent[driveID]:
+			ds.MissingSince = nil
+		case ds.MissingSince == nil:
+			ds.MissingSince = &now
+		case now.Sub(*ds.MissingSince) > Config.Retention.ForgetDrivesAfter:
+			util.LogInfo("forgetting drive %s (last seen at %s) since it has been missing since %s",
+				driveID, ds.DevicePath, ds.MissingSince.Format(time.RFC3339))
+			c.State.Forget(driveID)
+			util.RemoveDriveLogFiles(driveID)
+		}
+	}
+}
+
+//CheckReadiness decides whether storage may be marked as ready for
+//consumption by Swift. If Config.ExpectedDrives is set and fewer drives have
+//been found, readiness is delayed until the grace period after startup has
+//expired, to accommodate slow controller scans.
+func (c *Converger) CheckReadiness() bool {
+	expected := Config.ExpectedDrives.Count
+	if c.IsReady || expected == 0 || len(c.Drives) >= expected {
+		c.IsReady = true
+		return true
+	}
+
+	missing := "none known"
+	if ids := c.MissingDriveIDs(); len(ids) > 0 {
+		missing = strings.Join(ids, ", ")
+	}
+	gracePeriod := Config.ExpectedDrives.GracePeriod
+	if time.Since(c.StartedAt) < gracePeriod {
+		if !c.loggedReadinessDelay {
+			util.LogInfo("found only %d of %d expected drives, delaying readiness for up to %s (missing drives: %s)",
+				len(c.Drives), expected, gracePeriod.String(), missing)
+			c.loggedReadinessDelay = true
+		}
+		return false
+	}
+
+	util.LogError("found only %d of %d expected drives after waiting for %s, marking storage as ready anyway (missing drives: %s)",
+		len(c.Drives), expected, gracePeriod.String(), missing)
+	c.IsReady = true
+	return true
+}
+
+//MissingDriveIDs returns the IDs of all drives that are known from the
+//persistent state, but have not been found on the system (yet).
+func (c *Converger) MissingDriveIDs() []string {
+	isPresent := make(map[string]bool, len(c.Drives))
+	for _, drive := range c.Drives {
+		isPresent[drive.DriveID] = true
+	}
+
+	var result []string
+	for _, driveID := range c.State.DriveIDs() {
+		if !isPresent[driveID] {
+			result = append(result, driveID)
+		}
+	}
+	return result
 }
 
 //CheckForUnexpectedMounts prints error messages for every unexpected mount
@@ -132,43 +490,176 @@ func (c *Converger) WriteDriveAudit() {
 	}
 }
 
+//convergerQueryEvent is sent by QueryConverger().
+type convergerQueryEvent struct {
+	query func(c *Converger)
+	done  chan struct{}
+}
+
+//QueryConverger runs the given function on the converger thread, for callers
+//in other goroutines that need to observe the converger's live state. The
+//query must not modify the Converger. Returns false if the converger did not
+//get to this query within the given timeout (e.g. because it is stuck in a
+//long-running operation).
+func QueryConverger(queue chan []Event, timeout time.Duration, query func(c *Converger)) bool {
+	e := convergerQueryEvent{query, make(chan struct{})}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case queue <- []Event{e}:
+	case <-timer.C:
+		return false
+	}
+	select {
+	case <-e.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func isQueryOnly(events []Event) bool {
+	for _, event := range events {
+		if _, ok := event.(convergerQueryEvent); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//LogMessage implements the Event interface.
+func (e convergerQueryEvent) LogMessage() string {
+	return ""
+}
+
+//EventType implements the Event interface.
+func (e convergerQueryEvent) EventType() string {
+	return "query"
+}
+
+//Handle implements the Event interface.
+func (e convergerQueryEvent) Handle(c *Converger) {
+	e.query(c)
+	close(e.done)
+}
+
 //Handle implements the Event interface.
 func (e DriveAddedEvent) Handle(c *Converger) {
-	keys := make([]string, len(Config.Keys))
-	for idx, key := range Config.Keys {
-		keys[idx] = string(key.Secret)
+	c.drivesDiscovered = true
+	if isVerityDevice(e.DevicePath) {
+		util.LogInfo("%s belongs to a verity volume, so it will not be set up as a drive", e.DevicePath)
+		return
+	}
+	if Config.ZFS.Zvols && e.SerialNumber == "" {
+		e.SerialNumber = zvolSerialNumber(e.FoundAtPath)
+	}
+	if !acceptedByPlugins(e) || !c.flaps.Admit(e) {
+		return
 	}
 
-	drive := core.NewDrive(e.DevicePath, e.SerialNumber, keys, c.OS)
+	if err := checkDriveOverrides(e.DevicePath, e.FoundAtPath, e.DevicePath); err != nil {
+		util.LogError("%s, so it will be ignored", err.Error())
+		return
+	}
+
+	driveID := core.DriveIDOf(e.DevicePath, e.SerialNumber)
+	settings := c.chooseDriveSettings(driveID, e.FoundAtPath, e.DevicePath)
+	opts := configuredDriveOptions(e.FoundAtPath, e.DevicePath, e.SerialNumber, settings)
+
+	drive := c.newDrive(e.DevicePath, e.BackingDevicePath, e.SerialNumber, opts)
+	if ds, exists := c.State.Drives[drive.DriveID]; exists && ds.EncryptionStartedAt != nil {
+		c.resumeEncryption(drive)
+	}
+	c.reportFormatOptionsMismatch(drive)
+	c.State.Drive(drive.DriveID).FoundAtPath = e.FoundAtPath
+	drive.RunAfterDiscoveryHook()
+	checkDriveFirmware(drive)
+	if Config.Topology.ApplyIRQAffinity {
+		c.OS.ApplyIRQAffinity(drive.Topology)
+	}
 	c.Drives = append(c.Drives, drive)
-	drive.Converge(c.OS)
+	//when drives are processed concurrently, leave the setup to the following
+	//Converge() to have all new drives set up at the same time (same if the
+	//setup shall be limited by the convergence budget)
+	if Config.Concurrency.Drives <= 1 && !budgetConfigured() {
+		c.convergeDrive(drive, nil)
+	}
+}
+
+//Builds the options for a newly discovered drive from the configuration.
+func configuredDriveOptions(foundAtPath, devicePath, serialNumber string, settings state.DriveSettings) core.DriveOptions {
+	opts := core.DriveOptions{
+		Keys:             EncryptionKeys(),
+		PostMountActions: pluginPostMountActions(),
+	}
+	if Config.Bcache.CacheDevice != "" && Config.Bcache.Matches(foundAtPath, devicePath) {
+		opts.CacheDevicePath = Config.Bcache.CacheDevice
+	}
+	if serialNumber != "" {
+		opts.LogDevicePath = Config.XFSLogDevices[serialNumber]
+	}
+	opts.MountOptions = settings.MountOptions
+	opts.FormatOptions = settings.FormatOptions
+	opts.WipeSignatures = Config.WipeSignatures
+	opts.LUKSFormatOptions = Config.LUKS.Format
+	opts.ConvertToLUKS2 = Config.LUKS.ConvertToLUKS2
+	opts.LUKSHeaderBackupDirectory = Config.LUKS.HeaderBackupDirectory
+	opts.LUKSHeaderDirectory = Config.LUKS.HeaderDirectory
+	opts.BackupLUKSHeaders = Config.LUKS.HeaderBackups.Enabled
+	opts.ReconcileKeyslots = Config.LUKS.ReconcileKeyslots
+	opts.VerifyLUKSHeaders = Config.LUKS.VerifyHeaders
+	opts.HashDeviceNames = Config.HashDeviceNames
+	opts.SwiftIDChecksums = Config.SwiftIDChecksums
+	opts.ReadOnly = Config.Recovery
+	opts.Hooks = Config.Hooks
+	opts.Labels = Config.Labels
+	opts.Optional = Config.OptionalDrives.Matches(serialNumber, foundAtPath, devicePath)
+	for _, pool := range Config.PlainCryptPools {
+		if pool.Matches(foundAtPath, devicePath) {
+			options := pool.PlainCryptOptions
+			opts.PlainCrypt = &options
+			break
+		}
+	}
+	return opts
 }
 
 //Handle implements the Event interface.
 func (e DriveRemovedEvent) Handle(c *Converger) {
+	c.flaps.RecordRemoval(e.DevicePath)
+
 	//do we know this drive?
 	var drive *core.Drive
-	var otherDrives []*core.Drive
 	for _, d := range c.Drives {
 		if d.DevicePath == e.DevicePath {
 			drive = d
-		} else {
-			otherDrives = append(otherDrives, d)
 		}
 	}
 	if drive == nil {
 		return
 	}
+	c.removeDrive(drive)
+}
 
-	//remove drive
+//removeDrive tears down the given drive and stops managing it.
+func (c *Converger) removeDrive(drive *core.Drive) {
 	drive.Teardown(c.OS)
+	var otherDrives []*core.Drive
+	for _, d := range c.Drives {
+		if d != drive {
+			otherDrives = append(otherDrives, d)
+		}
+	}
 	c.Drives = otherDrives
+	util.UnregisterDriveLog(drive.DriveID)
 }
 
 //Handle implements the Event interface.
 func (e DriveErrorEvent) Handle(c *Converger) {
 	for _, d := range c.Drives {
-		if d.DevicePath == e.DevicePath {
+		if d.DevicePath == e.DevicePath || d.BackingDevicePath == e.DevicePath || d.LogDevicePath == e.DevicePath {
+			c.State.Drive(d.DriveID).RecordKernelError(e.LogLine, time.Now())
 			d.MarkAsBroken(c.OS)
 			return
 		}
@@ -179,10 +670,15 @@ func (e DriveErrorEvent) Handle(c *Converger) {
 func (e DriveReinstatedEvent) Handle(c *Converger) {
 	for idx, d := range c.Drives {
 		if d.DevicePath == e.DevicePath {
+			if d.Encrypting {
+				util.LogError("cannot reinstate %s while its filesystem is being encrypted", d.DevicePath)
+				break
+			}
 			//reset the drive to pristine condition
-			d = core.NewDrive(d.DevicePath, d.DriveID, d.Keys, c.OS)
+			d.Unexport(c.OS)
+			d = c.newDrive(d.DevicePath, d.BackingDevicePath, d.SerialNumber, d.DriveOptions)
 			c.Drives[idx] = d
-			d.Converge(c.OS)
+			c.convergeDrive(d, nil)
 			break
 		}
 	}
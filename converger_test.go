@@ -0,0 +1,104 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	std_os "os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//These tests drive a Converger through its events against os.Fake. Like the
+//converge tests in pkg/core, they run in an empty directory that stands in for
+//the chroot, with log output discarded.
+func newTestConverger(t *testing.T) (c *Converger, osi *os.Fake, leave func()) {
+	wd, err := std_os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	root, err := ioutil.TempDir("", "swift-drive-autopilot-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, dir := range append(runtimeDirectories(), "/run/swift-storage/state") {
+		err = std_os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err = std_os.Chdir(root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+
+	Config.StatePath = "/var/lib/swift-drive-autopilot/state.json"
+
+	osi = os.NewFake()
+	c = &Converger{
+		OS:            osi,
+		State:         &state.State{Drives: make(map[string]*state.DriveState)},
+		readyPolicies: make(map[string]bool),
+	}
+	return c, osi, func() {
+		for _, d := range c.Drives {
+			util.UnregisterDriveLog(d.DriveID)
+		}
+		Config.StatePath = ""
+		log.SetOutput(logOutput)
+		std_os.Chdir(wd)
+		std_os.RemoveAll(root)
+	}
+}
+
+func TestRebuiltDrivesAreProtected(t *testing.T) {
+	c, osi, leave := newTestConverger(t)
+	defer leave()
+	Config.VerifyFilesystemUUID = true
+	defer func() { Config.VerifyFilesystemUUID = false }()
+
+	osi.AddDrive("/dev/sda", "SERIAL1")
+	DriveAddedEvent{DevicePath: "/dev/sda", FoundAtPath: "/dev/sda", SerialNumber: "SERIAL1"}.Handle(c)
+	if len(c.Drives) != 1 {
+		t.Fatalf("expected 1 drive, got %d", len(c.Drives))
+	}
+
+	//the filesystem UUID that the drive is expected to have shall be taken
+	//from the state whenever the drive is rebuilt, not only on discovery
+	c.State.Drive("SERIAL1").FilesystemUUID = "uuid-1"
+	DriveReinstatedEvent{DevicePath: "/dev/sda"}.Handle(c)
+	if uuid := c.Drives[0].ExpectedFilesystemUUID; uuid != "uuid-1" {
+		t.Errorf("expected reinstated drive to expect filesystem UUID %q, got %q", "uuid-1", uuid)
+	}
+
+	c.State.Drive("SERIAL1").FilesystemUUID = "uuid-2"
+	c.Drives[0].Encrypting = true
+	FilesystemEncryptedEvent{DevicePath: "/dev/sda", DriveID: "SERIAL1", OK: true}.Handle(c)
+	if uuid := c.Drives[0].ExpectedFilesystemUUID; uuid != "uuid-2" {
+		t.Errorf("expected encrypted drive to expect filesystem UUID %q, got %q", "uuid-2", uuid)
+	}
+}
@@ -0,0 +1,241 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	std_os "os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/parsers"
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
+)
+
+//Kinds of StateDifference.
+const (
+	BrokenDriveDifference       = "broken-drive"
+	NoDrivesDifference          = "no-drives"
+	UnknownDriveDifference      = "unknown-drive"
+	MissingSwiftIDDifference    = "missing-swift-id"
+	OutdatedSettingsDifference  = "outdated-settings"
+	MissingMountDifference      = "missing-mount"
+	UnopenedContainerDifference = "unopened-container"
+	WrongMountSourceDifference  = "wrong-mount-source"
+	WrongMountOptionsDifference = "wrong-mount-options"
+	ExtraMountDifference        = "extra-mount"
+	MissingDriveDifference      = "missing-drive"
+)
+
+//StateDifference is a difference between the desired state of the drives
+//(as derived from the configuration and the state file) and their actual
+//state, as found by FindStateDifferences().
+type StateDifference struct {
+	Kind       string `json:"kind"`
+	DevicePath string `json:"device_path,omitempty"`
+	MountPath  string `json:"mount_path,omitempty"`
+	Message    string `json:"message"`
+}
+
+//StateDifferenceReport is the JSON format of `--diff json`.
+type StateDifferenceReport struct {
+	SchemaVersion int               `json:"schema_version"`
+	Differences   []StateDifference `json:"differences"`
+}
+
+//FindStateDifferences compares the desired state of the drives with their
+//actual state, without changing anything. Like CheckAlreadyConverged (which
+//builds on it), it only looks at the filesystem, the state file and the
+//kernel's mount table, and never spawns any external commands. Drives are
+//expected to be mounted at /srv/node/<swift-id> with their last known swift-id
+//(through a dm-crypt mapping if encryption keys are configured), with the
+//configured drive settings and mount options.
+func FindStateDifferences() ([]StateDifference, error) {
+	var result []StateDifference
+	add := func(kind, devicePath, mountPath, msg string, args ...interface{}) {
+		result = append(result, StateDifference{kind, devicePath, mountPath, fmt.Sprintf(msg, args...)})
+	}
+
+	brokenFlags, err := ioutil.ReadDir("run/swift-storage/broken")
+	if err != nil && !std_os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range brokenFlags {
+		devicePath, _ := std_os.Readlink(filepath.Join("run/swift-storage/broken", fi.Name()))
+		add(BrokenDriveDifference, devicePath, "", "drive %s is flagged as broken", fi.Name())
+	}
+
+	s, err := state.Load(Config.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	knownDrives := make(map[string]*state.DriveState)
+	for _, driveID := range s.DriveIDs() {
+		ds := s.Drives[driveID]
+		if ds.MissingSince == nil {
+			knownDrives[ds.DevicePath] = ds
+		}
+	}
+
+	devicePaths, err := globDevicePaths(Config.DriveGlobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(devicePaths) == 0 {
+		add(NoDrivesDifference, "", "", "no drives found")
+	}
+
+	mounts, err := readMountTable()
+	if err != nil {
+		return nil, err
+	}
+	expectedKind := directMountSource
+	if len(EncryptionKeys()) > 0 {
+		expectedKind = mappedMountSource
+	}
+
+	isExpectedMount := make(map[string]bool)
+	for _, devicePath := range devicePaths {
+		ds := knownDrives[devicePath]
+		if ds == nil {
+			add(UnknownDriveDifference, devicePath, "", "%s is not known from the state file", devicePath)
+			continue
+		}
+		delete(knownDrives, devicePath)
+		configuredSettings := ConfiguredDriveSettings(devicePath)
+		if ds.SwiftID == "" || ds.SwiftID == "spare" {
+			add(MissingSwiftIDDifference, devicePath, "", "%s is a spare or does not have a swift-id", devicePath)
+			continue
+		}
+		if ds.Settings == nil || !ds.Settings.Equal(configuredSettings) {
+			add(OutdatedSettingsDifference, devicePath, "", "%s does not use the configured drive settings", devicePath)
+		}
+
+		mountPath := filepath.Join("/srv/node", ds.SwiftID)
+		isExpectedMount[mountPath] = true
+		entry, exists := mounts[mountPath]
+		if !exists {
+			if expectedKind == mappedMountSource && !hasHolders(devicePath) {
+				add(UnopenedContainerDifference, devicePath, mountPath, "LUKS container on %s is not open", devicePath)
+			} else {
+				add(MissingMountDifference, devicePath, mountPath, "%s is not mounted at %s", devicePath, mountPath)
+			}
+			continue
+		}
+		kind, err := mountSourceKind(entry.Source, devicePath)
+		if err != nil {
+			return nil, err
+		}
+		if kind != expectedKind {
+			add(WrongMountSourceDifference, devicePath, mountPath, "%s is not mounted from %s as expected (found %s)", mountPath, devicePath, entry.Source)
+			continue
+		}
+		if missing := missingMountOptions(entry, configuredSettings.MountOptions); len(missing) > 0 {
+			add(WrongMountOptionsDifference, devicePath, mountPath, "%s is mounted without the options %s",
+				mountPath, strings.Join(missing, ","))
+		}
+	}
+
+	var extraMounts []string
+	for mountPath := range mounts {
+		if filepath.Dir(mountPath) == "/srv/node" && !isExpectedMount[mountPath] {
+			extraMounts = append(extraMounts, mountPath)
+		}
+	}
+	sort.Strings(extraMounts)
+	for _, mountPath := range extraMounts {
+		add(ExtraMountDifference, "", mountPath, "%s is mounted from %s, which is not an expected drive", mountPath, mounts[mountPath].Source)
+	}
+
+	for _, driveID := range s.DriveIDs() {
+		ds := s.Drives[driveID]
+		if knownDrives[ds.DevicePath] == ds {
+			add(MissingDriveDifference, ds.DevicePath, "", "drive %s is known from the state file (at %s), but was not found", driveID, ds.DevicePath)
+		}
+	}
+	return result, nil
+}
+
+//Returns whether another device (e.g. a dm-crypt mapping) is stacked on top
+//of the given device.
+func hasHolders(devicePath string) bool {
+	resolved, err := resolveInChroot(".", strings.TrimPrefix(devicePath, "/"))
+	if err != nil {
+		return false
+	}
+	holders, err := ioutil.ReadDir(filepath.Join("/sys/block", filepath.Base(resolved), "holders"))
+	return err == nil && len(holders) > 0
+}
+
+//Returns those of the given options that the kernel does not report for the
+//given mount. Options that the kernel does not echo back (like "defaults")
+//will show up here, too.
+func missingMountOptions(entry parsers.MountInfoEntry, options []string) []string {
+	isPresent := make(map[string]bool)
+	for _, option := range append(append([]string(nil), entry.MountOptions...), entry.SuperOptions...) {
+		isPresent[option] = true
+	}
+	var missing []string
+	for _, option := range options {
+		for _, o := range strings.Split(option, ",") {
+			if o != "" && !isPresent[o] {
+				missing = append(missing, o)
+			}
+		}
+	}
+	return missing
+}
+
+//PrintStateDifferences prints the result of FindStateDifferences() in the
+//given format ("text" or "json"). Returns whether any differences were found.
+func PrintStateDifferences(w io.Writer, format string) (bool, error) {
+	diffs, err := FindStateDifferences()
+	if err != nil {
+		return false, err
+	}
+	found := len(diffs) > 0
+
+	switch format {
+	case "json":
+		if diffs == nil {
+			diffs = []StateDifference{}
+		}
+		buf, err := json.MarshalIndent(StateDifferenceReport{SchemaVersion, diffs}, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		_, err = fmt.Fprintln(w, string(buf))
+		return found, err
+	case "text":
+		if len(diffs) == 0 {
+			fmt.Fprintln(w, "no differences found")
+		}
+		for _, d := range diffs {
+			fmt.Fprintf(w, "%-20s %s\n", d.Kind, d.Message)
+		}
+		return found, nil
+	default:
+		return false, fmt.Errorf("unknown output format %q (expected \"text\" or \"json\")", format)
+	}
+}
@@ -0,0 +1,263 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Types of DriveEvent.
+const (
+	DriveAppearedEvent = "drive-appeared"
+	DriveChangedEvent  = "drive-changed"
+	DriveVanishedEvent = "drive-vanished"
+)
+
+//DriveEvent is a change in the state of a drive, as reported by GET
+///api/v1/events.
+type DriveEvent struct {
+	//ID increases by one with each event (starting at 1 for each run of the
+	//autopilot), so that clients can resume watching where they left off.
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	DriveID string    `json:"drive_id"`
+	//Drive is the new state of the drive (absent for drive-vanished).
+	Drive *DriveStatus `json:"drive,omitempty"`
+}
+
+//DriveEventList is the response body of GET /api/v1/events without
+//watch=true.
+type DriveEventList struct {
+	SchemaVersion int          `json:"schema_version"`
+	Events        []DriveEvent `json:"events"`
+}
+
+//DriveEventMessage is the data of each server-sent event that is streamed by
+//GET /api/v1/events?watch=true.
+type DriveEventMessage struct {
+	SchemaVersion int `json:"schema_version"`
+	DriveEvent
+}
+
+//How many past events are kept for clients that resume watching, and how
+//many events may pile up for a slow client before it is disconnected.
+const (
+	driveEventHistorySize = 256
+	driveEventBufferSize  = 64
+)
+
+//How often an idle event stream sends a comment to keep the connection alive.
+const driveEventKeepAliveInterval = 30 * time.Second
+
+//The drive events are generated by the converger thread whenever the status
+//report is published, and streamed to watchers by the HTTP handler in other
+//goroutines.
+var (
+	driveEventHistory    []DriveEvent
+	driveEventWatchers   = make(map[chan DriveEvent]bool)
+	driveEventLastID     uint64
+	driveEventLastDrives = make(map[string][]byte) //JSON-encoded DriveStatus by drive ID
+	driveEventsMutex     sync.Mutex
+)
+
+//Compares the drives in the given status report with those in the previous
+//one, and emits a DriveEvent for each drive that appeared, changed or
+//vanished. This is called by PublishStatus().
+func emitDriveEvents(report StatusReport) {
+	driveEventsMutex.Lock()
+	defer driveEventsMutex.Unlock()
+
+	now := time.Now()
+	current := make(map[string][]byte, len(report.Drives))
+	for idx := range report.Drives {
+		ds := &report.Drives[idx]
+		buf, err := json.Marshal(ds)
+		if err != nil {
+			continue
+		}
+		current[ds.DriveID] = buf
+		previous, exists := driveEventLastDrives[ds.DriveID]
+		switch {
+		case !exists:
+			emitDriveEvent(DriveEvent{Time: now, Type: DriveAppearedEvent, DriveID: ds.DriveID, Drive: ds})
+		case !bytes.Equal(previous, buf):
+			emitDriveEvent(DriveEvent{Time: now, Type: DriveChangedEvent, DriveID: ds.DriveID, Drive: ds})
+		}
+	}
+	var vanished []string
+	for driveID := range driveEventLastDrives {
+		if _, exists := current[driveID]; !exists {
+			vanished = append(vanished, driveID)
+		}
+	}
+	sort.Strings(vanished)
+	for _, driveID := range vanished {
+		emitDriveEvent(DriveEvent{Time: now, Type: DriveVanishedEvent, DriveID: driveID})
+	}
+	driveEventLastDrives = current
+}
+
+//Must be called with driveEventsMutex held.
+func emitDriveEvent(e DriveEvent) {
+	driveEventLastID++
+	e.ID = driveEventLastID
+	driveEventHistory = append(driveEventHistory, e)
+	if len(driveEventHistory) > driveEventHistorySize {
+		driveEventHistory = driveEventHistory[len(driveEventHistory)-driveEventHistorySize:]
+	}
+	for ch := range driveEventWatchers {
+		select {
+		case ch <- e:
+		default:
+			//the watcher cannot keep up, so disconnect it (it can resume from its
+			//last event ID if that is still in the history)
+			close(ch)
+			delete(driveEventWatchers, ch)
+		}
+	}
+}
+
+//Returns all events after the given ID that are still in the history. If
+//watch is set, also returns a channel that receives all later events.
+func driveEventsSince(lastID uint64, watch bool) ([]DriveEvent, chan DriveEvent) {
+	driveEventsMutex.Lock()
+	defer driveEventsMutex.Unlock()
+
+	var result []DriveEvent
+	for _, e := range driveEventHistory {
+		if e.ID > lastID {
+			result = append(result, e)
+		}
+	}
+	if !watch {
+		return result, nil
+	}
+	ch := make(chan DriveEvent, driveEventBufferSize)
+	driveEventWatchers[ch] = true
+	return result, ch
+}
+
+func stopWatchingDriveEvents(ch chan DriveEvent) {
+	driveEventsMutex.Lock()
+	defer driveEventsMutex.Unlock()
+	if driveEventWatchers[ch] {
+		close(ch)
+		delete(driveEventWatchers, ch)
+	}
+}
+
+//Handles GET /api/v1/events. Without "watch=true", the recent events are
+//returned as a JSON array. With it, they are streamed as server-sent events,
+//followed by all new events as they happen. In both cases, "since=<id>" (or
+//the Last-Event-ID header) skips the events up to that ID.
+func handleDriveEventsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	since := query.Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	var lastID uint64
+	if since != "" {
+		var err error
+		lastID, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid event ID: "+since, http.StatusBadRequest)
+			return
+		}
+	}
+	watch := query.Get("watch") == "true"
+	flusher, canFlush := w.(http.Flusher)
+	if watch && !canFlush {
+		http.Error(w, "streaming is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+
+	events, ch := driveEventsSince(lastID, watch && r.Method == http.MethodGet)
+	if ch == nil {
+		if events == nil {
+			events = []DriveEvent{}
+		}
+		buf, err := json.Marshal(DriveEventList{SchemaVersion, events})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf)
+		return
+	}
+	defer stopWatchingDriveEvents(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range events {
+		if writeDriveEvent(w, e) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(driveEventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if writeDriveEvent(w, e) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+//Writes the given event in the format of server-sent events.
+func writeDriveEvent(w http.ResponseWriter, e DriveEvent) error {
+	buf, err := json.Marshal(DriveEventMessage{SchemaVersion, e})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, buf)
+	return err
+}
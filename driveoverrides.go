@@ -0,0 +1,216 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//DriveOverride appears in type Configuration. It replaces some of the drive
+//settings for the drives matching its globs. Settings that are not given
+//(i.e. nil lists) are not overridden.
+type DriveOverride struct {
+	DriveGlobs    []string `yaml:"drives"`
+	MountOptions  []string `yaml:"mount-options"`
+	FormatOptions []string `yaml:"format-options"`
+}
+
+//Acceptable values for Configuration.DriveOverrides.Precedence, which decides
+//between multiple DriveOverrides matching the same drive.
+const (
+	//FirstMatchPrecedence prefers the override that is listed first.
+	FirstMatchPrecedence = "first-match"
+	//MostSpecificPrecedence prefers the override with the most specific
+	//matching glob (i.e. the one with the most literal characters), and falls
+	//back to the order of the overrides in case of a tie.
+	MostSpecificPrecedence = "most-specific"
+	//ErrorPrecedence refuses to manage drives that are matched by multiple
+	//overrides with conflicting settings.
+	ErrorPrecedence = "error"
+)
+
+//Validate returns an error message if this override is invalid.
+func (o DriveOverride) Validate() string {
+	if len(o.DriveGlobs) == 0 {
+		return "missing value for drives"
+	}
+	for _, pattern := range o.DriveGlobs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Sprintf("invalid glob %q: %s", pattern, err.Error())
+		}
+	}
+	if o.MountOptions == nil && o.FormatOptions == nil {
+		return "does not override any settings"
+	}
+	return ""
+}
+
+//Returns the specificity of the most specific glob in this override that
+//matches one of the given paths, or -1 if none matches.
+func (o DriveOverride) matchSpecificity(paths ...string) int {
+	result := -1
+	for _, pattern := range o.DriveGlobs {
+		for _, path := range paths {
+			if ok, _ := filepath.Match(pattern, path); ok && globSpecificity(pattern) > result {
+				result = globSpecificity(pattern)
+			}
+		}
+	}
+	return result
+}
+
+//Returns whether both overrides set one of the settings to different values.
+func (o DriveOverride) conflictsWith(other DriveOverride) bool {
+	conflicts := func(a, b []string) bool {
+		return a != nil && b != nil && !stringListsEqual(a, b)
+	}
+	return conflicts(o.MountOptions, other.MountOptions) || conflicts(o.FormatOptions, other.FormatOptions)
+}
+
+//Counts the literal characters in the given glob. Bracket expressions do not
+//count since they match a variety of characters (an escaped "]" does not end
+//them).
+func globSpecificity(pattern string) int {
+	count := 0
+	inBrackets := false
+	for idx := 0; idx < len(pattern); idx++ {
+		switch c := pattern[idx]; {
+		case inBrackets:
+			switch c {
+			case '\\':
+				idx++
+			case ']':
+				inBrackets = false
+			}
+		case c == '[':
+			inBrackets = true
+		case c == '*' || c == '?':
+		case c == '\\':
+			idx++
+			count++
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+//Returns the indexes of the DriveOverrides matching the drive with the given
+//paths, in descending order of precedence.
+func matchingDriveOverrides(paths ...string) []int {
+	var (
+		matches       []int
+		specificities = make(map[int]int)
+	)
+	for idx, o := range Config.DriveOverrides.Rules {
+		if s := o.matchSpecificity(paths...); s >= 0 {
+			matches = append(matches, idx)
+			specificities[idx] = s
+		}
+	}
+	if Config.DriveOverrides.Precedence == MostSpecificPrecedence {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return specificities[matches[i]] > specificities[matches[j]]
+		})
+	}
+	return matches
+}
+
+//Checks the DriveOverrides matching the drive with the given paths, and
+//returns an error if they conflict with each other while
+//DriveOverridePrecedence is ErrorPrecedence. Otherwise, the resolution of
+//overlaps is reported in the log.
+func checkDriveOverrides(devicePath string, paths ...string) error {
+	matches := matchingDriveOverrides(paths...)
+	if len(matches) < 2 {
+		return nil
+	}
+	names := make([]string, len(matches))
+	for idx, match := range matches {
+		names[idx] = fmt.Sprintf("#%d", match+1)
+	}
+
+	if Config.DriveOverrides.Precedence == ErrorPrecedence {
+		for _, i := range matches {
+			for _, j := range matches {
+				if i < j && Config.DriveOverrides.Rules[i].conflictsWith(Config.DriveOverrides.Rules[j]) {
+					return fmt.Errorf("%s matches drive-overrides.rules #%d and #%d, which conflict with each other", devicePath, i+1, j+1)
+				}
+			}
+		}
+	}
+	util.LogInfo("%s matches drive-overrides.rules %s, which are applied in this order of precedence (%s)",
+		devicePath, strings.Join(names, ", "), Config.DriveOverrides.Precedence)
+	return nil
+}
+
+//Reports pairs of DriveOverrides with conflicting settings whose globs
+//obviously overlap (i.e. are identical, or one glob matches the other one
+//verbatim). Other overlaps can only be detected once drives are found (see
+//checkDriveOverrides).
+func reportOverlappingDriveOverrides() {
+	for i, a := range Config.DriveOverrides.Rules {
+		for j := i + 1; j < len(Config.DriveOverrides.Rules); j++ {
+			b := Config.DriveOverrides.Rules[j]
+			if !a.conflictsWith(b) || !globsOverlap(a.DriveGlobs, b.DriveGlobs) {
+				continue
+			}
+			msg := fmt.Sprintf("drive-overrides.rules #%d and #%d overlap and conflict with each other", i+1, j+1)
+			if Config.DriveOverrides.Precedence == ErrorPrecedence {
+				util.LogFatal("parse configuration: %s", msg)
+			}
+			util.LogInfo("%s (resolved by %s precedence)", msg, Config.DriveOverrides.Precedence)
+		}
+	}
+}
+
+func globsOverlap(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+			if ok, _ := filepath.Match(x, y); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(y, x); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stringListsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
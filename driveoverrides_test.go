@@ -0,0 +1,132 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestGlobSpecificity(t *testing.T) {
+	testCases := []struct {
+		Pattern  string
+		Expected int
+	}{
+		{"/dev/sda", 8},
+		{"/dev/sd*", 7},
+		{"/dev/sd?", 7},
+		{"/dev/sd[a-f]", 7},
+		{`/dev/sd[\]a]x`, 8},
+		{`/dev/sd\*`, 8},
+		{"*", 0},
+		{"", 0},
+	}
+	for _, tc := range testCases {
+		if actual := globSpecificity(tc.Pattern); actual != tc.Expected {
+			t.Errorf("expected globSpecificity(%q) to return %d, but got %d", tc.Pattern, tc.Expected, actual)
+		}
+	}
+}
+
+//Also discards the log output, which reports how overlaps are resolved.
+func withDriveOverrides(precedence string, rules ...DriveOverride) (restore func()) {
+	saved := Config.DriveOverrides
+	Config.DriveOverrides.Precedence = precedence
+	Config.DriveOverrides.Rules = rules
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	return func() {
+		Config.DriveOverrides = saved
+		log.SetOutput(logOutput)
+	}
+}
+
+func TestMatchingDriveOverrides(t *testing.T) {
+	rules := []DriveOverride{
+		{DriveGlobs: []string{"/dev/sd*"}, MountOptions: []string{"noatime"}},
+		{DriveGlobs: []string{"/dev/nvme*"}, MountOptions: []string{"discard"}},
+		{DriveGlobs: []string{"/dev/sdb", "/dev/disk/by-path/*"}, FormatOptions: []string{"-i", "size=1024"}},
+		{DriveGlobs: []string{"/dev/sd?"}, MountOptions: []string{"nobarrier"}},
+	}
+
+	testCases := []struct {
+		Precedence string
+		Paths      []string
+		Expected   []int
+	}{
+		{FirstMatchPrecedence, []string{"/dev/sdb"}, []int{0, 2, 3}},
+		//the exact match wins, and ties keep the order of the rules
+		{MostSpecificPrecedence, []string{"/dev/sdb"}, []int{2, 0, 3}},
+		{FirstMatchPrecedence, []string{"/dev/sdc"}, []int{0, 3}},
+		{MostSpecificPrecedence, []string{"/dev/sdc"}, []int{0, 3}},
+		//the most specific glob of a rule counts, across all paths of the drive
+		{MostSpecificPrecedence, []string{"/dev/disk/by-path/pci-0000:00:1f.2-ata-1", "/dev/sdc"}, []int{2, 0, 3}},
+		{MostSpecificPrecedence, []string{"/dev/vda"}, nil},
+	}
+	for _, tc := range testCases {
+		restore := withDriveOverrides(tc.Precedence, rules...)
+		actual := matchingDriveOverrides(tc.Paths...)
+		restore()
+		if !reflect.DeepEqual(actual, tc.Expected) {
+			t.Errorf("expected matchingDriveOverrides(%v) with %s precedence to return %v, but got %v",
+				tc.Paths, tc.Precedence, tc.Expected, actual)
+		}
+	}
+}
+
+func TestCheckDriveOverridesWithErrorPrecedence(t *testing.T) {
+	rules := []DriveOverride{
+		{DriveGlobs: []string{"/dev/sd*"}, MountOptions: []string{"noatime"}},
+		//does not conflict with the first rule since it overrides other settings
+		{DriveGlobs: []string{"/dev/sd?"}, FormatOptions: []string{"-i", "size=1024"}},
+		//conflicts with the first rule, but only for sdb
+		{DriveGlobs: []string{"/dev/sdb"}, MountOptions: []string{"nobarrier"}},
+		//agrees with the first rule
+		{DriveGlobs: []string{"/dev/sdc"}, MountOptions: []string{"noatime"}},
+	}
+
+	testCases := []struct {
+		Precedence    string
+		DevicePath    string
+		ExpectedError string
+	}{
+		{ErrorPrecedence, "/dev/sda", ""},
+		{ErrorPrecedence, "/dev/sdb", "/dev/sdb matches drive-overrides.rules #1 and #3, which conflict with each other"},
+		{ErrorPrecedence, "/dev/sdc", ""},
+		//other precedences resolve the conflict instead
+		{FirstMatchPrecedence, "/dev/sdb", ""},
+		{MostSpecificPrecedence, "/dev/sdb", ""},
+	}
+	for _, tc := range testCases {
+		restore := withDriveOverrides(tc.Precedence, rules...)
+		err := checkDriveOverrides(tc.DevicePath, tc.DevicePath)
+		restore()
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if actual != tc.ExpectedError {
+			t.Errorf("expected checkDriveOverrides(%q) with %s precedence to return %q, but got %q",
+				tc.DevicePath, tc.Precedence, tc.ExpectedError, actual)
+		}
+	}
+}
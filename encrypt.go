@@ -0,0 +1,221 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//EncryptionRequestDirectory is where administrators place files to request
+//the in-place encryption of a drive's filesystem. The file name is the
+//swift-id or drive ID of the drive in question.
+const EncryptionRequestDirectory = "/run/swift-storage/encrypt-filesystem"
+
+//EncryptFilesystemEvent is an Event that is emitted by CollectRequestFiles
+//for EncryptionRequestDirectory.
+type EncryptFilesystemEvent struct {
+	//Name is the swift-id or the drive ID of the drive in question.
+	Name string
+}
+
+//LogMessage implements the Event interface.
+func (e EncryptFilesystemEvent) LogMessage() string {
+	return "filesystem encryption requested for " + e.Name
+}
+
+//EventType implements the Event interface.
+func (e EncryptFilesystemEvent) EventType() string {
+	return "filesystem-encryption-requested"
+}
+
+//Handle implements the Event interface.
+func (e EncryptFilesystemEvent) Handle(c *Converger) {
+	err := c.encryptFilesystem(e.Name)
+	if err != nil {
+		util.LogError(err.Error())
+	}
+}
+
+//Takes the drive with the given swift-id or drive ID out of /srv/node, and
+//starts converting its filesystem into a LUKS container with a detached
+//header. The drive is set up again once the encryption is complete.
+func (c *Converger) encryptFilesystem(name string) error {
+	drive, err := c.findEncryptableDrive(name)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt filesystem of %s: %s", name, err.Error())
+	}
+
+	unlock, err := c.lockDrive(drive)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt filesystem of %s: %s", drive.DevicePath, err.Error())
+	}
+
+	util.LogInfo("encrypting filesystem of %s (swift-id %s) in place", drive.DevicePath, drive.Assignment.SwiftID)
+	if !drive.Device.Teardown(drive, c.OS) {
+		unlock()
+		return fmt.Errorf("cannot encrypt filesystem of %s: unmounting failed", drive.DevicePath)
+	}
+
+	//the marker must be persisted before the encryption starts, otherwise a
+	//reboot at the wrong moment could get the half-encrypted filesystem mounted
+	now := time.Now().UTC().Truncate(time.Second)
+	c.State.Drive(drive.DriveID).EncryptionStartedAt = &now
+	err = c.State.Save(Config.StatePath)
+	if err != nil {
+		c.State.Drive(drive.DriveID).EncryptionStartedAt = nil
+		unlock()
+		return fmt.Errorf("cannot encrypt filesystem of %s: cannot save state to %s: %s", drive.DevicePath, Config.StatePath, err.Error())
+	}
+	c.startEncryption(drive, unlock)
+	return nil
+}
+
+//Like findActiveDrive, but also checks that the drive's filesystem can be
+//encrypted in place.
+func (c *Converger) findEncryptableDrive(name string) (*core.Drive, error) {
+	drive, err := c.findActiveDrive(name)
+	switch {
+	case err != nil:
+		return nil, err
+	case !drive.HasUnencryptedFilesystem():
+		return nil, errors.New("drive is already encrypted or uses a cache device")
+	case len(drive.Keys) == 0:
+		return nil, errors.New("no keys configured")
+	}
+	return drive, nil
+}
+
+//Called by DriveAddedEvent for drives whose encryption was interrupted (e.g.
+//by a reboot). The half-encrypted filesystem must not be mounted, so the drive
+//is not set up until the encryption is complete.
+func (c *Converger) resumeEncryption(drive *core.Drive) {
+	if !Config.EncryptionMigration.Enabled || len(drive.Keys) == 0 {
+		util.LogError("encryption of %s was interrupted and cannot be resumed without encryption-migration and keys: will not set up the drive", drive.DevicePath)
+		drive.Encrypting = true
+		return
+	}
+	if c.runningEncryptions[drive.DriveID] {
+		//the drive was replugged while the encryption was running (which holds
+		//the drive lock)
+		drive.Encrypting = true
+		return
+	}
+	unlock, err := c.lockDrive(drive)
+	if err != nil {
+		util.LogError("cannot resume encryption of %s: %s", drive.DevicePath, err.Error())
+		drive.Encrypting = true
+		return
+	}
+	util.LogInfo("resuming interrupted encryption of %s", drive.DevicePath)
+	c.startEncryption(drive, unlock)
+}
+
+//Runs the encryption of the given drive outside of the converger thread, since
+//it takes as long as it takes to rewrite the whole drive. The result is
+//reported in a FilesystemEncryptedEvent. The drive lock held by the caller is
+//released by calling unlock once the encryption has finished.
+func (c *Converger) startEncryption(drive *core.Drive, unlock func()) {
+	drive.Encrypting = true
+	if c.runningEncryptions[drive.DriveID] {
+		//the drive was replugged while the encryption was running
+		unlock()
+		return
+	}
+	if c.runningEncryptions == nil {
+		c.runningEncryptions = make(map[string]bool)
+	}
+	c.runningEncryptions[drive.DriveID] = true
+
+	osi := c.OS
+	event := FilesystemEncryptedEvent{DriveID: drive.DriveID, DevicePath: drive.DevicePath}
+	headerPath := drive.DetachedLUKSHeaderPath()
+	key := drive.Keys[0]
+	options := drive.LUKSFormatOptions
+	go func() {
+		event.OK = osi.EncryptDeviceInPlace(event.DevicePath, headerPath, key, options)
+		unlock()
+		encryptionResults <- event
+	}()
+}
+
+var encryptionResults = make(chan FilesystemEncryptedEvent)
+
+//CollectEncryptionResults is a collector job that forwards the results of
+//in-place encryptions to the converger.
+func CollectEncryptionResults(queue chan []Event) {
+	for event := range encryptionResults {
+		queue <- []Event{event}
+	}
+}
+
+//FilesystemEncryptedEvent is an Event that is emitted by
+//CollectEncryptionResults when the in-place encryption of a drive has
+//finished.
+type FilesystemEncryptedEvent struct {
+	DriveID    string
+	DevicePath string
+	OK         bool
+}
+
+//LogMessage implements the Event interface.
+func (e FilesystemEncryptedEvent) LogMessage() string {
+	if e.OK {
+		return "filesystem encryption finished for " + e.DevicePath
+	}
+	return "filesystem encryption failed for " + e.DevicePath
+}
+
+//EventType implements the Event interface.
+func (e FilesystemEncryptedEvent) EventType() string {
+	return "filesystem-encryption-finished"
+}
+
+//Handle implements the Event interface.
+func (e FilesystemEncryptedEvent) Handle(c *Converger) {
+	delete(c.runningEncryptions, e.DriveID)
+	if !e.OK {
+		util.LogError("encryption of %s failed: will not set up the drive until the encryption has been resumed by restarting the autopilot", e.DevicePath)
+		return
+	}
+
+	if ds, exists := c.State.Drives[e.DriveID]; exists {
+		ds.EncryptionStartedAt = nil
+		err := c.State.Save(Config.StatePath)
+		if err != nil {
+			util.LogError("cannot save state to %s: %s", Config.StatePath, err.Error())
+		}
+	}
+
+	for idx, d := range c.Drives {
+		if d.DriveID == e.DriveID && d.Encrypting {
+			//the drive now contains a LUKS container with a detached header, and
+			//will be opened as such
+			d = c.newDrive(d.DevicePath, d.BackingDevicePath, d.SerialNumber, d.DriveOptions)
+			c.Drives[idx] = d
+			c.convergeDrive(d, nil)
+			break
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//EvacuationRequestDirectory is where administrators place files to request
+//the evacuation of a drive. The file name is the swift-id or drive ID of the
+//drive in question.
+const EvacuationRequestDirectory = "/run/swift-storage/evacuate"
+
+//While a drive is being evacuated, a marker file exists at the root of its
+//filesystem. Since the marker lives on the drive itself, the evacuation
+//survives restarts of the autopilot, and ends when the drive is wiped.
+func evacuationMarkerPath(mountPath string) string {
+	path := filepath.Join(mountPath, Config.Evacuation.MarkerFile)
+	//make path relative to working directory to account for chrootPath
+	return strings.TrimPrefix(path, "/")
+}
+
+//EvacuationStatus describes the progress of a drive evacuation. It appears in
+//type DriveStatus.
+type EvacuationStatus struct {
+	SwiftID        string    `json:"swift_id"`
+	RemainingFiles int       `json:"remaining_files"`
+	RemainingBytes int64     `json:"remaining_bytes"`
+	SafeToWipe     bool      `json:"safe_to_wipe"`
+	CheckedAt      time.Time `json:"checked_at"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// evacuation requests
+
+//EvacuateDriveEvent is an Event that is emitted by CollectRequestFiles for
+//EvacuationRequestDirectory.
+type EvacuateDriveEvent struct {
+	//Name is the swift-id or the drive ID of the drive in question.
+	Name string
+}
+
+//LogMessage implements the Event interface.
+func (e EvacuateDriveEvent) LogMessage() string {
+	return "evacuation requested for " + e.Name
+}
+
+//EventType implements the Event interface.
+func (e EvacuateDriveEvent) EventType() string {
+	return "drive-evacuation-requested"
+}
+
+//Handle implements the Event interface.
+func (e EvacuateDriveEvent) Handle(c *Converger) {
+	err := c.evacuateDrive(e.Name)
+	if err != nil {
+		util.LogError(err.Error())
+	}
+}
+
+//Starts the evacuation of the drive with the given swift-id or drive ID.
+func (c *Converger) evacuateDrive(name string) error {
+	drive, err := c.findActiveDrive(name)
+	if err != nil {
+		return fmt.Errorf("cannot evacuate %s: %s", name, err.Error())
+	}
+	mountPath := drive.MountedPath()
+	swiftID := drive.Assignment.SwiftID
+
+	markerPath := evacuationMarkerPath(mountPath)
+	_, err = std_os.Stat(markerPath)
+	if err == nil {
+		util.LogInfo("%s (swift-id %s) is already being evacuated", drive.DevicePath, swiftID)
+		return nil
+	}
+	err = ioutil.WriteFile(markerPath, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot evacuate %s: %s", drive.DevicePath, err.Error())
+	}
+
+	//tell the outside world (e.g. set the drive's weight in the ring to zero)
+	startCommand := Config.Evacuation.StartCommand
+	if len(startCommand) > 0 {
+		_, ok := command.Run(append(append([]string(nil), startCommand...), mountPath)...)
+		if !ok {
+			err := std_os.Remove(markerPath)
+			if err != nil {
+				util.LogError(err.Error())
+			}
+			return fmt.Errorf("cannot evacuate %s: start command failed", drive.DevicePath)
+		}
+	}
+
+	util.LogInfo("started evacuation of %s (swift-id %s)", drive.DevicePath, swiftID)
+	select {
+	case evacuationCheckRequests <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// evacuation monitor
+
+var evacuationCheckRequests = make(chan struct{}, 1)
+
+//evacuationTarget is a drive that MonitorEvacuations() needs to look at.
+type evacuationTarget struct {
+	DriveID   string
+	SwiftID   string
+	MountPath string
+}
+
+//MonitorEvacuations is a collector job that periodically measures how much
+//data remains on drives that are being evacuated, and reports the results in
+//an EvacuationProgressEvent. The measurement happens outside of the converger
+//thread since it can take a long time on a drive with lots of data.
+func MonitorEvacuations(queue chan []Event) {
+	reportedAny := false
+	for {
+		var targets []evacuationTarget
+		ok := QueryConverger(queue, time.Minute, func(c *Converger) {
+			for _, d := range c.Drives {
+				a := d.Assignment
+				mountPath := d.MountedPath()
+				if d.Broken || a == nil || a.Error != "" || a.SwiftID == "" || mountPath == "" {
+					continue
+				}
+				targets = append(targets, evacuationTarget{d.DriveID, a.SwiftID, mountPath})
+			}
+		})
+
+		if ok {
+			progress := make(map[string]EvacuationStatus)
+			for _, t := range targets {
+				_, err := std_os.Stat(evacuationMarkerPath(t.MountPath))
+				if err != nil {
+					if !std_os.IsNotExist(err) {
+						util.LogError(err.Error())
+					}
+					continue
+				}
+				status, ok := checkEvacuation(t)
+				if ok {
+					progress[t.DriveID] = status
+				}
+			}
+
+			//only wake up the converger if there is something to report
+			if len(progress) > 0 || reportedAny {
+				queue <- []Event{EvacuationProgressEvent{Progress: progress}}
+			}
+			reportedAny = len(progress) > 0
+		}
+
+		select {
+		case <-time.After(Config.Evacuation.CheckInterval):
+		case <-evacuationCheckRequests:
+		}
+	}
+}
+
+//Measures the data that remains on a drive that is being evacuated. The drive
+//is safe to wipe once no data remains on it and, if configured, the check
+//command agrees.
+func checkEvacuation(t evacuationTarget) (EvacuationStatus, bool) {
+	remaining, err := measureRemainingData(t.MountPath, Config.Evacuation.IgnorePaths)
+	if err != nil {
+		util.LogError("cannot check evacuation of swift-id %s: %s", t.SwiftID, err.Error())
+		return EvacuationStatus{}, false
+	}
+
+	status := EvacuationStatus{
+		SwiftID:        t.SwiftID,
+		RemainingFiles: remaining.Files,
+		RemainingBytes: remaining.Bytes,
+		CheckedAt:      time.Now(),
+	}
+	//without a check command, the measurement above already is the drain check
+	switch {
+	case remaining.Files > 0:
+		status.SafeToWipe = false
+	case len(Config.Evacuation.CheckCommand) == 0:
+		status.SafeToWipe = true
+	default:
+		status.SafeToWipe = checkDriveIsDrained(t.MountPath, Config.Evacuation.CheckCommand, Config.Evacuation.IgnorePaths) == nil
+	}
+	return status, true
+}
+
+//EvacuationProgressEvent is an Event that is emitted by MonitorEvacuations.
+type EvacuationProgressEvent struct {
+	//Progress contains one entry for each drive that is being evacuated, keyed
+	//by drive ID.
+	Progress map[string]EvacuationStatus
+}
+
+//LogMessage implements the Event interface.
+func (e EvacuationProgressEvent) LogMessage() string {
+	return "checked progress of drive evacuations"
+}
+
+//EventType implements the Event interface.
+func (e EvacuationProgressEvent) EventType() string {
+	return "drive-evacuation-progress"
+}
+
+//Handle implements the Event interface.
+func (e EvacuationProgressEvent) Handle(c *Converger) {
+	for driveID, previous := range c.evacuations {
+		if _, exists := e.Progress[driveID]; !exists {
+			util.LogInfo("drive %s (swift-id %s) is not being evacuated anymore", driveID, previous.SwiftID)
+		}
+	}
+
+	evacuationRemainingBytesGauge.Reset()
+	for driveID, status := range e.Progress {
+		switch {
+		case status.SafeToWipe && !c.evacuations[driveID].SafeToWipe:
+			util.LogInfo("evacuation of drive %s (swift-id %s) is complete: the drive is safe to wipe", driveID, status.SwiftID)
+		case !status.SafeToWipe:
+			util.LogInfo("evacuation of drive %s (swift-id %s) in progress: %d files (%d bytes) remaining",
+				driveID, status.SwiftID, status.RemainingFiles, status.RemainingBytes)
+		}
+		evacuationRemainingBytesGauge.With(prometheus.Labels{"swift_id": status.SwiftID}).Set(float64(status.RemainingBytes))
+	}
+	c.evacuations = e.Progress
+}
@@ -0,0 +1,72 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/autopilot"
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+)
+
+//EvaluationReport is the JSON format of `--evaluate`.
+type EvaluationReport struct {
+	SchemaVersion int `json:"schema_version"`
+	autopilot.Plan
+}
+
+//PrintEvaluation reads a drive inventory (see autopilot.Inventory) from the
+//given JSON file, and prints the actions that the autopilot would take on a
+//node with these drives as JSON (see autopilot.Evaluate). Remote keys,
+//plugins and the drive manifest are not considered, hooks are not run, and
+//LUKS header backups are not written.
+func PrintEvaluation(w io.Writer, inventoryPath string) error {
+	buf, err := ioutil.ReadFile(inventoryPath)
+	if err != nil {
+		return err
+	}
+	var inventory autopilot.Inventory
+	err = json.Unmarshal(buf, &inventory)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %s", inventoryPath, err.Error())
+	}
+
+	plan, err := autopilot.Evaluate(inventory,
+		autopilot.WithDriveGlobs(Config.DriveGlobs...),
+		autopilot.WithSwiftIDPool(Config.SwiftIDPool...),
+		autopilot.WithDriveOptionsFor(func(drive os.Drive, opts *core.DriveOptions) {
+			*opts = configuredDriveOptions(drive.FoundAtPath, drive.DevicePath, drive.SerialNumber, ConfiguredDriveSettings(drive.FoundAtPath, drive.DevicePath))
+			opts.BackupLUKSHeaders = false
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	buf, err = json.MarshalIndent(EvaluationReport{SchemaVersion, plan}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(buf))
+	return err
+}
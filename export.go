@@ -0,0 +1,157 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//ExportRequestDirectory is where administrators place files to request that
+//a broken drive be exposed read-only below Config.ReadOnlyExport.Path. The
+//file name is the last known swift-id or the drive ID of the drive in
+//question.
+const ExportRequestDirectory = "/run/swift-storage/export-read-only"
+
+//UnexportRequestDirectory is where administrators place files to end the
+//read-only export of a drive, with the same file names as in
+//ExportRequestDirectory.
+const UnexportRequestDirectory = "/run/swift-storage/unexport"
+
+//ExportDriveEvent is an Event that is emitted by CollectRequestFiles for
+//ExportRequestDirectory.
+type ExportDriveEvent struct {
+	//Name is the last known swift-id or the drive ID of the drive in question.
+	Name string
+}
+
+//LogMessage implements the Event interface.
+func (e ExportDriveEvent) LogMessage() string {
+	return "read-only export requested for " + e.Name
+}
+
+//EventType implements the Event interface.
+func (e ExportDriveEvent) EventType() string {
+	return "drive-export-requested"
+}
+
+//Handle implements the Event interface.
+func (e ExportDriveEvent) Handle(c *Converger) {
+	err := c.exportDrive(e.Name)
+	if err != nil {
+		util.LogError(err.Error())
+	}
+}
+
+//UnexportDriveEvent is an Event that is emitted by CollectRequestFiles for
+//UnexportRequestDirectory.
+type UnexportDriveEvent struct {
+	//Name is the last known swift-id or the drive ID of the drive in question.
+	Name string
+}
+
+//LogMessage implements the Event interface.
+func (e UnexportDriveEvent) LogMessage() string {
+	return "end of read-only export requested for " + e.Name
+}
+
+//EventType implements the Event interface.
+func (e UnexportDriveEvent) EventType() string {
+	return "drive-unexport-requested"
+}
+
+//Handle implements the Event interface.
+func (e UnexportDriveEvent) Handle(c *Converger) {
+	err := c.unexportDrive(e.Name)
+	if err != nil {
+		util.LogError(err.Error())
+	}
+}
+
+//Returns the broken drive with the given drive ID or last known swift-id.
+//Since broken drives lose their assignment, the swift-id is taken from the
+//persistent state.
+func (c *Converger) findBrokenDrive(name string) (*core.Drive, string, error) {
+	for _, d := range c.Drives {
+		swiftID := ""
+		if ds, exists := c.State.Drives[d.DriveID]; exists {
+			swiftID = ds.SwiftID
+		}
+		if d.DriveID != name && swiftID != name {
+			continue
+		}
+		if !d.Broken {
+			return nil, "", errors.New("drive is not broken (use evacuation for healthy drives)")
+		}
+		return d, swiftID, nil
+	}
+	return nil, "", errors.New("no such drive")
+}
+
+//Exposes the broken drive with the given name read-only at
+//Config.ReadOnlyExport.Path/<swift-id> (or <drive-id> if its swift-id is not
+//known).
+func (c *Converger) exportDrive(name string) error {
+	drive, swiftID, err := c.findBrokenDrive(name)
+	if err != nil {
+		return fmt.Errorf("cannot export %s: %s", name, err.Error())
+	}
+	if swiftID == "" {
+		swiftID = drive.DriveID
+	}
+	mountPath := filepath.Join(Config.ReadOnlyExport.Path, swiftID)
+
+	unlock, err := c.lockDrive(drive)
+	if err != nil {
+		return fmt.Errorf("cannot export %s: %s", drive.DevicePath, err.Error())
+	}
+	defer unlock()
+	err = drive.ExportReadOnly(c.OS, mountPath)
+	if err != nil {
+		return fmt.Errorf("cannot export %s: %s", drive.DevicePath, err.Error())
+	}
+	util.LogInfo("exported %s read-only at %s (to end the export, create %s)",
+		drive.DevicePath, mountPath, filepath.Join(UnexportRequestDirectory, name))
+	return nil
+}
+
+//Ends the read-only export of the drive with the given name.
+func (c *Converger) unexportDrive(name string) error {
+	drive, _, err := c.findBrokenDrive(name)
+	if err != nil {
+		return fmt.Errorf("cannot end export of %s: %s", name, err.Error())
+	}
+	if drive.Export == nil {
+		return fmt.Errorf("cannot end export of %s: drive is not exported", name)
+	}
+	unlock, err := c.lockDrive(drive)
+	if err != nil {
+		return fmt.Errorf("cannot end export of %s: %s", drive.DevicePath, err.Error())
+	}
+	defer unlock()
+	if !drive.Unexport(c.OS) {
+		return fmt.Errorf("cannot end export of %s", drive.DevicePath)
+	}
+	return nil
+}
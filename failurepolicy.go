@@ -0,0 +1,133 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	std_os "os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Values for Config.FailurePolicy.Mode.
+const (
+	//BestEffortPolicy sets up as many drives as possible, and marks storage as
+	//ready regardless of how many drives are broken (the default).
+	BestEffortPolicy = "best-effort"
+	//FailFastPolicy aborts the setup as soon as any drive is broken.
+	FailFastPolicy = "fail-fast"
+	//ThresholdPolicy aborts the setup once more than
+	//Config.FailurePolicy.MaxBrokenDrives drives are broken.
+	ThresholdPolicy = "threshold"
+)
+
+//Returns how many broken drives the configured failure policy tolerates, or
+//-1 if there is no limit.
+func toleratedBrokenDrives() int {
+	switch Config.FailurePolicy.Mode {
+	case FailFastPolicy:
+		return 0
+	case ThresholdPolicy:
+		return Config.FailurePolicy.MaxBrokenDrives
+	default:
+		return -1
+	}
+}
+
+//failureTracker counts the broken drives during a convergence before storage
+//has been marked as ready, to enforce the configured failure policy. Once the
+//policy is violated, no further drives are set up, and the convergence ends
+//with abortSetup(). A nil tracker (when the policy does not apply) admits
+//all drives.
+type failureTracker struct {
+	tolerated int
+	mutex     sync.Mutex //since drives may be processed concurrently
+	broken    map[string]string
+}
+
+//Returns a failureTracker for the current convergence, or nil if the failure
+//policy does not apply to it: once storage is ready, broken drives are
+//handled as usual, and in recovery mode, storage is never marked as ready in
+//the first place.
+func (c *Converger) newFailureTracker() *failureTracker {
+	tolerated := toleratedBrokenDrives()
+	if tolerated < 0 || c.IsReady || Config.Recovery {
+		return nil
+	}
+	t := &failureTracker{tolerated: tolerated, broken: make(map[string]string)}
+	for _, drive := range c.Drives {
+		t.Record(drive)
+	}
+	return t
+}
+
+//Admit decides whether the setup of further drives may continue.
+func (t *failureTracker) Admit() bool {
+	return !t.Exceeded()
+}
+
+//Record remembers the given drive if it is broken (unless it is optional).
+func (t *failureTracker) Record(drive *core.Drive) {
+	if t == nil || !drive.Broken || drive.Optional {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.broken[drive.DriveID] = drive.DevicePath
+}
+
+//Exceeded returns whether more drives are broken than the policy tolerates.
+func (t *failureTracker) Exceeded() bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.broken) > t.tolerated
+}
+
+//exitProcess is std_os.Exit, except in tests.
+var exitProcess = std_os.Exit
+
+//Ends the autopilot with an error since the failure policy was violated. The
+//node is left not ready, so that Swift does not start on a node with too many
+//missing drives.
+func (c *Converger) abortSetup(t *failureTracker) {
+	c.UpdateState()
+
+	var devicePaths []string
+	for _, devicePath := range t.broken {
+		devicePaths = append(devicePaths, devicePath)
+	}
+	sort.Strings(devicePaths)
+	util.LogError("%d drives are broken (%s), but failure-policy %s tolerates only %d: aborting without marking storage as ready",
+		len(devicePaths), strings.Join(devicePaths, ", "), Config.FailurePolicy.Mode, t.tolerated)
+
+	//a previous run may have marked storage as ready already
+	err := std_os.Remove("run/swift-storage/state/flag-ready")
+	if err != nil && !std_os.IsNotExist(err) {
+		util.LogError(err.Error())
+	}
+	StopHelpers()
+	exitProcess(1)
+}
@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"testing"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+)
+
+//Sets up a converger with one healthy drive (sda) and two drives that will
+//break because their LUKS containers cannot be opened without keys (sdb and
+//sdc), with the threshold failure policy tolerating one broken drive.
+func enterFailurePolicyTest(t *testing.T) (c *Converger, leave func()) {
+	c, osi, leaveConverger := newTestConverger(t)
+	Config.FailurePolicy.Mode = ThresholdPolicy
+	Config.FailurePolicy.MaxBrokenDrives = 1
+	//keep storage from being marked as ready, which would run touch(1)
+	Config.ExpectedDrives.Count = 99
+	Config.ExpectedDrives.GracePeriod = time.Hour
+	c.StartedAt = time.Now()
+
+	osi.AddDrive("/dev/sda", "SERIAL1")
+	osi.AddDriveWithContents("/dev/sdb", "SERIAL2", os.FakeDriveContents{Encrypted: true, Formatted: true})
+	osi.AddDriveWithContents("/dev/sdc", "SERIAL3", os.FakeDriveContents{Encrypted: true, Formatted: true})
+	return c, func() {
+		Config.FailurePolicy.Mode = ""
+		Config.FailurePolicy.MaxBrokenDrives = 0
+		Config.ExpectedDrives.Count = 0
+		Config.ExpectedDrives.GracePeriod = 0
+		Config.OptionalDrives = OptionalDrivesConfiguration{}
+		leaveConverger()
+	}
+}
+
+//Handles the DriveAddedEvents for all drives and converges once. Returns the
+//exit code if the converger tried to exit, or -1 otherwise.
+func convergeForExitCode(c *Converger) (exitCode int) {
+	type exited int
+	exitProcess = func(code int) { panic(exited(code)) }
+	defer func() {
+		exitProcess = std_os.Exit
+		if r := recover(); r != nil {
+			code, ok := r.(exited)
+			if !ok {
+				panic(r)
+			}
+			exitCode = int(code)
+		}
+	}()
+
+	for idx, devicePath := range []string{"/dev/sda", "/dev/sdb", "/dev/sdc"} {
+		serialNumber := fmt.Sprintf("SERIAL%d", idx+1)
+		DriveAddedEvent{DevicePath: devicePath, FoundAtPath: devicePath, SerialNumber: serialNumber}.Handle(c)
+	}
+	c.Converge()
+	return -1
+}
+
+func TestFailurePolicyThresholdExceeded(t *testing.T) {
+	c, leave := enterFailurePolicyTest(t)
+	defer leave()
+	//a previous run had marked storage as ready
+	err := ioutil.WriteFile("run/swift-storage/state/flag-ready", nil, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if exitCode := convergeForExitCode(c); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if c.IsReady {
+		t.Error("expected storage not to be ready")
+	}
+	if _, err := std_os.Stat("run/swift-storage/state/flag-ready"); !std_os.IsNotExist(err) {
+		t.Errorf("expected flag-ready to be removed, but got %v", err)
+	}
+}
+
+func TestFailurePolicyIgnoresOptionalDrives(t *testing.T) {
+	c, leave := enterFailurePolicyTest(t)
+	defer leave()
+	Config.OptionalDrives.SerialNumbers = []string{"SERIAL3"}
+
+	if exitCode := convergeForExitCode(c); exitCode != -1 {
+		t.Errorf("expected no exit, got exit code %d", exitCode)
+	}
+	brokenCount := 0
+	for _, d := range c.Drives {
+		if d.Broken {
+			brokenCount++
+		}
+	}
+	if brokenCount != 2 {
+		t.Errorf("expected 2 broken drives, got %d", brokenCount)
+	}
+}
@@ -0,0 +1,161 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/parsers"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//CheckAlreadyConverged is used by --once to skip the full run when nothing
+//needs to be done. It only looks at the filesystem, the state file and the
+//kernel's mount table, and never spawns any external commands, so that it
+//takes only a few milliseconds. If it returns nil, then storage has already
+//been marked as ready, and FindStateDifferences did not find anything: all
+//drives matching the configured globs are known from the state file, have a
+//swift-id, are mounted at /srv/node/<swift-id> (through a dm-crypt mapping if
+//encryption keys are configured) and use the configured drive settings, and
+//no drive is flagged as broken. Otherwise, the returned error describes the
+//first difference that was found.
+func CheckAlreadyConverged() error {
+	//features that need external commands to check their state are always
+	//handled by the full run
+	switch {
+	case Config.Recovery:
+		return errors.New("recovery mode is enabled")
+	case len(Config.BlockDeviceProviders()) > 0:
+		return fmt.Errorf("block devices from %s are configured", Config.BlockDeviceProviders()[0].Name())
+	case Config.Bcache.CacheDevice != "":
+		return errors.New("bcache is configured")
+	case len(Config.XFSLogDevices) > 0:
+		return errors.New("external XFS log devices are configured")
+	case len(Config.Plugins) > 0:
+		return errors.New("plugins are configured")
+	case Config.DriveManifest.Path != "":
+		return errors.New("a drive manifest is configured")
+	}
+
+	_, err := std_os.Stat("run/swift-storage/state/flag-ready")
+	if err != nil {
+		return errors.New("storage has not been marked as ready yet")
+	}
+	diffs, err := FindStateDifferences()
+	if err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return errors.New(diffs[0].Message)
+	}
+	return nil
+}
+
+//Expands the drive globs like the drive scanner does, and returns the
+//resulting device paths (with symlinks resolved) in sorted order.
+func globDevicePaths(patterns []string) ([]string, error) {
+	isSeen := make(map[string]bool)
+	var result []string
+	for _, pattern := range patterns {
+		//make pattern relative to current directory (== chroot directory)
+		matches, err := filepath.Glob(strings.TrimPrefix(pattern, "/"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			resolved, err := resolveInChroot(".", match)
+			if err != nil {
+				return nil, err
+			}
+			devicePath := "/" + resolved
+			if !isSeen[devicePath] {
+				isSeen[devicePath] = true
+				result = append(result, devicePath)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+//Reads /proc/self/mountinfo and returns the entry for each mountpoint, with
+//mountpoints given as paths inside the chroot.
+func readMountTable() (map[string]parsers.MountInfoEntry, error) {
+	buf, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	chrootPath := filepath.Clean("/" + Config.ChrootPath)
+
+	result := make(map[string]parsers.MountInfoEntry)
+	for _, entry := range parsers.ParseMountInfo(string(buf)) {
+		mountPoint := filepath.Clean(entry.MountPoint)
+		if chrootPath != "/" {
+			if !strings.HasPrefix(mountPoint, chrootPath+"/") {
+				continue
+			}
+			mountPoint = strings.TrimPrefix(mountPoint, chrootPath)
+		}
+		result[mountPoint] = entry
+	}
+	return result, nil
+}
+
+const (
+	directMountSource = "direct"
+	mappedMountSource = "mapped"
+)
+
+//Checks whether the given mount source is the given device itself
+//(directMountSource), or a device mapper device on top of it
+//(mappedMountSource), as is the case for LUKS containers. Returns an empty
+//string if neither is the case.
+func mountSourceKind(source, devicePath string) (string, error) {
+	resolved, err := resolveInChroot(".", strings.TrimPrefix(source, "/"))
+	if err != nil {
+		util.LogDebug("cannot resolve mount source %s: %s", source, err.Error())
+		return "", nil
+	}
+	sourceName := filepath.Base(resolved)
+	deviceName := filepath.Base(devicePath)
+	if sourceName == deviceName {
+		return directMountSource, nil
+	}
+	if !strings.HasPrefix(sourceName, "dm-") {
+		return "", nil
+	}
+
+	slaves, err := ioutil.ReadDir(filepath.Join("/sys/block", sourceName, "slaves"))
+	if err != nil {
+		return "", err
+	}
+	for _, slave := range slaves {
+		if slave.Name() == deviceName {
+			return mappedMountSource, nil
+		}
+	}
+	return "", nil
+}
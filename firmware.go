@@ -0,0 +1,113 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//BadFirmwareRule describes a combination of firmware and driver versions that
+//is known to cause problems (e.g. data corruption under Swift workloads). Each
+//field is a glob pattern that is matched against the respective field of
+//os.FirmwareInfo; empty fields match anything.
+type BadFirmwareRule struct {
+	Model              string `yaml:"model"`
+	FirmwareRevision   string `yaml:"firmware-revision"`
+	HBADriver          string `yaml:"hba-driver"`
+	HBADriverVersion   string `yaml:"hba-driver-version"`
+	HBAFirmwareVersion string `yaml:"hba-firmware-version"`
+	//Reason is shown in log messages and in the status API.
+	Reason string `yaml:"reason"`
+}
+
+//Validate checks that the rule is not empty and that all patterns are valid.
+func (r BadFirmwareRule) Validate() error {
+	patterns := []string{r.Model, r.FirmwareRevision, r.HBADriver, r.HBADriverVersion, r.HBAFirmwareVersion}
+	empty := true
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		empty = false
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %s", pattern, err.Error())
+		}
+	}
+	if empty {
+		return errors.New("rule does not match on anything")
+	}
+	return nil
+}
+
+//Matches checks whether the given firmware info is matched by this rule.
+func (r BadFirmwareRule) Matches(info os.FirmwareInfo) bool {
+	return matchesFirmwarePattern(r.Model, info.Model) &&
+		matchesFirmwarePattern(r.FirmwareRevision, info.FirmwareRevision) &&
+		matchesFirmwarePattern(r.HBADriver, info.HBADriver) &&
+		matchesFirmwarePattern(r.HBADriverVersion, info.HBADriverVersion) &&
+		matchesFirmwarePattern(r.HBAFirmwareVersion, info.HBAFirmwareVersion)
+}
+
+func matchesFirmwarePattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	//an unknown value does not match, so that rules do not fire on drives
+	//whose firmware could not be determined
+	if value == "" {
+		return false
+	}
+	matched, _ := filepath.Match(pattern, value) //error already checked in Validate()
+	return matched
+}
+
+//Returns the reason why the firmware of this drive is considered bad, or ""
+//if no bad-firmware rule matches.
+func badFirmwareReason(d *core.Drive) string {
+	if d.Firmware == nil {
+		return ""
+	}
+	for _, rule := range Config.Firmware.BadVersions {
+		if rule.Matches(*d.Firmware) {
+			if rule.Reason == "" {
+				return "listed in firmware.bad-versions"
+			}
+			return rule.Reason
+		}
+	}
+	return ""
+}
+
+//Logs a warning if the firmware of this drive is considered bad.
+func checkDriveFirmware(d *core.Drive) {
+	reason := badFirmwareReason(d)
+	if reason == "" {
+		return
+	}
+	f := d.Firmware
+	util.LogError("%s has known-bad firmware (model %q, firmware revision %q, HBA driver %q version %q, HBA firmware %q): %s",
+		d.DevicePath, f.Model, f.FirmwareRevision, f.HBADriver, f.HBADriverVersion, f.HBAFirmwareVersion, reason)
+}
@@ -0,0 +1,291 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//QuarantineDirectory contains a flag file for each drive that has been
+//quarantined because it kept appearing and disappearing. Deleting the flag
+//file releases the drive from quarantine.
+const QuarantineDirectory = "/run/swift-storage/quarantined"
+
+//flapTracker remembers when drives disappeared, in order to debounce drives
+//that reappear soon afterwards, and to quarantine drives that keep flapping
+//(e.g. because of a flaky cable or SAS expander). Each mount/unmount cycle on
+//such a drive risks ending up in an inconsistent state, so we rather stop
+//acting on its events altogether. It is owned by the converger thread.
+type flapTracker struct {
+	//the key is the drive's serial number or, if it has none, its device name
+	keysByDevicePath map[string]string
+	removals         map[string][]time.Time
+	//DriveAddedEvents that are deferred until the grace period has expired
+	pending map[string]DriveAddedEvent
+	//quarantined drives, with the DriveAddedEvent that will be handled once the
+	//drive is released (or nil if the drive is absent at the moment)
+	quarantined map[string]*DriveAddedEvent
+}
+
+//The key is also the name of the quarantine flag file, so it is sanitized like
+//the serial numbers reported by smartctl (see zvolNameRx) to ensure that it
+//cannot point outside of the QuarantineDirectory.
+func flapKeyOf(e DriveAddedEvent) string {
+	key := e.SerialNumber
+	if key == "" {
+		key = filepath.Base(e.DevicePath)
+	}
+	return zvolNameRx.ReplaceAllString(key, "-")
+}
+
+func (t *flapTracker) init() {
+	if t.keysByDevicePath != nil {
+		return
+	}
+	t.keysByDevicePath = make(map[string]string)
+	t.removals = make(map[string][]time.Time)
+	t.pending = make(map[string]DriveAddedEvent)
+	t.quarantined = make(map[string]*DriveAddedEvent)
+
+	//drives that were quarantined before the autopilot was restarted stay in
+	//quarantine until their flag file is deleted
+	entries, err := ioutil.ReadDir(strings.TrimPrefix(QuarantineDirectory, "/"))
+	if err != nil {
+		if !std_os.IsNotExist(err) {
+			util.LogError("cannot read %s: %s", QuarantineDirectory, err.Error())
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		util.LogInfo("drive %s is still quarantined (to release it, delete %s)",
+			entry.Name(), filepath.Join(QuarantineDirectory, entry.Name()))
+		t.quarantined[entry.Name()] = nil
+	}
+}
+
+//Admit decides whether a DriveAddedEvent shall be handled right away. If not,
+//it is remembered and handled later by Process().
+func (t *flapTracker) Admit(e DriveAddedEvent) bool {
+	if Config.Flapping.GracePeriod == 0 && Config.Flapping.MaxFlaps == 0 {
+		return true
+	}
+	t.init()
+	key := flapKeyOf(e)
+	t.keysByDevicePath[e.DevicePath] = key
+
+	if _, exists := t.quarantined[key]; exists {
+		util.LogInfo("ignoring %s since it is quarantined", e.DevicePath)
+		t.quarantined[key] = &e
+		return false
+	}
+
+	removals := t.removals[key]
+	if gracePeriod := Config.Flapping.GracePeriod; gracePeriod > 0 && len(removals) > 0 {
+		sinceRemoval := time.Since(removals[len(removals)-1])
+		if sinceRemoval < gracePeriod {
+			util.LogInfo("deferring setup of %s since it disappeared only %s ago",
+				e.DevicePath, sinceRemoval.Truncate(time.Second))
+			t.pending[key] = e
+			return false
+		}
+	}
+	return true
+}
+
+//RecordRemoval is called for each DriveRemovedEvent. Drives that disappear
+//too often within the configured window are quarantined.
+func (t *flapTracker) RecordRemoval(devicePath string) {
+	if Config.Flapping.GracePeriod == 0 && Config.Flapping.MaxFlaps == 0 {
+		return
+	}
+	t.init()
+	key, exists := t.keysByDevicePath[devicePath]
+	if !exists {
+		return
+	}
+	delete(t.keysByDevicePath, devicePath)
+	//if the reappearance was still being debounced, the drive just flapped again
+	delete(t.pending, key)
+	if _, exists := t.quarantined[key]; exists {
+		t.quarantined[key] = nil
+		return
+	}
+
+	now := time.Now()
+	var removals []time.Time
+	for _, removedAt := range t.removals[key] {
+		if now.Sub(removedAt) < Config.Flapping.Window {
+			removals = append(removals, removedAt)
+		}
+	}
+	removals = append(removals, now)
+	t.removals[key] = removals
+
+	if Config.Flapping.MaxFlaps > 0 && len(removals) >= Config.Flapping.MaxFlaps {
+		flagPath := filepath.Join(QuarantineDirectory, key)
+		util.LogError("%s disappeared %d times within %s, quarantining it (to release it, delete %s)",
+			devicePath, len(removals), Config.Flapping.Window, flagPath)
+		err := writeQuarantineFlag(flagPath, devicePath)
+		if err != nil {
+			util.LogError(err.Error())
+		}
+		t.quarantined[key] = nil
+	}
+}
+
+//Quarantine is called when an administrator quarantines a drive that is
+//present, through the bulk API. The given DriveAddedEvent will be handled once
+//the drive is released.
+func (t *flapTracker) Quarantine(e DriveAddedEvent) error {
+	t.init()
+	key := flapKeyOf(e)
+	flagPath := filepath.Join(QuarantineDirectory, key)
+	err := writeQuarantineFlag(flagPath, e.DevicePath)
+	if err != nil {
+		return err
+	}
+	util.LogInfo("quarantining %s as requested (to release it, delete %s)", e.DevicePath, flagPath)
+	t.keysByDevicePath[e.DevicePath] = key
+	delete(t.pending, key)
+	t.quarantined[key] = &e
+	return nil
+}
+
+func writeQuarantineFlag(flagPath, devicePath string) error {
+	err := ioutil.WriteFile(strings.TrimPrefix(flagPath, "/"), []byte(devicePath+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %s", flagPath, err.Error())
+	}
+	return nil
+}
+
+//Process handles DriveAddedEvents whose grace period has expired, and those
+//of drives whose quarantine flag has been deleted by an administrator.
+func (t *flapTracker) Process(c *Converger) {
+	if t.keysByDevicePath == nil {
+		return
+	}
+
+	//forget removals that are outside the window, so that drives that come and
+	//go over months of uptime do not accumulate here
+	for key, removals := range t.removals {
+		_, isPending := t.pending[key]
+		_, isQuarantined := t.quarantined[key]
+		last := removals[len(removals)-1]
+		if !isPending && !isQuarantined && time.Since(last) >= Config.Flapping.Window && time.Since(last) >= Config.Flapping.GracePeriod {
+			delete(t.removals, key)
+		}
+	}
+
+	var events []DriveAddedEvent
+	for key, e := range t.pending {
+		removals := t.removals[key]
+		if len(removals) == 0 || time.Since(removals[len(removals)-1]) >= Config.Flapping.GracePeriod {
+			delete(t.pending, key)
+			events = append(events, e)
+		}
+	}
+	for key, e := range t.quarantined {
+		flagPath := filepath.Join(QuarantineDirectory, key)
+		_, err := std_os.Stat(strings.TrimPrefix(flagPath, "/"))
+		if err == nil || !std_os.IsNotExist(err) {
+			continue
+		}
+		util.LogInfo("releasing drive %s from quarantine since %s has been deleted", key, flagPath)
+		delete(t.quarantined, key)
+		delete(t.removals, key)
+		if e != nil {
+			events = append(events, *e)
+		}
+	}
+
+	//handle events in a stable order to keep the log readable
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].DevicePath < events[j].DevicePath
+	})
+	for _, e := range events {
+		e.Handle(c)
+	}
+}
+
+//QuarantinedDrives returns the keys of all quarantined drives.
+func (t *flapTracker) QuarantinedDrives() []string {
+	var result []string
+	for key := range t.quarantined {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+//Finds the drive with the given serial number or device name (see flapKeyOf)
+//for the "quarantine" action of the bulk API.
+func (c *Converger) findQuarantinableDrive(name string) (*core.Drive, error) {
+	if _, exists := c.flaps.quarantined[name]; exists {
+		return nil, errors.New("drive is already quarantined")
+	}
+	for _, drive := range c.Drives {
+		if flapKeyOf(DriveAddedEvent{DevicePath: drive.DevicePath, SerialNumber: drive.SerialNumber}) != name {
+			continue
+		}
+		if drive.Encrypting {
+			return nil, errors.New("drive is being encrypted")
+		}
+		return drive, nil
+	}
+	return nil, errors.New("no such drive")
+}
+
+//Quarantines the given drive: It is torn down as if it had disappeared, and
+//set up again once it is released from quarantine.
+func (c *Converger) quarantineDrive(name string) error {
+	drive, err := c.findQuarantinableDrive(name)
+	if err != nil {
+		return err
+	}
+	e := DriveAddedEvent{
+		DevicePath:        drive.DevicePath,
+		FoundAtPath:       drive.DevicePath,
+		SerialNumber:      drive.SerialNumber,
+		BackingDevicePath: drive.BackingDevicePath,
+	}
+	if ds, exists := c.State.Drives[drive.DriveID]; exists && ds.FoundAtPath != "" {
+		e.FoundAtPath = ds.FoundAtPath
+	}
+	err = c.flaps.Quarantine(e)
+	if err != nil {
+		return err
+	}
+	c.removeDrive(drive)
+	return nil
+}
@@ -0,0 +1,142 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	std_os "os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func enterFlappingTest(t *testing.T, gracePeriod time.Duration, maxFlaps int) (c *Converger, leave func()) {
+	c, osi, leaveConverger := newTestConverger(t)
+	Config.Flapping.GracePeriod = gracePeriod
+	Config.Flapping.MaxFlaps = maxFlaps
+	Config.Flapping.Window = 10 * time.Minute
+	err := std_os.MkdirAll(strings.TrimPrefix(QuarantineDirectory, "/"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	osi.AddDrive("/dev/sda", "SERIAL1")
+	return c, func() {
+		Config.Flapping.GracePeriod = 0
+		Config.Flapping.MaxFlaps = 0
+		Config.Flapping.Window = 0
+		leaveConverger()
+	}
+}
+
+var flappingTestEvent = DriveAddedEvent{DevicePath: "/dev/sda", FoundAtPath: "/dev/sda", SerialNumber: "SERIAL1"}
+
+func TestFlapTrackerDefersReappearingDrives(t *testing.T) {
+	c, leave := enterFlappingTest(t, time.Hour, 0)
+	defer leave()
+
+	if !c.flaps.Admit(flappingTestEvent) {
+		t.Fatal("expected new drive to be admitted")
+	}
+	c.flaps.RecordRemoval("/dev/sda")
+	if c.flaps.Admit(flappingTestEvent) {
+		t.Fatal("expected drive to be deferred within the grace period")
+	}
+	c.flaps.Process(c)
+	if len(c.Drives) != 0 {
+		t.Fatal("expected drive to stay deferred within the grace period")
+	}
+
+	//once the grace period has expired, Process() sets the drive up
+	c.flaps.removals["SERIAL1"] = []time.Time{time.Now().Add(-2 * time.Hour)}
+	c.flaps.Process(c)
+	if len(c.Drives) != 1 {
+		t.Errorf("expected drive to be set up after the grace period, got %d drives", len(c.Drives))
+	}
+}
+
+func TestFlapTrackerQuarantinesFlappingDrives(t *testing.T) {
+	c, leave := enterFlappingTest(t, 0, 2)
+	defer leave()
+	flagPath := strings.TrimPrefix(filepath.Join(QuarantineDirectory, "SERIAL1"), "/")
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if !c.flaps.Admit(flappingTestEvent) {
+			t.Fatalf("expected drive to be admitted on attempt %d", attempt)
+		}
+		c.flaps.RecordRemoval("/dev/sda")
+	}
+	if _, err := std_os.Stat(flagPath); err != nil {
+		t.Fatalf("expected quarantine flag file: %s", err.Error())
+	}
+	if c.flaps.Admit(flappingTestEvent) {
+		t.Fatal("expected quarantined drive not to be admitted")
+	}
+	c.flaps.Process(c)
+	if len(c.Drives) != 0 {
+		t.Fatal("expected drive to stay quarantined while its flag file exists")
+	}
+
+	//deleting the flag file releases the drive that is present
+	err := std_os.Remove(flagPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c.flaps.Process(c)
+	if len(c.Drives) != 1 {
+		t.Errorf("expected drive to be set up after its release, got %d drives", len(c.Drives))
+	}
+	if q := c.flaps.QuarantinedDrives(); len(q) != 0 {
+		t.Errorf("expected no quarantined drives, got %v", q)
+	}
+}
+
+func TestFlapTrackerKeepsQuarantineAcrossRestart(t *testing.T) {
+	c, leave := enterFlappingTest(t, 0, 2)
+	defer leave()
+	flagPath := strings.TrimPrefix(filepath.Join(QuarantineDirectory, "SERIAL1"), "/")
+	err := ioutil.WriteFile(flagPath, []byte("/dev/sda\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if c.flaps.Admit(flappingTestEvent) {
+		t.Fatal("expected drive that was quarantined before the restart not to be admitted")
+	}
+	if q := c.flaps.QuarantinedDrives(); len(q) != 1 || q[0] != "SERIAL1" {
+		t.Errorf("expected SERIAL1 to be quarantined, got %v", q)
+	}
+}
+
+func TestFlapKeyStaysInsideQuarantineDirectory(t *testing.T) {
+	testCases := []struct {
+		Event    DriveAddedEvent
+		Expected string
+	}{
+		{DriveAddedEvent{DevicePath: "/dev/sda", SerialNumber: "SERIAL1"}, "SERIAL1"},
+		{DriveAddedEvent{DevicePath: "/dev/sda", SerialNumber: "../../etc/passwd"}, "------etc-passwd"},
+		{DriveAddedEvent{DevicePath: "/dev/cciss!c0d0"}, "cciss-c0d0"},
+	}
+	for _, tc := range testCases {
+		if actual := flapKeyOf(tc.Event); actual != tc.Expected {
+			t.Errorf("expected flapKeyOf(%#v) to return %q, but got %q", tc.Event, tc.Expected, actual)
+		}
+	}
+}
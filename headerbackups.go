@@ -0,0 +1,99 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	std_os "os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//ScheduleLUKSHeaderBackups is a collector job that pushes a
+//LUKSHeaderBackupEvent once per Config.LUKS.HeaderBackups.Interval. (The
+//backup of each header is also written when the container is first opened by
+//us, see core.Drive.BackupLUKSHeader.)
+func ScheduleLUKSHeaderBackups(queue chan []Event) {
+	trigger := util.StandardTrigger(Config.LUKS.HeaderBackups.Interval, "run/swift-storage/backup-luks-headers", false)
+	for range trigger {
+		queue <- []Event{LUKSHeaderBackupEvent{}}
+	}
+}
+
+//LUKSHeaderBackupEvent is sent by the ScheduleLUKSHeaderBackups collector.
+type LUKSHeaderBackupEvent struct{}
+
+//LogMessage implements the Event interface.
+func (e LUKSHeaderBackupEvent) LogMessage() string {
+	return "scheduled refresh of LUKS header backups"
+}
+
+//EventType implements the Event interface.
+func (e LUKSHeaderBackupEvent) EventType() string {
+	return "luks-header-backup"
+}
+
+//Handle implements the Event interface.
+func (e LUKSHeaderBackupEvent) Handle(c *Converger) {
+	//refresh the backups of all open containers (keys may have been added or
+	//removed since the last backup)
+	isPresent := make(map[string]bool, len(c.Drives))
+	for _, drive := range c.Drives {
+		isPresent[drive.DriveID] = true
+		if !drive.Broken {
+			drive.BackupLUKSHeader(c.OS)
+		}
+	}
+	pruneLUKSHeaderBackups(isPresent)
+}
+
+//Removes the header backups of drives that are not present anymore, once the
+//backup has not been refreshed for Config.LUKS.HeaderBackups.Retention.
+func pruneLUKSHeaderBackups(isPresent map[string]bool) {
+	dir := Config.LUKS.HeaderBackupDirectory
+	//make path relative to working directory to account for chrootPath
+	fis, err := ioutil.ReadDir(strings.TrimPrefix(dir, "/"))
+	if err != nil {
+		if !std_os.IsNotExist(err) {
+			util.LogError("cannot prune LUKS header backups: %s", err.Error())
+		}
+		return
+	}
+	for _, fi := range fis {
+		driveID := strings.TrimSuffix(fi.Name(), core.LUKSHeaderBackupSuffix)
+		if fi.IsDir() || driveID == fi.Name() || isPresent[driveID] {
+			continue
+		}
+		if time.Since(fi.ModTime()) < Config.LUKS.HeaderBackups.Retention {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		err := std_os.Remove(strings.TrimPrefix(path, "/"))
+		if err != nil {
+			util.LogError("cannot prune LUKS header backups: %s", err.Error())
+			continue
+		}
+		util.LogInfo("removed LUKS header backup %s since drive %s has not been seen for %s", path, driveID, Config.LUKS.HeaderBackups.Retention.String())
+	}
+}
@@ -0,0 +1,298 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//HelperPIDDirectory is where the PIDs of running helper processes are
+//recorded, so that helpers that were left behind by a previous run of the
+//autopilot (e.g. after a crash) can be terminated at startup.
+const HelperPIDDirectory = "/run/swift-storage/helpers"
+
+//How long helpers get to shut down after SIGTERM before they are killed.
+const helperStopTimeout = 10 * time.Second
+
+//Helper appears in type Configuration. It describes a long-lived helper
+//process (e.g. a key agent) that is started by the autopilot at startup,
+//restarted whenever it exits, and terminated when the autopilot exits.
+type Helper struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	//ReadyPath is a file (e.g. a socket) that the helper creates once it is
+	//ready. If given, the startup waits for it for up to ReadyTimeout.
+	ReadyPath    string        `yaml:"ready-path"`
+	ReadyTimeout time.Duration `yaml:"ready-timeout"`
+	RestartDelay time.Duration `yaml:"restart-delay"`
+}
+
+//Validate checks the helper configuration, and fills in default values.
+func (h *Helper) Validate() string {
+	if h.Name == "" || strings.Contains(h.Name, "/") {
+		return "name must be non-empty and may not contain slashes"
+	}
+	if len(h.Command) == 0 {
+		return "command may not be empty"
+	}
+	if h.ReadyTimeout == 0 {
+		h.ReadyTimeout = 30 * time.Second
+	}
+	if h.RestartDelay == 0 {
+		h.RestartDelay = 5 * time.Second
+	}
+	return ""
+}
+
+//Returns the path of the PID file of this helper (relative to the working
+//directory to account for chrootPath).
+func (h Helper) pidFilePath() string {
+	return strings.TrimPrefix(filepath.Join(HelperPIDDirectory, h.Name+".pid"), "/")
+}
+
+var helperRestartCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "swift_drive_autopilot_helper_restarts",
+		Help: "Counts how often helper processes had to be restarted after exiting unexpectedly.",
+	},
+	[]string{"helper"},
+)
+
+//supervisedHelper is a Helper that is being run by StartHelpers().
+type supervisedHelper struct {
+	Helper
+	mutex    sync.Mutex
+	process  *std_os.Process
+	stopping bool
+	stop     chan struct{} //closed by requestStop()
+	exited   chan struct{} //closed when supervise() returns
+}
+
+//All helpers started by StartHelpers(). This is only written during startup.
+var supervisedHelpers []*supervisedHelper
+
+//StartHelpers starts all configured helper processes (after terminating
+//leftovers from a previous run), and waits until they are ready. From then on,
+//helpers are restarted whenever they exit, until StopHelpers() is called. On
+//SIGTERM or SIGINT, the helpers are stopped before the autopilot exits.
+//Like plugins, helpers are executed outside of the chroot.
+func StartHelpers() {
+	if len(Config.Helpers) == 0 {
+		return
+	}
+	err := std_os.MkdirAll(strings.TrimPrefix(HelperPIDDirectory, "/"), 0755)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+
+	for _, cfg := range Config.Helpers {
+		h := &supervisedHelper{
+			Helper: cfg,
+			stop:   make(chan struct{}),
+			exited: make(chan struct{}),
+		}
+		h.terminateLeftover()
+		supervisedHelpers = append(supervisedHelpers, h)
+		go h.supervise()
+		if h.ReadyPath != "" {
+			err := waitForPath(h.ReadyPath, h.ReadyTimeout)
+			if err != nil {
+				util.LogFatal("helper %s did not become ready: %s", h.Name, err.Error())
+			}
+		}
+	}
+
+	go func() {
+		signals := make(chan std_os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		util.LogInfo("received %s, stopping helpers", sig.String())
+		StopHelpers()
+		//exit in the same way as without the signal handler
+		signal.Reset(sig)
+		err := syscall.Kill(std_os.Getpid(), sig.(syscall.Signal))
+		if err != nil {
+			util.LogFatal(err.Error())
+		}
+	}()
+}
+
+//StopHelpers terminates all helper processes, and waits for them to exit.
+//Helpers that do not exit within a few seconds after SIGTERM are killed.
+func StopHelpers() {
+	for _, h := range supervisedHelpers {
+		h.requestStop(syscall.SIGTERM)
+	}
+	for _, h := range supervisedHelpers {
+		select {
+		case <-h.exited:
+		case <-time.After(helperStopTimeout):
+			util.LogError("helper %s did not exit within %s, killing it", h.Name, helperStopTimeout)
+			h.requestStop(syscall.SIGKILL)
+			<-h.exited
+		}
+	}
+}
+
+//Runs the helper process, and restarts it after it exits, until requestStop()
+//is called.
+func (h *supervisedHelper) supervise() {
+	defer close(h.exited)
+	for {
+		cmd := exec.Command(h.Command[0], h.Command[1:]...)
+		cmd.Stdout = std_os.Stderr
+		cmd.Stderr = std_os.Stderr
+		//put the helper into its own process group, so that its children can be
+		//terminated together with it
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+		h.mutex.Lock()
+		if h.stopping {
+			h.mutex.Unlock()
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			h.process = cmd.Process
+		}
+		h.mutex.Unlock()
+
+		if err != nil {
+			util.LogError("cannot start helper %s: %s", h.Name, err.Error())
+		} else {
+			pid := cmd.Process.Pid
+			util.LogInfo("started helper %s (PID %d)", h.Name, pid)
+			err := ioutil.WriteFile(h.pidFilePath(), []byte(strconv.Itoa(pid)+"\n"), 0644)
+			if err != nil {
+				util.LogError("cannot record PID of helper %s: %s", h.Name, err.Error())
+			}
+
+			err = cmd.Wait()
+			h.mutex.Lock()
+			h.process = nil
+			stopping := h.stopping
+			h.mutex.Unlock()
+			if removeErr := std_os.Remove(h.pidFilePath()); removeErr != nil && !std_os.IsNotExist(removeErr) {
+				util.LogError(removeErr.Error())
+			}
+			if stopping {
+				util.LogInfo("helper %s stopped", h.Name)
+				return
+			}
+			if err == nil {
+				err = errors.New("exit status 0")
+			}
+			util.LogError("helper %s exited unexpectedly (%s), restarting in %s", h.Name, err.Error(), h.RestartDelay)
+		}
+
+		helperRestartCounter.With(prometheus.Labels{"helper": h.Name}).Inc()
+		select {
+		case <-time.After(h.RestartDelay):
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+//Stops the supervision loop and sends the given signal to the helper's
+//process group (if it is running).
+func (h *supervisedHelper) requestStop(sig syscall.Signal) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.stopping {
+		h.stopping = true
+		close(h.stop)
+	}
+	if h.process != nil {
+		err := syscall.Kill(-h.process.Pid, sig)
+		if err != nil && err != syscall.ESRCH {
+			util.LogError("cannot stop helper %s: %s", h.Name, err.Error())
+		}
+	}
+}
+
+//If the PID file names a process that is still running this helper's command
+//(i.e. it was left behind by a previous run of the autopilot), terminates it.
+func (h *supervisedHelper) terminateLeftover() {
+	buf, err := ioutil.ReadFile(h.pidFilePath())
+	if err != nil {
+		if !std_os.IsNotExist(err) {
+			util.LogError(err.Error())
+		}
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 1 {
+		util.LogError("ignoring malformed PID file for helper %s", h.Name)
+		return
+	}
+	//the PID may have been reused by an unrelated process in the meantime
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || strings.TrimSuffix(string(cmdline), "\x00") != strings.Join(h.Command, "\x00") {
+		return
+	}
+
+	util.LogInfo("terminating helper %s (PID %d) that was left behind by a previous run", h.Name, pid)
+	sig := syscall.SIGTERM
+	for deadline := time.Now().Add(helperStopTimeout); ; {
+		err := syscall.Kill(-pid, sig)
+		if err == syscall.ESRCH {
+			return
+		}
+		if err != nil {
+			util.LogFatal("cannot terminate helper %s (PID %d): %s", h.Name, pid, err.Error())
+		}
+		if time.Now().After(deadline) {
+			sig = syscall.SIGKILL
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//Waits until a file exists at the given path.
+func waitForPath(path string, timeout time.Duration) error {
+	for deadline := time.Now().Add(timeout); ; {
+		_, err := std_os.Stat(path)
+		if err == nil {
+			return nil
+		}
+		if !std_os.IsNotExist(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s does not exist after %s", path, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
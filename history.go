@@ -0,0 +1,92 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//PrintDriveHistory prints what the persistent state knows about the drives
+//with the given device path, drive ID or swift-id (there can be several, e.g.
+//when a drive was replaced and the old one has not been forgotten yet). This
+//reads only the state file, so it also works while the autopilot is running.
+func PrintDriveHistory(w io.Writer, name string) {
+	s, err := state.Load(Config.StatePath)
+	if err != nil {
+		util.LogFatal("cannot load state from %s: %s", Config.StatePath, err.Error())
+	}
+
+	found := false
+	for _, driveID := range s.DriveIDs() {
+		ds := s.Drives[driveID]
+		if driveID != name && ds.DevicePath != name && ds.SwiftID != name {
+			continue
+		}
+		if found {
+			fmt.Fprintln(w)
+		}
+		found = true
+		printDriveState(w, driveID, ds)
+	}
+	if !found {
+		util.LogFatal("no drive matching %q found in %s", name, Config.StatePath)
+	}
+}
+
+func printDriveState(w io.Writer, driveID string, ds *state.DriveState) {
+	fmt.Fprintf(w, "drive ID:          %s\n", driveID)
+	fmt.Fprintf(w, "last seen at:      %s\n", ds.DevicePath)
+	if ds.MissingSince != nil {
+		fmt.Fprintf(w, "missing since:     %s\n", formatHistoryTime(ds.MissingSince))
+	}
+	if ds.SwiftID != "" {
+		fmt.Fprintf(w, "swift-id:          %s\n", ds.SwiftID)
+	}
+	if ds.FilesystemUUID != "" {
+		fmt.Fprintf(w, "filesystem UUID:   %s\n", ds.FilesystemUUID)
+	}
+
+	h := ds.History
+	if h == nil {
+		h = &state.DriveHistory{}
+	}
+	if h.LastMountedAt == nil {
+		fmt.Fprintf(w, "last mounted:      never\n")
+	} else {
+		fmt.Fprintf(w, "last mounted:      %s at %s\n", formatHistoryTime(h.LastMountedAt), h.LastMountPath)
+	}
+	fmt.Fprintf(w, "kernel log errors: %d\n", h.KernelErrorCount)
+	if h.LastKernelErrorAt != nil {
+		fmt.Fprintf(w, "  last at %s: %s\n", formatHistoryTime(h.LastKernelErrorAt), h.LastKernelError)
+	}
+	fmt.Fprintf(w, "flagged as broken: %d times\n", h.BrokenCount)
+	if h.LastBrokenAt != nil {
+		fmt.Fprintf(w, "  last at %s\n", formatHistoryTime(h.LastBrokenAt))
+	}
+}
+
+func formatHistoryTime(t *time.Time) string {
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), time.Since(*t).Truncate(time.Second))
+}
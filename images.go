@@ -0,0 +1,52 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"strings"
+)
+
+//ImageFile appears in type Configuration. It describes an image file that is
+//attached as a block device and then used like a drive (e.g. to set up a
+//complete Swift test environment on a single VM). Image files are attached by
+//imageFileProvider.
+type ImageFile struct {
+	Path string `yaml:"path"`
+	//Format is "raw" or "qcow2". If empty, it is derived from the file name.
+	Format string `yaml:"format"`
+}
+
+//Validate checks the image file configuration, and fills in the default
+//format.
+func (f *ImageFile) Validate() string {
+	if !strings.HasPrefix(f.Path, "/") {
+		return "path must be absolute"
+	}
+	if f.Format == "" {
+		f.Format = "raw"
+		if strings.HasSuffix(f.Path, ".qcow2") {
+			f.Format = "qcow2"
+		}
+	}
+	if f.Format != "raw" && f.Format != "qcow2" {
+		return "format must be \"raw\" or \"qcow2\""
+	}
+	return ""
+}
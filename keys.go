@@ -0,0 +1,179 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	std_os "os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/go-bits/secrets"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//The inherited file descriptors that were consumed by ReadInheritedKeys().
+//They are skipped when looking for sockets from systemd socket activation.
+var consumedKeyFDs = make(map[int]bool)
+
+//ReadInheritedKeys reads those encryption keys that were passed to us by the
+//process that started us: either in an inherited file descriptor, or as a
+//systemd credential (see LoadCredential= in systemd.exec(5)). The file
+//descriptors are closed afterwards, so that they do not leak into the
+//commands that we execute. This happens once during startup, before any
+//commands are executed.
+func ReadInheritedKeys() {
+	for idx := range Config.Keys {
+		key := &Config.Keys[idx]
+		var (
+			buf    []byte
+			err    error
+			source string
+		)
+		switch {
+		case key.FD != nil:
+			source = "file descriptor " + strconv.Itoa(*key.FD)
+			f := std_os.NewFile(uintptr(*key.FD), "key-fd-"+strconv.Itoa(*key.FD))
+			buf, err = ioutil.ReadAll(f)
+			f.Close()
+			consumedKeyFDs[*key.FD] = true
+		case key.Credential != "":
+			source = "credential " + key.Credential
+			dir := std_os.Getenv("CREDENTIALS_DIRECTORY")
+			if dir == "" {
+				err = fmt.Errorf("$CREDENTIALS_DIRECTORY is not set (is LoadCredential= configured?)")
+			} else {
+				buf, err = ioutil.ReadFile(filepath.Join(dir, key.Credential))
+			}
+		default:
+			continue
+		}
+
+		secret := strings.TrimSuffix(strings.TrimSuffix(string(buf), "\n"), "\r")
+		if err == nil && secret == "" {
+			err = fmt.Errorf("key is empty")
+		}
+		if err != nil {
+			util.LogFatal("cannot read encryption key #%d from %s: %s", idx+1, source, err.Error())
+		}
+		util.AddRedactedSecret(secret)
+		key.Secret = secrets.AuthPassword(secret)
+	}
+}
+
+//remoteKeySource is implemented by VaultKeySource and BarbicanKeySource.
+type remoteKeySource interface {
+	Fetch(client *http.Client) (string, error)
+	String() string
+}
+
+//FetchRemoteKeys fetches those encryption keys that are stored in external
+//services (e.g. Vault or Barbican) instead of in the configuration file. This
+//happens once during startup, before the converger thread starts.
+func FetchRemoteKeys() {
+	var client *http.Client
+	for idx := range Config.Keys {
+		key := &Config.Keys[idx]
+		var source remoteKeySource
+		switch {
+		case key.Vault != nil:
+			source = key.Vault
+		case key.Barbican != nil:
+			source = key.Barbican
+		default:
+			continue
+		}
+		if client == nil {
+			var err error
+			client, err = Config.Network.HTTPClient()
+			if err != nil {
+				util.LogFatal("cannot fetch encryption keys: %s", err.Error())
+			}
+		}
+		secret, err := source.Fetch(client)
+		if err != nil {
+			util.LogFatal("cannot fetch encryption key #%d from %s: %s", idx+1, source.String(), err.Error())
+		}
+		util.AddRedactedSecret(secret)
+		key.Secret = secrets.AuthPassword(secret)
+	}
+}
+
+//CheckKeyFiles exits with an error if one of the configured key files cannot
+//be read, so that this is noticed before the first drive is set up. Key files
+//in the autopilot's own filesystem are not read here for later use, since
+//they are read again every time they are needed (to pick up rotated keys).
+func CheckKeyFiles() {
+	for idx, key := range Config.Keys {
+		if key.KeyFile == "" {
+			continue
+		}
+		path := key.KeyFile
+		if key.KeyFileInChroot {
+			//make path relative to working directory to account for chrootPath
+			path = strings.TrimPrefix(path, "/")
+		}
+		if err := checkKeyFile(path); err != nil {
+			util.LogFatal("cannot use key file from entry #%d in keys: %s", idx+1, err.Error())
+		}
+	}
+}
+
+func checkKeyFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	return nil
+}
+
+//EncryptionKeys returns all LUKS encryption keys, in order of preference:
+//first those from the configuration file, then those provided by plugins.
+func EncryptionKeys() []os.LUKSKey {
+	result := make([]os.LUKSKey, 0, len(Config.Keys)+len(pluginKeys))
+	for _, key := range Config.Keys {
+		result = append(result, os.LUKSKey{
+			Secret:          string(key.Secret),
+			KeyFile:         key.KeyFile,
+			KeyFileInChroot: key.KeyFileInChroot,
+		})
+	}
+	return append(result, pluginKeys...)
+}
+
+//RetiredEncryptionKeys returns the keys from luks.retired-keys.
+func RetiredEncryptionKeys() []os.LUKSKey {
+	result := make([]os.LUKSKey, 0, len(Config.LUKS.RetiredKeys))
+	for _, key := range Config.LUKS.RetiredKeys {
+		result = append(result, os.LUKSKey{
+			Secret:          string(key.Secret),
+			KeyFile:         key.KeyFile,
+			KeyFileInChroot: key.KeyFileInChroot,
+		})
+	}
+	return result
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Records the lifecycle data of this drive (model, formats and, if enabled,
+//power-on hours) in its persistent state.
+func (c *Converger) recordLifecycleData(drive *core.Drive, ds *state.DriveState) {
+	if f := drive.Firmware; f != nil {
+		ds.RecordFirmware(f.Model, f.FirmwareRevision)
+	}
+	if !drive.FormattedAt.IsZero() {
+		ds.RecordFormat(drive.FormattedAt)
+	}
+
+	//SMART is only queried for physical drives, and only once per interval
+	//(also if the drive does not report its power-on hours, to avoid running
+	//smartctl on every convergence)
+	cfg := Config.LifecycleStatistics
+	if !cfg.PowerOnHours || drive.Firmware == nil || !ds.PowerOnHoursDue(cfg.RefreshInterval) {
+		return
+	}
+	if checkedAt, exists := c.powerOnHoursCheckedAt[drive.DriveID]; exists && time.Since(checkedAt) < cfg.RefreshInterval {
+		return
+	}
+	if c.powerOnHoursCheckedAt == nil {
+		c.powerOnHoursCheckedAt = make(map[string]time.Time)
+	}
+	c.powerOnHoursCheckedAt[drive.DriveID] = time.Now()
+	hours, ok := c.OS.GetPowerOnHours(drive.PhysicalDevicePath())
+	if ok {
+		ds.RecordPowerOnHours(hours, time.Now())
+	} else {
+		util.LogDebug("cannot read power-on hours of %s from SMART", drive.PhysicalDevicePath())
+	}
+}
+
+//fleetReportEntry is a line in the output of PrintFleetReport.
+type fleetReportEntry struct {
+	Model            string
+	FirmwareRevision string
+	Drives           int
+	FailedDrives     int
+	Formats          int
+	PowerOnHours     int
+}
+
+//PrintFleetReport summarizes the lifecycle statistics of all drives in the
+//given state files (including drives that have been forgotten) per model and
+//firmware revision. Since each node only knows its own drives, state files
+//collected from other nodes can be given to cover the whole fleet. A drive
+//counts as failed if it has been flagged as broken at least once.
+func PrintFleetReport(w io.Writer, statePaths []string) {
+	entries := make(map[[2]string]*fleetReportEntry)
+	addDrive := func(h *state.DriveHistory) {
+		if h == nil {
+			h = &state.DriveHistory{}
+		}
+		model := h.Model
+		if model == "" {
+			model = "unknown"
+		}
+		key := [2]string{model, h.FirmwareRevision}
+		e := entries[key]
+		if e == nil {
+			e = &fleetReportEntry{Model: model, FirmwareRevision: h.FirmwareRevision}
+			entries[key] = e
+		}
+		e.Drives++
+		if h.BrokenCount > 0 {
+			e.FailedDrives++
+		}
+		e.Formats += h.FormatCount
+		e.PowerOnHours += h.PowerOnHours
+	}
+
+	for _, path := range statePaths {
+		s, err := state.Load(path)
+		if err != nil {
+			util.LogFatal("cannot load state from %s: %s", path, err.Error())
+		}
+		for _, ds := range s.Drives {
+			addDrive(ds.History)
+		}
+		for driveID, h := range s.RetiredDrives {
+			//a retired drive that has reappeared is already counted above
+			if _, exists := s.Drives[driveID]; !exists {
+				addDrive(h)
+			}
+		}
+	}
+
+	sorted := make([]*fleetReportEntry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Model != sorted[j].Model {
+			return sorted[i].Model < sorted[j].Model
+		}
+		return sorted[i].FirmwareRevision < sorted[j].FirmwareRevision
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tFIRMWARE\tDRIVES\tFAILED\tFORMATS\tPOWER-ON HOURS\tAFR\tMTBF (HOURS)")
+	for _, e := range sorted {
+		firmware := e.FirmwareRevision
+		if firmware == "" {
+			firmware = "-"
+		}
+		//the annualized failure rate and the mean time between failures can only
+		//be computed when the power-on hours are known
+		afr, mtbf := "-", "-"
+		if e.PowerOnHours > 0 {
+			afr = fmt.Sprintf("%.2f%%", 100*float64(e.FailedDrives)/(float64(e.PowerOnHours)/8760))
+			if e.FailedDrives > 0 {
+				mtbf = fmt.Sprintf("%d", e.PowerOnHours/e.FailedDrives)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			e.Model, firmware, e.Drives, e.FailedDrives, e.Formats, e.PowerOnHours, afr, mtbf)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,143 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	std_os "os"
+	"strconv"
+	"syscall"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//The first file descriptor passed by systemd socket activation (see
+//sd_listen_fds(3)).
+const listenFDsStart = 3
+
+//ServeHTTP serves the given handler on all configured listeners: the
+//metrics-listen-address, each of the metrics-listen-addresses, and all
+//sockets passed by systemd socket activation. This function does not block.
+func ServeHTTP(handler http.Handler) {
+	var listeners []net.Listener
+	var descriptions []string
+
+	if Config.MetricsListenAddress != "" {
+		l, err := net.Listen("tcp", Config.MetricsListenAddress)
+		if err != nil {
+			util.LogFatal("cannot listen on %s for metric shipping: %s", Config.MetricsListenAddress, err.Error())
+		}
+		listeners = append(listeners, l)
+		descriptions = append(descriptions, Config.MetricsListenAddress)
+	}
+
+	for _, addr := range Config.MetricsListenAddresses {
+		network, err := listenNetworkFor(addr)
+		if err != nil {
+			util.LogFatal("cannot listen on %s for metric shipping: %s", addr, err.Error())
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			util.LogFatal("cannot listen on %s for metric shipping: %s", addr, err.Error())
+		}
+		listeners = append(listeners, l)
+		descriptions = append(descriptions, addr)
+	}
+
+	activated, err := activatedListeners()
+	if err != nil {
+		util.LogFatal("cannot use sockets from systemd socket activation: %s", err.Error())
+	}
+	if Config.Network.Disabled && len(activated) > 0 {
+		util.LogFatal("network is disabled, but received %d sockets from systemd socket activation", len(activated))
+	}
+	for _, l := range activated {
+		listeners = append(listeners, l)
+		descriptions = append(descriptions, l.Addr().String()+" (from systemd)")
+	}
+
+	for idx, l := range listeners {
+		util.LogInfo("listening on " + descriptions[idx] + " for metric shipping")
+		go func(l net.Listener, description string) {
+			err := http.Serve(l, handler)
+			if err != nil {
+				util.LogFatal("cannot serve metrics on %s: %s", description, err.Error())
+			}
+		}(l, descriptions[idx])
+	}
+}
+
+//Returns the network for net.Listen() that restricts the listener to the
+//address family of the given address, so that e.g. "0.0.0.0:9102" and
+//"[::]:9102" can be bound at the same time. Host names are left to
+//net.Listen().
+func listenNetworkFor(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp", nil
+	case ip.To4() != nil:
+		return "tcp4", nil
+	default:
+		return "tcp6", nil
+	}
+}
+
+//Returns the listening sockets that were passed to us by systemd socket
+//activation, if any. The environment variables describing them are removed,
+//so that they do not leak into the commands that we execute.
+func activatedListeners() ([]net.Listener, error) {
+	defer func() {
+		std_os.Unsetenv("LISTEN_PID")
+		std_os.Unsetenv("LISTEN_FDS")
+		std_os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(std_os.Getenv("LISTEN_PID"))
+	if err != nil || pid != std_os.Getpid() {
+		return nil, nil //not for us
+	}
+	count, err := strconv.Atoi(std_os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("malformed LISTEN_FDS: %q", std_os.Getenv("LISTEN_FDS"))
+	}
+
+	var result []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		if consumedKeyFDs[fd] {
+			continue //not a socket, but a key (see ReadInheritedKeys)
+		}
+		syscall.CloseOnExec(fd)
+		f := std_os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d: %s", fd, err.Error())
+		}
+		f.Close() //net.FileListener() has made its own copy
+		result = append(result, l)
+	}
+	return result, nil
+}
@@ -20,17 +20,36 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
 	"net/http"
+	"net/http/pprof"
 	std_os "os"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/state"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
 func main() {
+	loadConfiguration()
+	if *evaluateFlag != "" {
+		//this does not need the chroot, so it can run e.g. in CI; stdout is kept
+		//clean for the result
+		log.SetOutput(std_os.Stderr)
+		err := PrintEvaluation(std_os.Stdout, *evaluateFlag)
+		if err != nil {
+			util.LogFatal("cannot evaluate configuration: %s", err.Error())
+		}
+		return
+	}
+
 	//set working directory to the chroot directory; this simplifies file
 	//system operations because we can just use relative paths to refer to
 	//stuff inside the chroot
@@ -43,31 +62,168 @@ func main() {
 		util.LogFatal("chdir to %s: %s", workingDir, err.Error())
 	}
 
-	//prepare directories that the converger wants to write to
-	command.Command{ExitOnError: true}.Run("mkdir", "-p",
-		"/run/swift-storage/broken",
-		"/run/swift-storage/state/unmount-propagation",
-		"/var/cache/swift",
-	)
+	//the journal or syslog socket is on the host, i.e. inside the chroot
+	if t := Config.LogSink.Type; t != "" && t != "stdout" {
+		err := util.UseLogSink(t, strings.TrimPrefix(Config.LogSink.SocketPath, "/"))
+		if err != nil {
+			util.LogFatal("cannot connect to %s log sink: %s", t, err.Error())
+		}
+	}
+
+	if *historyFlag != "" {
+		PrintDriveHistory(std_os.Stdout, *historyFlag)
+		return
+	}
+
+	//the running autopilot would overwrite the restored state with its own, so
+	//it needs to be stopped before this (Rollback refuses while the autopilot
+	//holds the lock on the state file)
+	if *rollbackFlag != 0 {
+		s, err := state.Rollback(Config.StatePath, *rollbackFlag, Config.Retention.StateSnapshots)
+		if err != nil {
+			util.LogFatal("cannot roll back %s: %s", Config.StatePath, err.Error())
+		}
+		util.LogInfo("restored %s from snapshot %d with %d drives", Config.StatePath, *rollbackFlag, len(s.Drives))
+		return
+	}
+
+	if *diffFlag != "" {
+		//like diff(1), exit with status 1 if there are differences
+		found, err := PrintStateDifferences(std_os.Stdout, *diffFlag)
+		if err != nil {
+			util.LogFatal("cannot compute differences: %s", err.Error())
+		}
+		if found {
+			std_os.Exit(1)
+		}
+		return
+	}
+
+	if *topFlag {
+		err := RunTop(std_os.Stdout)
+		if err != nil {
+			util.LogFatal("cannot show drive status: %s", err.Error())
+		}
+		return
+	}
+
+	if *fleetReportFlag {
+		PrintFleetReport(std_os.Stdout, append([]string{Config.StatePath}, flag.Args()[1:]...))
+		return
+	}
+
+	//inherited file descriptors must not leak into any of the commands that we
+	//execute
+	ReadInheritedKeys()
+
+	LoadDriveManifest()
+
+	//when run from a timer, most runs find nothing to do; those should not
+	//have to pay for the full setup (which spawns lots of commands)
+	if *onceFlag {
+		err := CheckAlreadyConverged()
+		if err == nil {
+			util.LogInfo("everything is already converged, exiting")
+			return
+		}
+		util.LogDebug("cannot take the fast path: %s", err.Error())
+	}
+
+	//key rotation runs next to the autopilot, so it must not touch anything
+	//that the autopilot owns (e.g. the API endpoint or the runtime directories)
+	if *rotateKeysFlag {
+		if Config.Recovery {
+			util.LogFatal("cannot rotate keys in recovery mode")
+		}
+		osi, err := os.NewLinux()
+		if err != nil {
+			util.LogFatal(err.Error())
+		}
+		StartHelpers()
+		FetchRemoteKeys()
+		UnsealTPM2Keys()
+		CheckKeyFiles()
+		LoadPlugins()
+		if !RotateKeys(osi) {
+			std_os.Exit(1)
+		}
+		return
+	}
+
+	StartBootProfiling()
+
+	//the cgroup needs to exist before the first command is moved into it
+	if path := Config.Concurrency.Cgroup.Path; path != "" {
+		err := command.SetupCgroup(path, Config.Concurrency.Cgroup.Limits)
+		if err != nil {
+			util.LogFatal("cannot setup cgroup %s: %s", path, err.Error())
+		}
+	}
+
+	//the flag is only valid for the process that prepared the reboot
+	if Config.RebootPreparation.Enabled {
+		err := std_os.Remove(strings.TrimPrefix(SafeToRebootFlagPath, "/"))
+		if err != nil && !std_os.IsNotExist(err) {
+			util.LogFatal(err.Error())
+		}
+	}
 
-	//swift cache path must be accesible from user swift
 	osi, err := os.NewLinux()
 	if err != nil {
 		util.LogFatal(err.Error())
 	}
-	osi.Chown("/var/cache/swift", Config.Owner.User, Config.Owner.Group)
+	//prepare directories that the converger wants to write to
+	CreateRuntimeDirectories(osi)
 
-	//start the metrics endpoint
-	if Config.MetricsListenAddress != "" {
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			util.LogInfo("listening on " + Config.MetricsListenAddress + " for metric shipping")
-			err := http.ListenAndServe(Config.MetricsListenAddress, nil)
-			if err != nil {
-				util.LogFatal("cannot listen on %s for metric shipping: %s", Config.MetricsListenAddress, err.Error())
-			}
-		}()
+	//start the metrics endpoint (which also serves the status API)
+	if len(Config.Labels) > 0 {
+		registerLabelsMetric(Config.Labels)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/api/v1/status", handleStatusRequest)
+	mux.HandleFunc("/api/v1/events", handleDriveEventsRequest)
+	mux.HandleFunc("/api/v1/converge", handleConvergeRequest)
+	mux.HandleFunc("/api/v1/health/", handleStoragePolicyHealthRequest)
+	if Config.BulkAPI.Enabled {
+		mux.HandleFunc("/api/v1/bulk", handleBulkRequest)
 	}
+	if Config.RebootPreparation.Enabled {
+		mux.HandleFunc("/api/v1/prepare-reboot", handleRebootRequest)
+	}
+	if Config.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	ServeHTTP(AuthorizeAPIRequests(mux))
+
+	//helpers (e.g. a key agent) may be needed by plugins and by the drive setup
+	StartHelpers()
+	FetchRemoteKeys()
+	UnsealTPM2Keys()
+	CheckKeyFiles()
+	LoadPlugins()
+
+	//fail early (with a clear error message) if the chroot or the kernel lacks
+	//support for what we are going to do
+	VerifyChroot()
+	checkKernelModules(osi)
+
+	//image files etc. are attached as block devices before we look for drives
+	AttachBlockDevices(osi)
+
+	//multipath and iSCSI drives only appear once their services are ready
+	WaitForStorageServices(osi)
+
+	//static content is mounted independently of the Swift drives
+	SetupVerityVolumes(osi)
+
+	//give site-specific setup steps (e.g. HBA tweaks) a chance to run before
+	//we look for drives
+	Config.Hooks.Run(core.BeforeDiscoveryHook, core.LabelEnv(Config.Labels)...)
 
 	//start the collectors
 	queue := make(chan []Event, 10)
@@ -75,6 +231,51 @@ func main() {
 	go CollectReinstatements(queue)
 	go ScheduleWakeups(queue)
 	go WatchKernelLog(osi, queue)
+	if Config.HotplugEvents {
+		go WatchHotplugEvents(osi)
+	}
+	go HandleStateDumpSignals(osi, queue)
+	go CollectConvergenceRequests(queue)
+	go CollectBulkRequests(queue)
+	if Config.LUKS.HeaderBackups.Enabled {
+		go ScheduleLUKSHeaderBackups(queue)
+	}
+	if Config.Migration.Enabled {
+		go CollectRequestFiles(MigrationRequestDirectory, queue, func(name string) Event {
+			return MigrateFilesystemEvent{Name: name}
+		})
+	}
+	if Config.EncryptionMigration.Enabled {
+		go CollectRequestFiles(EncryptionRequestDirectory, queue, func(name string) Event {
+			return EncryptFilesystemEvent{Name: name}
+		})
+	}
+	go CollectEncryptionResults(queue)
+	if Config.Evacuation.Enabled {
+		go CollectRequestFiles(EvacuationRequestDirectory, queue, func(name string) Event {
+			return EvacuateDriveEvent{Name: name}
+		})
+		go MonitorEvacuations(queue)
+	}
+	if Config.ReadOnlyExport.Enabled {
+		go CollectRequestFiles(ExportRequestDirectory, queue, func(name string) Event {
+			return ExportDriveEvent{Name: name}
+		})
+		go CollectRequestFiles(UnexportRequestDirectory, queue, func(name string) Event {
+			return UnexportDriveEvent{Name: name}
+		})
+	}
+	if Config.VerifyFilesystemUUID {
+		go CollectRequestFiles(AdoptionRequestDirectory, queue, func(name string) Event {
+			return AdoptDriveEvent{Name: name}
+		})
+	}
+	if Config.RebootPreparation.Enabled {
+		go CollectRequestFiles(RebootRequestDirectory, queue, func(name string) Event {
+			return PrepareRebootEvent{RequestedBy: "request file " + name, Cancel: name == "cancel"}
+		})
+		go CollectRebootRequests(queue)
+	}
 
 	if util.InTestMode() {
 		util.SetupTestMode()
@@ -83,3 +284,55 @@ func main() {
 	//the converger runs in the main thread
 	RunConverger(queue, osi)
 }
+
+//Loads the kernel modules that are required for the configured setup, and
+//exits with an error if any of them is not available.
+func checkKernelModules(osi os.Interface) {
+	modules := []string{"xfs"}
+	purposes := map[string]string{"xfs": "needed for Swift's filesystems"}
+	if len(EncryptionKeys()) > 0 {
+		modules = append(modules, "dm_mod", "dm_crypt")
+		purposes["dm_mod"] = "needed for LUKS encryption"
+		purposes["dm_crypt"] = "needed for LUKS encryption"
+	}
+	if Config.Bcache.CacheDevice != "" {
+		modules = append(modules, "bcache")
+		purposes["bcache"] = "needed for bcache.cache-device"
+	}
+	if len(Config.VerityVolumes) > 0 {
+		if _, exists := purposes["dm_mod"]; !exists {
+			modules = append(modules, "dm_mod")
+			purposes["dm_mod"] = "needed for verity-volumes"
+		}
+		modules = append(modules, "dm_verity")
+		purposes["dm_verity"] = "needed for verity-volumes"
+	}
+	if Config.ZFS.Zvols {
+		modules = append(modules, "zfs")
+		purposes["zfs"] = "needed for zfs.zvols"
+	}
+	for _, glob := range Config.DriveGlobs {
+		if strings.Contains(glob, "/dev/loop") {
+			modules = append(modules, "loop")
+			purposes["loop"] = "needed for loop devices matched by drive globs"
+			break
+		}
+	}
+	for _, p := range Config.BlockDeviceProviders() {
+		for _, module := range p.KernelModules() {
+			if _, exists := purposes[module]; !exists {
+				modules = append(modules, module)
+				purposes[module] = "needed for " + p.Name()
+			}
+		}
+	}
+
+	missing := osi.LoadKernelModules(modules)
+	if len(missing) > 0 {
+		descriptions := make([]string, len(missing))
+		for idx, module := range missing {
+			descriptions[idx] = fmt.Sprintf("%s (%s)", module, purposes[module])
+		}
+		util.LogFatal("required kernel modules are not available: %s", strings.Join(descriptions, ", "))
+	}
+}
@@ -0,0 +1,138 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	std_os "os"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//DriveManifestConfiguration appears in type Configuration. It points to a
+//signed manifest that lists the serial numbers of the drives that are
+//expected in each node of the fleet.
+type DriveManifestConfiguration struct {
+	Path string `yaml:"path"`
+	//SignaturePath defaults to Path + ".sig".
+	SignaturePath string `yaml:"signature-path"`
+	//PublicKey is the base64-encoded Ed25519 public key that the manifest must
+	//be signed with.
+	PublicKey string `yaml:"public-key"`
+}
+
+//Validate checks the drive manifest configuration, and fills in default
+//values.
+func (m *DriveManifestConfiguration) Validate() error {
+	if m.Path == "" {
+		return nil
+	}
+	if m.SignaturePath == "" {
+		m.SignaturePath = m.Path + ".sig"
+	}
+	key, err := base64.StdEncoding.DecodeString(m.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("public-key must be a base64-encoded Ed25519 public key")
+	}
+	return nil
+}
+
+//The drive IDs (usually serial numbers) that are expected in this node
+//according to the drive manifest, or nil if no manifest is configured. This
+//is only written during startup, before the converger thread starts.
+var expectedDriveIDs map[string]bool
+
+//LoadDriveManifest verifies the signature of the drive manifest, and records
+//which drives are expected in this node. The manifest is a text file with
+//lines of the form "<hostname> <serial number>". Empty lines and lines
+//starting with "#" are ignored.
+func LoadDriveManifest() {
+	m := Config.DriveManifest
+	if m.Path == "" {
+		return
+	}
+	hostname, err := std_os.Hostname()
+	if err != nil {
+		util.LogFatal("cannot load drive manifest: %s", err.Error())
+	}
+	ids, err := readDriveManifest(m, hostname)
+	if err != nil {
+		util.LogFatal("cannot load drive manifest from %s: %s", m.Path, err.Error())
+	}
+	util.LogInfo("drive manifest lists %d drives for %s", len(ids), hostname)
+	expectedDriveIDs = ids
+}
+
+func readDriveManifest(m DriveManifestConfiguration, hostname string) (map[string]bool, error) {
+	buf, err := ioutil.ReadFile(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	sigBuf, err := ioutil.ReadFile(m.SignaturePath)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigBuf)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature in %s: %s", m.SignaturePath, err.Error())
+	}
+	publicKey, _ := base64.StdEncoding.DecodeString(m.PublicKey) //already checked by Validate()
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), buf, signature) {
+		return nil, fmt.Errorf("signature in %s does not match", m.SignaturePath)
+	}
+
+	result := make(map[string]bool)
+	for idx, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected hostname and serial number", idx+1)
+		}
+		if fields[0] == hostname {
+			result[fields[1]] = true
+		}
+	}
+	return result, nil
+}
+
+//MissingManifestDriveIDs returns the IDs of all drives that are listed in the
+//drive manifest for this node, but have not been found (yet).
+func (c *Converger) MissingManifestDriveIDs() []string {
+	isPresent := make(map[string]bool, len(c.Drives))
+	for _, drive := range c.Drives {
+		isPresent[drive.DriveID] = true
+	}
+	var result []string
+	for driveID := range expectedDriveIDs {
+		if !isPresent[driveID] {
+			result = append(result, driveID)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -29,8 +29,31 @@ var eventCounter = prometheus.NewCounterVec(
 	[]string{"type"},
 )
 
+var evacuationRemainingBytesGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "swift_drive_autopilot_evacuation_remaining_bytes",
+		Help: "Size of the data that remains on drives that are being evacuated.",
+	},
+	[]string{"swift_id"},
+)
+
+//Registers a metric that is always 1 and carries the configured labels (see
+//Configuration.Labels) as its labels, so that they can be joined onto the
+//other metrics.
+func registerLabelsMetric(labels map[string]string) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "swift_drive_autopilot_labels",
+		Help:        "Always 1. Carries the labels from the configuration.",
+		ConstLabels: labels,
+	})
+	gauge.Set(1)
+	prometheus.MustRegister(gauge)
+}
+
 func init() {
 	prometheus.MustRegister(eventCounter)
+	prometheus.MustRegister(evacuationRemainingBytesGauge)
+	prometheus.MustRegister(helperRestartCounter)
 
 	//make sure that the count for every event type is reported, even as 0, so
 	//that users know which (possibly rare) events can occur
@@ -40,6 +63,12 @@ func init() {
 		DriveReinstatedEvent{},
 		DriveErrorEvent{},
 		WakeupEvent{},
+		ConvergenceRequestedEvent{},
+		MigrateFilesystemEvent{},
+		EvacuateDriveEvent{},
+		EvacuationProgressEvent{},
+		AdoptDriveEvent{},
+		PrepareRebootEvent{},
 	}
 	for _, event := range events {
 		eventCounter.With(prometheus.Labels{"type": event.EventType()}).Add(0)
@@ -0,0 +1,208 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	std_os "os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//MigrationRequestDirectory is where administrators place files to request a
+//filesystem migration. The file name is the swift-id or drive ID of the drive
+//in question.
+const MigrationRequestDirectory = "/run/swift-storage/migrate-filesystem"
+
+//MigrateFilesystemEvent is an Event that is emitted by CollectRequestFiles
+//for MigrationRequestDirectory.
+type MigrateFilesystemEvent struct {
+	//Name is the swift-id or the drive ID of the drive in question.
+	Name string
+}
+
+//LogMessage implements the Event interface.
+func (e MigrateFilesystemEvent) LogMessage() string {
+	return "filesystem migration requested for " + e.Name
+}
+
+//EventType implements the Event interface.
+func (e MigrateFilesystemEvent) EventType() string {
+	return "filesystem-migration-requested"
+}
+
+//Handle implements the Event interface.
+func (e MigrateFilesystemEvent) Handle(c *Converger) {
+	err := c.migrateFilesystem(e.Name)
+	if err != nil {
+		util.LogError(err.Error())
+	}
+}
+
+//Reformats the drive with the given swift-id or drive ID, and restores its
+//swift-id afterwards.
+func (c *Converger) migrateFilesystem(name string) error {
+	//only healthy drives with a valid assignment can be migrated, since we need
+	//to restore the swift-id afterwards
+	drive, err := c.findActiveDrive(name)
+	if err != nil {
+		return fmt.Errorf("cannot migrate filesystem of %s: %s", name, err.Error())
+	}
+
+	err = checkDriveIsDrained(drive.MountedPath(), Config.Migration.CheckCommand, Config.Migration.IgnorePaths)
+	if err != nil {
+		return fmt.Errorf("cannot migrate filesystem of %s: %s", drive.DevicePath, err.Error())
+	}
+
+	unlock, err := c.lockDrive(drive)
+	if err != nil {
+		return fmt.Errorf("cannot migrate filesystem of %s: %s", drive.DevicePath, err.Error())
+	}
+	defer unlock()
+
+	swiftID := drive.Assignment.SwiftID
+	util.LogInfo("migrating filesystem of %s (swift-id %s)", drive.DevicePath, swiftID)
+	if !drive.ReformatFilesystem(c.OS) {
+		drive.MarkAsBroken(c.OS)
+		return fmt.Errorf("cannot migrate filesystem of %s: reformatting failed", drive.DevicePath)
+	}
+
+	//restore the swift-id; the next Converge() will then move the drive back
+	//into /srv/node
+	err = c.OS.WriteSwiftID(drive.MountedPath(), swiftID)
+	if err == nil && drive.SwiftIDChecksums {
+		err = c.OS.WriteSwiftIDChecksum(drive.MountedPath())
+	}
+	if err != nil {
+		return fmt.Errorf("cannot restore swift-id on %s: %s", drive.DevicePath, err.Error())
+	}
+	return nil
+}
+
+//Returns the drive with the given swift-id or drive ID, if it is healthy,
+//mounted and has a valid swift-id.
+func (c *Converger) findActiveDrive(name string) (*core.Drive, error) {
+	for _, d := range c.Drives {
+		if d.DriveID != name && (d.Assignment == nil || d.Assignment.SwiftID != name) {
+			continue
+		}
+		a := d.Assignment
+		switch {
+		case d.Broken:
+			return nil, errors.New("drive is broken")
+		case a == nil || a.Error != "" || a.SwiftID == "":
+			return nil, errors.New("drive does not have a valid swift-id")
+		case d.MountedPath() == "":
+			return nil, errors.New("drive is not mounted")
+		}
+		return d, nil
+	}
+	return nil, errors.New("no such drive")
+}
+
+//Checks whether Swift replication has moved all data off the filesystem
+//mounted at the given path. If a check command is given, its exit code decides
+//(it is called with the mount path as additional argument). Otherwise, the
+//filesystem is considered drained if measureRemainingData() does not find
+//anything.
+func checkDriveIsDrained(mountPath string, checkCommand, ignorePaths []string) error {
+	if len(checkCommand) > 0 {
+		_, ok := command.Run(append(append([]string(nil), checkCommand...), mountPath)...)
+		if !ok {
+			return errors.New("check command reports that drive has not been drained yet")
+		}
+		return nil
+	}
+
+	remaining, err := measureRemainingData(mountPath, ignorePaths)
+	if err != nil {
+		return err
+	}
+	if remaining.Files > 0 {
+		return errors.New("drive has not been drained yet (found " + remaining.ExamplePath + ")")
+	}
+	return nil
+}
+
+//remainingData is returned by measureRemainingData().
+type remainingData struct {
+	Files int
+	Bytes int64
+	//ExamplePath is one of the files that were found (for log messages).
+	ExamplePath string
+}
+
+//Counts the files on the filesystem mounted at the given path, except for the
+//swift-id and its checksum, the layout version file, lost+found, the
+//evacuation marker and those matching one of the given ignore patterns
+//(relative to the mount path). Directories are not counted.
+func measureRemainingData(mountPath string, ignorePaths []string) (remainingData, error) {
+	//make path relative to working directory to account for chrootPath
+	rootPath := strings.TrimPrefix(mountPath, "/")
+	var result remainingData
+	err := filepath.Walk(rootPath, func(path string, fi std_os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if relPath == "swift-id" || relPath == os.SwiftIDChecksumFileName || relPath == os.LayoutVersionFileName || relPath == "lost+found" || relPath == Config.Evacuation.MarkerFile || isIgnoredPath(relPath, ignorePaths) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if result.Files == 0 {
+			result.ExamplePath = filepath.Join(mountPath, relPath)
+		}
+		result.Files++
+		result.Bytes += fi.Size()
+		return nil
+	})
+	return result, err
+}
+
+func isIgnoredPath(relPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		matched, err := filepath.Match(pattern, relPath)
+		if err != nil {
+			util.LogError("invalid ignore pattern %q: %s", pattern, err.Error())
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//NetworkConfiguration appears in type Configuration. It describes how to
+//reach external services on nodes without DNS or direct internet access.
+//Instead of a mapping, the string "disabled" can be given in the config file
+//to disable all network access (see Disabled).
+type NetworkConfiguration struct {
+	//Disabled forbids all listeners and outbound integrations, for air-gapped
+	//deployments. It is an error to configure any feature that needs network
+	//access.
+	Disabled bool `yaml:"-"`
+
+	Proxy   string   `yaml:"proxy"`
+	NoProxy []string `yaml:"no-proxy"`
+	//CABundle is a PEM file with the CA certificates that are trusted instead
+	//of the system's CA certificates.
+	CABundle string `yaml:"ca-bundle"`
+	//StaticHosts maps host names to IP addresses, to avoid DNS lookups.
+	StaticHosts map[string]string `yaml:"static-hosts"`
+}
+
+//UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (n *NetworkConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		if value != "disabled" {
+			return fmt.Errorf(`network must be "disabled" or a mapping, but is %q`, value)
+		}
+		*n = NetworkConfiguration{Disabled: true}
+		return nil
+	}
+	type plain NetworkConfiguration //avoid infinite recursion
+	return unmarshal((*plain)(n))
+}
+
+//Validate checks the network configuration.
+func (n NetworkConfiguration) Validate() error {
+	if n.Proxy != "" {
+		u, err := url.Parse(n.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy: %s", err.Error())
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid proxy %q: expected a URL like http://proxy:3128", n.Proxy)
+		}
+	}
+	for host, ip := range n.StaticHosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP address %q for static host %s", ip, host)
+		}
+	}
+	if n.CABundle != "" {
+		_, err := n.certPool()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ApplyToEnvironment sets the proxy and CA variables that are understood by
+//most HTTP clients in our own environment, so that they are inherited by all
+//hooks, plugins, helpers and other commands that we execute, as well as by
+//Go's own HTTP client. Variables are only set for configured values.
+func (n NetworkConfiguration) ApplyToEnvironment() {
+	if n.Proxy != "" {
+		for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+			os.Setenv(name, n.Proxy)
+		}
+	}
+	if len(n.NoProxy) > 0 {
+		value := strings.Join(n.NoProxy, ",")
+		os.Setenv("no_proxy", value)
+		os.Setenv("NO_PROXY", value)
+	}
+	if n.CABundle != "" {
+		os.Setenv("SSL_CERT_FILE", n.CABundle)
+		os.Setenv("CURL_CA_BUNDLE", n.CABundle)
+		os.Setenv("REQUESTS_CA_BUNDLE", n.CABundle)
+	}
+}
+
+//HTTPClient returns an HTTP client for the autopilot's own integrations with
+//external services. It uses the configured proxy and CA bundle, and resolves
+//the configured static hosts without DNS (while TLS certificates are still
+//verified against the host name).
+func (n NetworkConfiguration) HTTPClient() (*http.Client, error) {
+	if n.Disabled {
+		return nil, errors.New("network access is disabled")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if n.Proxy != "" {
+		proxyURL, err := url.Parse(n.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		noProxy := n.NoProxy
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			if isNoProxyHost(r.URL.Hostname(), noProxy) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	}
+	if n.CABundle != "" {
+		pool, err := n.certPool()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if len(n.StaticHosts) > 0 {
+		staticHosts := n.StaticHosts
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil {
+				if ip, exists := staticHosts[host]; exists {
+					addr = net.JoinHostPort(ip, port)
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func (n NetworkConfiguration) certPool() (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(n.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA bundle: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, errors.New("no certificates found in CA bundle " + n.CABundle)
+	}
+	return pool, nil
+}
+
+//Checks whether the given host matches one of the no-proxy entries. Like
+//curl, entries are domain names (matching the domain and its subdomains), IP
+//addresses or CIDR ranges, and "*" matches everything.
+func isNoProxyHost(host string, noProxy []string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.TrimPrefix(strings.ToLower(entry), ".")
+		switch {
+		case entry == "*":
+			return true
+		case ip != nil && strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err == nil && ipNet.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		default:
+			host := strings.ToLower(host)
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Returns the features in the configuration that need network access, which
+//may not be configured when the network is disabled.
+func (c Configuration) networkDependentFeatures() []string {
+	var result []string
+	if c.MetricsListenAddress != "" {
+		result = append(result, "metrics-listen-address")
+	}
+	if len(c.MetricsListenAddresses) > 0 {
+		result = append(result, "metrics-listen-addresses")
+	}
+	if c.EnablePprof {
+		result = append(result, "enable-pprof")
+	}
+	for _, p := range c.BlockDeviceProviders() {
+		if p.NeedsNetwork() {
+			result = append(result, p.Name()+" drives")
+		}
+	}
+	for _, key := range c.Keys {
+		if key.Vault != nil {
+			result = append(result, "keys from Vault")
+			break
+		}
+	}
+	for _, key := range c.Keys {
+		if key.Barbican != nil {
+			result = append(result, "keys from Barbican")
+			break
+		}
+	}
+	return result
+}
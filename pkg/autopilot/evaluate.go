@@ -0,0 +1,253 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package autopilot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Inventory describes the drives of a node as found after a reboot, i.e. with
+//nothing mounted and no LUKS containers opened. It is the input to Evaluate(),
+//and is usually recorded from a real node.
+type Inventory struct {
+	Drives []InventoryDrive `json:"drives"`
+}
+
+//InventoryDrive appears in type Inventory.
+type InventoryDrive struct {
+	DevicePath   string `json:"device_path"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	//Encrypted is whether the drive contains a LUKS container. The other fields
+	//then describe the contents of the container.
+	Encrypted bool `json:"encrypted,omitempty"`
+	//Formatted is whether the drive contains a filesystem.
+	Formatted bool `json:"formatted,omitempty"`
+	//SwiftID is the swift-id on the filesystem (if any).
+	SwiftID string `json:"swift_id,omitempty"`
+}
+
+//PlannedAction is an action that a Manager would take, as reported by
+//Evaluate().
+type PlannedAction struct {
+	//Action is e.g. "format", "create-luks-container", "open-luks-container",
+	//"mount" or "write-swift-id".
+	Action string `json:"action"`
+	//Path is the device path or mount path that the action operates on.
+	Path string `json:"path"`
+	//Target is the mount path for "mount", the mapped device path for
+	//"open-luks-container", the detached header (if any) for
+	//"create-luks-container", the swift-id for "write-swift-id" and so on.
+	Target string `json:"target,omitempty"`
+}
+
+//Plan is the result of Evaluate().
+type Plan struct {
+	//Actions are in the order in which they would be taken.
+	Actions []PlannedAction `json:"actions"`
+	//Drives describes the state of the drives after all actions were taken.
+	Drives []DriveStatus `json:"drives"`
+}
+
+//Evaluate computes which actions a Manager with the given options would take
+//on a node with the given inventory, without executing any commands and
+//without touching the filesystem. This allows to validate configuration
+//changes against recorded inventories (e.g. in CI) before rolling them out.
+//WithOS() is ignored, and hooks and post-mount actions are not run.
+//
+//Since per-drive log files are disabled while Evaluate() runs, it must not
+//be called while a Manager is active in the same process.
+func Evaluate(inventory Inventory, options ...Option) (Plan, error) {
+	m := &Manager{}
+	for _, option := range options {
+		option(m)
+	}
+	if err := m.validate(); err != nil {
+		return Plan{}, err
+	}
+
+	fake := os.NewFake()
+	seen := make(map[string]bool)
+	for idx, d := range inventory.Drives {
+		switch {
+		case d.DevicePath == "":
+			return Plan{}, fmt.Errorf("drive #%d in inventory has no device path", idx+1)
+		case seen[d.DevicePath]:
+			return Plan{}, fmt.Errorf("drive %s appears multiple times in inventory", d.DevicePath)
+		case d.SwiftID != "" && !d.Formatted:
+			return Plan{}, fmt.Errorf("drive %s in inventory has a swift-id, but no filesystem", d.DevicePath)
+		}
+		seen[d.DevicePath] = true
+		fake.AddDriveWithContents(d.DevicePath, d.SerialNumber, os.FakeDriveContents{
+			Encrypted: d.Encrypted,
+			Formatted: d.Formatted,
+			SwiftID:   d.SwiftID,
+		})
+	}
+
+	rec := &recordingOS{Interface: fake}
+	m.osi = rec
+	m.scanner = rec.NewDriveScanner(m.driveGlobs)
+	modify := m.driveOptionsFor
+	m.driveOptionsFor = func(drive os.Drive, opts *core.DriveOptions) {
+		if modify != nil {
+			modify(drive, opts)
+		}
+		opts.Hooks = nil
+		opts.PostMountActions = nil
+	}
+
+	util.DriveLogFiles = false
+	defer func() { util.DriveLogFiles = true }()
+	defer func() {
+		for _, d := range m.drives {
+			util.UnregisterDriveLog(d.DriveID)
+		}
+	}()
+
+	err := m.Discover()
+	if err != nil {
+		return Plan{}, err
+	}
+	if len(m.drives) == 0 {
+		return Plan{}, errors.New("no drives in inventory match the drive globs")
+	}
+	m.Converge()
+
+	plan := Plan{Actions: rec.actions, Drives: m.Status()}
+	if plan.Actions == nil {
+		plan.Actions = []PlannedAction{}
+	}
+	return plan, nil
+}
+
+//recordingOS wraps an os.Interface (usually os.Fake) and records all calls that
+//would change something on a real system. Mounts are only recorded for the
+//host mount namespace since each one is mirrored in the local mount namespace.
+type recordingOS struct {
+	os.Interface
+	actions []PlannedAction
+}
+
+func (r *recordingOS) record(action, path, target string) {
+	r.actions = append(r.actions, PlannedAction{action, path, target})
+}
+
+func (r *recordingOS) FormatDevice(devicePath, logDevicePath string, extraArgs []string) bool {
+	r.record("format", devicePath, logDevicePath)
+	return r.Interface.FormatDevice(devicePath, logDevicePath, extraArgs)
+}
+
+func (r *recordingOS) WipeSignatures(devicePath string) bool {
+	r.record("wipe-signatures", devicePath, "")
+	return r.Interface.WipeSignatures(devicePath)
+}
+
+func (r *recordingOS) MountDevice(devicePath, mountPath string, options []string, scope os.MountScope) bool {
+	if scope == os.HostScope {
+		r.record("mount", devicePath, mountPath)
+	}
+	return r.Interface.MountDevice(devicePath, mountPath, options, scope)
+}
+
+func (r *recordingOS) RemountDevice(mountPath string, options []string, scope os.MountScope) bool {
+	if scope == os.HostScope {
+		r.record("remount", mountPath, "")
+	}
+	return r.Interface.RemountDevice(mountPath, options, scope)
+}
+
+func (r *recordingOS) UnmountDevice(mountPath string, scope os.MountScope) bool {
+	if scope == os.HostScope {
+		r.record("unmount", mountPath, "")
+	}
+	return r.Interface.UnmountDevice(mountPath, scope)
+}
+
+func (r *recordingOS) CreateLUKSContainer(devicePath, headerPath string, key os.LUKSKey, options os.LUKSFormatOptions) bool {
+	r.record("create-luks-container", devicePath, headerPath)
+	return r.Interface.CreateLUKSContainer(devicePath, headerPath, key, options)
+}
+
+func (r *recordingOS) EncryptDeviceInPlace(devicePath, headerPath string, key os.LUKSKey, options os.LUKSFormatOptions) bool {
+	r.record("encrypt-device-in-place", devicePath, headerPath)
+	return r.Interface.EncryptDeviceInPlace(devicePath, headerPath, key, options)
+}
+
+func (r *recordingOS) OpenLUKSContainer(devicePath, headerPath, mappingName string, keys []os.LUKSKey, readOnly bool) (string, bool, bool) {
+	mappedDevicePath, keysRejected, ok := r.Interface.OpenLUKSContainer(devicePath, headerPath, mappingName, keys, readOnly)
+	r.record("open-luks-container", devicePath, mappedDevicePath)
+	return mappedDevicePath, keysRejected, ok
+}
+
+func (r *recordingOS) OpenPlainCryptMapping(devicePath, mappingName string, key os.LUKSKey, options os.PlainCryptOptions, readOnly bool) (string, bool) {
+	mappedDevicePath, ok := r.Interface.OpenPlainCryptMapping(devicePath, mappingName, key, options, readOnly)
+	r.record("open-plain-crypt-mapping", devicePath, mappedDevicePath)
+	return mappedDevicePath, ok
+}
+
+func (r *recordingOS) ConvertLUKSContainer(devicePath string) bool {
+	r.record("convert-luks-container", devicePath, "")
+	return r.Interface.ConvertLUKSContainer(devicePath)
+}
+
+func (r *recordingOS) AddLUKSKey(devicePath string, existingKey, newKey os.LUKSKey) bool {
+	r.record("add-luks-key", devicePath, "")
+	return r.Interface.AddLUKSKey(devicePath, existingKey, newKey)
+}
+
+func (r *recordingOS) RemoveLUKSKeyslot(devicePath string, slot int, key os.LUKSKey) bool {
+	r.record("remove-luks-keyslot", devicePath, fmt.Sprintf("%d", slot))
+	return r.Interface.RemoveLUKSKeyslot(devicePath, slot, key)
+}
+
+func (r *recordingOS) BackupLUKSHeader(devicePath, backupPath string) bool {
+	r.record("backup-luks-header", devicePath, backupPath)
+	return r.Interface.BackupLUKSHeader(devicePath, backupPath)
+}
+
+func (r *recordingOS) CloseLUKSContainer(mappingName string) bool {
+	r.record("close-luks-container", "/dev/mapper/"+mappingName, "")
+	return r.Interface.CloseLUKSContainer(mappingName)
+}
+
+func (r *recordingOS) CreateBcacheDevice(backingDevicePath, cacheDevicePath string) (string, bool) {
+	r.record("create-bcache-device", backingDevicePath, cacheDevicePath)
+	return r.Interface.CreateBcacheDevice(backingDevicePath, cacheDevicePath)
+}
+
+func (r *recordingOS) WriteSwiftID(mountPath, swiftID string) error {
+	r.record("write-swift-id", mountPath, swiftID)
+	return r.Interface.WriteSwiftID(mountPath, swiftID)
+}
+
+func (r *recordingOS) WriteSwiftIDChecksum(mountPath string) error {
+	r.record("write-swift-id-checksum", mountPath, "")
+	return r.Interface.WriteSwiftIDChecksum(mountPath)
+}
+
+func (r *recordingOS) WriteLayoutVersion(mountPath string, version int) error {
+	r.record("write-layout-version", mountPath, fmt.Sprintf("%d", version))
+	return r.Interface.WriteLayoutVersion(mountPath, version)
+}
@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package autopilot
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(logOutput)
+
+	inventory := Inventory{Drives: []InventoryDrive{
+		{DevicePath: "/dev/sda", SerialNumber: "SERIAL1"},
+		{DevicePath: "/dev/sdb", SerialNumber: "SERIAL2", Encrypted: true, Formatted: true, SwiftID: "swift2"},
+		{DevicePath: "/dev/vda", SerialNumber: "SERIAL3"},
+	}}
+	plan, err := Evaluate(inventory,
+		WithDriveGlobs("/dev/sd*"),
+		WithSwiftIDPool("swift1", "swift2"),
+		WithKeys("secret"),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expectedSwiftIDs := map[string]string{"/dev/sda": "swift1", "/dev/sdb": "swift2"}
+	if len(plan.Drives) != len(expectedSwiftIDs) {
+		t.Fatalf("expected %d drives, got %d", len(expectedSwiftIDs), len(plan.Drives))
+	}
+	for _, ds := range plan.Drives {
+		if ds.SwiftID != expectedSwiftIDs[ds.DevicePath] {
+			t.Errorf("expected swift-id %q for %s, got %q", expectedSwiftIDs[ds.DevicePath], ds.DevicePath, ds.SwiftID)
+		}
+	}
+
+	//only the empty drive shall be formatted
+	formatted := make(map[string]bool)
+	for _, a := range plan.Actions {
+		if a.Action == "create-luks-container" || a.Action == "format" {
+			formatted[a.Path] = true
+		}
+	}
+	for _, path := range []string{"/dev/sda", "/dev/mapper/SERIAL1"} {
+		if !formatted[path] {
+			t.Errorf("expected %s to be formatted", path)
+		}
+	}
+	if len(formatted) != 2 {
+		t.Errorf("expected 2 devices to be formatted, got %v", formatted)
+	}
+}
+
+func TestEvaluateRejectsInvalidInventory(t *testing.T) {
+	inventory := Inventory{Drives: []InventoryDrive{
+		{DevicePath: "/dev/sda", SwiftID: "swift1"},
+	}}
+	_, err := Evaluate(inventory, WithDriveGlobs("/dev/sd*"))
+	if err == nil {
+		t.Error("expected error for swift-id without filesystem")
+	}
+}
+
+func TestEvaluateWithDriveManifest(t *testing.T) {
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(logOutput)
+
+	inventory := Inventory{Drives: []InventoryDrive{
+		{DevicePath: "/dev/sda", SerialNumber: "SERIAL1"},
+		{DevicePath: "/dev/sdb", SerialNumber: "SERIAL2"},
+	}}
+	plan, err := Evaluate(inventory,
+		WithDriveGlobs("/dev/sd*"),
+		WithDriveManifest("SERIAL1"),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(plan.Drives) != 2 {
+		t.Fatalf("expected 2 drives, got %d", len(plan.Drives))
+	}
+
+	//the drive that is not listed in the manifest shall not be formatted
+	for _, a := range plan.Actions {
+		if a.Action == "format" && a.Path != "/dev/sda" {
+			t.Errorf("expected only /dev/sda to be formatted, but %s is formatted too", a.Path)
+		}
+	}
+	for _, ds := range plan.Drives {
+		if ds.DevicePath == "/dev/sda" && ds.MountPath == "" {
+			t.Error("expected /dev/sda to be mounted")
+		}
+		if ds.DevicePath == "/dev/sdb" && ds.MountPath != "" {
+			t.Errorf("expected /dev/sdb not to be mounted, but it is mounted at %s", ds.MountPath)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package autopilot provides drive management as a library, for programs that
+//want to embed it (e.g. node agents of Kubernetes operators) instead of
+//running the swift-drive-autopilot binary. Unlike the binary, a Manager does
+//not run on its own: The caller decides when to look for drives and when to
+//converge them.
+//
+//Like the binary, a Manager executes commands in the chroot at the current
+//working directory of the process, and may exit the process on fatal errors.
+package autopilot
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Manager manages a set of drives. All its methods may be called from
+//multiple goroutines, but only one of them runs at a time.
+type Manager struct {
+	osi          os.Interface
+	driveGlobs   []string
+	swiftIDPool  []string
+	driveOptions core.DriveOptions
+	//optional, see WithDriveOptionsFor
+	driveOptionsFor func(os.Drive, *core.DriveOptions)
+	safeguards      core.Safeguards
+	//drive ID -> UUID of the filesystem that was last seen on it (nil unless
+	//WithFilesystemUUIDs is given)
+	filesystemUUIDs map[string]string
+
+	mutex   sync.Mutex
+	scanner os.DriveScanner
+	drives  []*core.Drive
+}
+
+//Option is an optional argument to New().
+type Option func(*Manager)
+
+//WithOS sets the OS interface used by the manager. The default is
+//os.NewLinux().
+func WithOS(osi os.Interface) Option {
+	return func(m *Manager) { m.osi = osi }
+}
+
+//WithDriveGlobs sets the globs that are used to find drives. This option is
+//required.
+func WithDriveGlobs(globs ...string) Option {
+	return func(m *Manager) { m.driveGlobs = append(m.driveGlobs, globs...) }
+}
+
+//WithSwiftIDPool sets the swift-ids that may be auto-assigned to drives (see
+//`swift-id-pool` in the README).
+func WithSwiftIDPool(swiftIDs ...string) Option {
+	return func(m *Manager) { m.swiftIDPool = append(m.swiftIDPool, swiftIDs...) }
+}
+
+//WithKeys sets the LUKS encryption keys. When creating new LUKS containers,
+//the first key is used.
+func WithKeys(keys ...string) Option {
+	return func(m *Manager) {
+		for _, key := range keys {
+			m.driveOptions.Keys = append(m.driveOptions.Keys, os.LUKSKey{Secret: key})
+		}
+	}
+}
+
+//WithMountOptions sets the options that are given to mount(8).
+func WithMountOptions(options ...string) Option {
+	return func(m *Manager) { m.driveOptions.MountOptions = append(m.driveOptions.MountOptions, options...) }
+}
+
+//WithFormatOptions sets the options that are given to mkfs.xfs.
+func WithFormatOptions(options ...string) Option {
+	return func(m *Manager) { m.driveOptions.FormatOptions = append(m.driveOptions.FormatOptions, options...) }
+}
+
+//WithHooks sets the hooks that run around the individual steps of the drive
+//setup.
+func WithHooks(hooks core.Hooks) Option {
+	return func(m *Manager) { m.driveOptions.Hooks = hooks }
+}
+
+//WithPostMountAction adds an action that is called whenever a drive has been
+//mounted below /srv/node.
+func WithPostMountAction(action core.PostMountAction) Option {
+	return func(m *Manager) { m.driveOptions.PostMountActions = append(m.driveOptions.PostMountActions, action) }
+}
+
+//WithReadOnly makes the manager open and mount all drives read-only, and
+//never format anything (like the `recovery` option of the binary).
+func WithReadOnly() Option {
+	return func(m *Manager) { m.driveOptions.ReadOnly = true }
+}
+
+//WithDriveManifest restricts formatting to the drives with the given IDs
+//(usually serial numbers) like the `drive-manifest` option of the binary.
+//Other drives are still set up if they contain a filesystem already.
+func WithDriveManifest(driveIDs ...string) Option {
+	return func(m *Manager) {
+		if m.safeguards.ExpectedDriveIDs == nil {
+			m.safeguards.ExpectedDriveIDs = make(map[string]bool)
+		}
+		for _, driveID := range driveIDs {
+			m.safeguards.ExpectedDriveIDs[driveID] = true
+		}
+	}
+}
+
+//WithDeviceLocking makes the manager hold an advisory lock on each drive while
+//setting it up, like the `device-locking` option of the binary. Drives that
+//are locked by other processes for longer than the given timeout are skipped
+//until the next Converge().
+func WithDeviceLocking(timeout time.Duration) Option {
+	return func(m *Manager) { m.safeguards.DeviceLockTimeout = timeout }
+}
+
+//WithFilesystemUUIDs enables the verification of filesystem UUIDs like the
+//`verify-filesystem-uuid` option of the binary: A drive that turns out to
+//contain a different filesystem than the one last seen on it is not mounted
+//below /srv/node until it is adopted (see Adopt). The given map (drive ID ->
+//filesystem UUID, e.g. from a previous Status()) may be empty, in which case
+//only the filesystems seen by this manager are verified.
+func WithFilesystemUUIDs(uuids map[string]string) Option {
+	return func(m *Manager) {
+		m.filesystemUUIDs = make(map[string]string, len(uuids))
+		for driveID, uuid := range uuids {
+			m.filesystemUUIDs[driveID] = uuid
+		}
+	}
+}
+
+//WithDriveOptions allows to modify all other options for new drives.
+func WithDriveOptions(modify func(*core.DriveOptions)) Option {
+	return func(m *Manager) { modify(&m.driveOptions) }
+}
+
+//WithDriveOptionsFor allows to modify the options for each new drive
+//individually (e.g. to choose mount options by serial number). The given
+//function is called with a copy of the options that result from all other
+//Options.
+func WithDriveOptionsFor(modify func(drive os.Drive, opts *core.DriveOptions)) Option {
+	return func(m *Manager) { m.driveOptionsFor = modify }
+}
+
+//New initializes a Manager. No drives are touched until Discover() and
+//Converge() are called.
+func New(options ...Option) (*Manager, error) {
+	m := &Manager{}
+	for _, option := range options {
+		option(m)
+	}
+
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	if m.osi == nil {
+		osi, err := os.NewLinux()
+		if err != nil {
+			return nil, err
+		}
+		m.osi = osi
+	}
+	m.scanner = m.osi.NewDriveScanner(m.driveGlobs)
+
+	//prepare directories that the drives want to write to
+	_, ok := command.Run("mkdir", "-p",
+		"/run/swift-storage/broken",
+		util.DriveLogDirectory,
+		"/run/swift-storage/state/unmount-propagation",
+	)
+	if !ok {
+		return nil, errors.New("cannot create directories in /run/swift-storage")
+	}
+	return m, nil
+}
+
+//Checks the options given to New() or Evaluate().
+func (m *Manager) validate() error {
+	if len(m.driveGlobs) == 0 {
+		return errors.New("no drive globs given")
+	}
+	for _, pattern := range m.driveGlobs {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.New("invalid drive glob " + pattern + ": " + err.Error())
+		}
+	}
+	return m.driveOptions.Hooks.Validate()
+}
+
+//Discover looks for drives that have been added or removed since the last
+//call. Removed drives are torn down, while added drives are only set up by
+//the next Converge().
+func (m *Manager) Discover() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	added, removed, err := m.scanner.Scan()
+	if err != nil {
+		return err
+	}
+
+	m.osi.RefreshMountPoints()
+	m.osi.RefreshLUKSMappings()
+
+	for _, devicePath := range removed {
+		var remaining []*core.Drive
+		for _, d := range m.drives {
+			if d.DevicePath == devicePath {
+				d.Teardown(m.osi)
+				util.UnregisterDriveLog(d.DriveID)
+			} else {
+				remaining = append(remaining, d)
+			}
+		}
+		m.drives = remaining
+	}
+
+	for _, drive := range added {
+		opts := m.driveOptions
+		if m.driveOptionsFor != nil {
+			m.driveOptionsFor(drive, &opts)
+		}
+		d := core.NewDrive(drive.DevicePath, drive.BackingDevicePath, drive.SerialNumber, opts, m.osi)
+		m.safeguards.Protect(d, m.filesystemUUIDs[d.DriveID])
+		d.RunAfterDiscoveryHook()
+		m.drives = append(m.drives, d)
+	}
+	sort.SliceStable(m.drives, func(i, j int) bool {
+		return m.drives[i].DevicePath < m.drives[j].DevicePath
+	})
+	return nil
+}
+
+//Converge sets up all drives that are not broken: LUKS containers are
+//created and opened, filesystems are created and mounted, and swift-ids are
+//assigned from the pool where necessary. Drives that fail are marked as
+//broken. Drives that are locked by other processes (see WithDeviceLocking)
+//are skipped.
+func (m *Manager) Converge() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.osi.RefreshMountPoints()
+	m.osi.RefreshLUKSMappings()
+
+	for _, d := range m.drives {
+		m.convergeDrive(d)
+	}
+	core.UpdateDriveAssignments(m.drives, m.swiftIDPool, m.osi)
+	for _, d := range m.drives {
+		if !d.Broken && !d.LockedElsewhere {
+			m.convergeDrive(d) //to reflect updated drive assignments
+		}
+	}
+}
+
+func (m *Manager) convergeDrive(d *core.Drive) {
+	err := m.safeguards.Converge(m.osi, d)
+	if err != nil {
+		util.LogInfo("skipping %s for now: %s", d.DevicePath, err.Error())
+		return
+	}
+	if m.filesystemUUIDs != nil && d.ExpectedFilesystemUUID != "" {
+		m.filesystemUUIDs[d.DriveID] = d.ExpectedFilesystemUUID
+	}
+}
+
+//Adopt accepts the filesystem that is currently on the given drive as the
+//expected one (see WithFilesystemUUIDs), so that the next Converge() mounts
+//it below /srv/node again.
+func (m *Manager) Adopt(driveID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, d := range m.drives {
+		if d.DriveID == driveID {
+			d.Adopt()
+			if m.filesystemUUIDs != nil && d.ExpectedFilesystemUUID != "" {
+				m.filesystemUUIDs[d.DriveID] = d.ExpectedFilesystemUUID
+			}
+			return nil
+		}
+	}
+	return errors.New("no such drive: " + driveID)
+}
+
+//Teardown unmounts all drives and closes their LUKS containers. The drives
+//remain known to the manager, so a later Converge() will set them up again.
+func (m *Manager) Teardown() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.osi.RefreshMountPoints()
+	m.osi.RefreshLUKSMappings()
+
+	for _, d := range m.drives {
+		d.Teardown(m.osi)
+	}
+}
+
+//DriveStatus describes a drive that is known to the manager.
+type DriveStatus struct {
+	DriveID           string             `json:"id"`
+	DevicePath        string             `json:"device_path"`
+	BackingDevicePath string             `json:"backing_device_path,omitempty"`
+	MountPath         string             `json:"mount_path,omitempty"`
+	SwiftID           string             `json:"swift_id,omitempty"`
+	AssignmentError   string             `json:"assignment_error,omitempty"`
+	Broken            bool               `json:"broken"`
+	Foreign           bool               `json:"foreign,omitempty"`
+	LockedElsewhere   bool               `json:"locked_elsewhere,omitempty"`
+	FilesystemUUID    string             `json:"filesystem_uuid,omitempty"`
+	NeedsAdoption     bool               `json:"needs_adoption,omitempty"`
+	Layers            []string           `json:"layers,omitempty"`
+	Topology          *os.TopologyHints  `json:"topology,omitempty"`
+	Firmware          *os.FirmwareInfo   `json:"firmware,omitempty"`
+	LUKSHeader        *os.LUKSHeaderInfo `json:"luks_header,omitempty"`
+	LayoutVersion     int                `json:"layout_version,omitempty"`
+}
+
+//Status describes all drives that are known to the manager. The result does
+//not share any memory with the manager's state.
+func (m *Manager) Status() []DriveStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]DriveStatus, 0, len(m.drives))
+	for _, d := range m.drives {
+		ds := DriveStatus{
+			DriveID:           d.DriveID,
+			DevicePath:        d.DevicePath,
+			BackingDevicePath: d.BackingDevicePath,
+			MountPath:         d.MountedPath(),
+			Broken:            d.Broken,
+			Foreign:           d.Foreign,
+			LockedElsewhere:   d.LockedElsewhere,
+			FilesystemUUID:    d.FilesystemUUID,
+			NeedsAdoption:     d.NeedsAdoption(),
+			Layers:            d.DeviceLayers(),
+			LayoutVersion:     d.LayoutVersion,
+		}
+		if d.Topology != nil {
+			topology := *d.Topology
+			topology.IRQs = append([]os.IRQHint(nil), topology.IRQs...)
+			ds.Topology = &topology
+		}
+		if d.Firmware != nil {
+			firmware := *d.Firmware
+			ds.Firmware = &firmware
+		}
+		if d.LUKSHeader != nil {
+			header := *d.LUKSHeader
+			header.UsedKeyslots = append([]int(nil), header.UsedKeyslots...)
+			ds.LUKSHeader = &header
+		}
+		if a := d.Assignment; a != nil {
+			if a.Error == "" {
+				ds.SwiftID = a.SwiftID
+			} else {
+				ds.AssignmentError = a.ErrorMessage(d)
+			}
+		}
+		result = append(result, ds)
+	}
+	return result
+}
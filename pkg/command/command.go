@@ -21,14 +21,43 @@ package command
 
 import (
 	"bytes"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
+//Maps command names to the chroot directory (as a path inside the main
+//chroot) in which they shall be executed instead of the main chroot.
+var chrootRoutes map[string]string
+
+//SetChrootRoutes configures commands to be executed in a different chroot
+//than the main chroot. The keys are command names (e.g. "cryptsetup"), the
+//values are chroot directories (as absolute paths inside the main chroot).
+//This must be called before any commands are executed.
+func SetChrootRoutes(routes map[string]string) {
+	chrootRoutes = routes
+}
+
+//EntersHostMountNamespace returns whether the given command is executed in
+//the mount namespace of PID 1 (unless Command.NoNsenter is set). Since that
+//resets the root directory, a chroot that such a command is routed into (see
+//SetChrootRoutes) is entered from the host's root filesystem instead of from
+//the main chroot.
+func EntersHostMountNamespace(cmdName string) bool {
+	switch cmdName {
+	case "mount", "umount", "cryptsetup":
+		return true
+	default:
+		return false
+	}
+}
+
 //Run is a shortcut for Command.Run() that just takes a command line.
 func Run(cmd ...string) (string, bool) {
 	return Command{}.Run(cmd...)
@@ -41,29 +70,96 @@ type Command struct {
 	SkipLog     bool
 	NoNsenter   bool
 	ExitOnError bool
+	//Env contains additional environment variables for the command (in the
+	//form "KEY=value"). They are set with env(1) inside the chroot, so that
+	//they survive sudo.
+	Env []string
+	//CleanEnv causes the command to not inherit the environment of the
+	//autopilot (which may contain secrets), so that only Env is set.
+	CleanEnv bool
+	//SecretOutput causes stdout to never be logged (not even in debug mode or
+	//in the per-drive logs) since it contains secrets.
+	SecretOutput bool
+	//Timeout, if not zero, is the time after which the command is killed.
+	Timeout time.Duration
+	//Retry overrides DefaultRetryPolicy for this command.
+	Retry *RetryPolicy
 }
 
 //Run executes the given command, possibly within the chroot (if
 //configured in Config.ChrootPath, and if the first argument is true).
 func (c Command) Run(cmd ...string) (stdout string, success bool) {
+	stdout, err := c.run(cmd)
+	return stdout, err == nil
+}
+
+//RunForExitCode is like Run, but returns the exit code of the command instead
+//of just whether it succeeded. The exit code is -1 if the command did not exit
+//by itself (e.g. because it could not be started, or was killed after its
+//Timeout).
+func (c Command) RunForExitCode(cmd ...string) (stdout string, exitCode int) {
+	stdout, err := c.run(cmd)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return stdout, 0
+	case errors.As(err, &exitErr):
+		return stdout, exitErr.ExitCode()
+	default:
+		return stdout, -1
+	}
+}
+
+func (c Command) run(cmd []string) (stdout string, err error) {
 	cmdName := cmd[0]
+	origCmd := cmd
+	class := ClassifyOperation(cmd)
+	phase := phaseOf(cmd)
 
 	//if we are executing mount, we need to make sure that we are in the
 	//correct mount namespace; for cryptsetup, we even need to be in the
 	//correct IPC namespace (device-mapper wants to talk to udev)
-	if !c.NoNsenter {
-		switch cmd[0] {
-		case "mount", "umount":
-			cmd = append([]string{"nsenter", "--mount=/proc/1/ns/mnt", "--"}, cmd...)
-		case "cryptsetup":
-			cmd = append([]string{"nsenter", "--mount=/proc/1/ns/mnt", "--ipc=/proc/1/ns/ipc", "--"}, cmd...)
+	var nsenter []string
+	if !c.NoNsenter && EntersHostMountNamespace(cmd[0]) {
+		nsenter = []string{"nsenter", "--mount=/proc/1/ns/mnt", "--"}
+		if cmd[0] == "cryptsetup" {
+			nsenter = []string{"nsenter", "--mount=/proc/1/ns/mnt", "--ipc=/proc/1/ns/ipc", "--"}
 		}
 	}
 
+	//some commands may be routed into a different chroot (see SetChrootRoutes);
+	//since entering the host mount namespace resets the root directory, the
+	//routed chroot needs to be entered after nsenter in that case
+	routedChroot := ""
+	if !c.NoChroot {
+		routedChroot = chrootRoutes[cmd[0]]
+	}
+	if routedChroot != "" && len(nsenter) > 0 {
+		cmd = append([]string{"chroot", routedChroot}, cmd...)
+	}
+	cmd = append(nsenter, cmd...)
+
+	if len(c.Env) > 0 || c.CleanEnv {
+		envCmd := []string{"env"}
+		if c.CleanEnv {
+			envCmd = append(envCmd, "-i")
+		}
+		cmd = append(append(envCmd, c.Env...), cmd...)
+	}
+
 	//prepend chroot if requested (note that if there is a ChrootPath, it's our
 	//cwd; and if there is none, our cwd is /, so this is a no-op)
 	if !c.NoChroot {
-		cmd = append([]string{"chroot", "."}, cmd...)
+		root := "."
+		if routedChroot != "" && len(nsenter) == 0 {
+			root = strings.TrimPrefix(routedChroot, "/")
+		}
+		cmd = append([]string{"chroot", root}, cmd...)
+	}
+
+	//lower the priority of heavy and background operations if requested
+	if prefix := priorityPrefix(class); len(prefix) > 0 {
+		cmd = append(prefix, cmd...)
 	}
 
 	//become root if necessary (useful for development mode)
@@ -71,39 +167,157 @@ func (c Command) Run(cmd ...string) (stdout string, success bool) {
 		cmd = append([]string{"sudo"}, cmd...)
 	}
 
+	policy := DefaultRetryPolicy
+	if c.Retry != nil {
+		policy = *c.Retry
+	}
+
+	cmdForLog := strings.Join(cmd, " ")
+	var stderr string
+	for attempt := 0; ; attempt++ {
+		release := acquireSlot(class)
+		startedAt := time.Now()
+		var stopProgress func()
+		if class != LightOperation {
+			stopProgress = util.StreamProgress("exec(" + cmdForLog + ")")
+		}
+		stdout, stderr, err = c.executeWithFaults(origCmd, cmd)
+		if stopProgress != nil {
+			stopProgress()
+		}
+		util.RecordTiming(phase, cmdForLog, startedAt, err == nil)
+		if util.IsDebug() {
+			util.LogDebug("exec(%s) finished with %s after %s", cmdForLog, exitStatusOf(err), time.Since(startedAt).String())
+		}
+		release()
+		if c.SecretOutput {
+			captureForDrives(cmdForLog, "", stderr, err)
+		} else {
+			captureForDrives(cmdForLog, stdout, stderr, err)
+		}
+		if !c.SkipLog {
+			for _, line := range strings.Split(stderr, "\n") {
+				if line != "" {
+					util.Print(fmt.Sprintf("Output from %s: %s", cmdName, line))
+				}
+			}
+		}
+
+		//retry only if the error looks like it could go away by itself
+		if err == nil || attempt >= policy.Count || policy.Classify(stderr) != TransientError {
+			break
+		}
+		backoff := policy.BackoffFor(attempt)
+		if !c.SkipLog {
+			util.LogInfo("exec(%s) failed with a transient error, retrying in %s (retry %d of %d)",
+				cmdForLog, backoff.String(), attempt+1, policy.Count)
+		}
+		time.Sleep(backoff)
+	}
+
+	if err != nil && !c.SkipLog {
+		logLevel := util.LogError
+		if c.ExitOnError {
+			logLevel = util.LogFatal
+		}
+		logLevel("exec(%s) failed: %s", cmdForLog, err.Error())
+	}
+
+	if !c.SecretOutput {
+		for _, line := range strings.Split(stdout, "\n") {
+			if strings.TrimSpace(line) != "" {
+				util.LogDebug("exec(%s) produced stdout: %s", cmdForLog, line)
+			}
+		}
+	}
+	return stdout, err
+}
+
+//Describes how a command exited (e.g. "exit status 1" or "signal: killed"),
+//for debug logging.
+func exitStatusOf(err error) string {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "exit status 0"
+	case errors.As(err, &exitErr):
+		return exitErr.String()
+	default:
+		return "error: " + err.Error()
+	}
+}
+
+//Returns the phase name for the given command line (without any
+//chroot/nsenter/sudo prefixes), for use with util.RecordTiming().
+func phaseOf(cmd []string) string {
+	switch cmd[0] {
+	case "file":
+		return "classify"
+	case "cryptsetup":
+		if len(cmd) > 1 {
+			return cmd[1]
+		}
+	case "udevadm":
+		return "udev-settle"
+	case "xfs_repair", "fsck", "fsck.xfs":
+		return "fsck"
+	}
+	return cmd[0]
+}
+
+func (c Command) execute(cmd []string) (stdout, stderr string, err error) {
 	stdoutBuf := bytes.NewBuffer(nil)
 	stderrBuf := bytes.NewBuffer(nil)
 
 	util.LogDebug("executing command: %v", cmd)
-	execCmd := exec.Command(cmd[0], cmd[1:]...)
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	execCmd := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
 	execCmd.Stdout = stdoutBuf
 	execCmd.Stderr = stderrBuf
 	if c.Stdin != "" {
 		execCmd.Stdin = bytes.NewReader([]byte(c.Stdin))
 	}
-	err := execCmd.Run()
-
-	cmdForLog := strings.Join(cmd, " ")
-	if !c.SkipLog {
-		for _, line := range strings.Split(stderrBuf.String(), "\n") {
-			if line != "" {
-				log.Printf("Output from %s: %s\n", cmdName, line)
-			}
-		}
-		if err != nil {
-			logLevel := util.LogError
-			if c.ExitOnError {
-				logLevel = util.LogFatal
-			}
-			logLevel("exec(%s) failed: %s", cmdForLog, err.Error())
-		}
+	err = execCmd.Start()
+	if err != nil {
+		return "", "", err
 	}
+	//Go cannot start the process directly in the cgroup, so it is moved right
+	//after it has been started (the wrapper commands like chroot or nice are
+	//usually still running at this point)
+	if cgErr := moveIntoCgroup(execCmd.Process.Pid); cgErr != nil {
+		util.LogError("cannot move process %d into cgroup: %s", execCmd.Process.Pid, cgErr.Error())
+	}
+	err = execCmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", c.Timeout)
+	}
+	return stdoutBuf.String(), stderrBuf.String(), err
+}
 
-	stdout = stdoutBuf.String()
+//Copies the command and its results into the per-drive logs of all drives
+//that are mentioned in the command line. (We cannot rely on the per-drive log
+//capturing in package util for this because successful commands and their
+//stdout are usually not logged at all.)
+func captureForDrives(cmdForLog, stdout, stderr string, err error) {
+	util.CaptureForDrives("executing command: " + cmdForLog)
 	for _, line := range strings.Split(stdout, "\n") {
 		if strings.TrimSpace(line) != "" {
-			util.LogDebug("exec(%s) produced stdout: %s", cmdForLog, line)
+			util.CaptureForDrives(fmt.Sprintf("exec(%s) produced stdout: %s", cmdForLog, line))
 		}
 	}
-	return stdout, err == nil
+	for _, line := range strings.Split(stderr, "\n") {
+		if strings.TrimSpace(line) != "" {
+			util.CaptureForDrives(fmt.Sprintf("exec(%s) produced stderr: %s", cmdForLog, line))
+		}
+	}
+	if err == nil {
+		util.CaptureForDrives(fmt.Sprintf("exec(%s) succeeded", cmdForLog))
+	} else {
+		util.CaptureForDrives(fmt.Sprintf("exec(%s) failed: %s", cmdForLog, err.Error()))
+	}
 }
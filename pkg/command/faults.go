@@ -0,0 +1,164 @@
+//go:build faultinjection
+// +build faultinjection
+
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//FaultScenarioEnvVar is the environment variable that contains the path to a
+//fault scenario file. Fault injection is meant for resilience testing only.
+//It is only compiled in with the build tag "faultinjection" (see nofaults.go),
+//and is disabled unless this variable is set.
+const FaultScenarioEnvVar = "SWIFT_DRIVE_AUTOPILOT_FAULTS"
+
+//Fault describes a fault that is injected into matching commands.
+type Fault struct {
+	//Command is the name of the command (e.g. "cryptsetup"). If Match is given,
+	//the command line (without chroot, nsenter or sudo prefixes) must also
+	//match this regex.
+	Command string `yaml:"command"`
+	Match   string `yaml:"match"`
+	//Action is "fail" (do not run the command and report an error instead),
+	//"delay" (run the command after Delay) or "corrupt" (run the command, but
+	//replace its stdout with Stdout, or truncate it if Stdout is empty).
+	Action string        `yaml:"action"`
+	Delay  time.Duration `yaml:"delay"`
+	Stdout string        `yaml:"stdout"`
+	Stderr string        `yaml:"stderr"`
+	//Skip is the number of matching commands that are left alone before the
+	//fault is injected. Count limits how often it is injected (0 means always).
+	Skip  int `yaml:"skip"`
+	Count int `yaml:"count"`
+
+	rx      *regexp.Regexp
+	matches int
+}
+
+var (
+	faults      []*Fault
+	faultsMutex sync.Mutex
+)
+
+func init() {
+	path := os.Getenv(FaultScenarioEnvVar)
+	if path == "" {
+		return
+	}
+	err := loadFaultScenario(path)
+	if err != nil {
+		util.LogFatal("cannot load fault scenario from %s: %s", path, err.Error())
+	}
+	util.LogInfo("fault injection: loaded %d faults from %s", len(faults), path)
+}
+
+func loadFaultScenario(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var scenario struct {
+		Faults []*Fault `yaml:"faults"`
+	}
+	err = yaml.UnmarshalStrict(buf, &scenario)
+	if err != nil {
+		return err
+	}
+	for idx, f := range scenario.Faults {
+		if f.Command == "" {
+			return fmt.Errorf("fault #%d: missing command", idx+1)
+		}
+		switch f.Action {
+		case "fail", "delay", "corrupt":
+		default:
+			return fmt.Errorf("fault #%d: unknown action %q", idx+1, f.Action)
+		}
+		if f.Match != "" {
+			f.rx, err = regexp.Compile(f.Match)
+			if err != nil {
+				return fmt.Errorf("fault #%d: %s", idx+1, err.Error())
+			}
+		}
+	}
+	faults = scenario.Faults
+	return nil
+}
+
+//Returns the fault that shall be injected into the given command line, if
+//any. Each call counts as one execution of the command.
+func findFault(cmd []string) *Fault {
+	if len(faults) == 0 {
+		return nil
+	}
+	cmdLine := strings.Join(cmd, " ")
+
+	faultsMutex.Lock()
+	defer faultsMutex.Unlock()
+	for _, f := range faults {
+		if f.Command != cmd[0] || (f.rx != nil && !f.rx.MatchString(cmdLine)) {
+			continue
+		}
+		f.matches++
+		if f.matches <= f.Skip || (f.Count > 0 && f.matches > f.Skip+f.Count) {
+			continue
+		}
+		return f
+	}
+	return nil
+}
+
+//Like execute(), but injects a fault if the fault scenario says so. The
+//origCmd is the command line without any prefixes.
+func (c Command) executeWithFaults(origCmd, cmd []string) (stdout, stderr string, err error) {
+	f := findFault(origCmd)
+	if f == nil {
+		return c.execute(cmd)
+	}
+	util.LogInfo("fault injection: %s on exec(%s)", f.Action, strings.Join(origCmd, " "))
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+
+	switch f.Action {
+	case "fail":
+		return f.Stdout, f.Stderr, errors.New("exit status 1 (injected fault)")
+	case "corrupt":
+		stdout, stderr, err = c.execute(cmd)
+		if f.Stdout != "" {
+			return f.Stdout, stderr, err
+		}
+		return stdout[:len(stdout)/2], stderr, err
+	default: //"delay"
+		return c.execute(cmd)
+	}
+}
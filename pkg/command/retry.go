@@ -0,0 +1,90 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package command
+
+import (
+	"regexp"
+	"time"
+)
+
+//ErrorClass describes whether a failed command is worth retrying.
+type ErrorClass int
+
+const (
+	//PermanentError is the ErrorClass for errors that will most likely occur
+	//again when the command is retried.
+	PermanentError ErrorClass = iota
+	//TransientError is the ErrorClass for errors that are known to go away after
+	//a while, e.g. when a device is still busy because udev is processing it.
+	TransientError
+)
+
+//DefaultTransientErrorPatterns is used by RetryPolicy.Classify() when the
+//policy does not specify its own patterns.
+var DefaultTransientErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)device or resource busy`),
+	regexp.MustCompile(`(?i)resource temporarily unavailable`),
+}
+
+//RetryPolicy describes how Command.Run() retries failed commands.
+type RetryPolicy struct {
+	//Count is the maximum number of retries. 0 disables retrying.
+	Count int
+	//Backoff is the delay before the first retry. It is doubled for each
+	//following retry.
+	Backoff time.Duration
+	//Patterns are matched against the stderr of failed commands. Only if one of
+	//them matches is the error considered transient. If empty,
+	//DefaultTransientErrorPatterns is used.
+	Patterns []*regexp.Regexp
+}
+
+//DefaultRetryPolicy is used by Command.Run() unless the Command has its own
+//Retry policy. By default, commands are not retried at all. loadConfiguration()
+//in package main fills this from the configuration before anything else runs.
+var DefaultRetryPolicy RetryPolicy
+
+//Classify decides whether a command that failed with the given stderr shall
+//be retried.
+func (p RetryPolicy) Classify(stderr string) ErrorClass {
+	patterns := p.Patterns
+	if len(patterns) == 0 {
+		patterns = DefaultTransientErrorPatterns
+	}
+	for _, rx := range patterns {
+		if rx.MatchString(stderr) {
+			return TransientError
+		}
+	}
+	return PermanentError
+}
+
+//BackoffFor returns how long to wait before the retry following the given
+//(zero-based) attempt.
+func (p RetryPolicy) BackoffFor(attempt int) time.Duration {
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for idx := 0; idx < attempt; idx++ {
+		backoff *= 2
+	}
+	return backoff
+}
@@ -0,0 +1,73 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package command
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyClassify(t *testing.T) {
+	custom := RetryPolicy{Patterns: []*regexp.Regexp{regexp.MustCompile(`lock held`)}}
+
+	testCases := []struct {
+		Policy   RetryPolicy
+		Stderr   string
+		Expected ErrorClass
+	}{
+		{RetryPolicy{}, "mount: /dev/sdb: Device or resource busy", TransientError},
+		{RetryPolicy{}, "flock: Resource temporarily unavailable", TransientError},
+		{RetryPolicy{}, "mkfs.xfs: no such file or directory", PermanentError},
+		{RetryPolicy{}, "", PermanentError},
+		//custom patterns replace the default patterns
+		{custom, "cryptsetup: lock held by another process", TransientError},
+		{custom, "mount: /dev/sdb: Device or resource busy", PermanentError},
+	}
+
+	for _, tc := range testCases {
+		actual := tc.Policy.Classify(tc.Stderr)
+		if actual != tc.Expected {
+			t.Errorf("expected Classify(%q) to return %d, but got %d", tc.Stderr, tc.Expected, actual)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffFor(t *testing.T) {
+	testCases := []struct {
+		Backoff  time.Duration
+		Attempt  int
+		Expected time.Duration
+	}{
+		{0, 0, time.Second},
+		{0, 2, 4 * time.Second},
+		{-time.Second, 1, 2 * time.Second},
+		{100 * time.Millisecond, 0, 100 * time.Millisecond},
+		{100 * time.Millisecond, 1, 200 * time.Millisecond},
+		{100 * time.Millisecond, 3, 800 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		actual := RetryPolicy{Backoff: tc.Backoff}.BackoffFor(tc.Attempt)
+		if actual != tc.Expected {
+			t.Errorf("expected BackoffFor(%d) with backoff %s to return %s, but got %s", tc.Attempt, tc.Backoff, tc.Expected, actual)
+		}
+	}
+}
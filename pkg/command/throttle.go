@@ -0,0 +1,193 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//OperationClass describes how expensive a command is for the storage
+//subsystem.
+type OperationClass int
+
+const (
+	//LightOperation is the OperationClass for cheap commands that only read
+	//metadata or change the kernel's state (e.g. mount, luksOpen, lsblk).
+	LightOperation OperationClass = iota
+	//HeavyOperation is the OperationClass for destructive or bandwidth-heavy
+	//commands that write to large portions of a drive (e.g. mkfs, luksFormat,
+	//wipefs).
+	HeavyOperation
+	//BackgroundOperation is the OperationClass for bandwidth-heavy commands that
+	//run for hours while the drive is otherwise left alone (e.g. cryptsetup
+	//reencrypt). They are prioritized like heavy operations, but do not count
+	//against any concurrency limit, since a slot would be held for the whole
+	//runtime and block the setup of other drives.
+	BackgroundOperation
+)
+
+//ClassifyOperation returns the OperationClass of the given command line
+//(without any chroot/nsenter/sudo prefixes).
+func ClassifyOperation(cmd []string) OperationClass {
+	switch cmd[0] {
+	case "mkfs.xfs", "make-bcache", "wipefs", "dd", "blkdiscard", "xfs_repair":
+		return HeavyOperation
+	case "cryptsetup":
+		if len(cmd) > 1 {
+			switch cmd[1] {
+			case "luksFormat", "convert":
+				return HeavyOperation
+			case "reencrypt":
+				return BackgroundOperation
+			}
+		}
+	}
+	return LightOperation
+}
+
+//Throttle limits how many commands of each OperationClass may run at the same
+//time, and how heavy operations are prioritized against other processes on
+//the system (esp. Swift itself, which keeps serving requests from the other
+//drives in the meantime).
+type Throttle struct {
+	//MaxLightOperations and MaxHeavyOperations are the concurrency limits for
+	//each OperationClass. 0 means unlimited.
+	MaxLightOperations int
+	MaxHeavyOperations int
+	//Nice is the niceness for heavy operations (0 leaves the niceness
+	//unchanged).
+	Nice int
+	//IONiceClass is the I/O scheduling class for heavy operations ("idle",
+	//"best-effort" or "realtime"; empty leaves the class unchanged).
+	IONiceClass string
+	//NiceAllOperations applies Nice and IONiceClass to light operations, too.
+	NiceAllOperations bool
+	//CgroupPath is the directory of a cgroup (v2) into which all commands are
+	//moved as soon as they have been started (empty to leave commands in the
+	//autopilot's own cgroup). See SetupCgroup.
+	CgroupPath string
+}
+
+var ioniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+//Validate returns an error if the throttle contains invalid values.
+func (t Throttle) Validate() error {
+	if t.MaxLightOperations < 0 || t.MaxHeavyOperations < 0 {
+		return fmt.Errorf("concurrency limits may not be negative")
+	}
+	if t.Nice < -20 || t.Nice > 19 {
+		return fmt.Errorf("nice must be between -20 and 19, but is %d", t.Nice)
+	}
+	if _, ok := ioniceClasses[t.IONiceClass]; t.IONiceClass != "" && !ok {
+		return fmt.Errorf(`ionice-class must be "idle", "best-effort" or "realtime", but is %q`, t.IONiceClass)
+	}
+	if t.CgroupPath != "" && !filepath.IsAbs(t.CgroupPath) {
+		return fmt.Errorf("cgroup.path must be an absolute path, but is %q", t.CgroupPath)
+	}
+	return nil
+}
+
+var (
+	currentThrottle Throttle
+	semaphores      = make(map[OperationClass]chan struct{})
+)
+
+//SetThrottle replaces the current Throttle. By default, commands are not
+//throttled at all. This must be called before any commands are executed (in
+//practice, main() calls this with the values from the configuration).
+func SetThrottle(t Throttle) {
+	currentThrottle = t
+	semaphores = make(map[OperationClass]chan struct{})
+	if t.MaxLightOperations > 0 {
+		semaphores[LightOperation] = make(chan struct{}, t.MaxLightOperations)
+	}
+	if t.MaxHeavyOperations > 0 {
+		semaphores[HeavyOperation] = make(chan struct{}, t.MaxHeavyOperations)
+	}
+}
+
+//Blocks until a command of the given class may be executed. The returned
+//function must be called when the command has completed.
+func acquireSlot(class OperationClass) (release func()) {
+	sem := semaphores[class]
+	if sem == nil {
+		return func() {}
+	}
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+//Returns the prefix for the command line that sets up the configured process
+//priority (only for heavy and background operations, unless NiceAllOperations
+//is set).
+func priorityPrefix(class OperationClass) []string {
+	if class == LightOperation && !currentThrottle.NiceAllOperations {
+		return nil
+	}
+	var prefix []string
+	if currentThrottle.IONiceClass != "" {
+		prefix = append(prefix, "ionice", "-c", strconv.Itoa(ioniceClasses[currentThrottle.IONiceClass]))
+	}
+	if currentThrottle.Nice != 0 {
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(currentThrottle.Nice))
+	}
+	return prefix
+}
+
+//SetupCgroup creates the cgroup at the given path (if it does not exist yet)
+//and writes the given limits into its interface files, e.g. "cpu.max" =>
+//"50000 100000" or "io.weight" => "default 10". The path refers to outside the
+//chroot, and is usually below /sys/fs/cgroup. The cgroup's parent must have
+//the respective controllers enabled.
+func SetupCgroup(path string, limits map[string]string) error {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
+	for name, value := range limits {
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("invalid cgroup interface file name: %q", name)
+		}
+		err := ioutil.WriteFile(filepath.Join(path, name), []byte(value+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Moves the process with the given PID into the configured cgroup, if any.
+//Processes that the command spawns after this will inherit the cgroup.
+func moveIntoCgroup(pid int) error {
+	if currentThrottle.CgroupPath == "" {
+		return nil
+	}
+	procsPath := filepath.Join(currentThrottle.CgroupPath, "cgroup.procs")
+	return ioutil.WriteFile(procsPath, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
@@ -0,0 +1,73 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package command
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClassifyOperation(t *testing.T) {
+	testCases := []struct {
+		Command  []string
+		Expected OperationClass
+	}{
+		{[]string{"mount", "/dev/sda", "/srv/node/swift1"}, LightOperation},
+		{[]string{"cryptsetup", "luksOpen", "/dev/sda", "sda"}, LightOperation},
+		{[]string{"cryptsetup", "luksFormat", "/dev/sda"}, HeavyOperation},
+		{[]string{"mkfs.xfs", "-f", "/dev/sda"}, HeavyOperation},
+		{[]string{"cryptsetup", "reencrypt", "--encrypt", "/dev/sda"}, BackgroundOperation},
+	}
+
+	for _, tc := range testCases {
+		actual := ClassifyOperation(tc.Command)
+		if actual != tc.Expected {
+			t.Errorf("expected ClassifyOperation(%v) to return %d, but got %d", tc.Command, tc.Expected, actual)
+		}
+	}
+}
+
+func TestBackgroundOperationsDoNotTakeHeavySlots(t *testing.T) {
+	SetThrottle(Throttle{MaxHeavyOperations: 1, IONiceClass: "idle"})
+	defer SetThrottle(Throttle{})
+
+	//while a reencryption runs, heavy operations on other drives can proceed
+	releaseBackground := acquireSlot(BackgroundOperation)
+	defer releaseBackground()
+	done := make(chan struct{})
+	go func() {
+		acquireSlot(HeavyOperation)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("heavy operation was blocked by a background operation")
+	}
+
+	expected := []string{"ionice", "-c", "3"}
+	if actual := priorityPrefix(BackgroundOperation); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected background operations to run with %v, but got %v", expected, actual)
+	}
+	if actual := priorityPrefix(LightOperation); len(actual) > 0 {
+		t.Errorf("expected light operations to run without priority prefix, but got %v", actual)
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
@@ -47,6 +49,18 @@ const (
 	//AssignmentMismatch indicates a drive whose SwiftID differs from its
 	//mountpoint below /srv/node.
 	AssignmentMismatch = "mountpoint mismatches swift-id \"%s\""
+	//AssignmentCorrupted indicates a drive whose swift-id file does not match
+	//its checksum.
+	AssignmentCorrupted = "swift-id file does not match its checksum (not mounting)"
+	//AssignmentInvalid indicates a drive whose swift-id file contains something
+	//that cannot be a swift-id (e.g. because the file was partially overwritten).
+	AssignmentInvalid = "swift-id file is corrupted (not mounting)"
+	//AssignmentUnadopted indicates a drive that contains a different filesystem
+	//than the one that was last seen on it (see Drive.NeedsAdoption).
+	AssignmentUnadopted = "drive contains a different filesystem than when it was last seen (not mounting as swift-id \"%s\" until adopted)"
+	//AssignmentUnsafeMountpoint indicates a drive whose mountpoint below
+	///srv/node cannot be used safely (see os.Interface.CheckMountTarget).
+	AssignmentUnsafeMountpoint = "mountpoint for swift-id \"%s\" is unsafe to use (not mounting)"
 )
 
 //Assignment describes whether a drive is assigned an identity within Swift,
@@ -108,10 +122,10 @@ func (a *Assignment) MountPath() string {
 //UpdateDriveAssignments scans all drives for their swift-id assignments, and
 //auto-assigns swift-ids from the given pool if required and possible.
 func UpdateDriveAssignments(drives []*Drive, swiftIDPool []string, osi os.Interface) {
-	//are there any broken drives?
+	//are there any broken (or foreign, or locked) drives?
 	hasBrokenDrives := false
 	for _, drive := range drives {
-		if drive.Broken {
+		if drive.Broken || drive.Foreign || drive.LockedElsewhere {
 			hasBrokenDrives = true
 			break
 		}
@@ -120,6 +134,7 @@ func UpdateDriveAssignments(drives []*Drive, swiftIDPool []string, osi os.Interf
 	//read existing swift-id assignments
 	drivesBySwiftID := make(map[string]*Drive)
 	hasMismountedDrives := false
+	hasCorruptedDrives := false
 	isAssignedSwiftID := make(map[string]bool)
 	spareIdx := 0
 	for _, drive := range drives {
@@ -152,6 +167,14 @@ func UpdateDriveAssignments(drives []*Drive, swiftIDPool []string, osi os.Interf
 			continue
 		}
 
+		//do not trust swift-ids that look corrupted (we cannot know the actual
+		//swift-id of such a drive, so auto-assignment is inhibited)
+		if problem := drive.checkSwiftID(osi, mountedPath, swiftID); problem != "" {
+			Assignment{Error: problem}.Apply(drive)
+			hasCorruptedDrives = true
+			continue
+		}
+
 		//recognize spare disks
 		if swiftID == "spare" {
 			Assignment{SwiftID: "spare"}.Apply(drive)
@@ -172,6 +195,13 @@ func UpdateDriveAssignments(drives []*Drive, swiftIDPool []string, osi os.Interf
 		if filepath.Dir(mountedPath) == "/srv/node" && filepath.Base(mountedPath) != swiftID {
 			Assignment{SwiftID: swiftID, Error: AssignmentMismatch}.Apply(drive)
 			hasMismountedDrives = true //something is seriously wrong - inhibit automatic assignment
+		} else if drive.NeedsAdoption() && drive.MountedPath() != (&Assignment{SwiftID: swiftID}).MountPath() {
+			Assignment{SwiftID: swiftID, Error: AssignmentUnadopted}.Apply(drive)
+		} else if err := checkMountTarget(drive, swiftID, osi); err != nil {
+			if drive.Assignment == nil || drive.Assignment.Error != AssignmentUnsafeMountpoint {
+				util.LogError("cannot mount %s below /srv/node: %s", drive.DevicePath, err.Error())
+			}
+			Assignment{SwiftID: swiftID, Error: AssignmentUnsafeMountpoint}.Apply(drive)
 		} else {
 			Assignment{SwiftID: swiftID}.Apply(drive)
 		}
@@ -189,7 +219,7 @@ func UpdateDriveAssignments(drives []*Drive, swiftIDPool []string, osi os.Interf
 	}
 
 	//can we perform auto-assignment?
-	if hasBrokenDrives || hasMismountedDrives || len(swiftIDPool) == 0 {
+	if hasBrokenDrives || hasMismountedDrives || hasCorruptedDrives || len(swiftIDPool) == 0 {
 		return
 	}
 
@@ -227,8 +257,72 @@ func UpdateDriveAssignments(drives []*Drive, swiftIDPool []string, osi os.Interf
 				continue
 			}
 
+			if drive.SwiftIDChecksums {
+				err := osi.WriteSwiftIDChecksum(drive.MountPath())
+				if err != nil {
+					util.LogError(err.Error())
+				}
+			}
+
 			isAssignedSwiftID[poolID] = true
 			Assignment{SwiftID: swiftID}.Apply(drive)
 		}
 	}
 }
+
+//Checks whether the swift-id that was read from the filesystem mounted at the
+//given path looks like it has been corrupted. If checksums are enabled, a
+//swift-id without a checksum is trusted (since operators usually write
+//swift-id files by hand), and its checksum is recorded.
+func (d *Drive) checkSwiftID(osi os.Interface, mountedPath, swiftID string) AssignmentError {
+	if !isValidSwiftID(swiftID) {
+		return AssignmentInvalid
+	}
+	if !d.SwiftIDChecksums {
+		return ""
+	}
+
+	exists, err := osi.CheckSwiftIDChecksum(mountedPath)
+	switch {
+	case err == os.ErrSwiftIDChecksumMismatch:
+		return AssignmentCorrupted
+	case err != nil:
+		util.LogError("cannot check swift-id on %s: %s", d.DevicePath, err.Error())
+	case !exists && !d.ReadOnly:
+		err := osi.WriteSwiftIDChecksum(mountedPath)
+		if err != nil {
+			util.LogError("cannot record checksum of swift-id on %s: %s", d.DevicePath, err.Error())
+		} else {
+			util.LogInfo("recorded checksum of swift-id \"%s\" on %s", swiftID, d.DevicePath)
+		}
+	}
+	return ""
+}
+
+//Checks that the drive can be mounted safely at the mountpoint for the given
+//swift-id (unless it is already mounted there). Since the swift-id comes from
+//the drive itself, we must not trust it to point to a sensible location.
+func checkMountTarget(drive *Drive, swiftID string, osi os.Interface) error {
+	mountPath := (&Assignment{SwiftID: swiftID}).MountPath()
+	if mountPath == "" || mountPath == drive.MountedPath() {
+		return nil
+	}
+	if filepath.Dir(mountPath) != "/srv/node" {
+		return fmt.Errorf("%s is not directly below /srv/node", mountPath)
+	}
+	return osi.CheckMountTarget(mountPath)
+}
+
+//Since the swift-id becomes part of the mountpoint path below /srv/node, it
+//must be a single path element consisting of printable characters.
+func isValidSwiftID(swiftID string) bool {
+	if !utf8.ValidString(swiftID) || swiftID == "." || swiftID == ".." {
+		return false
+	}
+	for _, r := range swiftID {
+		if r == '/' || !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
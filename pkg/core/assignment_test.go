@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+)
+
+func TestIsValidSwiftID(t *testing.T) {
+	testCases := map[string]bool{
+		"swift1":         true,
+		"spare":          true,
+		"sdb-01_ä":       true,
+		".":              false,
+		"..":             false,
+		"../../etc":      false,
+		"swift1/../..":   false,
+		"swift 1":        false,
+		"swift1\x00\x00": false,
+		"\xff\xfe":       false,
+	}
+	for swiftID, expected := range testCases {
+		actual := isValidSwiftID(swiftID)
+		if actual != expected {
+			t.Errorf("expected isValidSwiftID(%q) = %t, but got %t", swiftID, expected, actual)
+		}
+	}
+}
+
+func TestCheckMountTargetStaysBelowSrvNode(t *testing.T) {
+	osi := os.NewFake()
+	drive := &Drive{}
+	for _, swiftID := range []string{"swift1", "spare"} {
+		err := checkMountTarget(drive, swiftID, osi)
+		if err != nil {
+			t.Errorf("expected swift-id %q to be accepted, but got: %s", swiftID, err.Error())
+		}
+	}
+	for _, swiftID := range []string{"..", "swift1/nested"} {
+		err := checkMountTarget(drive, swiftID, osi)
+		if err == nil {
+			t.Errorf("expected swift-id %q to be rejected, but it was accepted", swiftID)
+		}
+	}
+}
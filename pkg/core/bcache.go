@@ -0,0 +1,114 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//BcacheDevice is a device that shall become a bcache backing device. This is
+//only used for drives that are set up from scratch. Once the bcache device
+//exists, CollectDrives() reports the bcache device instead of the backing
+//device, so existing bcache devices are handled like any other device.
+type BcacheDevice struct {
+	path       string
+	formatted  bool
+	preferLUKS bool
+	//luksHeaderPath is given to the LUKS container in the bcache device.
+	luksHeaderPath string
+
+	//internal state
+	mapped Device
+}
+
+//DevicePath implements the Device interface.
+func (d *BcacheDevice) DevicePath() string {
+	return d.path
+}
+
+//MountedPath implements the Device interface.
+func (d *BcacheDevice) MountedPath() string {
+	if d.mapped == nil {
+		return ""
+	}
+	return d.mapped.MountedPath()
+}
+
+//Setup implements the Device interface.
+func (d *BcacheDevice) Setup(drive *Drive, osi os.Interface) bool {
+	err := d.Validate(drive, osi)
+	if err != nil {
+		util.LogError(err.Error())
+		return false
+	}
+
+	//format on first use
+	if !d.formatted {
+		//double-check that disk is empty
+		if osi.ClassifyDevice(d.path) != os.DeviceTypeUnknown {
+			util.LogError("BcacheDevice.Setup called on %s, but is not empty!", d.path)
+			return false
+		}
+		if reason := drive.formatRefusal(); reason != "" {
+			util.LogError("will not create bcache device on %s %s", d.path, reason)
+			return false
+		}
+		if !drive.wipeSignatures(osi, d.path) {
+			return false
+		}
+
+		bcacheDevicePath, ok := osi.CreateBcacheDevice(d.path, drive.CacheDevicePath)
+		if !ok {
+			return false
+		}
+		util.LogInfo("created bcache device %s on %s with cache %s", bcacheDevicePath, d.path, drive.CacheDevicePath)
+		d.formatted = true
+		d.mapped = newDevice(bcacheDevicePath, osi, d.preferLUKS, d.luksHeaderPath)
+	}
+
+	if d.mapped == nil {
+		return false
+	}
+	return d.mapped.Setup(drive, osi)
+}
+
+//Teardown implements the Device interface.
+func (d *BcacheDevice) Teardown(drive *Drive, osi os.Interface) bool {
+	//the bcache device itself stays active (just like when it is found by
+	//CollectDrives); only its contents need to be torn down
+	if d.mapped == nil {
+		return true
+	}
+	return d.mapped.Teardown(drive, osi)
+}
+
+//Validate implements the Device interface.
+func (d *BcacheDevice) Validate(drive *Drive, osi os.Interface) error {
+	if d.formatted && d.mapped == nil {
+		return fmt.Errorf("bcache device on %s should be active, but is not", d.path)
+	}
+	if d.mapped == nil {
+		return nil
+	}
+	return d.mapped.Validate(drive, osi)
+}
@@ -0,0 +1,159 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	std_os "os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//These benchmarks run the same steps as one cycle of the converger (see
+//Converger.Converge in the main package) against os.Fake, so they measure
+//only the CPU time and allocations of the convergence logic itself.
+
+var benchmarkDriveCounts = []int{100, 250, 500}
+
+func BenchmarkConvergeInitialSetup(b *testing.B) {
+	forEachBenchmarkCase(b, func(b *testing.B, driveCount int, opts DriveOptions) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			osi, swiftIDPool := prepareFakeDrives(driveCount)
+			b.StartTimer()
+
+			drives := discoverFakeDrives(osi, opts)
+			convergeDrives(drives, swiftIDPool, osi)
+
+			b.StopTimer()
+			unregisterDrives(drives)
+			b.StartTimer()
+		}
+	})
+}
+
+func BenchmarkConvergeSteadyState(b *testing.B) {
+	forEachBenchmarkCase(b, func(b *testing.B, driveCount int, opts DriveOptions) {
+		osi, swiftIDPool := prepareFakeDrives(driveCount)
+		drives := discoverFakeDrives(osi, opts)
+		convergeDrives(drives, swiftIDPool, osi)
+		defer unregisterDrives(drives)
+		for _, d := range drives {
+			if d.Broken || d.Assignment == nil || d.Assignment.Error != "" {
+				b.Fatalf("drive %s did not converge", d.DevicePath)
+			}
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			convergeDrives(drives, swiftIDPool, osi)
+		}
+	})
+}
+
+//The drives write to the filesystem in a few places (e.g. per-drive logs), so
+//tests and benchmarks run in an empty directory that stands in for the chroot.
+//Log lines are still formatted and captured, but not printed. The returned
+//function restores the previous working directory and log output.
+func enterFakeChroot(tb testing.TB) (leave func()) {
+	wd, err := std_os.Getwd()
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	root, err := ioutil.TempDir("", "swift-drive-autopilot-test")
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	err = std_os.MkdirAll(filepath.Join(root, util.DriveLogDirectory), 0755)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	err = std_os.Chdir(root)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	return func() {
+		log.SetOutput(logOutput)
+		std_os.Chdir(wd)
+		std_os.RemoveAll(root)
+	}
+}
+
+func forEachBenchmarkCase(b *testing.B, action func(b *testing.B, driveCount int, opts DriveOptions)) {
+	defer enterFakeChroot(b)()
+
+	for _, driveCount := range benchmarkDriveCounts {
+		b.Run(fmt.Sprintf("drives=%d/plain", driveCount), func(b *testing.B) {
+			b.ReportAllocs()
+			action(b, driveCount, DriveOptions{})
+		})
+		b.Run(fmt.Sprintf("drives=%d/luks", driveCount), func(b *testing.B) {
+			b.ReportAllocs()
+			action(b, driveCount, DriveOptions{Keys: []os.LUKSKey{{Secret: "benchmark"}}})
+		})
+	}
+}
+
+func prepareFakeDrives(driveCount int) (*os.Fake, []string) {
+	osi := os.NewFake()
+	swiftIDPool := make([]string, driveCount)
+	for idx := 0; idx < driveCount; idx++ {
+		osi.AddDrive(fmt.Sprintf("/dev/sd%04d", idx), fmt.Sprintf("SERIAL%04d", idx))
+		swiftIDPool[idx] = fmt.Sprintf("swift-%04d", idx)
+	}
+	return osi, swiftIDPool
+}
+
+func discoverFakeDrives(osi os.Interface, opts DriveOptions) []*Drive {
+	added, _, _ := osi.NewDriveScanner([]string{"/dev/sd*"}).Scan()
+	drives := make([]*Drive, 0, len(added))
+	for _, drive := range added {
+		drives = append(drives, NewDrive(drive.DevicePath, drive.BackingDevicePath, drive.SerialNumber, opts, osi))
+	}
+	return drives
+}
+
+func convergeDrives(drives []*Drive, swiftIDPool []string, osi os.Interface) {
+	osi.RefreshMountPoints()
+	osi.RefreshLUKSMappings()
+	for _, d := range drives {
+		d.Converge(osi)
+	}
+	UpdateDriveAssignments(drives, swiftIDPool, osi)
+	for _, d := range drives {
+		if !d.Broken {
+			d.Converge(osi)
+		}
+	}
+}
+
+func unregisterDrives(drives []*Drive) {
+	for _, d := range drives {
+		util.UnregisterDriveLog(d.DriveID)
+	}
+}
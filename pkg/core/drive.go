@@ -21,33 +21,84 @@ package core
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	std_os "os"
 	"strings"
+	"time"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
-//NewDrive initializes a Drive instance.
-func NewDrive(devicePath, serialNumber string, keys []string, osi os.Interface) *Drive {
+//PhysicalDevicePath returns the device path of the physical drive, i.e. the
+//BackingDevicePath for stacked devices, and the DevicePath otherwise. Topology
+//hints, firmware info and SMART data refer to this device.
+func (d *Drive) PhysicalDevicePath() string {
+	if d.BackingDevicePath != "" {
+		return d.BackingDevicePath
+	}
+	return d.DevicePath
+}
+
+//DriveIDOf returns the DriveID for the drive with the given device path and
+//serial number. The fallback value for drives without a serial number is the
+//md5sum of the device path.
+func DriveIDOf(devicePath, serialNumber string) string {
+	if serialNumber != "" {
+		return serialNumber
+	}
+	s := md5.Sum([]byte(devicePath))
+	return hex.EncodeToString(s[:])
+}
+
+//NewDrive initializes a Drive instance. The backingDevicePath shall only be
+//given if the devicePath refers to a stacked device (see
+//Drive.BackingDevicePath).
+func NewDrive(devicePath, backingDevicePath, serialNumber string, opts DriveOptions, osi os.Interface) *Drive {
 	d := &Drive{
-		DevicePath: devicePath,
-		Device:     newDevice(devicePath, osi, len(keys) > 0),
-		DriveID:    serialNumber,
-		Keys:       keys,
+		DevicePath:        devicePath,
+		BackingDevicePath: backingDevicePath,
+		SerialNumber:      serialNumber,
+		DriveID:           DriveIDOf(devicePath, serialNumber),
+		DriveOptions:      opts,
 	}
+	hasSerialNumber := serialNumber != ""
+	d.Device = newDeviceForDrive(d, osi)
 
-	//fallback value for DriveID is md5sum of devicePath
-	if d.DriveID == "" {
-		s := md5.Sum([]byte(devicePath))
-		d.DriveID = hex.EncodeToString(s[:])
+	d.Topology = osi.GetTopologyHints(d.PhysicalDevicePath())
+	d.Firmware = osi.GetFirmwareInfo(d.PhysicalDevicePath())
+
+	//the LUKS mapping and the temporary mountpoint are named after the DriveID
+	//(or a hash of it, to get names of uniform length and charset)
+	d.DeviceName = d.DriveID
+	if opts.HashDeviceNames && hasSerialNumber {
+		s := sha256.Sum256([]byte(d.DriveID))
+		d.DeviceName = hex.EncodeToString(s[:8])
+	}
+
+	//capture everything concerning this drive in its own log file (the
+	//DeviceName also covers the LUKS mapping and the temporary mountpoint)
+	util.RegisterDriveLog(d.DriveID, d.DevicePath, d.BackingDevicePath, d.LogDevicePath, d.DriveID, d.DeviceName)
+	if d.DeviceName != d.DriveID {
+		util.LogDebug("using device name %s for drive %s", d.DeviceName, d.DriveID)
+	}
+
+	if !hasSerialNumber {
 		util.LogError(
 			"cannot determine serial number for %s, will use device ID %s instead",
 			devicePath, d.DriveID)
 	}
 
+	if poolName, isMember := osi.GetZFSPoolName(d.DevicePath); isMember {
+		if poolName == "" {
+			poolName = "(unknown name)"
+		}
+		util.LogInfo("%s is a member of ZFS pool %s, so it will not be set up as a drive", d.DevicePath, poolName)
+		d.ZFSPoolMember = true
+	}
+
 	//detect unreadable device
 	if d.Device == nil {
 		d.Broken = true
@@ -88,7 +139,7 @@ func (d *Drive) MountPath() string {
 		if mountedPath != "" {
 			return mountedPath
 		}
-		return "/run/swift-storage/" + d.DriveID
+		return "/run/swift-storage/" + d.DeviceName
 	}
 	return path
 }
@@ -101,16 +152,27 @@ func (d *Drive) MountPath() string {
 //check for swift-id collisions) and the swift-id auto-assignment.
 //
 //If the drive is broken (or discovered to be broken during this operation),
-//any existing mappings or mounts will be teared down.
+//any existing mappings or mounts will be teared down. The same goes for
+//foreign drives, except that those are not flagged as broken.
 func (d *Drive) Converge(osi os.Interface) {
-	if d.Broken {
-		d.Device.Teardown(d, osi)
+	if d.Encrypting || d.ZFSPoolMember {
+		return
+	}
+	if d.Broken || d.Foreign {
+		//an exported drive was torn down before it was exported
+		if d.Export == nil {
+			d.Device.Teardown(d, osi)
+		}
 		return
 	}
 
 	ok := d.Device.Setup(d, osi)
 	if !ok {
-		d.MarkAsBroken(osi)
+		if d.Foreign {
+			util.LogError("%s contains a LUKS container that cannot be opened with any of the configured keys: treating it as a foreign drive, will not touch it until it is replugged or the autopilot is restarted", d.DevicePath)
+		} else {
+			d.MarkAsBroken(osi)
+		}
 		d.Device.Teardown(d, osi)
 		return
 	}
@@ -118,11 +180,106 @@ func (d *Drive) Converge(osi os.Interface) {
 
 //Teardown tears down all active mounts and mappings relating to this device.
 func (d *Drive) Teardown(osi os.Interface) {
+	d.Unexport(osi)
 	if d.Device != nil {
 		d.Device.Teardown(d, osi)
 	}
 }
 
+//HasUnencryptedFilesystem returns whether the filesystem of this drive lives
+//directly on the drive's device, without any LUKS container or other layers in
+//between.
+func (d *Drive) HasUnencryptedFilesystem() bool {
+	_, ok := d.Device.(*XFSDevice)
+	return ok
+}
+
+//ReformatFilesystem recreates the filesystem on this drive (with the drive's
+//current FormatOptions) and mounts it in a temporary location. All existing
+//data on the filesystem, including the swift-id, is lost, and the drive's
+//assignment is reset. The caller must ensure that the drive does not contain
+//any data that is still needed.
+func (d *Drive) ReformatFilesystem(osi os.Interface) bool {
+	xfs := d.findXFSDevice()
+	if xfs == nil {
+		util.LogError("cannot reformat %s: filesystem has not been set up", d.DevicePath)
+		return false
+	}
+
+	if !xfs.Teardown(d, osi) {
+		return false
+	}
+	logDevicePath, ok := d.prepareLogDevice(osi, false)
+	if !ok {
+		return false
+	}
+	if !d.runHook(BeforeFormatHook, xfs.path, "") {
+		return false
+	}
+	if !osi.FormatDevice(xfs.path, logDevicePath, d.FormatOptions) {
+		return false
+	}
+	util.LogInfo("XFS filesystem recreated on %s", xfs.path)
+	d.FormattedAt = time.Now()
+	xfs.layoutChecked = false
+	xfs.freshFilesystem = true
+	d.runHook(AfterFormatHook, xfs.path, "")
+
+	//mount in the temporary location, since the new filesystem does not have a
+	//swift-id yet
+	d.Assignment = nil
+	return xfs.Setup(d, osi)
+}
+
+//Returns the XFSDevice at the top of this drive's device stack, or nil if it
+//has not been set up (yet).
+func (d *Drive) findXFSDevice() *XFSDevice {
+	device := d.Device
+	for device != nil {
+		switch dev := device.(type) {
+		case *BcacheDevice:
+			device = dev.mapped
+		case *LUKSDevice:
+			device = dev.mapped
+		case *PlainCryptDevice:
+			device = dev.mapped
+		case *XFSDevice:
+			return dev
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+//DeviceLayers describes the stack of devices on this drive from the bottom up,
+//e.g. ["luks:/dev/sda", "xfs:/dev/mapper/ABCDEFGH"]. Layers that have not been
+//set up yet are not included. This is intended for diagnostic output.
+func (d *Drive) DeviceLayers() []string {
+	var result []string
+	device := d.Device
+	for device != nil {
+		switch dev := device.(type) {
+		case *BcacheDevice:
+			result = append(result, "bcache:"+dev.path)
+			device = dev.mapped
+		case *LUKSDevice:
+			result = append(result, "luks:"+dev.path)
+			device = dev.mapped
+		case *PlainCryptDevice:
+			result = append(result, "plain-crypt:"+dev.path)
+			device = dev.mapped
+		case *XFSDevice:
+			result = append(result, "xfs:"+dev.path)
+			device = nil
+		default:
+			result = append(result, "unknown:"+dev.DevicePath())
+			device = nil
+		}
+	}
+	return result
+}
+
 //BrokenFlagPath (TODO swift.Interface)
 func (d *Drive) BrokenFlagPath() string {
 	return "/run/swift-storage/broken/" + d.DriveID
@@ -131,6 +288,7 @@ func (d *Drive) BrokenFlagPath() string {
 //MarkAsBroken sets the d.Broken flag.
 func (d *Drive) MarkAsBroken(osi os.Interface) {
 	d.Broken = true
+	d.BrokenAt = time.Now()
 	util.LogInfo("flagging %s as broken because of previous error", d.DevicePath)
 
 	flagPath := d.BrokenFlagPath()
@@ -144,8 +302,66 @@ func (d *Drive) MarkAsBroken(osi os.Interface) {
 	d.Assignment = nil
 }
 
+//Records the UUID of the filesystem on the given device, and complains if it
+//differs from the expected one. Filesystems that we just created are expected
+//to have a new UUID.
+func (d *Drive) checkFilesystemUUID(osi os.Interface, devicePath string, freshFilesystem bool) {
+	d.FilesystemUUID = osi.GetFilesystemUUID(devicePath)
+	if d.FilesystemUUID == "" {
+		return
+	}
+	if freshFilesystem || d.ExpectedFilesystemUUID == "" {
+		d.ExpectedFilesystemUUID = d.FilesystemUUID
+		return
+	}
+	if d.NeedsAdoption() {
+		util.LogError("filesystem on %s has UUID %s, but expected UUID %s (was the drive swapped?); will not mount it below /srv/node until it is adopted",
+			d.DevicePath, d.FilesystemUUID, d.ExpectedFilesystemUUID)
+	}
+}
+
+//NeedsAdoption returns true if the drive contains a different filesystem than
+//the one that was last seen on it (see ExpectedFilesystemUUID).
+func (d *Drive) NeedsAdoption() bool {
+	return d.FilesystemUUID != "" && d.ExpectedFilesystemUUID != "" && d.FilesystemUUID != d.ExpectedFilesystemUUID
+}
+
+//Adopt accepts the filesystem that is currently on this drive as the expected
+//one, so that the drive can be mounted below /srv/node again.
+func (d *Drive) Adopt() {
+	d.ExpectedFilesystemUUID = d.FilesystemUUID
+}
+
+//Returns why this drive may not be formatted (as a phrase like "in read-only
+//mode"), or an empty string if formatting is allowed.
+func (d *Drive) formatRefusal() string {
+	if d.ReadOnly {
+		return "in read-only mode"
+	}
+	if d.Foreign {
+		return "since it contains a foreign LUKS container"
+	}
+	if d.ZFSPoolMember {
+		return "since it is a member of a ZFS pool"
+	}
+	return d.NoFormatReason
+}
+
+//Wipes stale signatures from the given device before it is formatted, if the
+//drive's options ask for it.
+func (d *Drive) wipeSignatures(osi os.Interface, devicePath string) bool {
+	if !d.WipeSignatures {
+		return true
+	}
+	if !osi.WipeSignatures(devicePath) {
+		return false
+	}
+	util.LogInfo("wiped stale signatures from %s", devicePath)
+	return true
+}
+
 //EligibleForAutoAssignment returns true if the drive does not have a swift-id
 //yet, but is eligible for having one auto-assigned.
 func (d *Drive) EligibleForAutoAssignment() bool {
-	return !d.Broken && d.Assignment != nil && d.Assignment.Error == AssignmentPending
+	return !d.Broken && !d.Foreign && !d.ReadOnly && d.Assignment != nil && d.Assignment.Error == AssignmentPending
 }
@@ -0,0 +1,48 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+)
+
+func TestRebuiltDriveKeepsHashedDeviceName(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	osi := os.NewFake()
+	osi.AddDrive("/dev/sda", "SERIAL1")
+	opts := DriveOptions{HashDeviceNames: true}
+	d := NewDrive("/dev/sda", "", "SERIAL1", opts, osi)
+	defer unregisterDrives([]*Drive{d})
+	if d.DeviceName == d.DriveID {
+		t.Fatalf("expected a hashed device name, got %q", d.DeviceName)
+	}
+
+	//drives are rebuilt from their own fields, e.g. on reinstatement
+	rebuilt := NewDrive(d.DevicePath, d.BackingDevicePath, d.SerialNumber, d.DriveOptions, osi)
+	if rebuilt.DeviceName != d.DeviceName {
+		t.Errorf("expected device name %q after rebuild, got %q", d.DeviceName, rebuilt.DeviceName)
+	}
+	if rebuilt.DriveID != d.DriveID {
+		t.Errorf("expected drive ID %q after rebuild, got %q", d.DriveID, rebuilt.DriveID)
+	}
+}
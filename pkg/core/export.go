@@ -0,0 +1,130 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//ReadOnlyExport describes where a broken drive has been exposed read-only, so
+//that the data remaining on it can be copied off it.
+type ReadOnlyExport struct {
+	MountPath string
+	//MappingName is the name of the read-only LUKS mapping (empty if the drive
+	//is not encrypted).
+	MappingName string
+	devicePath  string
+}
+
+//ExportReadOnly mounts the filesystem on this broken drive read-only at the
+//given path, after opening its LUKS container read-only (if any). The drive
+//must have been torn down already. Until Unexport is called, the drive is not
+//torn down by Converge.
+func (d *Drive) ExportReadOnly(osi os.Interface, mountPath string) error {
+	switch {
+	case d.Export != nil && d.Export.MountPath == mountPath:
+		return nil
+	case d.Export != nil:
+		return fmt.Errorf("drive is already exported at %s", d.Export.MountPath)
+	case !d.Broken:
+		return errors.New("drive is not broken")
+	case d.MountedPath() != "":
+		return errors.New("drive has not been torn down yet")
+	}
+	if err := osi.CheckMountTarget(mountPath); err != nil {
+		return err
+	}
+
+	e := &ReadOnlyExport{MountPath: mountPath, devicePath: d.DevicePath}
+	headerPath := d.DetachedLUKSHeaderPath()
+	if headerPath != "" {
+		exists, err := fileExists(headerPath)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			headerPath = ""
+		}
+	}
+	if headerPath != "" || osi.ClassifyDevice(d.DevicePath) == os.DeviceTypeLUKS {
+		//use a different mapping name than the regular setup, so that the
+		//mapping cannot be mistaken for a regular one
+		e.MappingName = d.DeviceName + "-ro"
+		mappedDevicePath, _, ok := osi.OpenLUKSContainer(d.DevicePath, headerPath, e.MappingName, d.Keys, true)
+		if !ok {
+			return errors.New("cannot open LUKS container")
+		}
+		e.devicePath = mappedDevicePath
+	}
+	if osi.ClassifyDevice(e.devicePath) != os.DeviceTypeFilesystem {
+		d.closeExportMapping(osi, e)
+		return fmt.Errorf("no filesystem found on %s", e.devicePath)
+	}
+
+	//norecovery is needed to mount a filesystem with a dirty log read-only, and
+	//also makes sure that nothing at all is written to the drive
+	ok := os.ForeachMountScope(func(scope os.MountScope) bool {
+		return osi.MountDevice(e.devicePath, mountPath, []string{"ro", "norecovery"}, scope)
+	})
+	if !ok {
+		d.unmountExport(osi, e)
+		d.closeExportMapping(osi, e)
+		return fmt.Errorf("cannot mount %s", e.devicePath)
+	}
+	d.Export = e
+	return nil
+}
+
+//Unexport removes the read-only export of this drive, if any. Returns false
+//if it could not be removed completely.
+func (d *Drive) Unexport(osi os.Interface) bool {
+	e := d.Export
+	if e == nil {
+		return true
+	}
+	if !d.unmountExport(osi, e) || !d.closeExportMapping(osi, e) {
+		return false
+	}
+	util.LogInfo("removed read-only export of %s at %s", d.DevicePath, e.MountPath)
+	d.Export = nil
+	return true
+}
+
+func (d *Drive) unmountExport(osi os.Interface, e *ReadOnlyExport) bool {
+	return os.ForeachMountScope(func(scope os.MountScope) bool {
+		for _, m := range osi.GetMountPointsOf(e.devicePath, scope) {
+			if m.MountPath == e.MountPath && !osi.UnmountDevice(m.MountPath, scope) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (d *Drive) closeExportMapping(osi os.Interface, e *ReadOnlyExport) bool {
+	if e.MappingName == "" {
+		return true
+	}
+	return osi.CloseLUKSContainer(e.MappingName)
+}
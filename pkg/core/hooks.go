@@ -0,0 +1,130 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Names of the hooks that can be configured in type Hooks.
+const (
+	BeforeDiscoveryHook = "before-discovery"
+	AfterDiscoveryHook  = "after-discovery"
+	BeforeLUKSOpenHook  = "before-luks-open"
+	AfterLUKSOpenHook   = "after-luks-open"
+	BeforeFormatHook    = "before-format"
+	AfterFormatHook     = "after-format"
+	BeforeMountHook     = "before-mount"
+	AfterMountHook      = "after-mount"
+)
+
+//HookNames lists all hooks that can be configured in type Hooks.
+var HookNames = []string{
+	BeforeDiscoveryHook, AfterDiscoveryHook,
+	BeforeLUKSOpenHook, AfterLUKSOpenHook,
+	BeforeFormatHook, AfterFormatHook,
+	BeforeMountHook, AfterMountHook,
+}
+
+//Hooks contains commands that are run before and after the individual steps
+//of the drive setup, indexed by hook name (see HookNames).
+type Hooks map[string][]string
+
+//Run executes the hook with the given name, if it is configured. The given
+//environment variables (in the form "KEY=value") are passed to the hook in
+//addition to SWIFT_DRIVE_HOOK, which contains the hook name. Returns false if
+//the hook failed.
+func (h Hooks) Run(name string, env ...string) bool {
+	cmd := h[name]
+	if len(cmd) == 0 {
+		return true
+	}
+	env = append([]string{"SWIFT_DRIVE_HOOK=" + name}, env...)
+	_, ok := command.Command{Env: env}.Run(cmd...)
+	if !ok {
+		util.LogError("%s hook failed", name)
+	}
+	return ok
+}
+
+//runHook executes the hook with the given name for this drive, with the
+//drive's context in environment variables. The targetDevicePath is the device
+//that the respective step operates on (e.g. the LUKS container for
+//before-luks-open).
+func (d *Drive) runHook(name, targetDevicePath, mountPath string) bool {
+	if len(d.Hooks[name]) == 0 {
+		return true
+	}
+	env := []string{
+		"SWIFT_DRIVE_ID=" + d.DriveID,
+		"SWIFT_DRIVE_DEVICE_PATH=" + d.DevicePath,
+		"SWIFT_DRIVE_BACKING_DEVICE_PATH=" + d.BackingDevicePath,
+		"SWIFT_DRIVE_TARGET_DEVICE_PATH=" + targetDevicePath,
+		"SWIFT_DRIVE_MOUNT_PATH=" + mountPath,
+	}
+	if a := d.Assignment; a != nil && a.Error == "" {
+		env = append(env, "SWIFT_ID="+a.SwiftID)
+	}
+	env = append(env, LabelEnv(d.Labels)...)
+	return d.Hooks.Run(name, env...)
+}
+
+//LabelEnv returns the environment variables that describe the given labels to
+//hooks: SWIFT_LABEL_<KEY>=value for each label (with the key in upper case),
+//in a stable order.
+func LabelEnv(labels map[string]string) []string {
+	env := make([]string, 0, len(labels))
+	for key, value := range labels {
+		env = append(env, "SWIFT_LABEL_"+strings.ToUpper(key)+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+//RunAfterDiscoveryHook executes the after-discovery hook for this drive, if
+//configured.
+func (d *Drive) RunAfterDiscoveryHook() {
+	d.runHook(AfterDiscoveryHook, d.DevicePath, "")
+}
+
+//PostMountAction is called after a drive has been mounted below /srv/node.
+type PostMountAction func(d *Drive, mountPath string)
+
+//Validate checks that all configured hooks have a known name.
+func (h Hooks) Validate() error {
+	for name := range h {
+		known := false
+		for _, knownName := range HookNames {
+			if name == knownName {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown hook %q", name)
+		}
+	}
+	return nil
+}
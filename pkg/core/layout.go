@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//LayoutMigration upgrades the on-drive layout (i.e. where and how the
+//autopilot stores its own metadata on a drive's filesystem) from the previous
+//version to the given Version.
+type LayoutMigration struct {
+	Version     int
+	Description string
+	//Apply performs the migration on the filesystem mounted at the given path.
+	//It may be nil for migrations that only record the new version.
+	Apply func(d *Drive, osi os.Interface, mountPath string) error
+}
+
+//LayoutMigrations lists all migrations in order. Drives that were formatted
+//by older versions of the autopilot are upgraded by running all migrations
+//after the drive's recorded layout version. Drives that do not have a layout
+//version recorded are considered to have version 0.
+//
+//Migrations must be idempotent since the autopilot might crash between
+//running a migration and recording the new layout version.
+var LayoutMigrations = []LayoutMigration{
+	{
+		Version:     1,
+		Description: "record layout version",
+	},
+}
+
+//CurrentLayoutVersion is the layout version of filesystems that are created
+//by this version of the autopilot.
+func CurrentLayoutVersion() int {
+	return LayoutMigrations[len(LayoutMigrations)-1].Version
+}
+
+//Upgrades the on-drive layout of the filesystem mounted at the given path to
+//the current layout version. A freshly created filesystem is just marked with
+//the current layout version. Returns false if a migration failed.
+func (d *Drive) migrateLayout(osi os.Interface, mountPath string, freshFilesystem bool) bool {
+	current := CurrentLayoutVersion()
+	if freshFilesystem && !d.ReadOnly {
+		err := osi.WriteLayoutVersion(mountPath, current)
+		if err != nil {
+			util.LogError("cannot record layout version on %s: %s", mountPath, err.Error())
+			return false
+		}
+		d.LayoutVersion = current
+		return true
+	}
+
+	version, err := osi.ReadLayoutVersion(mountPath)
+	if err != nil {
+		util.LogError("cannot read layout version of %s: %s", mountPath, err.Error())
+		return false
+	}
+	d.LayoutVersion = version
+	switch {
+	case version == current:
+		return true
+	case version > current:
+		//leave drives that were set up by a newer version alone, to allow rollbacks
+		util.LogError("%s has layout version %d, but this version of the autopilot only knows up to layout version %d; will not touch the layout",
+			mountPath, version, current)
+		return true
+	case d.ReadOnly:
+		util.LogDebug("%s has layout version %d, but will not migrate it to layout version %d in read-only mode",
+			mountPath, version, current)
+		return true
+	}
+
+	for _, m := range LayoutMigrations {
+		if m.Version <= version {
+			continue
+		}
+		if m.Apply != nil {
+			err := m.Apply(d, osi, mountPath)
+			if err != nil {
+				util.LogError("cannot migrate %s to layout version %d (%s): %s", mountPath, m.Version, m.Description, err.Error())
+				return false
+			}
+		}
+		err := osi.WriteLayoutVersion(mountPath, m.Version)
+		if err != nil {
+			util.LogError("cannot record layout version on %s: %s", mountPath, err.Error())
+			return false
+		}
+		//migrations that only record the version are not worth mentioning
+		logf := util.LogInfo
+		if m.Apply == nil {
+			logf = util.LogDebug
+		}
+		logf("migrated %s to layout version %d (%s)", mountPath, m.Version, m.Description)
+		d.LayoutVersion = m.Version
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"path/filepath"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//prepareLogDevice makes the drive's external XFS log device (if any) ready
+//for use, and returns the device path that needs to be given to mkfs.xfs and
+//mount. Returns an empty path if no external log device is configured. When
+//`formatting` is false, the log device is expected to have been set up by a
+//previous run already.
+//
+//The log device is considered part of the drive: If it fails, the whole
+//drive is considered broken.
+func (d *Drive) prepareLogDevice(osi os.Interface, formatting bool) (string, bool) {
+	if d.LogDevicePath == "" {
+		return "", true
+	}
+	devType := osi.ClassifyDevice(d.LogDevicePath)
+	if devType == os.DeviceTypeUnreadable {
+		util.LogError("external log device %s for %s is not readable", d.LogDevicePath, d.DevicePath)
+		return "", false
+	}
+
+	//without encryption, the log device is used directly
+	if len(d.Keys) == 0 {
+		if formatting && devType != os.DeviceTypeUnknown {
+			util.LogError("will not format %s: external log device %s is not empty", d.DevicePath, d.LogDevicePath)
+			return "", false
+		}
+		return d.LogDevicePath, true
+	}
+
+	//with encryption, the log device gets its own LUKS container (same keys,
+	//mapping name derived from the drive's mapping name)
+	mappedDevicePath := osi.GetLUKSMappingOf(d.LogDevicePath)
+	if mappedDevicePath != "" {
+		d.logMappingName = filepath.Base(mappedDevicePath)
+		return mappedDevicePath, true
+	}
+
+	switch devType {
+	case os.DeviceTypeUnknown:
+		if !formatting || d.formatRefusal() != "" {
+			util.LogError("expected LUKS container on external log device %s for %s, but found none", d.LogDevicePath, d.DevicePath)
+			return "", false
+		}
+		if !osi.CreateLUKSContainer(d.LogDevicePath, "", d.Keys[0], d.LUKSFormatOptions) {
+			return "", false
+		}
+	case os.DeviceTypeLUKS:
+		//ok
+	default:
+		util.LogError("will not use external log device %s for %s: contains a filesystem instead of a LUKS container", d.LogDevicePath, d.DevicePath)
+		return "", false
+	}
+
+	mappingName := d.DeviceName + "-log"
+	d.convertLUKSContainer(osi, d.LogDevicePath, mappingName)
+	if !d.runHook(BeforeLUKSOpenHook, d.LogDevicePath, "") {
+		return "", false
+	}
+	mappedDevicePath, keysRejected, ok := osi.OpenLUKSContainer(d.LogDevicePath, "", mappingName, d.Keys, d.ReadOnly)
+	if !ok {
+		if keysRejected {
+			util.LogError(
+				"exec(cryptsetup luksOpen %s %s) failed: none of the configured keys was accepted",
+				d.LogDevicePath, mappingName,
+			)
+		} else {
+			util.LogError("exec(cryptsetup luksOpen %s %s) failed", d.LogDevicePath, mappingName)
+		}
+		return "", false
+	}
+	util.LogInfo("LUKS container at %s opened as %s", d.LogDevicePath, mappedDevicePath)
+	d.runHook(AfterLUKSOpenHook, d.LogDevicePath, "")
+	d.logMappingName = mappingName
+	return mappedDevicePath, true
+}
+
+//teardownLogDevice closes the LUKS container on the external log device, if
+//any. This must only be called after the filesystem has been unmounted.
+func (d *Drive) teardownLogDevice(osi os.Interface) {
+	if d.logMappingName == "" {
+		return
+	}
+	if osi.CloseLUKSContainer(d.logMappingName) {
+		util.LogInfo("LUKS container /dev/mapper/%s closed", d.logMappingName)
+		d.logMappingName = ""
+	}
+}
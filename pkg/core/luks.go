@@ -21,6 +21,9 @@ package core
 
 import (
 	"fmt"
+	sys_os "os"
+	"path/filepath"
+	"strings"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
@@ -30,10 +33,13 @@ import (
 type LUKSDevice struct {
 	path      string
 	formatted bool
+	//headerPath is only set if the LUKS header is detached from the device.
+	headerPath string
 
 	//internal state
-	mapped      Device
-	mappingName string
+	mapped        Device
+	mappingName   string
+	headerChecked bool
 }
 
 //DevicePath implements the Device interface.
@@ -63,17 +69,39 @@ func (d *LUKSDevice) Setup(drive *Drive, osi os.Interface) bool {
 	}
 
 	//format on first use
+	created := false
 	if !d.formatted {
 		//double-check that disk is empty
 		if osi.ClassifyDevice(d.path) != os.DeviceTypeUnknown {
 			util.LogError("LUKSDevice.Setup called on %s, but is not empty!", d.path)
 			return false
 		}
+		if reason := drive.formatRefusal(); reason != "" {
+			util.LogError("will not create LUKS container on %s %s", d.path, reason)
+			return false
+		}
+		if d.headerPath != "" {
+			//if the header directory is missing (e.g. because the system disk was
+			//reinstalled), all drives would look empty, so do not format any of them
+			dir := filepath.Dir(d.headerPath)
+			exists, err := fileExists(dir)
+			if err == nil && !exists {
+				err = fmt.Errorf("directory %s does not exist", dir)
+			}
+			if err != nil {
+				util.LogError("will not create LUKS container with detached header on %s: %s", d.path, err.Error())
+				return false
+			}
+		}
+		if !drive.wipeSignatures(osi, d.path) {
+			return false
+		}
 
 		//format with the preferred key
-		ok := osi.CreateLUKSContainer(d.path, drive.Keys[0])
+		ok := osi.CreateLUKSContainer(d.path, d.headerPath, drive.Keys[0], drive.LUKSFormatOptions)
 		if ok {
 			d.formatted = true
+			created = true
 		} else {
 			return false
 		}
@@ -81,16 +109,32 @@ func (d *LUKSDevice) Setup(drive *Drive, osi os.Interface) bool {
 
 	//decrypt if necessary
 	if d.mapped == nil {
-		mappedDevicePath, ok := osi.OpenLUKSContainer(d.path, drive.DriveID, drive.Keys)
-		if ok {
+		if drive.VerifyLUKSHeaders && !drive.verifyLUKSHeader(osi, d.headerDevicePath()) {
+			return false
+		}
+		drive.convertLUKSContainer(osi, d.headerDevicePath(), drive.DeviceName)
+		if !drive.runHook(BeforeLUKSOpenHook, d.path, "") {
+			return false
+		}
+		mappedDevicePath, keysRejected, ok := osi.OpenLUKSContainer(d.path, d.headerPath, drive.DeviceName, drive.Keys, drive.ReadOnly)
+		switch {
+		case ok:
 			util.LogInfo("LUKS container at %s opened as %s", d.path, mappedDevicePath)
-			d.mapped = newDevice(mappedDevicePath, osi, false)
-			d.mappingName = drive.DriveID
-		} else {
+			drive.runHook(AfterLUKSOpenHook, d.path, "")
+			d.mapped = newDevice(mappedDevicePath, osi, false, "")
+			d.mappingName = drive.DeviceName
+		case keysRejected && !created:
+			//only a container that rejects all our keys is someone else's; other
+			//failures (e.g. a busy device) may go away, so the drive is only
+			//marked as broken, and a container that we just created is ours anyway
 			util.LogError(
 				"exec(cryptsetup luksOpen %s %s) failed: none of the configured keys was accepted",
-				d.path, drive.DriveID,
+				d.path, drive.DeviceName,
 			)
+			drive.Foreign = true
+			return false
+		default:
+			util.LogError("exec(cryptsetup luksOpen %s %s) failed", d.path, drive.DeviceName)
 			return false
 		}
 	}
@@ -99,11 +143,28 @@ func (d *LUKSDevice) Setup(drive *Drive, osi os.Interface) bool {
 	if d.mapped == nil {
 		return false
 	}
+	if !d.headerChecked {
+		drive.checkLUKSHeader(osi, d.headerDevicePath())
+		drive.reconcileLUKSKeyslots(osi, d.headerDevicePath())
+		//(this also covers containers that were just created)
+		drive.backupLUKSHeader(osi, d.headerDevicePath())
+		d.headerChecked = true
+	}
 
 	//descend into decrypted drive
 	return d.mapped.Setup(drive, osi)
 }
 
+//Returns the path that is given to those cryptsetup commands which only work
+//on the LUKS header (e.g. luksDump or luksAddKey). For detached headers, that
+//is the header file; otherwise, it is the device itself.
+func (d *LUKSDevice) headerDevicePath() string {
+	if d.headerPath != "" {
+		return d.headerPath
+	}
+	return d.path
+}
+
 //Teardown implements the Device interface.
 func (d *LUKSDevice) Teardown(drive *Drive, osi os.Interface) bool {
 	//need to teardown contents of mapped device first
@@ -143,7 +204,7 @@ func (d *LUKSDevice) Validate(drive *Drive, osi os.Interface) error {
 	} else if d.mapped == nil {
 		//existing mapping is now discovered for the first time -> update ourselves
 		util.LogInfo("discovered %s to be mapped to %s already", d.path, mappedDevicePath)
-		d.mapped = newDevice(mappedDevicePath, osi, false)
+		d.mapped = newDevice(mappedDevicePath, osi, false, "")
 	} else if mappedDevicePath != d.mapped.DevicePath() {
 		//our internal state tells a different story!
 		return fmt.Errorf("LUKS container in %s should be open at %s, but is actually open at %s",
@@ -168,3 +229,325 @@ func (d *LUKSDevice) Validate(drive *Drive, osi os.Interface) error {
 	}
 	return d.mapped.Validate(drive, osi)
 }
+
+//DetachedLUKSHeaderPath returns the path of the file that holds the header of
+//this drive's LUKS container, or an empty string if the header is not detached
+//from the drive (see DriveOptions.LUKSHeaderDirectory).
+func (d *Drive) DetachedLUKSHeaderPath() string {
+	return detachedLUKSHeaderPath(d.LUKSHeaderDirectory, d.DriveID)
+}
+
+func detachedLUKSHeaderPath(directory, driveID string) string {
+	if directory == "" {
+		return ""
+	}
+	return filepath.Join(directory, driveID+".luks-header")
+}
+
+//LUKSHeaderDevicePath returns the path that cryptsetup commands which only work
+//on the LUKS header shall be given for the LUKS container on the given drive:
+//the header file below headerDirectory with the drive's DriveID as name if it
+//exists, and the device itself otherwise.
+func LUKSHeaderDevicePath(headerDirectory string, drive os.Drive) string {
+	headerPath := detachedLUKSHeaderPath(headerDirectory, DriveIDOf(drive.DevicePath, drive.SerialNumber))
+	if headerPath == "" {
+		return drive.DevicePath
+	}
+	exists, err := fileExists(headerPath)
+	if err != nil {
+		util.LogError("cannot check for LUKS header of %s: %s", drive.DevicePath, err.Error())
+	}
+	if !exists {
+		return drive.DevicePath
+	}
+	return headerPath
+}
+
+//Checks whether the given file exists (the path is relative to the chroot).
+func fileExists(path string) (bool, error) {
+	//make path relative to working directory to account for chrootPath
+	_, err := sys_os.Stat(strings.TrimPrefix(path, "/"))
+	switch {
+	case err == nil:
+		return true, nil
+	case sys_os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+//convertLUKSContainer converts the LUKS container on the given device (which
+//must not be open, and will be opened with the given mapping name) into the
+//LUKS2 format if the drive's options ask for it and it is still in the LUKS1
+//format. A failed conversion is logged, but is not fatal since the LUKS1
+//container can still be used.
+func (d *Drive) convertLUKSContainer(osi os.Interface, devicePath, mappingName string) {
+	if !d.ConvertToLUKS2 || osi.GetLUKSVersion(devicePath) != 1 {
+		return
+	}
+
+	//keep the LUKS1 header around in case the conversion goes wrong; if a
+	//previous attempt already wrote a backup, that one is just as good
+	//(the file name uses the mapping name since device names are not stable
+	//across reboots)
+	backupPath := filepath.Join(d.LUKSHeaderBackupDirectory, mappingName+".luks1-header")
+	_, err := sys_os.Stat(strings.TrimPrefix(backupPath, "/"))
+	switch {
+	case err == nil:
+		util.LogInfo("reusing existing LUKS header backup for %s at %s", devicePath, backupPath)
+	case sys_os.IsNotExist(err):
+		if !osi.BackupLUKSHeader(devicePath, backupPath) {
+			util.LogError("will not convert LUKS container on %s to LUKS2: header backup failed", devicePath)
+			return
+		}
+	default:
+		util.LogError("will not convert LUKS container on %s to LUKS2: %s", devicePath, err.Error())
+		return
+	}
+
+	if osi.ConvertLUKSContainer(devicePath) {
+		util.LogInfo("LUKS container at %s converted to LUKS2 (LUKS1 header backup is at %s)", devicePath, backupPath)
+	} else {
+		util.LogError("conversion of LUKS container at %s to LUKS2 failed, will continue with LUKS1", devicePath)
+	}
+}
+
+//LUKSHeaderBackupPath returns the path of the file where BackupLUKSHeader
+//writes the backup of this drive's LUKS header.
+func (d *Drive) LUKSHeaderBackupPath() string {
+	return filepath.Join(d.LUKSHeaderBackupDirectory, d.DriveID+LUKSHeaderBackupSuffix)
+}
+
+//LUKSHeaderBackupSuffix is the file name suffix of the header backups written
+//by BackupLUKSHeader.
+const LUKSHeaderBackupSuffix = ".luks-header-backup"
+
+//BackupLUKSHeader refreshes the backup of the header of this drive's LUKS
+//container (if the drive's options ask for it, and the container is open).
+//Returns false if the backup failed.
+func (d *Drive) BackupLUKSHeader(osi os.Interface) bool {
+	device := d.Device
+	for device != nil {
+		switch dev := device.(type) {
+		case *BcacheDevice:
+			device = dev.mapped
+		case *LUKSDevice:
+			if dev.mapped == nil {
+				return true
+			}
+			return d.backupLUKSHeader(osi, dev.headerDevicePath())
+		default:
+			device = nil
+		}
+	}
+	return true
+}
+
+//backupLUKSHeader writes a backup of the header of the LUKS container on the
+//given device into LUKSHeaderBackupPath(), if the drive's options ask for it.
+//The backup is written into a temporary file first, so that an existing
+//backup is only replaced by a complete one.
+func (d *Drive) backupLUKSHeader(osi os.Interface, devicePath string) bool {
+	if !d.BackupLUKSHeaders {
+		return true
+	}
+	backupPath := d.LUKSHeaderBackupPath()
+	existed, err := fileExists(backupPath)
+	if err == nil {
+		//cryptsetup refuses to overwrite existing files
+		err = sys_os.Remove(strings.TrimPrefix(backupPath+".new", "/"))
+		if sys_os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		util.LogError("cannot back up LUKS header of %s: %s", devicePath, err.Error())
+		return false
+	}
+	if !osi.BackupLUKSHeader(devicePath, backupPath+".new") {
+		util.LogError("cannot back up LUKS header of %s", devicePath)
+		return false
+	}
+	err = sys_os.Rename(strings.TrimPrefix(backupPath+".new", "/"), strings.TrimPrefix(backupPath, "/"))
+	if err != nil {
+		util.LogError("cannot back up LUKS header of %s: %s", devicePath, err.Error())
+		return false
+	}
+	if existed {
+		util.LogDebug("refreshed LUKS header backup of %s at %s", devicePath, backupPath)
+	} else {
+		util.LogInfo("wrote LUKS header backup of %s to %s", devicePath, backupPath)
+	}
+	return true
+}
+
+//verifyLUKSHeader inspects the header of the LUKS container on the given
+//device before it is opened. Returns false (after logging the reason) if the
+//header cannot be read or is inconsistent, so that the drive is marked as
+//broken instead of failing with an opaque luksOpen error (or being mistaken
+//for a foreign drive).
+func (d *Drive) verifyLUKSHeader(osi os.Interface, devicePath string) bool {
+	info := osi.InspectLUKSHeader(devicePath)
+	d.LUKSHeader = &info
+	switch {
+	case info.Error != "":
+		util.LogError("LUKS header of %s is damaged: %s", devicePath, info.Error)
+		return false
+	case len(info.Problems) > 0:
+		util.LogError("LUKS header of %s is damaged: %s", devicePath, strings.Join(info.Problems, ", "))
+		return false
+	}
+	return true
+}
+
+//checkLUKSHeader inspects the header of the LUKS container on the given
+//device (which must be open), and reports headers that cannot be read, and
+//containers where all keyslots are in use (which prevents key rotation).
+func (d *Drive) checkLUKSHeader(osi os.Interface, devicePath string) {
+	info := osi.InspectLUKSHeader(devicePath)
+	d.LUKSHeader = &info
+	if info.Error != "" {
+		util.LogError("problem with LUKS header of %s: %s", devicePath, info.Error)
+		return
+	}
+	if info.KeyslotsExhausted() {
+		util.LogError("all %d keyslots of the LUKS container on %s are in use, so no new keys can be added to it", info.TotalKeyslots, devicePath)
+	}
+}
+
+//reconcileLUKSKeyslots adds each of the drive's Keys that does not unlock any
+//keyslot of the LUKS container on the given device (which must be open) to
+//the container, using one of the keys that does, if the drive's options ask
+//for it. This keeps containers that were created with an older set of keys
+//openable once those keys are retired. Failures are logged, but are not fatal
+//since the container is open already.
+func (d *Drive) reconcileLUKSKeyslots(osi os.Interface, devicePath string) {
+	if !d.ReconcileKeyslots || d.ReadOnly {
+		return
+	}
+
+	var (
+		workingKey  *os.LUKSKey
+		missingKeys []int
+	)
+	for idx := range d.Keys {
+		if osi.FindLUKSKeyslot(devicePath, d.Keys[idx]) < 0 {
+			missingKeys = append(missingKeys, idx)
+		} else if workingKey == nil {
+			workingKey = &d.Keys[idx]
+		}
+	}
+	if len(missingKeys) == 0 {
+		return
+	}
+	if workingKey == nil {
+		util.LogError("cannot reconcile keyslots of the LUKS container on %s: none of the configured keys unlocks a keyslot", devicePath)
+		return
+	}
+	if d.LUKSHeader != nil && d.LUKSHeader.KeyslotsExhausted() {
+		util.LogError("cannot reconcile keyslots of the LUKS container on %s: all %d keyslots are in use", devicePath, d.LUKSHeader.TotalKeyslots)
+		return
+	}
+
+	for _, idx := range missingKeys {
+		if !osi.AddLUKSKey(devicePath, *workingKey, d.Keys[idx]) {
+			util.LogError("cannot add key #%d to the LUKS container on %s", idx+1, devicePath)
+			break
+		}
+		util.LogInfo("added key #%d to the LUKS container on %s since it did not unlock any keyslot", idx+1, devicePath)
+	}
+	info := osi.InspectLUKSHeader(devicePath)
+	d.LUKSHeader = &info
+}
+
+//RotateLUKSKeys makes sure that the LUKS container on the given device has a
+//keyslot for the first of the given keys (the preferred key), and then wipes
+//all keyslots that are unlocked by one of the retired keys. Keyslots are only
+//wiped once the preferred key has been added, so that the container is never
+//left without a keyslot for one of the configured keys. Returns false if
+//anything went wrong.
+//
+//If all keyslots are in use and freeRetiredKeyslots is set, one keyslot that
+//is unlocked by one of the retired keys is wiped first to make room for the
+//preferred key. Keyslots that are not unlocked by any of the retired keys
+//(e.g. recovery passphrases that were added manually) are never wiped.
+func RotateLUKSKeys(osi os.Interface, devicePath string, keys, retiredKeys []os.LUKSKey, freeRetiredKeyslots bool) bool {
+	preferredSlot := osi.FindLUKSKeyslot(devicePath, keys[0])
+	if preferredSlot < 0 {
+		//any key that we know can be used to add the preferred key
+		var unlockKey *os.LUKSKey
+		for _, candidates := range [][]os.LUKSKey{keys[1:], retiredKeys} {
+			for idx := range candidates {
+				if unlockKey == nil && osi.FindLUKSKeyslot(devicePath, candidates[idx]) >= 0 {
+					unlockKey = &candidates[idx]
+				}
+			}
+		}
+		if unlockKey == nil {
+			util.LogError("cannot add preferred key to the LUKS container on %s: none of the configured keys unlocks a keyslot", devicePath)
+			return false
+		}
+		info := osi.InspectLUKSHeader(devicePath)
+		if info.KeyslotsExhausted() && freeRetiredKeyslots && freeRetiredKeyslot(osi, devicePath, *unlockKey, retiredKeys) {
+			info = osi.InspectLUKSHeader(devicePath)
+		}
+		if info.KeyslotsExhausted() {
+			util.LogError("cannot add preferred key to the LUKS container on %s: all %d keyslots are in use", devicePath, info.TotalKeyslots)
+			return false
+		}
+		if !osi.AddLUKSKey(devicePath, *unlockKey, keys[0]) {
+			return false
+		}
+		preferredSlot = osi.FindLUKSKeyslot(devicePath, keys[0])
+		if preferredSlot < 0 {
+			util.LogError("added preferred key to the LUKS container on %s, but it does not unlock any keyslot", devicePath)
+			return false
+		}
+		util.LogInfo("added preferred key to keyslot %d of the LUKS container on %s", preferredSlot, devicePath)
+	}
+
+	ok := true
+	for idx, key := range retiredKeys {
+		//a retired key may have been added to more than one keyslot; each removal
+		//either frees one of them or ends the search
+		for {
+			slot := osi.FindLUKSKeyslot(devicePath, key)
+			if slot < 0 {
+				break
+			}
+			if slot == preferredSlot {
+				util.LogError("retired key #%d unlocks the same keyslot of the LUKS container on %s as the preferred key, will not remove it", idx+1, devicePath)
+				ok = false
+				break
+			}
+			if !osi.RemoveLUKSKeyslot(devicePath, slot, keys[0]) {
+				ok = false
+				break
+			}
+			util.LogInfo("removed keyslot %d (unlocked by retired key #%d) from the LUKS container on %s", slot, idx+1, devicePath)
+		}
+	}
+	return ok
+}
+
+//Wipes one keyslot of the LUKS container on the given device that is unlocked
+//by one of the retired keys, but not the one that is unlocked by the
+//unlockKey (which is needed afterwards to add the preferred key). Returns
+//whether a keyslot was freed.
+func freeRetiredKeyslot(osi os.Interface, devicePath string, unlockKey os.LUKSKey, retiredKeys []os.LUKSKey) bool {
+	unlockSlot := osi.FindLUKSKeyslot(devicePath, unlockKey)
+	for idx, key := range retiredKeys {
+		slot := osi.FindLUKSKeyslot(devicePath, key)
+		if slot < 0 || slot == unlockSlot {
+			continue
+		}
+		if !osi.RemoveLUKSKeyslot(devicePath, slot, unlockKey) {
+			return false
+		}
+		util.LogInfo("freed keyslot %d (unlocked by retired key #%d) of the LUKS container on %s to make room for the preferred key", slot, idx+1, devicePath)
+		return true
+	}
+	util.LogError("cannot free a keyslot of the LUKS container on %s: none of the retired keys unlocks a keyslot that can be wiped", devicePath)
+	return false
+}
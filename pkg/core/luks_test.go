@@ -0,0 +1,160 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+)
+
+func TestRotateLUKSKeysFreesOnlyRetiredKeyslots(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	osi := os.NewFake()
+	osi.SetLUKSKeyslots("/dev/sda", "current", "retired", "recovery")
+	keys := []os.LUKSKey{{Secret: "new"}, {Secret: "current"}}
+	retiredKeys := []os.LUKSKey{{Secret: "retired"}}
+
+	if !RotateLUKSKeys(osi, "/dev/sda", keys, retiredKeys, true) {
+		t.Error("expected key rotation to succeed")
+	}
+	for _, secret := range []string{"new", "current", "recovery"} {
+		if osi.FindLUKSKeyslot("/dev/sda", os.LUKSKey{Secret: secret}) < 0 {
+			t.Errorf("expected %q to unlock a keyslot after key rotation", secret)
+		}
+	}
+	if slot := osi.FindLUKSKeyslot("/dev/sda", retiredKeys[0]); slot >= 0 {
+		t.Errorf("expected retired key to be removed, but it still unlocks keyslot %d", slot)
+	}
+}
+
+func TestRotateLUKSKeysKeepsUnknownKeyslots(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	//all keyslots are in use, but none by a retired key, so there is no room
+	//for the new key
+	osi := os.NewFake()
+	osi.SetLUKSKeyslots("/dev/sda", "current", "recovery")
+	keys := []os.LUKSKey{{Secret: "new"}, {Secret: "current"}}
+	retiredKeys := []os.LUKSKey{{Secret: "retired"}}
+
+	if RotateLUKSKeys(osi, "/dev/sda", keys, retiredKeys, true) {
+		t.Error("expected key rotation to fail")
+	}
+	for _, secret := range []string{"current", "recovery"} {
+		if osi.FindLUKSKeyslot("/dev/sda", os.LUKSKey{Secret: secret}) < 0 {
+			t.Errorf("expected %q to still unlock a keyslot", secret)
+		}
+	}
+}
+
+func TestConvergeKeepsUnknownKeyslots(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	//opening a container with exhausted keyslots shall only report this, and
+	//leave the keyslot that none of our keys unlocks alone
+	osi := os.NewFake()
+	osi.AddDriveWithContents("/dev/sda", "SERIAL1", os.FakeDriveContents{Encrypted: true, Formatted: true})
+	osi.SetLUKSKeyslots("/dev/sda", "current", "recovery")
+	drives := discoverFakeDrives(osi, DriveOptions{Keys: []os.LUKSKey{{Secret: "current"}}})
+	defer unregisterDrives(drives)
+	convergeDrives(drives, nil, osi)
+
+	if drives[0].Broken || drives[0].LUKSHeader == nil || !drives[0].LUKSHeader.KeyslotsExhausted() {
+		t.Errorf("expected drive to be set up with exhausted keyslots, got broken = %t, header = %#v", drives[0].Broken, drives[0].LUKSHeader)
+	}
+	if osi.FindLUKSKeyslot("/dev/sda", os.LUKSKey{Secret: "recovery"}) < 0 {
+		t.Error("expected the recovery keyslot to survive")
+	}
+}
+
+func TestLUKSContainerWithUnknownKeysIsForeign(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	osi := os.NewFake()
+	osi.AddDriveWithContents("/dev/sda", "SERIAL1", os.FakeDriveContents{Encrypted: true, Formatted: true})
+	osi.SetLUKSKeyslots("/dev/sda", "someone else's key")
+	drives := discoverFakeDrives(osi, DriveOptions{Keys: []os.LUKSKey{{Secret: "our key"}}})
+	defer unregisterDrives(drives)
+	convergeDrives(drives, nil, osi)
+
+	if !drives[0].Foreign || drives[0].Broken {
+		t.Errorf("expected drive to be foreign and not broken, got foreign = %t, broken = %t", drives[0].Foreign, drives[0].Broken)
+	}
+}
+
+func TestFailedLUKSOpenIsNotForeign(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	//e.g. the device is busy: the keys were never rejected, so this must not
+	//be taken as a foreign drive
+	osi := os.NewFake()
+	osi.AddDriveWithContents("/dev/sda", "SERIAL1", os.FakeDriveContents{Encrypted: true, Formatted: true})
+	osi.SetLUKSKeyslots("/dev/sda", "our key")
+	osi.FailLUKSOpen("/dev/sda")
+	drives := discoverFakeDrives(osi, DriveOptions{Keys: []os.LUKSKey{{Secret: "our key"}}})
+	defer unregisterDrives(drives)
+	convergeDrives(drives, nil, osi)
+
+	if drives[0].Foreign || !drives[0].Broken {
+		t.Errorf("expected drive to be broken and not foreign, got foreign = %t, broken = %t", drives[0].Foreign, drives[0].Broken)
+	}
+}
+
+func TestConvergeSetsUpNewLUKSDriveInOneRun(t *testing.T) {
+	defer enterFakeChroot(t)()
+
+	//a factory-fresh drive is encrypted, formatted and mounted by the same
+	//Converge()
+	osi := os.NewFake()
+	osi.AddDrive("/dev/sda", "SERIAL1")
+	opts := DriveOptions{
+		Keys:          []os.LUKSKey{{Secret: "current"}},
+		FormatOptions: []string{"-i", "size=1024"},
+	}
+	drives := discoverFakeDrives(osi, opts)
+	defer unregisterDrives(drives)
+	osi.RefreshMountPoints()
+	osi.RefreshLUKSMappings()
+	d := drives[0]
+	d.Converge(osi)
+
+	if d.Broken {
+		t.Fatal("expected drive not to be broken")
+	}
+	if devType := osi.ClassifyDevice("/dev/sda"); devType != os.DeviceTypeLUKS {
+		t.Errorf("expected /dev/sda to contain a LUKS container, got %d", devType)
+	}
+	mappedDevicePath := "/dev/mapper/" + d.DeviceName
+	if devType := osi.ClassifyDevice(mappedDevicePath); devType != os.DeviceTypeFilesystem {
+		t.Errorf("expected %s to contain a filesystem, got %d", mappedDevicePath, devType)
+	}
+	if args := osi.FormatArgs(mappedDevicePath); strings.Join(args, " ") != "-i size=1024" {
+		t.Errorf("expected mkfs.xfs to be called with the configured format options, got %v", args)
+	}
+	if d.FormattedAt.IsZero() {
+		t.Error("expected FormattedAt to be set")
+	}
+	if m := osi.GetMountPointsOf(mappedDevicePath, os.HostScope); len(m) != 1 || d.MountedPath() != m[0].MountPath {
+		t.Errorf("expected %s to be mounted at %s, got %#v", mappedDevicePath, d.MountedPath(), m)
+	}
+}
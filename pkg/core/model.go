@@ -19,7 +19,12 @@
 
 package core
 
-import "github.com/sapcc/swift-drive-autopilot/pkg/os"
+import (
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
 
 //Device is implemented by each model class that represents the contents of a
 //device. Each method in the interface takes a reference to the drive that
@@ -41,12 +46,39 @@ type Device interface {
 	Validate(drive *Drive, osi os.Interface) error
 }
 
-//Returns nil to indicate unreadable device.
-func newDevice(devicePath string, osi os.Interface, preferLUKS bool) Device {
+//Like newDevice, but for the topmost device of a drive, where additional
+//layers may be requested by the drive's options.
+func newDeviceForDrive(d *Drive, osi os.Interface) Device {
+	preferLUKS := len(d.Keys) > 0
+	luksHeaderPath := d.DetachedLUKSHeaderPath()
+	//(this does not depend on preferLUKS: if no keys are configured, the drive
+	//must still not be mistaken for an empty one)
+	if d.PlainCrypt != nil && osi.ClassifyDevice(d.DevicePath) == os.DeviceTypeUnknown {
+		return &PlainCryptDevice{path: d.DevicePath}
+	}
+	if d.CacheDevicePath != "" && osi.ClassifyDevice(d.DevicePath) == os.DeviceTypeUnknown {
+		return &BcacheDevice{path: d.DevicePath, formatted: false, preferLUKS: preferLUKS, luksHeaderPath: luksHeaderPath}
+	}
+	return newDevice(d.DevicePath, osi, preferLUKS, luksHeaderPath)
+}
+
+//Returns nil to indicate unreadable device. If preferLUKS is set and a
+//luksHeaderPath is given, LUKS containers on this device have their header in
+//that file.
+func newDevice(devicePath string, osi os.Interface, preferLUKS bool, luksHeaderPath string) Device {
 	switch osi.ClassifyDevice(devicePath) {
 	case os.DeviceTypeUnreadable:
 		break
 	case os.DeviceTypeUnknown:
+		if preferLUKS && luksHeaderPath != "" {
+			//a LUKS container with a detached header looks like random data
+			exists, err := fileExists(luksHeaderPath)
+			if err != nil {
+				util.LogError("cannot check for LUKS header of %s: %s", devicePath, err.Error())
+				return nil
+			}
+			return &LUKSDevice{path: devicePath, formatted: exists, headerPath: luksHeaderPath}
+		}
 		if preferLUKS {
 			return &LUKSDevice{path: devicePath, formatted: false}
 		}
@@ -64,16 +96,155 @@ func newDevice(devicePath string, osi os.Interface, preferLUKS bool) Device {
 type Drive struct {
 	DevicePath string
 	Device     Device
+	//BackingDevicePath is only set if DevicePath refers to a stacked device
+	//(e.g. a bcache device), and then contains the path of the physical device
+	//below it.
+	BackingDevicePath string
+	//SerialNumber is empty if the serial number of the drive could not be
+	//determined (the DriveID is then derived from the DevicePath instead).
+	SerialNumber string
 
 	//state machine
 	Broken bool
+	//Foreign is set when the drive contains a LUKS container that none of our
+	//keys can open. Such a drive probably belongs to a different cluster and may
+	//contain data that is still needed, so it is neither set up nor formatted,
+	//but it is not flagged as broken either.
+	Foreign bool
+	//Encrypting is set while the drive's filesystem is being converted into a
+	//LUKS container (see HasUnencryptedFilesystem). In the meantime, the drive
+	//is neither set up nor torn down.
+	Encrypting bool
+	//ZFSPoolMember is set when the drive (or one of its partitions) is a member
+	//of a ZFS pool. Such a drive is never set up, since that would destroy the
+	//pool's data.
+	ZFSPoolMember bool
+	//LockedElsewhere is set while another process holds the advisory lock on
+	//the drive (see Safeguards.DeviceLockTimeout), so that it could not be set
+	//up. Since its swift-id cannot be read in the meantime, automatic swift-id
+	//assignment is blocked like for broken drives.
+	LockedElsewhere bool
 
 	//DriveID identifies this drive in derived filenames.
 	DriveID string
+	//DeviceName is used as the name of the drive's LUKS mapping and temporary
+	//mountpoint. It is derived from the DriveID (see HashDeviceNames).
+	DeviceName string
+	//Export is set while this broken drive is exposed read-only (see
+	//ExportReadOnly).
+	Export *ReadOnlyExport
 	//Assignment identifies this drive's location within the Swift ring.
 	Assignment *Assignment
+	//Topology describes where this drive is attached in the hardware topology
+	//(nil if unknown).
+	Topology *os.TopologyHints
+	//Firmware describes the firmware of this drive and its storage controller
+	//(nil if unknown).
+	Firmware *os.FirmwareInfo
+	//LUKSHeader describes the header of this drive's LUKS container (nil if the
+	//drive is not encrypted, or the container has not been opened yet).
+	LUKSHeader *os.LUKSHeaderInfo
+	//LayoutVersion is the version of the on-drive layout of this drive's
+	//filesystem (see LayoutMigrations). It is 0 until the filesystem has been
+	//mounted, and for filesystems that could not be migrated in read-only mode.
+	LayoutVersion int
+	//MountedAt is when this drive was last mounted below /srv/node by us,
+	//BrokenAt is when it was last flagged as broken, and FormattedAt is when we
+	//last created a filesystem on it (all zero if not yet).
+	MountedAt   time.Time
+	BrokenAt    time.Time
+	FormattedAt time.Time
+	//FilesystemUUID is the UUID of this drive's filesystem (empty until the
+	//filesystem has been mounted, or if it cannot be determined).
+	FilesystemUUID string
+	//logMappingName is the name of the LUKS mapping for the external XFS log
+	//device, if it has been opened.
+	logMappingName string
+
+	DriveOptions
+}
+
+//DriveOptions contains the configuration that determines how a drive is set
+//up.
+type DriveOptions struct {
 	//Keys contains the LUKS encryption keys that may be used with this drive. When
 	//creating a new LUKS container on this drive, Keys[0] must be used. An empty
 	//slice indicates that encryption is not configured.
-	Keys []string
+	Keys []os.LUKSKey
+	//CacheDevicePath is the device file of a bcache cache device. If not empty,
+	//an empty drive will be set up as a bcache backing device attached to this
+	//cache (before LUKS containers or filesystems are created).
+	CacheDevicePath string
+	//LogDevicePath is the device file for an external XFS log. If not empty, the
+	//filesystem on this drive is created and mounted with its log on this
+	//device. If encryption is configured, the log device is encrypted as well.
+	LogDevicePath string
+	//MountOptions are given to mount(8) when mounting this drive's filesystem.
+	MountOptions []string
+	//FormatOptions are given to mkfs.xfs when creating this drive's filesystem.
+	FormatOptions []string
+	//WipeSignatures indicates that stale signatures shall be wiped from empty
+	//devices before a bcache device, LUKS container or filesystem is created on
+	//them (see os.Interface.WipeSignatures).
+	WipeSignatures bool
+	//LUKSFormatOptions are used when creating LUKS containers on this drive.
+	LUKSFormatOptions os.LUKSFormatOptions
+	//ConvertToLUKS2 indicates that LUKS1 containers on this drive shall be
+	//converted into the LUKS2 format before they are opened. Before the
+	//conversion, a backup of the LUKS1 header is written into
+	//LUKSHeaderBackupDirectory.
+	ConvertToLUKS2            bool
+	LUKSHeaderBackupDirectory string
+	//BackupLUKSHeaders indicates that a backup of the header of this drive's
+	//LUKS container shall be kept in LUKSHeaderBackupDirectory (see
+	//BackupLUKSHeader).
+	BackupLUKSHeaders bool
+	//VerifyLUKSHeaders indicates that the header of this drive's LUKS container
+	//shall be checked for consistency before the container is opened. A drive
+	//with a damaged header is marked as broken.
+	VerifyLUKSHeaders bool
+	//PlainCrypt, if not nil, indicates that this drive is encrypted with plain
+	//dm-crypt using these parameters if it does not contain a LUKS container or
+	//a filesystem (see PlainCryptDevice).
+	PlainCrypt *os.PlainCryptOptions
+	//LUKSHeaderDirectory, if not empty, is where new LUKS containers on this
+	//drive store their header, instead of at the start of the device (see
+	//DetachedLUKSHeaderPath). This directory must exist already.
+	LUKSHeaderDirectory string
+	//ReconcileKeyslots indicates that, after a LUKS container on this drive has
+	//been opened, each of the Keys that does not unlock any of its keyslots
+	//shall be added to it.
+	ReconcileKeyslots bool
+	//Optional indicates that this drive is not critical for Swift (e.g. a
+	//scratch or cache device). Its setup works just like for any other drive,
+	//but callers do not let its failure affect readiness or exit status.
+	Optional bool
+	//ExpectedFilesystemUUID is the UUID of the filesystem that was last seen on
+	//this drive. If the drive turns out to contain a different filesystem that
+	//was not created by us (e.g. because the drive was swapped for one from
+	//elsewhere), it is not mounted below /srv/node until it has been adopted.
+	//An empty value indicates that no filesystem has been seen yet.
+	ExpectedFilesystemUUID string
+	//SwiftIDChecksums indicates that the swift-id file on this drive shall be
+	//protected by a checksum file. A drive whose swift-id file does not match
+	//its checksum is not mounted below /srv/node.
+	SwiftIDChecksums bool
+	//HashDeviceNames indicates that the DeviceName shall be a hash of the
+	//drive's serial number instead of the serial number itself.
+	HashDeviceNames bool
+	//Hooks are run before and after the individual steps of the drive setup.
+	Hooks Hooks
+	//Labels are passed to hooks in environment variables (see LabelEnv).
+	Labels map[string]string
+	//PostMountActions are called after the drive has been mounted below
+	///srv/node.
+	PostMountActions []PostMountAction
+	//ReadOnly indicates that nothing may be written to this drive: LUKS
+	//containers are opened and filesystems are mounted read-only, empty drives
+	//are not formatted, and no swift-id is assigned.
+	ReadOnly bool
+	//NoFormatReason, if not empty, forbids formatting this drive if it is
+	//empty. It explains why for the log, e.g. "since the drive is not listed in
+	//the drive manifest".
+	NoFormatReason string
 }
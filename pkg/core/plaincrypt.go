@@ -0,0 +1,164 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//PlainCryptDevice is a device that is encrypted with plain dm-crypt, i.e.
+//without a LUKS header (see DriveOptions.PlainCrypt). Such devices are only
+//opened, never created: Since plain dm-crypt accepts any key, an empty device
+//cannot be told apart from one that is opened with the wrong key or
+//parameters.
+type PlainCryptDevice struct {
+	path string
+
+	//internal state
+	mapped      Device
+	mappingName string
+}
+
+//DevicePath implements the Device interface.
+func (d *PlainCryptDevice) DevicePath() string {
+	return d.path
+}
+
+//MountedPath implements the Device interface.
+func (d *PlainCryptDevice) MountedPath() string {
+	if d.mapped == nil {
+		return ""
+	}
+	return d.mapped.MountedPath()
+}
+
+//Setup implements the Device interface.
+func (d *PlainCryptDevice) Setup(drive *Drive, osi os.Interface) bool {
+	//sanity check (and recognize pre-existing mapping before attempting our own)
+	err := d.Validate(drive, osi)
+	if err != nil {
+		util.LogError(err.Error())
+		return false
+	}
+	if len(drive.Keys) == 0 {
+		util.LogError("PlainCryptDevice.Setup called on %s, but no keys specified!", d.path)
+		return false
+	}
+
+	if d.mapped == nil {
+		if !drive.runHook(BeforeLUKSOpenHook, d.path, "") {
+			return false
+		}
+		//try each key until the mapped device contains a filesystem
+		for idx, key := range drive.Keys {
+			mappedDevicePath, ok := osi.OpenPlainCryptMapping(d.path, drive.DeviceName, key, *drive.PlainCrypt, drive.ReadOnly)
+			if !ok {
+				return false
+			}
+			if osi.ClassifyDevice(mappedDevicePath) == os.DeviceTypeFilesystem {
+				util.LogInfo("plain dm-crypt device %s opened as %s", d.path, mappedDevicePath)
+				drive.runHook(AfterLUKSOpenHook, d.path, "")
+				d.mapped = newDevice(mappedDevicePath, osi, false, "")
+				d.mappingName = drive.DeviceName
+				break
+			}
+			util.LogDebug("plain dm-crypt mapping of %s with key %d does not contain a filesystem", d.path, idx)
+			if !osi.CloseLUKSContainer(drive.DeviceName) {
+				return false
+			}
+		}
+		if d.mapped == nil {
+			util.LogError("plain dm-crypt device %s does not contain a filesystem with any of the configured keys", d.path)
+			drive.Foreign = true
+			return false
+		}
+	}
+
+	//descend into decrypted drive
+	return d.mapped.Setup(drive, osi)
+}
+
+//Teardown implements the Device interface.
+func (d *PlainCryptDevice) Teardown(drive *Drive, osi os.Interface) bool {
+	//need to teardown contents of mapped device first
+	if d.mapped != nil {
+		ok := d.mapped.Teardown(drive, osi)
+		if ok {
+			d.mapped = nil
+		} else {
+			return false
+		}
+	}
+
+	//unmap device if necessary
+	if d.mappingName != "" {
+		ok := osi.CloseLUKSContainer(d.mappingName)
+		if ok {
+			util.LogInfo("plain dm-crypt mapping /dev/mapper/%s closed", d.mappingName)
+			d.mappingName = ""
+		} else {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Validate implements the Device interface.
+func (d *PlainCryptDevice) Validate(drive *Drive, osi os.Interface) error {
+	mappedDevicePath := osi.GetLUKSMappingOf(d.path)
+
+	if mappedDevicePath == "" {
+		if d.mapped != nil {
+			return fmt.Errorf("plain dm-crypt device %s should be open at %s, but is not",
+				d.path, d.mapped.DevicePath(),
+			)
+		}
+	} else if d.mapped == nil {
+		//existing mapping is now discovered for the first time -> update ourselves
+		util.LogInfo("discovered %s to be mapped to %s already", d.path, mappedDevicePath)
+		d.mapped = newDevice(mappedDevicePath, osi, false, "")
+	} else if mappedDevicePath != d.mapped.DevicePath() {
+		//our internal state tells a different story!
+		return fmt.Errorf("plain dm-crypt device %s should be open at %s, but is actually open at %s",
+			d.path, d.mapped.DevicePath(), mappedDevicePath,
+		)
+	}
+
+	//an encrypted device should not be mounted itself
+	err := os.ForeachMountScopeOrError(func(scope os.MountScope) error {
+		if len(osi.GetMountPointsOf(d.path, scope)) > 0 {
+			return fmt.Errorf("%s is mapped with plain dm-crypt, but is also mounted directly in %s mount namespace", d.path, scope)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//mapping is looking good -> drill down into the mapped device
+	if d.mapped == nil {
+		return nil
+	}
+	return d.mapped.Validate(drive, osi)
+}
@@ -0,0 +1,86 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package core
+
+import (
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Safeguards protect drives from being set up (and especially formatted) by
+//mistake. They are shared by the converger of the swift-drive-autopilot
+//binary and by pkg/autopilot.Manager, so that both refuse to touch the same
+//drives. (Members of ZFS pools and drives with foreign LUKS containers are
+//always left alone by Drive.Converge, so they need no configuration here.)
+type Safeguards struct {
+	//ExpectedDriveIDs, if not nil, lists the IDs of the drives that may be
+	//formatted (see `drive-manifest` in the README). Other drives are still set
+	//up if they contain a filesystem already, but are never formatted.
+	ExpectedDriveIDs map[string]bool
+	//DeviceLockTimeout, if not zero, enables the advisory lock on the physical
+	//drive that is held while the drive is set up (see `device-locking` in the
+	//README), and is how long we wait for other processes to release it.
+	DeviceLockTimeout time.Duration
+}
+
+//Protect is called once for each newly discovered drive, before it is set up
+//for the first time. The expectedFilesystemUUID is the UUID of the filesystem
+//that was last seen on this drive (see ExpectedFilesystemUUID), or empty if it
+//is not known or shall not be verified.
+func (s Safeguards) Protect(d *Drive, expectedFilesystemUUID string) {
+	if expectedFilesystemUUID != "" {
+		d.ExpectedFilesystemUUID = expectedFilesystemUUID
+	}
+	if s.ExpectedDriveIDs != nil && !s.ExpectedDriveIDs[d.DriveID] {
+		util.LogInfo("%s is not listed in the drive manifest, so it will not be formatted", d.DevicePath)
+		d.NoFormatReason = "since the drive is not listed in the drive manifest"
+	}
+}
+
+//Lock takes the advisory lock on the physical drive if device locking is
+//enabled. The returned function releases the lock.
+func (s Safeguards) Lock(osi os.Interface, d *Drive) (unlock func(), err error) {
+	if s.DeviceLockTimeout == 0 {
+		return func() {}, nil
+	}
+	return osi.LockDevice(d.PhysicalDevicePath(), s.DeviceLockTimeout)
+}
+
+//Converge calls d.Converge() while holding the lock from Lock(). If the lock
+//cannot be taken because another process holds it, the drive is not touched
+//and the error is returned. In that case, a drive that is not set up yet is
+//flagged as LockedElsewhere, so that UpdateDriveAssignments() does not
+//auto-assign swift-ids in the meantime.
+func (s Safeguards) Converge(osi os.Interface, d *Drive) error {
+	unlock, err := s.Lock(osi, d)
+	if err != nil {
+		if !d.Broken && d.MountedPath() == "" {
+			d.LockedElsewhere = true
+		}
+		return err
+	}
+	defer unlock()
+	d.LockedElsewhere = false
+
+	d.Converge(osi)
+	return nil
+}
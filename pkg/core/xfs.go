@@ -23,6 +23,8 @@ import (
 	"fmt"
 	sys_os "os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
 	"github.com/sapcc/swift-drive-autopilot/pkg/os"
@@ -36,6 +38,14 @@ type XFSDevice struct {
 
 	//internal state
 	mountPath string
+	//whether the layout version has been checked (see migrateLayout), and
+	//whether the filesystem was created by us (and thus has the current layout)
+	layoutChecked   bool
+	freshFilesystem bool
+	//the mount options for which a remount was already attempted, and for which
+	//we already complained that a remount did not help (per mount scope)
+	remountedWith        map[os.MountScope]string
+	reportedStaleOptions map[os.MountScope]string
 }
 
 //DevicePath implements the Device interface.
@@ -57,6 +67,12 @@ func (d *XFSDevice) Setup(drive *Drive, osi os.Interface) bool {
 		return false
 	}
 
+	//prepare external log device (if any)
+	logDevicePath, ok := drive.prepareLogDevice(osi, !d.formatted)
+	if !ok {
+		return false
+	}
+
 	//format on first use
 	if !d.formatted {
 		//double-check that disk is empty
@@ -64,11 +80,24 @@ func (d *XFSDevice) Setup(drive *Drive, osi os.Interface) bool {
 			util.LogError("XFSDevice.Setup called on %s, but is not empty!", d.path)
 			return false
 		}
+		if reason := drive.formatRefusal(); reason != "" {
+			util.LogError("will not create XFS filesystem on %s %s", d.path, reason)
+			return false
+		}
 
-		ok := osi.FormatDevice(d.path)
+		if !drive.wipeSignatures(osi, d.path) {
+			return false
+		}
+		if !drive.runHook(BeforeFormatHook, d.path, "") {
+			return false
+		}
+		ok := osi.FormatDevice(d.path, logDevicePath, drive.FormatOptions)
 		if ok {
 			d.formatted = true
+			d.freshFilesystem = true
+			drive.FormattedAt = time.Now()
 			util.LogDebug("XFS filesystem created on %s", d.path)
+			drive.runHook(AfterFormatHook, d.path, "")
 		} else {
 			return false
 		}
@@ -79,7 +108,7 @@ func (d *XFSDevice) Setup(drive *Drive, osi os.Interface) bool {
 
 	//tear down all mounts not matching the desired mount path (esp. the
 	//temporary mount in /run when moving to the final mount in /srv/node)
-	ok := os.ForeachMountScope(func(scope os.MountScope) bool {
+	ok = os.ForeachMountScope(func(scope os.MountScope) bool {
 		for _, m := range osi.GetMountPointsOf(d.path, scope) {
 			if m.MountPath != mountPath {
 				if !osi.UnmountDevice(m.MountPath, scope) {
@@ -96,15 +125,39 @@ func (d *XFSDevice) Setup(drive *Drive, osi os.Interface) bool {
 		d.mountPath = ""
 	}
 
-	//perform the mount
+	//perform the mount (hooks only run for the final mount in /srv/node, and
+	//only if it is not in place yet)
+	options := drive.effectiveMountOptions()
+	if logDevicePath != "" {
+		options = append(options, "logdev="+logDevicePath)
+	}
+	runMountHooks := d.mountPath != mountPath && filepath.Dir(mountPath) == "/srv/node"
+	if runMountHooks && !drive.runHook(BeforeMountHook, d.path, mountPath) {
+		return false
+	}
 	ok = os.ForeachMountScope(func(scope os.MountScope) bool {
-		return osi.MountDevice(d.path, mountPath, scope)
+		return osi.MountDevice(d.path, mountPath, options, scope)
 	})
 	if ok {
 		d.mountPath = mountPath
 	} else {
 		return false
 	}
+	if !d.layoutChecked {
+		if !drive.migrateLayout(osi, mountPath, d.freshFilesystem) {
+			return false
+		}
+		drive.checkFilesystemUUID(osi, d.path, d.freshFilesystem)
+		d.layoutChecked = true
+	}
+	if runMountHooks {
+		drive.MountedAt = time.Now()
+		drive.runHook(AfterMountHook, d.path, mountPath)
+		for _, action := range drive.PostMountActions {
+			action(drive, mountPath)
+		}
+	}
+	d.migrateMountOptions(osi, drive.effectiveMountOptions())
 
 	//clear unmount-propagation flag if necessary (TODO swift.Interface)
 	if filepath.Dir(mountPath) == "/srv/node" {
@@ -120,6 +173,78 @@ func (d *XFSDevice) Setup(drive *Drive, osi os.Interface) bool {
 	return true
 }
 
+//Returns the options for mounting this drive's filesystem. In read-only mode,
+//"norecovery" is needed in addition to "ro" since XFS would otherwise replay
+//its log (and thus write to the drive) when the filesystem was not unmounted
+//cleanly.
+func (d *Drive) effectiveMountOptions() []string {
+	options := append([]string(nil), d.MountOptions...)
+	if d.ReadOnly {
+		options = append(options, "ro", "norecovery")
+	}
+	return options
+}
+
+//Checks whether the active mounts of this device are using all of the given
+//mount options (e.g. after the configured mount options changed). If not, a
+//remount is attempted to apply them. Some options cannot be changed by a
+//remount; for those, the drive needs a full unmount cycle, which we do not
+//perform automatically since it would interrupt Swift. Instead, this is
+//reported in the log.
+func (d *XFSDevice) migrateMountOptions(osi os.Interface, options []string) {
+	if len(options) == 0 {
+		return
+	}
+	if d.remountedWith == nil {
+		d.remountedWith = make(map[os.MountScope]string)
+		d.reportedStaleOptions = make(map[os.MountScope]string)
+	}
+	optionsStr := strings.Join(options, ",")
+
+	os.ForeachMountScope(func(scope os.MountScope) bool {
+		for _, m := range osi.GetMountPointsOf(d.path, scope) {
+			if m.MountPath != d.mountPath {
+				continue
+			}
+			stale := staleMountOptions(m, options)
+			if len(stale) == 0 {
+				continue
+			}
+
+			if d.remountedWith[scope] != optionsStr {
+				d.remountedWith[scope] = optionsStr
+				if osi.RemountDevice(m.MountPath, options, scope) {
+					util.LogInfo("remounted %s in %s mount namespace to apply changed mount options: %s",
+						m.MountPath, scope, strings.Join(stale, ","))
+				}
+				continue
+			}
+			if d.reportedStaleOptions[scope] != optionsStr {
+				d.reportedStaleOptions[scope] = optionsStr
+				util.LogError("mount options %s could not be applied to %s in %s mount namespace by remounting; the drive needs to be unmounted and mounted again to apply them",
+					strings.Join(stale, ","), m.MountPath, scope)
+			}
+		}
+		return true
+	})
+}
+
+//Returns those of the given options that are not in effect for the given
+//mount. If the active options of the mount are not known (e.g. because we
+//just mounted it ourselves), nothing is reported.
+func staleMountOptions(m os.MountPoint, options []string) []string {
+	if m.Options == nil {
+		return nil
+	}
+	var result []string
+	for _, option := range options {
+		if !m.Options[option] {
+			result = append(result, option)
+		}
+	}
+	return result
+}
+
 //Teardown implements the Device interface.
 func (d *XFSDevice) Teardown(drive *Drive, osi os.Interface) bool {
 	//remove all mounts of this device
@@ -137,6 +262,7 @@ func (d *XFSDevice) Teardown(drive *Drive, osi os.Interface) bool {
 
 	if ok {
 		d.mountPath = ""
+		drive.teardownLogDevice(osi)
 	}
 	return ok
 }
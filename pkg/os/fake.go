@@ -0,0 +1,633 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Fake is an in-memory implementation of Interface that does not execute any
+//commands. It is used for benchmarks and tests of the packages that build on
+//Interface, and starts out with a set of empty drives (see AddDrive). All
+//its methods succeed, and the mount scopes are not separate.
+type Fake struct {
+	mutex       sync.Mutex
+	drives      []Drive
+	contents    map[string]DeviceType //by device path
+	fsUUIDs     map[string]string     //by device path
+	luksMaps    map[string]string     //backing device path -> mapped device path
+	mountPoints []MountPoint
+	swiftIDs    map[string]string //by device path
+	checksums   map[string]string //by device path (the checksummed swift-id)
+	layouts     map[string]int    //by device path
+	//the contents of LUKS containers that were added by AddDriveWithContents,
+	//which appear on the mapped device once the container is opened
+	luksContents map[string]FakeDriveContents //by backing device path
+	//the secrets in each keyslot ("" for free keyslots) of LUKS containers that
+	//were set up by SetLUKSKeyslots
+	luksKeyslots map[string][]string //by header device path
+	//devices where the next OpenLUKSContainer fails (see FailLUKSOpen)
+	luksOpenFailures map[string]bool
+	//the extraArgs of the last FormatDevice on each device
+	formatArgs map[string][]string //by device path
+}
+
+//NewFake initializes a Fake without any drives.
+func NewFake() *Fake {
+	return &Fake{
+		contents:     make(map[string]DeviceType),
+		fsUUIDs:      make(map[string]string),
+		luksMaps:     make(map[string]string),
+		swiftIDs:     make(map[string]string),
+		checksums:    make(map[string]string),
+		layouts:      make(map[string]int),
+		luksContents: make(map[string]FakeDriveContents),
+		luksKeyslots: make(map[string][]string),
+
+		luksOpenFailures: make(map[string]bool),
+		formatArgs:       make(map[string][]string),
+	}
+}
+
+//FailLUKSOpen makes the next OpenLUKSContainer on the given device fail for a
+//reason other than the keys (e.g. because the device is busy).
+func (f *Fake) FailLUKSOpen(devicePath string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.luksOpenFailures[devicePath] = true
+}
+
+//SetLUKSKeyslots sets the keyslots of the LUKS container on the given device:
+//Each of the given secrets ("" for a free keyslot) is in the keyslot with the
+//same index. By default, a container has a single keyslot that is unlocked by
+//any key.
+func (f *Fake) SetLUKSKeyslots(devicePath string, secrets ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.luksKeyslots[devicePath] = secrets
+}
+
+//FormatArgs returns the extra arguments that were given when the filesystem on
+//the given device was created (or nil if FormatDevice was never called on it).
+func (f *Fake) FormatArgs(devicePath string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.formatArgs[devicePath]
+}
+
+//AddDrive adds an empty drive that will be reported by the next call to
+//DriveScanner.Scan().
+func (f *Fake) AddDrive(devicePath, serialNumber string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.drives = append(f.drives, Drive{DevicePath: devicePath, FoundAtPath: devicePath, SerialNumber: serialNumber})
+	f.contents[devicePath] = DeviceTypeUnknown
+}
+
+//FakeDriveContents describes the initial contents of a drive that is added by
+//AddDriveWithContents.
+type FakeDriveContents struct {
+	//Encrypted is whether the drive contains a LUKS container. The other fields
+	//then describe the contents of the container.
+	Encrypted bool
+	//Formatted is whether the drive contains a filesystem.
+	Formatted bool
+	//SwiftID is the swift-id on the filesystem (if any).
+	SwiftID string
+}
+
+//AddDriveWithContents is like AddDrive, but the drive is not empty.
+func (f *Fake) AddDriveWithContents(devicePath, serialNumber string, contents FakeDriveContents) {
+	f.AddDrive(devicePath, serialNumber)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if contents.Encrypted {
+		f.contents[devicePath] = DeviceTypeLUKS
+		contents.Encrypted = false
+		f.luksContents[devicePath] = contents
+	} else {
+		f.setContents(devicePath, contents)
+	}
+}
+
+//Must be called with the mutex held.
+func (f *Fake) setContents(devicePath string, contents FakeDriveContents) {
+	if !contents.Formatted {
+		f.contents[devicePath] = DeviceTypeUnknown
+		return
+	}
+	f.contents[devicePath] = DeviceTypeFilesystem
+	f.fsUUIDs[devicePath] = fmt.Sprintf("00000000-0000-0000-0000-%012d", len(f.fsUUIDs)+1)
+	if contents.SwiftID != "" {
+		f.swiftIDs[devicePath] = contents.SwiftID
+	}
+}
+
+//CollectDrives implements the Interface interface.
+func (f *Fake) CollectDrives(devicePathGlobs []string, trigger <-chan struct{}, added chan<- []Drive, removed chan<- []string) {
+	scanner := f.NewDriveScanner(devicePathGlobs)
+	for range trigger {
+		a, r, _ := scanner.Scan()
+		if len(a) > 0 {
+			added <- a
+		}
+		if len(r) > 0 {
+			removed <- r
+		}
+	}
+	select {} //shall not return
+}
+
+//NewDriveScanner implements the Interface interface.
+func (f *Fake) NewDriveScanner(devicePathGlobs []string) DriveScanner {
+	return &fakeDriveScanner{fake: f, globs: devicePathGlobs, known: make(map[string]bool)}
+}
+
+type fakeDriveScanner struct {
+	fake  *Fake
+	globs []string
+	known map[string]bool
+}
+
+//Scan implements the DriveScanner interface.
+func (s *fakeDriveScanner) Scan() (added []Drive, removed []string, err error) {
+	s.fake.mutex.Lock()
+	defer s.fake.mutex.Unlock()
+	for _, d := range s.fake.drives {
+		if s.known[d.DevicePath] {
+			continue
+		}
+		for _, pattern := range s.globs {
+			if matched, _ := filepath.Match(pattern, d.DevicePath); matched {
+				s.known[d.DevicePath] = true
+				added = append(added, d)
+				break
+			}
+		}
+	}
+	return added, nil, nil
+}
+
+//CollectDriveErrors implements the Interface interface.
+func (f *Fake) CollectDriveErrors(errors chan<- []DriveError) {
+	select {} //shall not return
+}
+
+//CollectBlockDeviceEvents implements the Interface interface.
+func (f *Fake) CollectBlockDeviceEvents(devicePaths chan<- string) {
+	select {} //shall not return
+}
+
+//ClassifyDevice implements the Interface interface.
+func (f *Fake) ClassifyDevice(devicePath string) DeviceType {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.contents[devicePath]
+}
+
+//GetFilesystemUUID implements the Interface interface.
+func (f *Fake) GetFilesystemUUID(devicePath string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.fsUUIDs[devicePath]
+}
+
+//GetZFSPoolName implements the Interface interface.
+func (f *Fake) GetZFSPoolName(devicePath string) (string, bool) {
+	return "", false
+}
+
+//LockDevice implements the Interface interface.
+func (f *Fake) LockDevice(devicePath string, timeout time.Duration) (func(), error) {
+	return func() {}, nil
+}
+
+//FormatDevice implements the Interface interface.
+func (f *Fake) FormatDevice(devicePath, logDevicePath string, extraArgs []string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.contents[devicePath] = DeviceTypeFilesystem
+	f.fsUUIDs[devicePath] = fmt.Sprintf("00000000-0000-0000-0000-%012d", len(f.fsUUIDs)+1)
+	f.formatArgs[devicePath] = append([]string(nil), extraArgs...)
+	return true
+}
+
+//WipeSignatures implements the Interface interface.
+func (f *Fake) WipeSignatures(devicePath string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.contents[devicePath] = DeviceTypeUnknown
+	return true
+}
+
+//MountDevice implements the Interface interface.
+func (f *Fake) MountDevice(devicePath, mountPath string, options []string, scope MountScope) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, m := range f.mountPoints {
+		if m.DevicePath == devicePath && m.MountPath == mountPath {
+			return true
+		}
+	}
+	m := MountPoint{DevicePath: devicePath, MountPath: mountPath, Options: make(map[string]bool)}
+	for _, option := range options {
+		m.Options[option] = true
+	}
+	f.mountPoints = append(f.mountPoints, m)
+	return true
+}
+
+//CheckMountTarget implements the Interface interface.
+func (f *Fake) CheckMountTarget(mountPath string) error {
+	return nil
+}
+
+//RemountDevice implements the Interface interface.
+func (f *Fake) RemountDevice(mountPath string, options []string, scope MountScope) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, m := range f.mountPoints {
+		if m.MountPath == mountPath {
+			for _, option := range options {
+				m.Options[option] = true
+			}
+		}
+	}
+	return true
+}
+
+//UnmountDevice implements the Interface interface.
+func (f *Fake) UnmountDevice(mountPath string, scope MountScope) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var remaining []MountPoint
+	for _, m := range f.mountPoints {
+		if m.MountPath != mountPath {
+			remaining = append(remaining, m)
+		}
+	}
+	f.mountPoints = remaining
+	return true
+}
+
+//RefreshMountPoints implements the Interface interface.
+func (f *Fake) RefreshMountPoints() {}
+
+//GetMountPointsIn implements the Interface interface.
+func (f *Fake) GetMountPointsIn(mountPathPrefix string, scope MountScope) []MountPoint {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var result []MountPoint
+	for _, m := range f.mountPoints {
+		if strings.HasPrefix(m.MountPath, mountPathPrefix) {
+			result = append(result, m)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].MountPath < result[j].MountPath })
+	return result
+}
+
+//GetMountPointsOf implements the Interface interface.
+func (f *Fake) GetMountPointsOf(devicePath string, scope MountScope) []MountPoint {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var result []MountPoint
+	for _, m := range f.mountPoints {
+		if m.DevicePath == devicePath {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+//CreateLUKSContainer implements the Interface interface.
+func (f *Fake) CreateLUKSContainer(devicePath, headerPath string, key LUKSKey, options LUKSFormatOptions) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	//with a detached header, the device looks like random data
+	if headerPath == "" {
+		f.contents[devicePath] = DeviceTypeLUKS
+	}
+	delete(f.luksContents, devicePath)
+	return true
+}
+
+//EncryptDeviceInPlace implements the Interface interface.
+func (f *Fake) EncryptDeviceInPlace(devicePath, headerPath string, key LUKSKey, options LUKSFormatOptions) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, exists := f.luksContents[devicePath]; exists {
+		return true
+	}
+	if f.contents[devicePath] != DeviceTypeFilesystem {
+		return false
+	}
+	//the filesystem appears on the mapped device once the container is opened
+	f.luksContents[devicePath] = FakeDriveContents{Formatted: true, SwiftID: f.swiftIDs[devicePath]}
+	delete(f.swiftIDs, devicePath)
+	f.contents[devicePath] = DeviceTypeUnknown
+	return true
+}
+
+//OpenLUKSContainer implements the Interface interface.
+func (f *Fake) OpenLUKSContainer(devicePath, headerPath, mappingName string, keys []LUKSKey, readOnly bool) (string, bool, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.luksOpenFailures[devicePath] {
+		delete(f.luksOpenFailures, devicePath)
+		return "", false, false
+	}
+	_, accepted := f.luksKeyslots[devicePath]
+	accepted = !accepted
+	for _, key := range keys {
+		if f.findLUKSKeyslot(devicePath, key) >= 0 {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return "", true, false
+	}
+
+	mappedDevicePath := "/dev/mapper/" + mappingName
+	if contents, exists := f.luksContents[devicePath]; exists {
+		f.setContents(mappedDevicePath, contents)
+		delete(f.luksContents, devicePath)
+	}
+	if _, exists := f.contents[mappedDevicePath]; !exists {
+		f.contents[mappedDevicePath] = DeviceTypeUnknown
+	}
+	f.luksMaps[devicePath] = mappedDevicePath
+	return mappedDevicePath, false, true
+}
+
+//OpenPlainCryptMapping implements the Interface interface.
+func (f *Fake) OpenPlainCryptMapping(devicePath, mappingName string, key LUKSKey, options PlainCryptOptions, readOnly bool) (string, bool) {
+	mappedDevicePath, _, ok := f.OpenLUKSContainer(devicePath, "", mappingName, []LUKSKey{key}, readOnly)
+	return mappedDevicePath, ok
+}
+
+//GetLUKSVersion implements the Interface interface.
+func (f *Fake) GetLUKSVersion(devicePath string) int {
+	return 2
+}
+
+//InspectLUKSHeader implements the Interface interface.
+func (f *Fake) InspectLUKSHeader(devicePath string) LUKSHeaderInfo {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keyslots, exists := f.luksKeyslots[devicePath]
+	if !exists {
+		return LUKSHeaderInfo{Version: 2, UsedKeyslots: []int{0}, TotalKeyslots: 32}
+	}
+	info := LUKSHeaderInfo{Version: 2, TotalKeyslots: len(keyslots)}
+	for slot, secret := range keyslots {
+		if secret != "" {
+			info.UsedKeyslots = append(info.UsedKeyslots, slot)
+		}
+	}
+	return info
+}
+
+//FindLUKSKeyslot implements the Interface interface.
+func (f *Fake) FindLUKSKeyslot(devicePath string, key LUKSKey) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.findLUKSKeyslot(devicePath, key)
+}
+
+//Must be called with the mutex held.
+func (f *Fake) findLUKSKeyslot(devicePath string, key LUKSKey) int {
+	keyslots, exists := f.luksKeyslots[devicePath]
+	if !exists {
+		return 0
+	}
+	for slot, secret := range keyslots {
+		if secret != "" && secret == key.Secret {
+			return slot
+		}
+	}
+	return -1
+}
+
+//AddLUKSKey implements the Interface interface.
+func (f *Fake) AddLUKSKey(devicePath string, existingKey, newKey LUKSKey) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keyslots, exists := f.luksKeyslots[devicePath]
+	if !exists {
+		return true
+	}
+	if f.findLUKSKeyslot(devicePath, existingKey) < 0 {
+		return false
+	}
+	for slot, secret := range keyslots {
+		if secret == "" {
+			keyslots[slot] = newKey.Secret
+			return true
+		}
+	}
+	return false
+}
+
+//RemoveLUKSKeyslot implements the Interface interface.
+func (f *Fake) RemoveLUKSKeyslot(devicePath string, slot int, key LUKSKey) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keyslots, exists := f.luksKeyslots[devicePath]
+	if !exists {
+		return true
+	}
+	if slot < 0 || slot >= len(keyslots) || f.findLUKSKeyslot(devicePath, key) < 0 {
+		return false
+	}
+	keyslots[slot] = ""
+	return true
+}
+
+//BackupLUKSHeader implements the Interface interface.
+func (f *Fake) BackupLUKSHeader(devicePath, backupPath string) bool {
+	return true
+}
+
+//ConvertLUKSContainer implements the Interface interface.
+func (f *Fake) ConvertLUKSContainer(devicePath string) bool {
+	return true
+}
+
+//CloseLUKSContainer implements the Interface interface.
+func (f *Fake) CloseLUKSContainer(mappingName string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for backingDevicePath, mappedDevicePath := range f.luksMaps {
+		if mappedDevicePath == "/dev/mapper/"+mappingName {
+			delete(f.luksMaps, backingDevicePath)
+		}
+	}
+	return true
+}
+
+//RefreshLUKSMappings implements the Interface interface.
+func (f *Fake) RefreshLUKSMappings() {}
+
+//GetLUKSMappingOf implements the Interface interface.
+func (f *Fake) GetLUKSMappingOf(devicePath string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.luksMaps[devicePath]
+}
+
+//CreateBcacheDevice implements the Interface interface.
+func (f *Fake) CreateBcacheDevice(backingDevicePath, cacheDevicePath string) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	bcacheDevicePath := "/dev/bcache-" + filepath.Base(backingDevicePath)
+	f.contents[bcacheDevicePath] = DeviceTypeUnknown
+	return bcacheDevicePath, true
+}
+
+//GetTopologyHints implements the Interface interface.
+func (f *Fake) GetTopologyHints(devicePath string) *TopologyHints {
+	return nil
+}
+
+//ApplyIRQAffinity implements the Interface interface.
+func (f *Fake) ApplyIRQAffinity(hints *TopologyHints) bool {
+	return true
+}
+
+//GetFirmwareInfo implements the Interface interface.
+func (f *Fake) GetFirmwareInfo(devicePath string) *FirmwareInfo {
+	return nil
+}
+
+//GetPowerOnHours implements the Interface interface.
+func (f *Fake) GetPowerOnHours(devicePath string) (int, bool) {
+	return 0, false
+}
+
+//AttachImageFile implements the Interface interface.
+func (f *Fake) AttachImageFile(imagePath, format string) (string, bool) {
+	return "", false
+}
+
+//OpenVerityDevice implements the Interface interface.
+func (f *Fake) OpenVerityDevice(dataDevicePath, hashDevicePath, mappingName, rootHash string) (string, bool) {
+	return "", false
+}
+
+//LoadKernelModules implements the Interface interface.
+func (f *Fake) LoadKernelModules(modules []string) []string {
+	return nil
+}
+
+//GetMultipathStatus implements the Interface interface.
+func (f *Fake) GetMultipathStatus() MultipathStatus {
+	return MultipathStatus{}
+}
+
+//GetISCSISessionStates implements the Interface interface.
+func (f *Fake) GetISCSISessionStates() []string {
+	return nil
+}
+
+//ReadSwiftID implements the Interface interface.
+func (f *Fake) ReadSwiftID(mountPath string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.swiftIDs[f.deviceMountedAt(mountPath)], nil
+}
+
+//WriteSwiftID implements the Interface interface.
+func (f *Fake) WriteSwiftID(mountPath, swiftID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	devicePath := f.deviceMountedAt(mountPath)
+	if devicePath == "" {
+		return errors.New("nothing mounted at " + mountPath)
+	}
+	f.swiftIDs[devicePath] = swiftID
+	return nil
+}
+
+//The swift-id is stored on the filesystem, so we need to know which device
+//is mounted at the given path.
+func (f *Fake) deviceMountedAt(mountPath string) string {
+	for _, m := range f.mountPoints {
+		if m.MountPath == mountPath {
+			return m.DevicePath
+		}
+	}
+	return ""
+}
+
+//CheckSwiftIDChecksum implements the Interface interface.
+func (f *Fake) CheckSwiftIDChecksum(mountPath string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	devicePath := f.deviceMountedAt(mountPath)
+	checksummed, exists := f.checksums[devicePath]
+	if !exists {
+		return false, nil
+	}
+	if checksummed != f.swiftIDs[devicePath] {
+		return true, ErrSwiftIDChecksumMismatch
+	}
+	return true, nil
+}
+
+//WriteSwiftIDChecksum implements the Interface interface.
+func (f *Fake) WriteSwiftIDChecksum(mountPath string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	devicePath := f.deviceMountedAt(mountPath)
+	if devicePath == "" {
+		return errors.New("nothing mounted at " + mountPath)
+	}
+	f.checksums[devicePath] = f.swiftIDs[devicePath]
+	return nil
+}
+
+//ReadLayoutVersion implements the Interface interface.
+func (f *Fake) ReadLayoutVersion(mountPath string) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.layouts[f.deviceMountedAt(mountPath)], nil
+}
+
+//WriteLayoutVersion implements the Interface interface.
+func (f *Fake) WriteLayoutVersion(mountPath string, version int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	devicePath := f.deviceMountedAt(mountPath)
+	if devicePath == "" {
+		return errors.New("nothing mounted at " + mountPath)
+	}
+	f.layouts[devicePath] = version
+	return nil
+}
+
+//Chown implements the Interface interface.
+func (f *Fake) Chown(path, owner, group string) {}
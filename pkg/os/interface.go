@@ -19,6 +19,8 @@
 
 package os
 
+import "time"
+
 //Interface describes the set of OS-level operations that can be executed by
 //the autopilot. The default implementation for production is struct Linux in
 //this package.
@@ -34,19 +36,49 @@ type Interface interface {
 	//reported as "added".) It shall not return. The `trigger` channel is used by
 	//the caller to trigger each work cycle of CollectDrives.
 	CollectDrives(devicePathGlobs []string, trigger <-chan struct{}, added chan<- []Drive, removed chan<- []string)
+	//NewDriveScanner returns a DriveScanner that finds drives like
+	//CollectDrives, but scans only when asked to.
+	NewDriveScanner(devicePathGlobs []string) DriveScanner
 	//CollectDriveErrors is run in a separate goroutine and reports drive errors
 	//that are observed in the kernel log. It shall not return.
 	CollectDriveErrors(errors chan<- []DriveError)
+	//CollectBlockDeviceEvents is run in a separate goroutine and reports the
+	//device paths of block devices that udev has seen being added or removed.
+	//It shall not return.
+	CollectBlockDeviceEvents(devicePaths chan<- string)
 
 	//ClassifyDevice examines the contents of the given device to detect existing
 	//LUKS containers or filesystems.
 	ClassifyDevice(devicePath string) DeviceType
+	//GetFilesystemUUID returns the UUID of the filesystem on this device, or an
+	//empty string if it cannot be determined.
+	GetFilesystemUUID(devicePath string) string
+	//GetZFSPoolName returns whether the given device is a member of a ZFS pool,
+	//and if so, the name of that pool (if it can be determined).
+	GetZFSPoolName(devicePath string) (poolName string, isMember bool)
 	//FormatDevice creates an XFS filesystem on this device. Existing containers
-	//or filesystems will be overwritten.
-	FormatDevice(devicePath string) (ok bool)
+	//or filesystems will be overwritten. If logDevicePath is not empty, the
+	//filesystem's log is placed on that device. The extraArgs are given to
+	//mkfs.xfs in addition to the default arguments.
+	FormatDevice(devicePath, logDevicePath string, extraArgs []string) (ok bool)
+	//WipeSignatures overwrites the first and the last MiB of this device with
+	//zeroes, to remove stale signatures (e.g. of RAID superblocks, partition
+	//tables or filesystems) before the device is formatted.
+	WipeSignatures(devicePath string) (ok bool)
+	//LockDevice takes an exclusive advisory lock (flock(2)) on this device node,
+	//waiting for up to the given timeout if another process holds a lock on it.
+	//The lock is held until the returned function is called.
+	LockDevice(devicePath string, timeout time.Duration) (unlock func(), err error)
 
-	//MountDevice mounts this device at the given location.
-	MountDevice(devicePath, mountPath string, scope MountScope) (ok bool)
+	//MountDevice mounts this device at the given location, with the given mount
+	//options (which may be empty).
+	MountDevice(devicePath, mountPath string, options []string, scope MountScope) (ok bool)
+	//CheckMountTarget returns an error if mounting something at the given
+	//location would be unsafe, i.e. if the mountpoint or its parent directory
+	//is a symlink, or if the mountpoint exists and is not an empty directory.
+	CheckMountTarget(mountPath string) error
+	//RemountDevice changes the options of the mount at the given location.
+	RemountDevice(mountPath string, options []string, scope MountScope) (ok bool)
 	//UnmountDevice unmounts the device that is mounted at the given location.
 	UnmountDevice(mountPath string, scope MountScope) (ok bool)
 	//RefreshMountPoints examines the system to find any mounts that have changed
@@ -58,11 +90,52 @@ type Interface interface {
 	GetMountPointsOf(devicePath string, scope MountScope) []MountPoint
 
 	//CreateLUKSContainer creates a LUKS container on the given device, using the
-	//given encryption key. Existing data on the device will be overwritten.
-	CreateLUKSContainer(devicePath, key string) (ok bool)
+	//given encryption key and format options. Existing data on the device will
+	//be overwritten. If headerPath is not empty, the LUKS header is written into
+	//that file instead of onto the device.
+	CreateLUKSContainer(devicePath, headerPath string, key LUKSKey, options LUKSFormatOptions) (ok bool)
+	//EncryptDeviceInPlace converts the unencrypted filesystem on the given
+	//device into a LUKS container with the given key and format options, keeping
+	//the filesystem's contents. The LUKS header is written into the file at
+	//headerPath, which also records the progress of the conversion: If that file
+	//exists already, an interrupted conversion is resumed (or, if it has
+	//finished already, nothing is done). This can take a very long time, and
+	//the device must not be in use in the meantime.
+	EncryptDeviceInPlace(devicePath, headerPath string, key LUKSKey, options LUKSFormatOptions) (ok bool)
 	//OpenLUKSContainer opens the LUKS container on the given device. The given
-	//keys are tried in order until one works.
-	OpenLUKSContainer(devicePath, mappingName string, keys []string) (mappedDevicePath string, ok bool)
+	//keys are tried in order until one works. If readOnly is set, the mapping
+	//is created read-only. The headerPath is given if the container has a
+	//detached header (see CreateLUKSContainer). If opening fails, keysRejected
+	//says whether this is because cryptsetup rejected each of the keys as a
+	//wrong passphrase (as opposed to e.g. the device being busy).
+	OpenLUKSContainer(devicePath, headerPath, mappingName string, keys []LUKSKey, readOnly bool) (mappedDevicePath string, keysRejected, ok bool)
+	//OpenPlainCryptMapping opens a plain dm-crypt mapping (without a LUKS
+	//header) of the given device with the given key. Since plain dm-crypt
+	//cannot tell whether the key is correct, this succeeds with any key; the
+	//caller needs to check the contents of the mapped device. The mapping is
+	//closed with CloseLUKSContainer.
+	OpenPlainCryptMapping(devicePath, mappingName string, key LUKSKey, options PlainCryptOptions, readOnly bool) (mappedDevicePath string, ok bool)
+	//GetLUKSVersion returns the format version of the LUKS container on the
+	//given device (1 or 2), or 0 if it cannot be determined.
+	GetLUKSVersion(devicePath string) int
+	//InspectLUKSHeader examines the header of the LUKS container on the given
+	//device. If the header cannot be read, the Error field of the result is set.
+	InspectLUKSHeader(devicePath string) LUKSHeaderInfo
+	//FindLUKSKeyslot returns the number of the keyslot of the LUKS container on
+	//the given device that is unlocked by the given key, or -1 if none is.
+	FindLUKSKeyslot(devicePath string, key LUKSKey) int
+	//AddLUKSKey adds the new key to a free keyslot of the LUKS container on the
+	//given device. The existing key must unlock one of its keyslots.
+	AddLUKSKey(devicePath string, existingKey, newKey LUKSKey) (ok bool)
+	//RemoveLUKSKeyslot wipes the given keyslot of the LUKS container on the
+	//given device. The key must unlock one of the other keyslots.
+	RemoveLUKSKeyslot(devicePath string, slot int, key LUKSKey) (ok bool)
+	//BackupLUKSHeader writes a backup of the header of the LUKS container on the
+	//given device into the given file, which must not exist yet.
+	BackupLUKSHeader(devicePath, backupPath string) (ok bool)
+	//ConvertLUKSContainer converts the LUKS1 container on the given device into
+	//the LUKS2 format in place. The container must not be open.
+	ConvertLUKSContainer(devicePath string) (ok bool)
 	//CloseLUKSContainer closes the LUKS container with the given mapping name.
 	CloseLUKSContainer(mappingName string) (ok bool)
 	//RefreshLUKSMappings examines the system to find any LUKS mappings that have
@@ -72,22 +145,201 @@ type Interface interface {
 	//this device, or "" if no such mapping exists.
 	GetLUKSMappingOf(devicePath string) (mappedDevicePath string)
 
+	//CreateBcacheDevice sets up the given device as a bcache backing device,
+	//and attaches it to the cache set on the given cache device (which is
+	//formatted as a bcache cache device first if it is empty). Existing data on
+	//the backing device will be overwritten.
+	CreateBcacheDevice(backingDevicePath, cacheDevicePath string) (bcacheDevicePath string, ok bool)
+
+	//GetTopologyHints examines the hardware topology of the storage controller
+	//to which the given device is attached. Returns nil if the device is not
+	//attached to a PCI device (e.g. for loop devices).
+	GetTopologyHints(devicePath string) *TopologyHints
+	//ApplyIRQAffinity pins the IRQs in the given hints to the CPUs that are
+	//local to the storage controller.
+	ApplyIRQAffinity(hints *TopologyHints) (ok bool)
+	//GetFirmwareInfo collects the firmware revision of the given drive and the
+	//driver and firmware versions of its storage controller. Returns nil if the
+	//device is not a physical drive (e.g. for loop devices).
+	GetFirmwareInfo(devicePath string) *FirmwareInfo
+	//GetPowerOnHours reads the power-on hours of the given drive from its SMART
+	//attributes. Returns false if the drive does not report them.
+	GetPowerOnHours(devicePath string) (hours int, ok bool)
+
+	//AttachImageFile makes the given image file (in the format "raw" or
+	//"qcow2") available as a block device, using a loop device or qemu-nbd
+	//respectively. If the image is already attached, the existing device is
+	//reused.
+	AttachImageFile(imagePath, format string) (devicePath string, ok bool)
+	//OpenVerityDevice creates a read-only dm-verity mapping with the given name
+	//for the given data device, whose contents are verified against the hash
+	//tree on the hash device and the given root hash. If the mapping exists
+	//already, it is reused.
+	OpenVerityDevice(dataDevicePath, hashDevicePath, mappingName, rootHash string) (mappedDevicePath string, ok bool)
+
+	//LoadKernelModules ensures that the given kernel modules are loaded (or
+	//built into the kernel), and loads them if necessary. Returns those modules
+	//that are not available.
+	LoadKernelModules(modules []string) (missing []string)
+
+	//GetMultipathStatus asks multipathd for its state and the multipath maps
+	//that it has set up. The DaemonState is empty if multipathd is not
+	//reachable.
+	GetMultipathStatus() MultipathStatus
+	//GetISCSISessionStates asks iscsid for the state of each iSCSI session
+	//(e.g. "LOGGED_IN"). Returns nil if there are no sessions, or if iscsid is
+	//not reachable.
+	GetISCSISessionStates() []string
+
 	//ReadSwiftID returns the swift-id in this directory, or an empty string if
 	//the file does not exist.
 	ReadSwiftID(mountPath string) (string, error)
 	//WriteSwiftID writes the given swift-id into this directory.
 	WriteSwiftID(mountPath, swiftID string) error
+	//CheckSwiftIDChecksum compares the swift-id file in this directory with the
+	//checksum file next to it. Returns false if there is no checksum file, or
+	//ErrSwiftIDChecksumMismatch if the swift-id file does not match it.
+	CheckSwiftIDChecksum(mountPath string) (bool, error)
+	//WriteSwiftIDChecksum records the checksum of the swift-id file in this
+	//directory.
+	WriteSwiftIDChecksum(mountPath string) error
+	//ReadLayoutVersion returns the layout version that is recorded in this
+	//directory, or 0 if none is recorded.
+	ReadLayoutVersion(mountPath string) (int, error)
+	//WriteLayoutVersion records the given layout version in this directory.
+	WriteLayoutVersion(mountPath string, version int) error
 	//Chown changes the ownership of the given path. Both owner and group may
 	//contain a name or an ID (as decimal integer literal) or be empty (to leave
 	//that field unchanged).
 	Chown(path, owner, group string)
 }
 
+//DriveScanner is returned by Interface.NewDriveScanner().
+type DriveScanner interface {
+	//Scan looks for drives matching the scanner's globs, and reports those that
+	//were added or removed since the previous scan. (In the first scan, all
+	//existing drives are reported as added.) Returns an error if no drives
+	//match the globs at all.
+	Scan() (added []Drive, removed []string, err error)
+}
+
 //Drive contains information about a drive as detected by the OS.
 type Drive struct {
 	DevicePath   string
 	FoundAtPath  string //only used in log messages
 	SerialNumber string
+	//BackingDevicePath is only set if DevicePath refers to a stacked device (a
+	//bcache or dm-cache device) that was found on top of a drive, and then
+	//contains the device path of the drive itself.
+	BackingDevicePath string
+}
+
+//TopologyHints describes where a drive is located in the hardware topology of
+//the machine, so that processes working with the drive (e.g. Swift workers)
+//can be placed on CPUs near to the drive's storage controller.
+type TopologyHints struct {
+	//PCIAddress identifies the storage controller.
+	PCIAddress string `json:"pci_address"`
+	//NUMANode is -1 if the machine does not have NUMA, or the controller's
+	//NUMA locality is unknown.
+	NUMANode int `json:"numa_node"`
+	//LocalCPUs is a CPU list (e.g. "0-11,24-35") of the CPUs that are local to
+	//the storage controller.
+	LocalCPUs string    `json:"local_cpus"`
+	IRQs      []IRQHint `json:"irqs,omitempty"`
+}
+
+//FirmwareInfo contains the firmware and driver versions of a drive and its
+//storage controller. Fields are empty if the respective information is not
+//available.
+type FirmwareInfo struct {
+	Model              string `json:"model,omitempty"`
+	FirmwareRevision   string `json:"firmware_revision,omitempty"`
+	HBADriver          string `json:"hba_driver,omitempty"`
+	HBADriverVersion   string `json:"hba_driver_version,omitempty"`
+	HBAFirmwareVersion string `json:"hba_firmware_version,omitempty"`
+}
+
+//LUKSKey is an encryption key for LUKS containers. Either Secret or KeyFile
+//is set.
+type LUKSKey struct {
+	Secret string
+	//KeyFile is the path to a file that contains the key. It is given to
+	//cryptsetup with --key-file, so the whole file (including any trailing
+	//newline) is the key.
+	KeyFile string
+	//KeyFileInChroot indicates that the KeyFile is inside the chroot (and thus
+	//read by cryptsetup itself), rather than in the autopilot's own filesystem.
+	KeyFileInChroot bool
+}
+
+//LUKSFormatOptions contains the parameters for Interface.CreateLUKSContainer().
+//Fields that are left empty are decided by cryptsetup's compiled-in defaults.
+type LUKSFormatOptions struct {
+	//Type is either "luks1" or "luks2".
+	Type   string `yaml:"type"`
+	Cipher string `yaml:"cipher"`
+	//KeySize is in bits.
+	KeySize int `yaml:"key-size"`
+	//SectorSize is the encryption sector size in bytes (LUKS2 only).
+	SectorSize int `yaml:"sector-size"`
+	//PBKDF is one of "pbkdf2", "argon2i" and "argon2id".
+	PBKDF string `yaml:"pbkdf"`
+	//PBKDFMemory is the memory cost of argon2 in KiB.
+	PBKDFMemory   int `yaml:"pbkdf-memory"`
+	PBKDFParallel int `yaml:"pbkdf-parallel"`
+	//PBKDFIterations is given to cryptsetup as --pbkdf-force-iterations, which
+	//disables the benchmark that cryptsetup otherwise uses to choose the costs.
+	PBKDFIterations int `yaml:"pbkdf-iterations"`
+}
+
+//PlainCryptOptions contains the parameters for
+//Interface.OpenPlainCryptMapping(). Since plain dm-crypt has no header that
+//records them, they must match the ones that were used when the mapping was
+//first created.
+type PlainCryptOptions struct {
+	Cipher string `yaml:"cipher"`
+	//Hash is the hash that derives the key from the passphrase, or "plain" to
+	//use the passphrase as is. It is not used for key files.
+	Hash string `yaml:"hash"`
+	//KeySize is in bits.
+	KeySize int `yaml:"key-size"`
+	//Offset is the start of the encrypted data on the device, and Skip is the
+	//offset of the IV, both in 512-byte sectors.
+	Offset int `yaml:"offset"`
+	Skip   int `yaml:"skip"`
+}
+
+//LUKSHeaderInfo is returned by Interface.InspectLUKSHeader().
+type LUKSHeaderInfo struct {
+	Version       int    `json:"version,omitempty"`
+	UsedKeyslots  []int  `json:"used_keyslots"`
+	TotalKeyslots int    `json:"total_keyslots,omitempty"`
+	Error         string `json:"error,omitempty"`
+	//Problems lists inconsistencies in the header that would prevent the
+	//container from being opened (e.g. a missing volume key digest).
+	Problems []string `json:"problems,omitempty"`
+}
+
+//KeyslotsExhausted returns whether all keyslots of the LUKS container are in
+//use, so that no new keys can be added to it.
+func (i LUKSHeaderInfo) KeyslotsExhausted() bool {
+	return i.Error == "" && i.TotalKeyslots > 0 && len(i.UsedKeyslots) >= i.TotalKeyslots
+}
+
+//MultipathStatus is returned by Interface.GetMultipathStatus().
+type MultipathStatus struct {
+	//DaemonState is "idle" once multipathd has processed all pending events.
+	DaemonState            string
+	Maps                   int
+	MapsWithoutActivePaths []string
+}
+
+//IRQHint appears in type TopologyHints.
+type IRQHint struct {
+	IRQ int `json:"irq"`
+	//Affinity is the CPU list to which this IRQ is currently pinned.
+	Affinity string `json:"affinity"`
 }
 
 //DriveError represents a drive error that was found e.g. in a kernel log.
@@ -25,7 +25,9 @@ import (
 	sys_os "os"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/sapcc/swift-drive-autopilot/pkg/parsers"
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
@@ -35,6 +37,9 @@ type Linux struct {
 	ActiveMountPoints    map[MountScope][]MountPoint
 	ActiveLUKSMappings   map[string]string
 	MountPropagationMode MountPropagationMode
+	//mutex protects ActiveMountPoints and ActiveLUKSMappings when drives are
+	//being set up concurrently
+	mutex sync.Mutex
 }
 
 //NewLinux initializes the OS interface for Linux.
@@ -99,23 +104,14 @@ func detectMountPropagationMode() (MountPropagationMode, error) {
 		return "", err
 	}
 
-	//parse mountinfo; format is documented at
-	//<https://www.kernel.org/doc/Documentation/filesystems/proc.txt>
-	for _, line := range strings.Split(string(buf), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
+	for _, entry := range parsers.ParseMountInfo(string(buf)) {
 		//find the bind-mount for the chrootPath
-		fields := strings.Fields(line)
-		if filepath.Clean(fields[4]) != chrootPath {
+		if filepath.Clean(entry.MountPoint) != chrootPath {
 			continue
 		}
 
 		//check the optional fields on the chroot's bind-mount
-		for idx := 6; fields[idx] != "-"; idx++ {
-			field := fields[idx]
+		for _, field := range entry.OptionalFields {
 			if strings.HasPrefix(field, "shared:") {
 				return ConnectedMountNamespaces, nil
 			}
@@ -0,0 +1,176 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//This is used to extract the cache set UUID from `bcache-super-show`.
+var csetUUIDRx = regexp.MustCompile(`(?m)^cset\.uuid\s+(\S+)\s*$`)
+
+//findStackedDeviceOn checks if the given device is the backing device of a
+//caching device (bcache or dm-cache), and returns the device path of the
+//topmost caching device, or "" if there is none. LUKS mappings are not
+//considered here since the autopilot manages those itself.
+func findStackedDeviceOn(devicePath string) string {
+	//paths are relative because the working directory is the chroot
+	name := filepath.Base(devicePath)
+	result := ""
+	for {
+		holders, err := ioutil.ReadDir(filepath.Join("sys/block", name, "holders"))
+		if err != nil || len(holders) != 1 {
+			return result
+		}
+		holder := holders[0].Name()
+
+		switch {
+		case strings.HasPrefix(holder, "bcache"):
+			result = "/dev/" + holder
+		case strings.HasPrefix(holder, "dm-"):
+			uuid, _ := ioutil.ReadFile(filepath.Join("sys/block", holder, "dm/uuid"))
+			if strings.HasPrefix(string(uuid), "CRYPT-") {
+				return result
+			}
+			dmName, err := ioutil.ReadFile(filepath.Join("sys/block", holder, "dm/name"))
+			if err != nil {
+				return result
+			}
+			mapperPath := "/dev/mapper/" + strings.TrimSpace(string(dmName))
+			//only dm-cache devices count as the top of the stack (with lvmcache,
+			//there is usually a linear mapping for the origin volume in between)
+			if isDMCacheDevice(mapperPath) {
+				result = mapperPath
+			}
+		default:
+			return result
+		}
+		name = holder
+	}
+}
+
+func isDMCacheDevice(mapperPath string) bool {
+	stdout, ok := command.Command{SkipLog: true}.Run("dmsetup", "table", mapperPath)
+	if !ok {
+		return false
+	}
+	//output looks like "0 1953525168 cache 253:2 253:1 253:3 ..."
+	fields := strings.Fields(stdout)
+	return len(fields) >= 3 && fields[2] == "cache"
+}
+
+//CreateBcacheDevice implements the Interface interface.
+func (l *Linux) CreateBcacheDevice(backingDevicePath, cacheDevicePath string) (string, bool) {
+	csetUUID, ok := l.prepareBcacheCache(cacheDevicePath)
+	if !ok {
+		return "", false
+	}
+
+	_, ok = command.Run("make-bcache", "-B", backingDevicePath)
+	if !ok {
+		return "", false
+	}
+	l.waitForUdev()
+
+	//udev usually registers new bcache devices automatically, but not always
+	//(e.g. when the udev rules from bcache-tools are missing)
+	bcacheName := findBcacheDeviceOf(backingDevicePath)
+	if bcacheName == "" {
+		registerBcacheDevice(backingDevicePath)
+		l.waitForUdev()
+		bcacheName = findBcacheDeviceOf(backingDevicePath)
+	}
+	if bcacheName == "" {
+		util.LogError("cannot find bcache device for %s after make-bcache", backingDevicePath)
+		return "", false
+	}
+
+	attachPath := filepath.Join("sys/block", bcacheName, "bcache/attach")
+	err := ioutil.WriteFile(attachPath, []byte(csetUUID+"\n"), 0200)
+	if err != nil {
+		util.LogError("cannot attach /dev/%s to bcache cache set %s: %s", bcacheName, csetUUID, err.Error())
+		return "", false
+	}
+
+	bcacheDevicePath := "/dev/" + bcacheName
+	l.waitForUdev(bcacheDevicePath)
+	return bcacheDevicePath, true
+}
+
+//Returns the cache set UUID of the given cache device, formatting it as a
+//bcache cache device first if necessary.
+func (l *Linux) prepareBcacheCache(cacheDevicePath string) (string, bool) {
+	stdout, ok := command.Command{SkipLog: true}.Run("bcache-super-show", cacheDevicePath)
+	if !ok {
+		//not a bcache device yet -> format it, but only if it is empty
+		if l.ClassifyDevice(cacheDevicePath) != DeviceTypeUnknown {
+			util.LogError("cannot use %s as bcache cache device: not empty and not a bcache device", cacheDevicePath)
+			return "", false
+		}
+		_, ok = command.Run("make-bcache", "-C", cacheDevicePath)
+		if !ok {
+			return "", false
+		}
+		util.LogInfo("created bcache cache device on %s", cacheDevicePath)
+		l.waitForUdev()
+		stdout, ok = command.Run("bcache-super-show", cacheDevicePath)
+		if !ok {
+			return "", false
+		}
+	}
+
+	match := csetUUIDRx.FindStringSubmatch(stdout)
+	if match == nil {
+		util.LogError("cannot find cset.uuid in output of `bcache-super-show %s`", cacheDevicePath)
+		return "", false
+	}
+
+	//make sure the cache set is known to the kernel (this is a no-op if it
+	//already is)
+	_, err := os.Stat(filepath.Join("sys/fs/bcache", match[1]))
+	if os.IsNotExist(err) {
+		registerBcacheDevice(cacheDevicePath)
+	}
+	return match[1], true
+}
+
+//Returns the name of the bcache device (e.g. "bcache0") for the given backing
+//device, or "" if it is not registered.
+func findBcacheDeviceOf(backingDevicePath string) string {
+	target, err := os.Readlink(filepath.Join("sys/block", filepath.Base(backingDevicePath), "bcache/dev"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+func registerBcacheDevice(devicePath string) {
+	err := ioutil.WriteFile("sys/fs/bcache/register", []byte(devicePath+"\n"), 0200)
+	if err != nil {
+		util.LogDebug("cannot register %s with bcache: %s", devicePath, err.Error())
+	}
+}
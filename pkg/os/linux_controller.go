@@ -0,0 +1,177 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Matches a PCI address like "0000:00:1f.2" (i.e. domain:bus:slot.function).
+var pciAddressRx = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-9a-f]$`)
+
+//Controllers with fewer known drives than this are not considered to be reset
+//when all their drives disappear, since this is indistinguishable from a
+//regular hot-swap of their only drive.
+const minDrivesForControllerReset = 2
+
+//controllerTracker is used by CollectDrives to recognize when all drives
+//attached to the same storage controller (i.e. the same PCI device) disappear
+//at once. This usually indicates a controller reset, after which a SCSI
+//rescan often brings the drives back.
+type controllerTracker struct {
+	//globbed path -> PCI address of storage controller (only for drives where
+	//the controller could be determined)
+	controllerOf map[string]string
+	//PCI address -> time when a rescan was triggered for this controller (we
+	//only try once until the controller's drives come back)
+	rescannedAt map[string]time.Time
+}
+
+//track is called by CollectDrives when a new drive is found.
+func (t *controllerTracker) track(globbedPath, devicePath string) {
+	if t.controllerOf == nil {
+		t.controllerOf = make(map[string]string)
+		t.rescannedAt = make(map[string]time.Time)
+	}
+
+	pciAddress := findControllerOf(devicePath)
+	if pciAddress == "" {
+		delete(t.controllerOf, globbedPath)
+		return
+	}
+	t.controllerOf[globbedPath] = pciAddress
+	delete(t.rescannedAt, pciAddress) //controller is healthy again
+}
+
+//recoveringDrives checks if all known drives of some controller have
+//disappeared. If so, a rescan of this controller is triggered (unless one was
+//already triggered before), and the controller's drives are given some time to
+//reappear. Returns the globbed paths of all vanished drives that shall not be
+//reported as removed yet. This does not wait for the rescan, so the caller
+//just looks again on its next scan.
+func (t *controllerTracker) recoveringDrives(knownDrives, existingDrives map[string]string) map[string]bool {
+	//count known and vanished drives per controller
+	knownCount := make(map[string]int)
+	vanishedCount := make(map[string]int)
+	for globbedPath := range knownDrives {
+		pciAddress := t.controllerOf[globbedPath]
+		if pciAddress == "" {
+			continue
+		}
+		knownCount[pciAddress]++
+		if _, exists := existingDrives[globbedPath]; !exists {
+			vanishedCount[pciAddress]++
+		}
+	}
+
+	var resetControllers []string
+	for pciAddress, count := range knownCount {
+		switch {
+		case vanishedCount[pciAddress] == 0:
+			delete(t.rescannedAt, pciAddress) //controller is healthy again
+		case !t.rescannedAt[pciAddress].IsZero():
+			//rescan was already triggered; keep waiting for the drives below
+		case vanishedCount[pciAddress] == count && count >= minDrivesForControllerReset:
+			resetControllers = append(resetControllers, pciAddress)
+		}
+	}
+	sort.Strings(resetControllers)
+
+	for _, pciAddress := range resetControllers {
+		util.LogError("all %d drives attached to storage controller %s have disappeared, trying a rescan before considering them removed",
+			knownCount[pciAddress], pciAddress)
+		rescanController(pciAddress)
+		t.rescannedAt[pciAddress] = time.Now()
+	}
+
+	//drives of rescanned controllers are given some time to be found again by
+	//the kernel
+	gracePeriod := util.GetJobInterval(10*time.Second, 1*time.Second)
+	result := make(map[string]bool)
+	for globbedPath := range knownDrives {
+		if _, exists := existingDrives[globbedPath]; exists {
+			continue
+		}
+		rescannedAt := t.rescannedAt[t.controllerOf[globbedPath]]
+		if !rescannedAt.IsZero() && time.Since(rescannedAt) < gracePeriod {
+			result[globbedPath] = true
+		}
+	}
+	return result
+}
+
+//Returns the PCI address of the controller to which the given device is
+//attached, or "" if it cannot be determined (e.g. for virtual devices like
+//loop devices or device-mapper devices).
+func findControllerOf(devicePath string) string {
+	//"sys/block/sda" is a symlink to something like
+	//"../devices/pci0000:00/0000:00:1f.2/ata1/host0/target0:0:0/0:0:0:0/block/sda";
+	//the last PCI address in there is the controller (path is relative because
+	//the working directory is the chroot)
+	sysPath := filepath.Join("sys/block", filepath.Base(devicePath))
+	target, err := os.Readlink(sysPath)
+	if err != nil {
+		return ""
+	}
+
+	pciAddress := ""
+	for _, component := range strings.Split(target, "/") {
+		if pciAddressRx.MatchString(component) {
+			pciAddress = component
+		}
+	}
+	return pciAddress
+}
+
+//Triggers a rescan on all SCSI hosts belonging to the given PCI device.
+func rescanController(pciAddress string) {
+	hostPaths, err := filepath.Glob(filepath.Join("sys/bus/pci/devices", pciAddress, "host*"))
+	if err == nil && len(hostPaths) == 0 {
+		//some drivers put the SCSI hosts further down in the hierarchy
+		hostPaths, err = filepath.Glob(filepath.Join("sys/bus/pci/devices", pciAddress, "*", "host*"))
+	}
+	if err != nil {
+		util.LogError("cannot enumerate SCSI hosts of storage controller %s: %s", pciAddress, err.Error())
+		return
+	}
+	if len(hostPaths) == 0 {
+		util.LogError("cannot rescan storage controller %s: no SCSI hosts found", pciAddress)
+		return
+	}
+
+	for _, hostPath := range hostPaths {
+		hostName := filepath.Base(hostPath)
+		scanPath := filepath.Join("sys/class/scsi_host", hostName, "scan")
+		err := ioutil.WriteFile(scanPath, []byte("- - -\n"), 0200)
+		if err == nil {
+			util.LogInfo("triggered rescan of SCSI host %s on storage controller %s", hostName, pciAddress)
+		} else {
+			util.LogError("cannot rescan SCSI host %s: %s", hostName, err.Error())
+		}
+	}
+}
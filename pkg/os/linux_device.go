@@ -20,9 +20,12 @@
 package os
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/parsers"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
 //ClassifyDevice implements the Interface interface.
@@ -48,11 +51,75 @@ func (l *Linux) ClassifyDevice(devicePath string) DeviceType {
 	}
 }
 
+//GetFilesystemUUID implements the Interface interface.
+func (l *Linux) GetFilesystemUUID(devicePath string) string {
+	stdout, ok := command.Run("lsblk", "-dno", "UUID", devicePath)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(stdout)
+}
+
+//GetZFSPoolName implements the Interface interface.
+func (l *Linux) GetZFSPoolName(devicePath string) (string, bool) {
+	//`zpool create` on a whole disk puts the pool on the first partition, so the
+	//partitions need to be checked as well
+	stdout, ok := command.Run("lsblk", "-J", "-o", "NAME,TYPE,FSTYPE,LABEL", devicePath)
+	if !ok {
+		return "", false
+	}
+	output, err := parsers.ParseLsblkOutput(stdout)
+	if err != nil {
+		util.LogError("cannot parse `lsblk -J` output: %s", err.Error())
+		return "", false
+	}
+	return output.FindZFSPool()
+}
+
 //FormatDevice implements the Interface interface.
-func (l *Linux) FormatDevice(devicePath string) bool {
+func (l *Linux) FormatDevice(devicePath, logDevicePath string, extraArgs []string) bool {
 	//TODO: remove `-f` (currently needed to work around
 	//https://github.com/karelzak/util-linux/issues/1159 until Flatcar updates
 	//util-linux to 2.36 or newer
-	_, ok := command.Run("mkfs.xfs", "-f", devicePath)
+	cmd := []string{"mkfs.xfs", "-f"}
+	if logDevicePath != "" {
+		cmd = append(cmd, "-l", "logdev="+logDevicePath)
+	}
+	cmd = append(cmd, extraArgs...)
+	_, ok := command.Run(append(cmd, devicePath)...)
+	if ok {
+		l.waitForUdev(devicePath)
+	}
 	return ok
 }
+
+//WipeSignatures implements the Interface interface.
+func (l *Linux) WipeSignatures(devicePath string) bool {
+	const mebibyte = 1 << 20
+	stdout, ok := command.Run("blockdev", "--getsize64", devicePath)
+	if !ok {
+		return false
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(stdout), 10, 64)
+	if err != nil {
+		util.LogError("cannot determine size of %s: %s", devicePath, err.Error())
+		return false
+	}
+
+	//the start of the device (where most signatures live), and the end (where
+	//e.g. MD superblocks and backup GPTs live); for small devices, both ranges
+	//may overlap
+	offsets := []int64{0}
+	if size > mebibyte {
+		offsets = append(offsets, size-mebibyte)
+	}
+	for _, offset := range offsets {
+		_, ok := command.Run("dd", "if=/dev/zero", "of="+devicePath, "bs=1M", "count=1",
+			"oflag=seek_bytes", "seek="+strconv.FormatInt(offset, 10), "conv=notrunc,fsync", "status=none")
+		if !ok {
+			return false
+		}
+	}
+	l.waitForUdev(devicePath)
+	return true
+}
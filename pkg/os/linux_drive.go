@@ -20,6 +20,7 @@
 package os
 
 import (
+	"fmt"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -40,119 +41,176 @@ var serialNumberRx = regexp.MustCompile(`(?m)^Serial number:\s*(\S+)\s*$`)
 
 //CollectDrives implements the Interface interface.
 func (l *Linux) CollectDrives(devicePathGlobs []string, trigger <-chan struct{}, added chan<- []Drive, removed chan<- []string) {
-	knownDrives := make(map[string]string)
+	scanner := l.NewDriveScanner(devicePathGlobs)
 
 	//work loop
 	for range trigger {
-		//expand globs to find drives
-		existingDrives := make(map[string]string)
-		for _, pattern := range devicePathGlobs {
-			//make pattern relative to current directory (== chroot directory)
-			pattern = strings.TrimPrefix(pattern, "/")
+		addedDrives, removedDrives, err := scanner.Scan()
+		//fail loudly when there are no drives matching our glob
+		//(https://github.com/sapcc/swift-drive-autopilot/issues/23)
+		if err != nil {
+			util.LogFatal(err.Error())
+		}
+		if len(removedDrives) > 0 {
+			removed <- removedDrives
+		}
+		if len(addedDrives) > 0 {
+			added <- addedDrives
+		}
+	}
+}
 
-			matches, err := filepath.Glob(pattern)
-			if err != nil {
-				util.LogFatal("glob(%#v) failed: %s", pattern, err.Error())
-			}
+//NewDriveScanner implements the Interface interface.
+func (l *Linux) NewDriveScanner(devicePathGlobs []string) DriveScanner {
+	return &linuxDriveScanner{
+		l:           l,
+		globs:       devicePathGlobs,
+		knownDrives: make(map[string]string),
+	}
+}
 
-			for _, globbedRelPath := range matches {
-				//resolve any symlinks to get the actual devicePath (this also makes
-				//the path absolute again)
-				devicePath, err := l.evalSymlinksInChroot(globbedRelPath)
-				if err != nil {
-					util.LogFatal(err.Error())
-				}
+type linuxDriveScanner struct {
+	l     *Linux
+	globs []string
+	//globbed path -> device path of drives that were reported as added
+	knownDrives map[string]string
+	controllers controllerTracker
+}
 
-				existingDrives["/"+globbedRelPath] = devicePath
-			}
-		}
+//Scan implements the DriveScanner interface.
+func (s *linuxDriveScanner) Scan() (addedDrives []Drive, removedDrives []string, err error) {
+	//expand globs to find drives
+	existingDrives := s.l.expandDriveGlobs(s.globs)
+
+	//if all drives of a storage controller vanished at once, the controller
+	//was probably reset; try to get the drives back before reporting them as
+	//removed
+	recovering := s.controllers.recoveringDrives(s.knownDrives, existingDrives)
+
+	//fail loudly when there are no drives matching our glob
+	//(https://github.com/sapcc/swift-drive-autopilot/issues/23)
+	if len(existingDrives) == 0 && len(recovering) == 0 {
+		return nil, nil, fmt.Errorf("no drives found matching the configured patterns: %s",
+			strings.Join(s.globs, ", "),
+		)
+	}
 
-		//fail loudly when there are no drives matching our glob
-		//(https://github.com/sapcc/swift-drive-autopilot/issues/23)
-		if len(existingDrives) == 0 {
-			util.LogFatal("no drives found matching the configured patterns: %s",
-				strings.Join(devicePathGlobs, ", "),
-			)
+	//check if any of the reported drives have been removed
+	for globbedPath, devicePath := range s.knownDrives {
+		if _, exists := existingDrives[globbedPath]; !exists && !recovering[globbedPath] {
+			removedDrives = append(removedDrives, devicePath)
+			delete(s.knownDrives, globbedPath)
 		}
+	}
 
-		//check if any of the reported drives have been removed
-		var removedDrives []string
-		for globbedPath, devicePath := range knownDrives {
-			if _, exists := existingDrives[globbedPath]; !exists {
-				removedDrives = append(removedDrives, devicePath)
-				delete(knownDrives, globbedPath)
-			}
-		}
+	sort.Strings(removedDrives) //test needs to be deterministic
 
-		if len(removedDrives) > 0 {
-			sort.Strings(removedDrives) //test needs to be deterministic
-			removed <- removedDrives
-		}
+	//handle new drives (in sorted order, so that the commands below and their
+	//log output appear in the same order on every run)
+	globbedPaths := make([]string, 0, len(existingDrives))
+	for globbedPath := range existingDrives {
+		globbedPaths = append(globbedPaths, globbedPath)
+	}
+	sort.Strings(globbedPaths)
 
-		//handle new drives
-		var addedDrives []Drive
-		for globbedPath, devicePath := range existingDrives {
-			//ignore drives that were already found in a previous run
-			if _, exists := knownDrives[globbedPath]; exists {
-				continue
-			}
-			knownDrives[globbedPath] = devicePath
-
-			//ignore devices with partitions
-			stdout, _ := command.Command{ExitOnError: false}.Run("sfdisk", "-l", devicePath)
-			switch {
-			case driveWithPartitionTableRx.MatchString(stdout):
-				util.LogInfo("ignoring drive %s because it contains partitions", devicePath)
-			case strings.TrimSpace(stdout) == "":
-				//if `sfdisk -l` does not print anything at all, then the device is
-				//not readable and should be ignored (e.g. on some servers, we have
-				///dev/sdX which is a KVM remote volume that's usually not
-				//accessible, i.e. open() fails with ENOMEDIUM; we want to ignore those)
-				//
-				//HOWEVER If the problem is an IO error and the drive has a LUKS
-				//container already opened from before the IO error, we can see that in
-				//`lsblk` and we can infer the serial number from the mapping name.
-				//In this case we want to report the device so that the IO error gets
-				//propagated upwards correctly.
-				serialNumber := tryFindSerialNumberForBrokenDevice(devicePath)
-				if serialNumber != nil {
-					drive := Drive{
-						DevicePath:   devicePath,
-						FoundAtPath:  globbedPath,
-						SerialNumber: *serialNumber,
-					}
-					addedDrives = append(addedDrives, drive)
-				}
-				util.LogInfo("ignoring drive %s because it is not readable", devicePath)
-			default:
-				//drive is eligible -> find serial number and report it
+	for _, globbedPath := range globbedPaths {
+		devicePath := existingDrives[globbedPath]
+		//ignore drives that were already found in a previous run
+		if _, exists := s.knownDrives[globbedPath]; exists {
+			continue
+		}
+		s.knownDrives[globbedPath] = devicePath
+		s.controllers.track(globbedPath, devicePath)
+
+		//ignore devices with partitions
+		stdout, _ := command.Command{ExitOnError: false}.Run("sfdisk", "-l", devicePath)
+		switch {
+		case driveWithPartitionTableRx.MatchString(stdout):
+			util.LogInfo("ignoring drive %s because it contains partitions", devicePath)
+		case strings.TrimSpace(stdout) == "":
+			//if `sfdisk -l` does not print anything at all, then the device is
+			//not readable and should be ignored (e.g. on some servers, we have
+			///dev/sdX which is a KVM remote volume that's usually not
+			//accessible, i.e. open() fails with ENOMEDIUM; we want to ignore those)
+			//
+			//HOWEVER If the problem is an IO error and the drive has a LUKS
+			//container already opened from before the IO error, we can see that in
+			//`lsblk` and we can infer the serial number from the mapping name.
+			//In this case we want to report the device so that the IO error gets
+			//propagated upwards correctly.
+			serialNumber := tryFindSerialNumberForBrokenDevice(devicePath)
+			if serialNumber != nil {
 				drive := Drive{
-					DevicePath:  devicePath,
-					FoundAtPath: globbedPath,
+					DevicePath:   devicePath,
+					FoundAtPath:  globbedPath,
+					SerialNumber: *serialNumber,
 				}
+				addedDrives = append(addedDrives, drive)
+			}
+			util.LogInfo("ignoring drive %s because it is not readable", devicePath)
+		default:
+			//drive is eligible -> find serial number and report it
+			drive := Drive{
+				DevicePath:  devicePath,
+				FoundAtPath: globbedPath,
+			}
 
-				//read serial number using smartctl (using the relative path and skipping
-				//nsenter and chroot here since the host may not have smartctl in its PATH)
-				relDevicePath := strings.TrimPrefix(devicePath, "/")
-				stdout, ok := command.Command{SkipLog: true, NoChroot: true, NoNsenter: true}.Run("smartctl", "-d", "scsi", "-i", relDevicePath)
-				if ok {
-					match := serialNumberRx.FindStringSubmatch(stdout)
-					if match != nil {
-						drive.SerialNumber = sanitizeSerialNumber(match[1])
-					}
+			//read serial number using smartctl (using the relative path and skipping
+			//nsenter and chroot here since the host may not have smartctl in its PATH)
+			relDevicePath := strings.TrimPrefix(devicePath, "/")
+			stdout, ok := command.Command{SkipLog: true, NoChroot: true, NoNsenter: true}.Run("smartctl", "-d", "scsi", "-i", relDevicePath)
+			if ok {
+				match := serialNumberRx.FindStringSubmatch(stdout)
+				if match != nil {
+					drive.SerialNumber = sanitizeSerialNumber(match[1])
 				}
+			}
 
-				addedDrives = append(addedDrives, drive)
+			//if the drive is the backing device of a caching device, the caching
+			//device is what we need to work with
+			stackedDevicePath := findStackedDeviceOn(devicePath)
+			if stackedDevicePath != "" {
+				util.LogInfo("using %s on top of %s", stackedDevicePath, devicePath)
+				drive.BackingDevicePath = devicePath
+				drive.DevicePath = stackedDevicePath
+				s.knownDrives[globbedPath] = stackedDevicePath
 			}
+
+			addedDrives = append(addedDrives, drive)
 		}
+	}
 
-		if len(addedDrives) > 0 {
-			sort.Slice(addedDrives, func(i, j int) bool { //test needs to be deterministic
-				return addedDrives[i].DevicePath < addedDrives[j].DevicePath
-			})
-			added <- addedDrives
+	sort.Slice(addedDrives, func(i, j int) bool { //test needs to be deterministic
+		return addedDrives[i].DevicePath < addedDrives[j].DevicePath
+	})
+	return addedDrives, removedDrives, nil
+}
+
+//Expands the given globs. Returns a map of globbed paths to device paths
+//(i.e. with symlinks resolved).
+func (l *Linux) expandDriveGlobs(devicePathGlobs []string) map[string]string {
+	existingDrives := make(map[string]string)
+	for _, pattern := range devicePathGlobs {
+		//make pattern relative to current directory (== chroot directory)
+		pattern = strings.TrimPrefix(pattern, "/")
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			util.LogFatal("glob(%#v) failed: %s", pattern, err.Error())
+		}
+
+		for _, globbedRelPath := range matches {
+			//resolve any symlinks to get the actual devicePath (this also makes
+			//the path absolute again)
+			devicePath, err := l.evalSymlinksInChroot(globbedRelPath)
+			if err != nil {
+				util.LogFatal(err.Error())
+			}
+
+			existingDrives["/"+globbedRelPath] = devicePath
 		}
 	}
+	return existingDrives
 }
 
 var specialCharInSerialNumberRx = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
@@ -20,9 +20,14 @@
 package os
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
@@ -53,6 +58,87 @@ func swiftIDPathIn(mountPath string) string {
 	return strings.TrimPrefix(path, "/")
 }
 
+//SwiftIDChecksumFileName is the name of the file next to the swift-id file
+//that contains the swift-id file's checksum, in the format of sha256sum(1),
+//such that `sha256sum -c swift-id.sha256` can be used to check it manually.
+const SwiftIDChecksumFileName = "swift-id.sha256"
+
+//ErrSwiftIDChecksumMismatch is returned by CheckSwiftIDChecksum if the
+//swift-id file does not match its checksum.
+var ErrSwiftIDChecksumMismatch = errors.New("swift-id file does not match its checksum")
+
+//CheckSwiftIDChecksum implements the Interface interface.
+func (l *Linux) CheckSwiftIDChecksum(mountPath string) (bool, error) {
+	checksumPath := strings.TrimPrefix(filepath.Join(mountPath, SwiftIDChecksumFileName), "/")
+	buf, err := ioutil.ReadFile(checksumPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return true, ErrSwiftIDChecksumMismatch
+	}
+
+	actual, err := sha256OfSwiftID(mountPath)
+	if err != nil {
+		return true, err
+	}
+	if !strings.EqualFold(fields[0], actual) {
+		return true, ErrSwiftIDChecksumMismatch
+	}
+	return true, nil
+}
+
+//WriteSwiftIDChecksum implements the Interface interface.
+func (l *Linux) WriteSwiftIDChecksum(mountPath string) error {
+	checksum, err := sha256OfSwiftID(mountPath)
+	if err != nil {
+		return err
+	}
+	checksumPath := strings.TrimPrefix(filepath.Join(mountPath, SwiftIDChecksumFileName), "/")
+	return ioutil.WriteFile(checksumPath, []byte(checksum+"  swift-id\n"), 0644)
+}
+
+func sha256OfSwiftID(mountPath string) (string, error) {
+	buf, err := ioutil.ReadFile(swiftIDPathIn(mountPath))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//LayoutVersionFileName is the name of the file in the root directory of a
+//drive's filesystem that records the layout version (see package core).
+const LayoutVersionFileName = "swift-drive-autopilot-layout"
+
+//ReadLayoutVersion implements the Interface interface.
+func (l *Linux) ReadLayoutVersion(mountPath string) (int, error) {
+	path := strings.TrimPrefix(filepath.Join(mountPath, LayoutVersionFileName), "/")
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		version, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err != nil || version < 1 {
+			return 0, fmt.Errorf("malformed layout version in %s: %q", filepath.Join(mountPath, LayoutVersionFileName), string(buf))
+		}
+		return version, nil
+	case os.IsNotExist(err): //not an error
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+//WriteLayoutVersion implements the Interface interface.
+func (l *Linux) WriteLayoutVersion(mountPath string, version int) error {
+	path := strings.TrimPrefix(filepath.Join(mountPath, LayoutVersionFileName), "/")
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(version)+"\n"), 0644)
+}
+
 //Chown implements the Interface interface.
 func (l *Linux) Chown(path, user, group string) {
 	var (
@@ -0,0 +1,143 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	std_os "os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+)
+
+//smartctl reports the drive model as "Product" (SCSI) or "Device Model"
+//(ATA), and the firmware revision as "Revision" (SCSI) or "Firmware Version"
+//(ATA, NVMe).
+var (
+	smartctlModelRx    = regexp.MustCompile(`(?m)^(?:Product|Device Model|Model Number):\s*(.+?)\s*$`)
+	smartctlFirmwareRx = regexp.MustCompile(`(?m)^(?:Revision|Firmware Version):\s*(.+?)\s*$`)
+)
+
+//smartctl reports the power-on hours as SMART attribute 9 (ATA, where the raw
+//value may carry a suffix like "h+12m+34.5s"), as "Power On Hours" (NVMe, with
+//thousands separators), or as the accumulated power-on time (SCSI).
+var (
+	smartctlATAPowerOnRx  = regexp.MustCompile(`(?m)^\s*9\s+Power_On_Hours\s+.*\s(\d+)(?:h\S*)?\s*$`)
+	smartctlNVMePowerOnRx = regexp.MustCompile(`(?m)^Power On Hours:\s*([\d,]+)\s*$`)
+	smartctlSCSIPowerOnRx = regexp.MustCompile(`(?m)^\s*Accumulated power on time, hours:minutes\s+(\d+):\d+`)
+)
+
+//Names of the sysfs attributes of SCSI hosts that contain the firmware version
+//of the storage controller. Each driver has its own name for this.
+var hbaFirmwareAttributes = []string{"version_fw", "fw_version", "firmware_revision"}
+
+//GetFirmwareInfo implements the Interface interface.
+func (l *Linux) GetFirmwareInfo(devicePath string) *FirmwareInfo {
+	var info FirmwareInfo
+
+	//SCSI and ATA drives have "model" and "rev" attributes, NVMe namespaces
+	//reach through to the controller's "model" and "firmware_rev" attributes
+	sysDevicePath := filepath.Join("sys/block", filepath.Base(devicePath), "device")
+	_, err := std_os.Stat(sysDevicePath)
+	if err != nil {
+		//not a physical drive (e.g. a loop device)
+		return nil
+	}
+	info.Model = readSysfsValue(filepath.Join(sysDevicePath, "model"))
+	info.FirmwareRevision = readSysfsValue(filepath.Join(sysDevicePath, "rev"))
+	if info.FirmwareRevision == "" {
+		info.FirmwareRevision = readSysfsValue(filepath.Join(sysDevicePath, "firmware_rev"))
+	}
+
+	//some controllers report a truncated or empty revision through SCSI
+	//emulation, so ask the drive itself (using the relative path and skipping
+	//nsenter and chroot here since the host may not have smartctl in its PATH)
+	if info.Model == "" || info.FirmwareRevision == "" {
+		relDevicePath := strings.TrimPrefix(devicePath, "/")
+		stdout, ok := command.Command{SkipLog: true, NoChroot: true, NoNsenter: true}.Run("smartctl", "-i", relDevicePath)
+		if ok {
+			if match := smartctlModelRx.FindStringSubmatch(stdout); match != nil && info.Model == "" {
+				info.Model = match[1]
+			}
+			if match := smartctlFirmwareRx.FindStringSubmatch(stdout); match != nil && info.FirmwareRevision == "" {
+				info.FirmwareRevision = match[1]
+			}
+		}
+	}
+
+	//the storage controller's driver is the target of the "driver" symlink on
+	//its PCI device
+	pciAddress := findControllerOf(devicePath)
+	if pciAddress != "" {
+		pciPath := filepath.Join("sys/bus/pci/devices", pciAddress)
+		driverPath, err := std_os.Readlink(filepath.Join(pciPath, "driver"))
+		if err == nil {
+			info.HBADriver = filepath.Base(driverPath)
+			info.HBADriverVersion = readSysfsValue(filepath.Join("sys/module", info.HBADriver, "version"))
+		}
+		info.HBAFirmwareVersion = readHBAFirmwareVersion(pciPath)
+	}
+
+	return &info
+}
+
+//GetPowerOnHours implements the Interface interface.
+func (l *Linux) GetPowerOnHours(devicePath string) (int, bool) {
+	//like for GetFirmwareInfo, smartctl is run outside of the chroot
+	relDevicePath := strings.TrimPrefix(devicePath, "/")
+	stdout, ok := command.Command{SkipLog: true, NoChroot: true, NoNsenter: true}.Run("smartctl", "-A", relDevicePath)
+	if !ok {
+		return 0, false
+	}
+	for _, rx := range []*regexp.Regexp{smartctlATAPowerOnRx, smartctlNVMePowerOnRx, smartctlSCSIPowerOnRx} {
+		match := rx.FindStringSubmatch(stdout)
+		if match == nil {
+			continue
+		}
+		hours, err := strconv.Atoi(strings.Replace(match[1], ",", "", -1))
+		if err == nil {
+			return hours, true
+		}
+	}
+	return 0, false
+}
+
+//Reads the firmware version of the storage controller at the given sysfs path
+//from the attributes of its SCSI hosts. Returns "" if the driver does not
+//expose this information.
+func readHBAFirmwareVersion(pciPath string) string {
+	hostPaths, _ := filepath.Glob(filepath.Join(pciPath, "host*"))
+	if len(hostPaths) == 0 {
+		//some drivers put the SCSI hosts further down in the hierarchy
+		hostPaths, _ = filepath.Glob(filepath.Join(pciPath, "*", "host*"))
+	}
+	for _, hostPath := range hostPaths {
+		hostName := filepath.Base(hostPath)
+		for _, attr := range hbaFirmwareAttributes {
+			value := readSysfsValue(filepath.Join("sys/class/scsi_host", hostName, attr))
+			if value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//`losetup -j <file>` prints lines like "/dev/loop0: [2049]:1234 (/path/to/file)"
+var losetupDeviceRx = regexp.MustCompile(`(?m)^(/dev/loop\d+):`)
+
+//How many nbd devices we look at when attaching qcow2 images (the nbd module
+//creates 16 by default).
+const maxNBDDevices = 256
+
+//AttachImageFile implements the Interface interface.
+func (l *Linux) AttachImageFile(imagePath, format string) (string, bool) {
+	switch format {
+	case "raw":
+		return l.attachRawImage(imagePath)
+	case "qcow2":
+		return l.attachQcow2Image(imagePath)
+	default:
+		util.LogError("cannot attach %s: unknown image format %q", imagePath, format)
+		return "", false
+	}
+}
+
+func (l *Linux) attachRawImage(imagePath string) (string, bool) {
+	//reuse an existing loop device (e.g. from before a restart of the autopilot)
+	stdout, ok := command.Run("losetup", "-j", imagePath)
+	if !ok {
+		return "", false
+	}
+	if match := losetupDeviceRx.FindStringSubmatch(stdout); match != nil {
+		return match[1], true
+	}
+
+	stdout, ok = command.Run("losetup", "--find", "--show", imagePath)
+	if !ok {
+		return "", false
+	}
+	devicePath := strings.TrimSpace(stdout)
+	util.LogInfo("attached %s as %s", imagePath, devicePath)
+	return devicePath, true
+}
+
+func (l *Linux) attachQcow2Image(imagePath string) (string, bool) {
+	//an nbd device is in use iff it has a "pid" attribute (containing the PID
+	//of the qemu-nbd process serving it)
+	freeDevicePath := ""
+	for idx := 0; idx < maxNBDDevices; idx++ {
+		sysPath := fmt.Sprintf("sys/block/nbd%d", idx)
+		if _, err := ioutil.ReadDir(sysPath); err != nil {
+			break
+		}
+		pid := readSysfsValue(filepath.Join(sysPath, "pid"))
+		if pid == "" {
+			if freeDevicePath == "" {
+				freeDevicePath = fmt.Sprintf("/dev/nbd%d", idx)
+			}
+			continue
+		}
+		//reuse an existing qemu-nbd process for this image (e.g. from before a
+		//restart of the autopilot)
+		cmdline, err := ioutil.ReadFile(filepath.Join("proc", pid, "cmdline"))
+		if err == nil && containsArgument(cmdline, imagePath) {
+			return fmt.Sprintf("/dev/nbd%d", idx), true
+		}
+	}
+	if freeDevicePath == "" {
+		util.LogError("cannot attach %s: no free nbd device found (is the nbd kernel module loaded?)", imagePath)
+		return "", false
+	}
+
+	_, ok := command.Run("qemu-nbd", "--connect="+freeDevicePath, "--format=qcow2", imagePath)
+	if !ok {
+		return "", false
+	}
+	l.waitForUdev(freeDevicePath)
+	util.LogInfo("attached %s as %s", imagePath, freeDevicePath)
+	return freeDevicePath, true
+}
+
+//Checks whether the NUL-separated command line contains the given argument.
+func containsArgument(cmdline []byte, arg string) bool {
+	for _, field := range strings.Split(string(cmdline), "\x00") {
+		if field == arg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//LockDevice implements the Interface interface.
+func (l *Linux) LockDevice(devicePath string, timeout time.Duration) (func(), error) {
+	//path is relative to the chroot (== our working directory); the lock is
+	//held on the device node's inode, which is shared with the host's /dev
+	f, err := os.Open(strings.TrimPrefix(devicePath, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	//udev takes a shared lock while it probes a device, so we may have to wait
+	//a bit even if no one else is working on the device
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, fmt.Errorf("cannot lock %s: %s", devicePath, err.Error())
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s is locked by another process", devicePath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	//closing the file releases the lock
+	return func() { f.Close() }, nil
+}
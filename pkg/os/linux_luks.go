@@ -20,7 +20,13 @@
 package os
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	sys_os "os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
@@ -28,39 +34,367 @@ import (
 	"github.com/sapcc/swift-drive-autopilot/pkg/util"
 )
 
+//Runs cryptsetup with the given arguments, and passes the given key to it.
+func runCryptsetupWithKey(c command.Command, key LUKSKey, args ...string) (string, bool) {
+	stdout, exitCode := runCryptsetupWithKeyForExitCode(c, key, args...)
+	return stdout, exitCode == 0
+}
+
+//Like runCryptsetupWithKey, but returns the exit code of cryptsetup (or -1 if
+//it could not be run at all).
+func runCryptsetupWithKeyForExitCode(c command.Command, key LUKSKey, args ...string) (string, int) {
+	cmd := append([]string{"cryptsetup"}, args...)
+	switch {
+	case key.KeyFile == "":
+		c.Stdin = key.Secret + "\n"
+	case key.KeyFileInChroot:
+		cmd = append(cmd, "--key-file", key.KeyFile)
+	default:
+		//cryptsetup runs inside the chroot, so it cannot read the file itself
+		buf, err := ioutil.ReadFile(key.KeyFile)
+		if err != nil {
+			util.LogError("cannot read LUKS key file: %s", err.Error())
+			return "", -1
+		}
+		c.Stdin = string(buf)
+		cmd = append(cmd, "--key-file", "-")
+	}
+	return c.RunForExitCode(cmd...)
+}
+
+//The exit code of cryptsetup when the passphrase is wrong ("No key available
+//with this passphrase").
+const cryptsetupWrongPassphraseExitCode = 2
+
 //CreateLUKSContainer implements the Interface interface.
-func (l *Linux) CreateLUKSContainer(devicePath, key string) bool {
-	_, ok := command.Command{Stdin: key + "\n"}.Run("cryptsetup", "luksFormat", devicePath)
+func (l *Linux) CreateLUKSContainer(devicePath, headerPath string, key LUKSKey, options LUKSFormatOptions) bool {
+	args := append([]string{"luksFormat", devicePath}, options.cryptsetupArgs()...)
+	if headerPath != "" {
+		//cryptsetup creates the header file if it does not exist yet
+		args = append(args, "--header", headerPath)
+	}
+	_, ok := runCryptsetupWithKey(command.Command{}, key, args...)
+	if ok {
+		l.waitForUdev(devicePath)
+	}
 	return ok
 }
 
+//EncryptDeviceInPlace implements the Interface interface.
+func (l *Linux) EncryptDeviceInPlace(devicePath, headerPath string, key LUKSKey, options LUKSFormatOptions) bool {
+	//make path relative to working directory to account for chrootPath
+	_, err := sys_os.Stat(strings.TrimPrefix(headerPath, "/"))
+	var args []string
+	switch {
+	case err == nil:
+		//if we were interrupted after the encryption finished, there is nothing
+		//left to resume
+		stdout, ok := command.Command{SkipLog: true}.Run("cryptsetup", "luksDump", headerPath)
+		if !ok {
+			return false
+		}
+		dump, err := parsers.ParseLUKSDump(stdout)
+		if err != nil {
+			util.LogError("cannot parse `cryptsetup luksDump` output for %s: %s", headerPath, err.Error())
+			return false
+		}
+		if !dump.ReencryptionInProgress() {
+			util.LogInfo("encryption of %s has already finished", devicePath)
+			return true
+		}
+		args = []string{"reencrypt", "--resume-only", "--header", headerPath, devicePath}
+	case sys_os.IsNotExist(err):
+		//with a detached header, the filesystem does not need to be shrunk to
+		//make room for the header
+		args = append([]string{"reencrypt", "--encrypt", "--header", headerPath, devicePath}, options.cryptsetupArgs()...)
+	default:
+		util.LogError("cannot check for LUKS header of %s: %s", devicePath, err.Error())
+		return false
+	}
+	_, ok := runCryptsetupWithKey(command.Command{}, key, args...)
+	if ok {
+		l.waitForUdev(devicePath)
+	}
+	return ok
+}
+
+//Validate checks that the options are understood by cryptsetup and fit
+//together.
+func (o LUKSFormatOptions) Validate() error {
+	switch o.Type {
+	case "", "luks1", "luks2":
+	default:
+		return fmt.Errorf("unknown type %q", o.Type)
+	}
+	switch o.PBKDF {
+	case "":
+		//cryptsetup chooses the PBKDF based on the type
+	case "pbkdf2":
+		if o.PBKDFMemory != 0 || o.PBKDFParallel != 0 {
+			return errors.New("pbkdf-memory and pbkdf-parallel require pbkdf argon2i or argon2id")
+		}
+	case "argon2i", "argon2id":
+		if o.Type == "luks1" {
+			return errors.New("LUKS1 only supports pbkdf pbkdf2")
+		}
+	default:
+		return fmt.Errorf("unknown pbkdf %q", o.PBKDF)
+	}
+	if o.SectorSize != 0 {
+		if o.Type != "luks2" {
+			return errors.New("sector-size requires type luks2")
+		}
+		if o.SectorSize < 512 || o.SectorSize > 4096 || o.SectorSize&(o.SectorSize-1) != 0 {
+			return errors.New("sector-size must be a power of two between 512 and 4096")
+		}
+	}
+	if o.KeySize < 0 || o.KeySize%8 != 0 {
+		return errors.New("key-size must be a positive multiple of 8")
+	}
+	if o.PBKDFMemory < 0 || o.PBKDFParallel < 0 || o.PBKDFIterations < 0 {
+		return errors.New("pbkdf-memory, pbkdf-parallel and pbkdf-iterations may not be negative")
+	}
+	return nil
+}
+
+//Returns the arguments for `cryptsetup luksFormat` that implement these
+//options.
+func (o LUKSFormatOptions) cryptsetupArgs() []string {
+	var args []string
+	addArg := func(name, value string) {
+		if value != "" && value != "0" {
+			args = append(args, name, value)
+		}
+	}
+	addArg("--type", o.Type)
+	addArg("--cipher", o.Cipher)
+	addArg("--key-size", strconv.Itoa(o.KeySize))
+	addArg("--sector-size", strconv.Itoa(o.SectorSize))
+	addArg("--pbkdf", o.PBKDF)
+	addArg("--pbkdf-memory", strconv.Itoa(o.PBKDFMemory))
+	addArg("--pbkdf-parallel", strconv.Itoa(o.PBKDFParallel))
+	addArg("--pbkdf-force-iterations", strconv.Itoa(o.PBKDFIterations))
+	return args
+}
+
 //OpenLUKSContainer implements the Interface interface.
-func (l *Linux) OpenLUKSContainer(devicePath, mappingName string, keys []string) (string, bool) {
+func (l *Linux) OpenLUKSContainer(devicePath, headerPath, mappingName string, keys []LUKSKey, readOnly bool) (string, bool, bool) {
+	cmd := []string{"luksOpen", devicePath, mappingName}
+	if headerPath != "" {
+		cmd = append(cmd, "--header", headerPath)
+	}
+	if readOnly {
+		cmd = append(cmd, "--readonly")
+	}
+
 	//try each key until one works
+	keysRejected := len(keys) > 0
 	for idx, key := range keys {
 		util.LogDebug("trying to luksOpen %s as %s with key %d...", devicePath, mappingName, idx)
-		_, ok := command.Command{
-			Stdin:   key + "\n",
-			SkipLog: true,
-		}.Run("cryptsetup", "luksOpen", devicePath, mappingName)
-		if ok {
+		_, exitCode := runCryptsetupWithKeyForExitCode(command.Command{SkipLog: true}, key, cmd...)
+		if exitCode == 0 {
 			mappedDevicePath := "/dev/mapper/" + mappingName
+			l.waitForUdev(mappedDevicePath)
 			//remember this mapping
+			l.mutex.Lock()
 			if l.ActiveLUKSMappings == nil {
 				l.ActiveLUKSMappings = make(map[string]string)
 			}
 			l.ActiveLUKSMappings[devicePath] = mappedDevicePath
-			return mappedDevicePath, true
+			l.mutex.Unlock()
+			return mappedDevicePath, false, true
+		}
+		if exitCode != cryptsetupWrongPassphraseExitCode {
+			util.LogDebug("luksOpen of %s with key %d failed with exit code %d", devicePath, idx, exitCode)
+			keysRejected = false
 		}
 	}
 
 	//no key worked
-	return "", false
+	return "", keysRejected, false
+}
+
+//Validate returns an error if these options are incomplete or invalid.
+func (o PlainCryptOptions) Validate() error {
+	if o.Cipher == "" || o.Hash == "" || o.KeySize == 0 {
+		return errors.New("cipher, hash and key-size are required")
+	}
+	if o.KeySize < 0 || o.KeySize%8 != 0 {
+		return errors.New("key-size must be a positive multiple of 8")
+	}
+	if o.Offset < 0 || o.Skip < 0 {
+		return errors.New("offset and skip may not be negative")
+	}
+	return nil
+}
+
+//OpenPlainCryptMapping implements the Interface interface.
+func (l *Linux) OpenPlainCryptMapping(devicePath, mappingName string, key LUKSKey, options PlainCryptOptions, readOnly bool) (string, bool) {
+	cmd := []string{
+		"open", "--type", "plain", devicePath, mappingName,
+		"--cipher", options.Cipher,
+		"--key-size", strconv.Itoa(options.KeySize),
+		"--offset", strconv.Itoa(options.Offset),
+		"--skip", strconv.Itoa(options.Skip),
+	}
+	if key.KeyFile == "" {
+		cmd = append(cmd, "--hash", options.Hash)
+	}
+	if readOnly {
+		cmd = append(cmd, "--readonly")
+	}
+	_, ok := runCryptsetupWithKey(command.Command{SkipLog: true}, key, cmd...)
+	if !ok {
+		return "", false
+	}
+
+	mappedDevicePath := "/dev/mapper/" + mappingName
+	l.waitForUdev(mappedDevicePath)
+	l.mutex.Lock()
+	if l.ActiveLUKSMappings == nil {
+		l.ActiveLUKSMappings = make(map[string]string)
+	}
+	l.ActiveLUKSMappings[devicePath] = mappedDevicePath
+	l.mutex.Unlock()
+	return mappedDevicePath, true
 }
 
 //CloseLUKSContainer implements the Interface interface.
 func (l *Linux) CloseLUKSContainer(mappingName string) bool {
 	_, ok := command.Run("cryptsetup", "close", mappingName)
+	if ok {
+		//forget this mapping (otherwise, a new mapping of the same device in the
+		//same event loop iteration would mistake it for an existing one)
+		l.mutex.Lock()
+		for devicePath, mappedDevicePath := range l.ActiveLUKSMappings {
+			if mappedDevicePath == "/dev/mapper/"+mappingName {
+				delete(l.ActiveLUKSMappings, devicePath)
+			}
+		}
+		l.mutex.Unlock()
+	}
+	return ok
+}
+
+//GetLUKSVersion implements the Interface interface.
+func (l *Linux) GetLUKSVersion(devicePath string) int {
+	stdout, ok := command.Run("cryptsetup", "luksDump", devicePath)
+	if !ok {
+		return 0
+	}
+	dump, err := parsers.ParseLUKSDump(stdout)
+	if err != nil {
+		util.LogError("cannot parse `cryptsetup luksDump %s` output: %s", devicePath, err.Error())
+		return 0
+	}
+	return dump.Version
+}
+
+//InspectLUKSHeader implements the Interface interface.
+func (l *Linux) InspectLUKSHeader(devicePath string) LUKSHeaderInfo {
+	stdout, ok := command.Command{SkipLog: true}.Run("cryptsetup", "luksDump", devicePath)
+	if !ok {
+		return LUKSHeaderInfo{Error: "`cryptsetup luksDump` failed (the header may be damaged)"}
+	}
+	dump, err := parsers.ParseLUKSDump(stdout)
+	if err != nil {
+		return LUKSHeaderInfo{Error: "cannot parse `cryptsetup luksDump` output: " + err.Error()}
+	}
+	return LUKSHeaderInfo{
+		Version:       dump.Version,
+		UsedKeyslots:  dump.UsedKeyslots,
+		TotalKeyslots: dump.TotalKeyslots,
+		Problems:      dump.Problems(),
+	}
+}
+
+var unlockedKeyslotRx = regexp.MustCompile(`(?m)^Key slot (\d+) unlocked\.$`)
+
+//FindLUKSKeyslot implements the Interface interface.
+func (l *Linux) FindLUKSKeyslot(devicePath string, key LUKSKey) int {
+	stdout, ok := runCryptsetupWithKey(command.Command{SkipLog: true}, key,
+		"open", "--test-passphrase", "--verbose", devicePath)
+	if !ok {
+		return -1
+	}
+	match := unlockedKeyslotRx.FindStringSubmatch(stdout)
+	if match == nil {
+		return -1
+	}
+	slot, err := strconv.Atoi(match[1])
+	if err != nil {
+		return -1
+	}
+	return slot
+}
+
+//AddLUKSKey implements the Interface interface.
+func (l *Linux) AddLUKSKey(devicePath string, existingKey, newKey LUKSKey) bool {
+	//cryptsetup reads the existing key first and the new key second; secrets are
+	//read from stdin one line at a time, but a key file on stdin takes all of it
+	var c command.Command
+	args := []string{"luksAddKey", devicePath}
+	keyFileOnStdin := false
+	switch {
+	case existingKey.KeyFile == "":
+		c.Stdin = existingKey.Secret + "\n"
+	case existingKey.KeyFileInChroot:
+		args = append(args, "--key-file", existingKey.KeyFile)
+	default:
+		buf, err := ioutil.ReadFile(existingKey.KeyFile)
+		if err != nil {
+			util.LogError("cannot read LUKS key file: %s", err.Error())
+			return false
+		}
+		c.Stdin = string(buf)
+		args = append(args, "--key-file", "-")
+		keyFileOnStdin = true
+	}
+	switch {
+	case newKey.KeyFile == "" && !keyFileOnStdin:
+		c.Stdin += newKey.Secret + "\n"
+	case newKey.KeyFileInChroot:
+		args = append(args, newKey.KeyFile)
+	case c.Stdin == "":
+		buf, err := ioutil.ReadFile(newKey.KeyFile)
+		if err != nil {
+			util.LogError("cannot read LUKS key file: %s", err.Error())
+			return false
+		}
+		c.Stdin = string(buf)
+		args = append(args, "-")
+	default:
+		util.LogError("cannot add key to LUKS container on %s: the existing key and the new key cannot both be given to cryptsetup on stdin (use keyfile-in-chroot for one of them)", devicePath)
+		return false
+	}
+	_, ok := c.Run(append([]string{"cryptsetup"}, args...)...)
+	return ok
+}
+
+//RemoveLUKSKeyslot implements the Interface interface.
+func (l *Linux) RemoveLUKSKeyslot(devicePath string, slot int, key LUKSKey) bool {
+	//without --batch-mode, cryptsetup requires a key for one of the remaining
+	//keyslots, which ensures that we cannot remove the last working keyslot
+	_, ok := runCryptsetupWithKey(command.Command{}, key, "luksKillSlot", devicePath, strconv.Itoa(slot))
+	return ok
+}
+
+//BackupLUKSHeader implements the Interface interface.
+func (l *Linux) BackupLUKSHeader(devicePath, backupPath string) bool {
+	_, ok := command.Run("mkdir", "-m", "0700", "-p", filepath.Dir(backupPath))
+	if !ok {
+		return false
+	}
+	_, ok = command.Run("cryptsetup", "luksHeaderBackup", devicePath, "--header-backup-file", backupPath)
+	return ok
+}
+
+//ConvertLUKSContainer implements the Interface interface.
+func (l *Linux) ConvertLUKSContainer(devicePath string) bool {
+	_, ok := command.Run("cryptsetup", "convert", "--batch-mode", "--type", "luks2", devicePath)
+	if ok {
+		l.waitForUdev(devicePath)
+	}
 	return ok
 }
 
@@ -72,29 +406,22 @@ func (l *Linux) RefreshLUKSMappings() {
 		util.LogFatal("cannot parse `lsblk -J` output: " + err.Error())
 	}
 
-	l.ActiveLUKSMappings = make(map[string]string)
+	activeLUKSMappings := make(map[string]string)
+	defer func() {
+		l.mutex.Lock()
+		l.ActiveLUKSMappings = activeLUKSMappings
+		l.mutex.Unlock()
+	}()
 	stdout, _ = command.Command{ExitOnError: true}.Run("dmsetup", "ls", "--target=crypt")
 
-	if strings.TrimSpace(stdout) == "No devices found" {
-		return
-	}
-
-	for _, line := range strings.Split(stdout, "\n") {
-		//each output line describes a mapping and looks like
-		//"mapname\t(devmajor, devminor)"; extract the mapping names
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
-			continue
-		}
-		mappingName := fields[0]
-
+	for _, mappingName := range parsers.ParseDmsetupLs(stdout) {
 		//check lsblk output for the device backing this mapping, otherwise ask cryptsetup for it
 		backingDevicePath := lsblkOutput.FindBackingDeviceForLUKS(mappingName)
 		if backingDevicePath == nil {
 			backingDevicePath = l.getBackingDevicePath(mappingName)
 		}
 		if backingDevicePath != nil {
-			l.ActiveLUKSMappings[*backingDevicePath] = "/dev/mapper/" + mappingName
+			activeLUKSMappings[*backingDevicePath] = "/dev/mapper/" + mappingName
 
 			//if `backingDevicePath` is a symlink (e.g. `/dev/mapper/mpathXXX` for
 			//multipath devices), callers may also ask us for the underlying device
@@ -103,44 +430,45 @@ func (l *Linux) RefreshLUKSMappings() {
 			if err != nil {
 				util.LogFatal("while resolving symlinks in %s: %s", *backingDevicePath, err.Error())
 			}
-			l.ActiveLUKSMappings[backingDeviceCanonicalPath] = "/dev/mapper/" + mappingName
+			activeLUKSMappings[backingDeviceCanonicalPath] = "/dev/mapper/" + mappingName
 		}
 	}
 	return
 }
 
-var backingDeviceRx = regexp.MustCompile(`(?m)^\s*device:\s*(\S+)\s*$`)
-
 //Ask cryptsetup for the device backing an open LUKS container.
 func (l *Linux) getBackingDevicePath(mapName string) *string {
 	stdout, _ := command.Command{ExitOnError: true}.Run("cryptsetup", "status", mapName)
 
-	//look for a line like "  device:  /dev/sdb"
-	match := backingDeviceRx.FindStringSubmatch(stdout)
-	if match == nil {
+	status, err := parsers.ParseCryptsetupStatus(stdout)
+	if err != nil {
 		util.LogFatal("cannot find backing device for /dev/mapper/%s", mapName)
-	} else if match[1] == "(null)" {
+	}
+	if status.Device == "(null)" {
 		util.LogError("skipping /dev/mapper/%s: `cryptsetup status` reports backing device as `(null)` (the kernel log probably has an IO error for the underlying device)", mapName)
 		return nil
+	}
+
+	//resolve any symlinks to get the actual devicePath
+	//when the luks container is created on top of multipathing, cryptsetup status might report the /dev/mapper/mpath device
+	//also the luksFormat was called on actual device
+	devicePath, err := l.evalSymlinksInChroot(status.Device)
+	if err != nil {
+		util.LogFatal(err.Error())
+	}
+	if devicePath != status.Device {
+		util.LogDebug("backing device path for %s is %s -> %s", mapName, status.Device, devicePath)
 	} else {
-		//resolve any symlinks to get the actual devicePath
-		//when the luks container is created on top of multipathing, cryptsetup status might report the /dev/mapper/mpath device
-		//also the luksFormat was called on actual device
-		devicePath, err := l.evalSymlinksInChroot(match[1])
-		if err != nil {
-			util.LogFatal(err.Error())
-		}
-		if devicePath != match[1] {
-			util.LogDebug("backing device path for %s is %s -> %s", mapName, match[1], devicePath)
-			return &devicePath
-		}
-		util.LogDebug("backing device path for %s is %s", mapName, match[1])
+		util.LogDebug("backing device path for %s is %s", mapName, status.Device)
 	}
-	return &match[1]
+	return &devicePath
 }
 
 //GetLUKSMappingOf implements the Interface interface.
 func (l *Linux) GetLUKSMappingOf(devicePath string) string {
-	util.LogDebug("discovered LUKS device path for %s is %q", devicePath, l.ActiveLUKSMappings[devicePath])
-	return l.ActiveLUKSMappings[devicePath]
+	l.mutex.Lock()
+	mappedDevicePath := l.ActiveLUKSMappings[devicePath]
+	l.mutex.Unlock()
+	util.LogDebug("discovered LUKS device path for %s is %q", devicePath, mappedDevicePath)
+	return mappedDevicePath
 }
@@ -0,0 +1,63 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLUKSFormatOptions(t *testing.T) {
+	options := LUKSFormatOptions{
+		Type:            "luks2",
+		Cipher:          "aes-xts-plain64",
+		SectorSize:      4096,
+		PBKDF:           "argon2id",
+		PBKDFMemory:     65536,
+		PBKDFIterations: 4,
+	}
+	if err := options.Validate(); err != nil {
+		t.Errorf("expected valid options, got error: %s", err.Error())
+	}
+	expected := []string{
+		"--type", "luks2", "--cipher", "aes-xts-plain64", "--sector-size", "4096",
+		"--pbkdf", "argon2id", "--pbkdf-memory", "65536", "--pbkdf-force-iterations", "4",
+	}
+	if actual := options.cryptsetupArgs(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected args %#v, got %#v", expected, actual)
+	}
+	if args := (LUKSFormatOptions{}).cryptsetupArgs(); len(args) != 0 {
+		t.Errorf("expected no args for empty options, got %#v", args)
+	}
+
+	invalid := []LUKSFormatOptions{
+		{Type: "luks3"},
+		{Type: "luks1", PBKDF: "argon2id"},
+		{Type: "luks1", SectorSize: 4096},
+		{Type: "luks2", SectorSize: 1024 + 512},
+		{PBKDF: "pbkdf2", PBKDFMemory: 65536},
+		{KeySize: 255},
+	}
+	for _, o := range invalid {
+		if o.Validate() == nil {
+			t.Errorf("expected error for %#v, got none", o)
+		}
+	}
+}
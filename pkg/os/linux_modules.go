@@ -0,0 +1,70 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//LoadKernelModules implements the Interface interface.
+func (l *Linux) LoadKernelModules(modules []string) (missing []string) {
+	for _, module := range modules {
+		if isKernelModuleAvailable(module) {
+			continue
+		}
+		//modprobe also succeeds for modules that are built into the kernel
+		_, ok := command.Command{SkipLog: true}.Run("modprobe", module)
+		if ok {
+			util.LogInfo("loaded kernel module %s", module)
+		} else {
+			missing = append(missing, module)
+		}
+	}
+	return missing
+}
+
+func isKernelModuleAvailable(module string) bool {
+	//loaded modules (and many builtin ones) appear in /sys/module (with
+	//underscores instead of dashes); paths are relative to the chroot (== our
+	//working directory)
+	_, err := os.Stat("sys/module/" + strings.Replace(module, "-", "_", -1))
+	if err == nil {
+		return true
+	}
+
+	//builtin filesystems do not necessarily appear in /sys/module
+	buf, err := ioutil.ReadFile("proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		//lines look like "nodev\ttmpfs" or "\txfs"
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == module {
+			return true
+		}
+	}
+	return false
+}
@@ -20,6 +20,11 @@
 package os
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/sapcc/swift-drive-autopilot/pkg/command"
@@ -38,9 +43,9 @@ func oppositeOf(scope MountScope) MountScope {
 }
 
 //MountDevice implements the Interface interface.
-func (l *Linux) MountDevice(devicePath, mountPath string, scope MountScope) bool {
+func (l *Linux) MountDevice(devicePath, mountPath string, options []string, scope MountScope) bool {
 	//check if already mounted
-	for _, m := range l.ActiveMountPoints[scope] {
+	for _, m := range l.getMountPoints(scope) {
 		if m.DevicePath == devicePath && m.MountPath == mountPath {
 			return true
 		}
@@ -52,7 +57,11 @@ func (l *Linux) MountDevice(devicePath, mountPath string, scope MountScope) bool
 		return false
 	}
 	//execute mount
-	_, ok = command.Command{NoNsenter: scope == LocalScope}.Run("mount", devicePath, mountPath)
+	cmd := []string{"mount"}
+	if len(options) > 0 {
+		cmd = append(cmd, "-o", strings.Join(options, ","))
+	}
+	_, ok = command.Command{NoNsenter: scope == LocalScope}.Run(append(cmd, devicePath, mountPath)...)
 	if !ok {
 		return false
 	}
@@ -66,21 +75,71 @@ func (l *Linux) MountDevice(devicePath, mountPath string, scope MountScope) bool
 		DevicePath: devicePath,
 		MountPath:  mountPath,
 	}
+	l.mutex.Lock()
 	if l.mountScopesAreSeparate() {
 		l.ActiveMountPoints[scope] = append(l.ActiveMountPoints[scope], m)
 	} else {
 		l.ActiveMountPoints[HostScope] = append(l.ActiveMountPoints[HostScope], m)
 		l.ActiveMountPoints[LocalScope] = append(l.ActiveMountPoints[LocalScope], m)
 	}
+	l.mutex.Unlock()
 
 	return true
 }
 
+//CheckMountTarget implements the Interface interface.
+func (l *Linux) CheckMountTarget(mountPath string) error {
+	//make path relative to working directory to account for chrootPath
+	return checkMountTarget(strings.TrimPrefix(mountPath, "/"))
+}
+
+func checkMountTarget(path string) error {
+	//a symlink in place of the parent directory (i.e. /srv/node) could redirect
+	//the mount anywhere, too
+	for _, p := range []string{filepath.Dir(path), path} {
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil //will be created by MountDevice
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("/%s is a symlink", p)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("/%s is not a directory", p)
+		}
+	}
+
+	//mounting over a non-empty directory would hide its contents
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("/%s is not empty", path)
+	}
+	return nil
+}
+
+//RemountDevice implements the Interface interface.
+func (l *Linux) RemountDevice(mountPath string, options []string, scope MountScope) bool {
+	_, ok := command.Command{NoNsenter: scope == LocalScope}.Run(
+		"mount", "-o", "remount,"+strings.Join(options, ","), mountPath)
+	return ok
+}
+
 //UnmountDevice implements the Interface interface.
 func (l *Linux) UnmountDevice(mountPath string, scope MountScope) bool {
 	//check if already unmounted
 	mounted := false
-	for _, m := range l.ActiveMountPoints[scope] {
+	for _, m := range l.getMountPoints(scope) {
 		if m.MountPath == mountPath {
 			mounted = true
 			break
@@ -101,36 +160,53 @@ func (l *Linux) UnmountDevice(mountPath string, scope MountScope) bool {
 	}
 
 	//record that the unmount happened
+	l.mutex.Lock()
 	if l.mountScopesAreSeparate() {
 		l.ActiveMountPoints[scope] = removeMountPoint(l.ActiveMountPoints[scope], mountPath)
 	} else {
 		l.ActiveMountPoints[HostScope] = removeMountPoint(l.ActiveMountPoints[HostScope], mountPath)
 		l.ActiveMountPoints[LocalScope] = removeMountPoint(l.ActiveMountPoints[LocalScope], mountPath)
 	}
+	l.mutex.Unlock()
 	return true
 }
 
 func removeMountPoint(ms []MountPoint, mountPath string) []MountPoint {
 	for idx, m := range ms {
 		if m.MountPath == mountPath {
-			return append(ms[:idx], ms[idx+1:]...)
+			//build a new slice instead of editing in place, since copies of the old
+			//slice may have been handed out by getMountPoints()
+			result := make([]MountPoint, 0, len(ms)-1)
+			result = append(result, ms[:idx]...)
+			return append(result, ms[idx+1:]...)
 		}
 	}
 	return ms
 }
 
+//Returns the list of active mount points in the given scope. The result
+//must not be modified by the caller.
+func (l *Linux) getMountPoints(scope MountScope) []MountPoint {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.ActiveMountPoints[scope]
+}
+
 //RefreshMountPoints implements the Interface interface.
 func (l *Linux) RefreshMountPoints() {
-	l.ActiveMountPoints = map[MountScope][]MountPoint{LocalScope: collectMountPoints(LocalScope)}
+	activeMountPoints := map[MountScope][]MountPoint{LocalScope: collectMountPoints(LocalScope)}
 	if l.mountScopesAreSeparate() {
-		l.ActiveMountPoints[HostScope] = collectMountPoints(HostScope)
+		activeMountPoints[HostScope] = collectMountPoints(HostScope)
 	} else {
 		//make a deep copy to ensure that editing of one list does not affect the other one inadvertently
-		l.ActiveMountPoints[HostScope] = append([]MountPoint(nil), l.ActiveMountPoints[LocalScope]...)
+		activeMountPoints[HostScope] = append([]MountPoint(nil), activeMountPoints[LocalScope]...)
 	}
+	l.mutex.Lock()
+	l.ActiveMountPoints = activeMountPoints
+	l.mutex.Unlock()
 
-	for scope, mounts := range l.ActiveMountPoints {
-		for _, mount := range mounts {
+	for _, scope := range []MountScope{HostScope, LocalScope} {
+		for _, mount := range activeMountPoints[scope] {
 			util.LogDebug("ActiveMountPoints[%s] += %#v", scope, mount)
 		}
 	}
@@ -184,18 +260,21 @@ func (l *Linux) GetMountPointsIn(mountPathPrefix string, scope MountScope) []Mou
 	}
 
 	var result []MountPoint
-	for _, m := range l.ActiveMountPoints[scope] {
+	for _, m := range l.getMountPoints(scope) {
 		if strings.HasPrefix(m.MountPath, mountPathPrefix) {
 			result = append(result, m)
 		}
 	}
+	sort.Slice(result, func(i, j int) bool { //callers log these, so keep the order stable
+		return result[i].MountPath < result[j].MountPath
+	})
 	return result
 }
 
 //GetMountPointsOf implements the Interface interface.
 func (l *Linux) GetMountPointsOf(devicePath string, scope MountScope) []MountPoint {
 	var result []MountPoint
-	for _, m := range l.ActiveMountPoints[scope] {
+	for _, m := range l.getMountPoints(scope) {
 		if m.DevicePath == devicePath {
 			result = append(result, m)
 		}
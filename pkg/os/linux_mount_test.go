@@ -0,0 +1,70 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckMountTarget(t *testing.T) {
+	root, err := ioutil.TempDir("", "swift-drive-autopilot-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(root)
+
+	//layout: srv/node contains an empty directory, a non-empty directory, a
+	//file, and a symlink pointing out of srv/node
+	mustSucceed(t, os.MkdirAll(filepath.Join(root, "srv/node/empty"), 0755))
+	mustSucceed(t, os.MkdirAll(filepath.Join(root, "srv/node/full"), 0755))
+	mustSucceed(t, ioutil.WriteFile(filepath.Join(root, "srv/node/full/objects"), nil, 0644))
+	mustSucceed(t, ioutil.WriteFile(filepath.Join(root, "srv/node/file"), nil, 0644))
+	mustSucceed(t, os.Symlink("/etc", filepath.Join(root, "srv/node/link")))
+	mustSucceed(t, os.MkdirAll(filepath.Join(root, "srv/elsewhere"), 0755))
+	mustSucceed(t, os.Symlink("elsewhere", filepath.Join(root, "srv/linked-node")))
+
+	testCases := map[string]bool{
+		"srv/node/empty":        true,
+		"srv/node/missing":      true,
+		"srv/node/full":         false,
+		"srv/node/file":         false,
+		"srv/node/link":         false,
+		"srv/linked-node/swift": false,
+	}
+	for path, expectedOK := range testCases {
+		err := checkMountTarget(filepath.Join(root, path))
+		if expectedOK && err != nil {
+			t.Errorf("expected %s to be a safe mount target, but got: %s", path, err.Error())
+		}
+		if !expectedOK && err == nil {
+			t.Errorf("expected %s to be rejected as mount target, but it was accepted", path)
+		}
+	}
+}
+
+func mustSucceed(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
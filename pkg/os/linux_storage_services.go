@@ -0,0 +1,78 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+)
+
+var (
+	//`multipathd show daemon` prints something like "pid 1234 idle"
+	multipathDaemonStateRx = regexp.MustCompile(`(?m)^pid\s+\d+\s+(\S+)\s*$`)
+	//`iscsiadm -m session -P 1` prints one such line per session
+	iscsiSessionStateRx = regexp.MustCompile(`(?m)^\s*iSCSI Session State:\s*(\S+)\s*$`)
+)
+
+//GetMultipathStatus implements the Interface interface.
+func (l *Linux) GetMultipathStatus() MultipathStatus {
+	stdout, ok := command.Command{SkipLog: true}.Run("multipathd", "show", "daemon")
+	if !ok {
+		return MultipathStatus{}
+	}
+	var status MultipathStatus
+	if match := multipathDaemonStateRx.FindStringSubmatch(stdout); match != nil {
+		status.DaemonState = match[1]
+	}
+
+	//"%n" is the map name, "%N" is the number of active paths
+	stdout, ok = command.Command{SkipLog: true}.Run("multipathd", "show", "maps", "raw", "format", "%n %N")
+	if !ok {
+		return status
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		status.Maps++
+		if activePaths, err := strconv.Atoi(fields[1]); err == nil && activePaths == 0 {
+			status.MapsWithoutActivePaths = append(status.MapsWithoutActivePaths, fields[0])
+		}
+	}
+	return status
+}
+
+//GetISCSISessionStates implements the Interface interface.
+func (l *Linux) GetISCSISessionStates() []string {
+	//when there are no sessions, iscsiadm exits with an error
+	stdout, ok := command.Command{SkipLog: true}.Run("iscsiadm", "-m", "session", "-P", "1")
+	if !ok {
+		return nil
+	}
+	var states []string
+	for _, match := range iscsiSessionStateRx.FindAllStringSubmatch(stdout, -1) {
+		states = append(states, match[1])
+	}
+	return states
+}
@@ -0,0 +1,113 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//GetTopologyHints implements the Interface interface.
+func (l *Linux) GetTopologyHints(devicePath string) *TopologyHints {
+	pciAddress := findControllerOf(devicePath)
+	if pciAddress == "" {
+		return nil
+	}
+	pciPath := filepath.Join("sys/bus/pci/devices", pciAddress)
+
+	hints := &TopologyHints{
+		PCIAddress: pciAddress,
+		NUMANode:   -1,
+		LocalCPUs:  readSysfsValue(filepath.Join(pciPath, "local_cpulist")),
+	}
+	if numaNode, err := strconv.Atoi(readSysfsValue(filepath.Join(pciPath, "numa_node"))); err == nil {
+		hints.NUMANode = numaNode
+	}
+
+	//MSI/MSI-X interrupts are listed by number in msi_irqs/; legacy interrupts
+	//are in the "irq" file
+	var irqs []int
+	entries, err := ioutil.ReadDir(filepath.Join(pciPath, "msi_irqs"))
+	if err == nil {
+		for _, entry := range entries {
+			if irq, err := strconv.Atoi(entry.Name()); err == nil {
+				irqs = append(irqs, irq)
+			}
+		}
+	}
+	if len(irqs) == 0 {
+		if irq, err := strconv.Atoi(readSysfsValue(filepath.Join(pciPath, "irq"))); err == nil && irq > 0 {
+			irqs = append(irqs, irq)
+		}
+	}
+	sort.Ints(irqs)
+
+	for _, irq := range irqs {
+		hints.IRQs = append(hints.IRQs, IRQHint{
+			IRQ:      irq,
+			Affinity: readSysfsValue(irqAffinityPath(irq)),
+		})
+	}
+	return hints
+}
+
+//ApplyIRQAffinity implements the Interface interface.
+func (l *Linux) ApplyIRQAffinity(hints *TopologyHints) bool {
+	if hints == nil || hints.LocalCPUs == "" {
+		return true
+	}
+
+	ok := true
+	for idx, irqHint := range hints.IRQs {
+		if irqHint.Affinity == hints.LocalCPUs {
+			continue
+		}
+		err := ioutil.WriteFile(irqAffinityPath(irqHint.IRQ), []byte(hints.LocalCPUs+"\n"), 0644)
+		if err != nil {
+			util.LogError("cannot pin IRQ %d of storage controller %s to CPUs %s: %s",
+				irqHint.IRQ, hints.PCIAddress, hints.LocalCPUs, err.Error())
+			ok = false
+			continue
+		}
+		util.LogInfo("pinned IRQ %d of storage controller %s to CPUs %s (was: %s)",
+			irqHint.IRQ, hints.PCIAddress, hints.LocalCPUs, irqHint.Affinity)
+		hints.IRQs[idx].Affinity = hints.LocalCPUs
+	}
+	return ok
+}
+
+func irqAffinityPath(irq int) string {
+	return filepath.Join("proc/irq", strconv.Itoa(irq), "smp_affinity_list")
+}
+
+//Reads a single-line value from sysfs or procfs. Returns "" if the file cannot
+//be read (which is not an error since many of these files are optional).
+func readSysfsValue(path string) string {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
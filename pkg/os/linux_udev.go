@@ -0,0 +1,156 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//How long we wait for udev after changing a device.
+const udevSettleTimeout = 10 * time.Second
+
+//waitForUdev is called after each operation that changes a device (creating a
+//LUKS container or a filesystem, or opening a LUKS container). udev reacts to
+//these changes by probing the device and (re)creating device files and
+//symlinks like /dev/disk/by-uuid/*, during which time the device may be busy
+//or the new device files may not exist yet. We therefore wait for udev to
+//finish processing its event queue, and for the given device files and their
+//by-uuid symlinks to appear.
+func (l *Linux) waitForUdev(devicePaths ...string) {
+	//udevadm talks to udevd via a socket in /run/udev, so it needs to run in the
+	//chroot (like the commands that caused the change); failure is not fatal
+	//since we double-check the device files below anyway
+	_, ok := command.Command{SkipLog: true}.Run("udevadm", "settle",
+		fmt.Sprintf("--timeout=%d", int(udevSettleTimeout.Seconds())))
+	if !ok {
+		util.LogDebug("udevadm settle failed, will only wait for device files to appear")
+	}
+
+	deadline := time.Now().Add(udevSettleTimeout)
+	for _, devicePath := range devicePaths {
+		startedAt := time.Now()
+		appeared := waitForDeviceFile(devicePath, deadline)
+		if appeared {
+			for _, linkPath := range udevUUIDSymlinks(devicePath) {
+				appeared = waitForDeviceFile(linkPath, deadline) && appeared
+			}
+		}
+		util.RecordTiming("udev-wait", devicePath, startedAt, appeared)
+	}
+}
+
+//Polls until the given device file (or symlink to a device file) exists, or
+//until the deadline has passed.
+func waitForDeviceFile(path string, deadline time.Time) bool {
+	//path is relative to the chroot (== our working directory)
+	relPath := strings.TrimPrefix(path, "/")
+	for {
+		_, err := os.Stat(relPath)
+		if err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			util.LogError("%s did not appear within %s: %s", path, udevSettleTimeout.String(), err.Error())
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//Returns the /dev/disk/by-uuid/* symlinks that udev has recorded in its
+//database for the given device. (The device file itself usually exists before
+//and after the change, so only these tell us whether udev has caught up with
+//a new filesystem or LUKS container.)
+func udevUUIDSymlinks(devicePath string) []string {
+	stdout, ok := command.Command{SkipLog: true}.Run("udevadm", "info", "--query=symlink", "--name="+devicePath)
+	if !ok {
+		return nil
+	}
+	var result []string
+	for _, link := range strings.Fields(stdout) {
+		if strings.HasPrefix(link, "disk/by-uuid/") {
+			result = append(result, "/dev/"+link)
+		}
+	}
+	return result
+}
+
+//udevadm monitor reports events like
+//"UDEV  [1234.567890] add      /devices/.../block/sdc (block)".
+var udevEventRx = regexp.MustCompile(`^UDEV\s+\[[0-9.]+\]\s+(add|remove)\s+(\S+)\s+\(block\)`)
+
+//CollectBlockDeviceEvents implements the Interface interface.
+func (l *Linux) CollectBlockDeviceEvents(devicePaths chan<- string) {
+	for {
+		err := l.monitorUdev(devicePaths)
+		util.LogError("udevadm monitor failed (restarting in 5 seconds): %s", err.Error())
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (l *Linux) monitorUdev(devicePaths chan<- string) error {
+	//assemble commandline for udevadm (similar to logic in Command.Run() which
+	//we cannot use here because we need a pipe on stdout); udev events are
+	//broadcast via netlink, so we need to be in the host's network namespace
+	command := []string{"chroot", ".", "nsenter", "--net=/proc/1/ns/net", "--",
+		"udevadm", "monitor", "--udev", "--subsystem-match=block"}
+	if os.Geteuid() != 0 {
+		command = append([]string{"sudo"}, command...)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		match := udevEventRx.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		util.LogDebug("udev reports %s of %s", match[1], match[2])
+		devicePaths <- "/dev/" + filepath.Base(match[2])
+	}
+	err = cmd.Wait()
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = fmt.Errorf("unexpected EOF")
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package os
+
+import (
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//OpenVerityDevice implements the Interface interface.
+func (l *Linux) OpenVerityDevice(dataDevicePath, hashDevicePath, mappingName, rootHash string) (string, bool) {
+	mappedDevicePath := "/dev/mapper/" + mappingName
+
+	//reuse an existing mapping (e.g. from before a restart of the autopilot)
+	_, ok := command.Command{SkipLog: true}.Run("veritysetup", "status", mappingName)
+	if ok {
+		return mappedDevicePath, true
+	}
+
+	_, ok = command.Run("veritysetup", "open", dataDevicePath, mappingName, hashDevicePath, rootHash)
+	if !ok {
+		return "", false
+	}
+	l.waitForUdev(mappedDevicePath)
+	util.LogInfo("opened dm-verity device for %s as %s", dataDevicePath, mappedDevicePath)
+	return mappedDevicePath, true
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"errors"
+	"strings"
+)
+
+//CryptsetupStatus contains the parsed output from `cryptsetup status`.
+type CryptsetupStatus struct {
+	//Type is e.g. "LUKS1" or "LUKS2".
+	Type string
+	//Device is the path of the backing device, or "(null)" if the kernel does
+	//not know about the backing device anymore (usually because of an IO error).
+	Device string
+}
+
+//ParseCryptsetupStatus parses output from `cryptsetup status`, which looks
+//like
+//
+//	/dev/mapper/foo is active and is in use.
+//	  type:    LUKS2
+//	  cipher:  aes-xts-plain64
+//	  device:  /dev/sdb
+//	  ...
+//
+//Unknown lines are ignored, but an error is returned if the backing device is
+//not listed.
+func ParseCryptsetupStatus(buf string) (CryptsetupStatus, error) {
+	var status CryptsetupStatus
+	for _, line := range strings.Split(buf, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		value := strings.TrimSpace(fields[1])
+		if value == "" || strings.ContainsAny(value, " \t") {
+			continue
+		}
+		switch key {
+		case "type":
+			status.Type = value
+		case "device":
+			status.Device = value
+		}
+	}
+	if status.Device == "" {
+		return status, errors.New("backing device not found in `cryptsetup status` output")
+	}
+	return status, nil
+}
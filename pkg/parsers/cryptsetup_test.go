@@ -0,0 +1,49 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseCryptsetupStatus(t *testing.T) {
+	status, err := ParseCryptsetupStatus(readFixture(t, "fixtures/cryptsetup-status.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := CryptsetupStatus{Type: "LUKS2", Device: "/dev/sdb"}
+	if status != expected {
+		t.Errorf("expected %#v, but got %#v", expected, status)
+	}
+
+	_, err = ParseCryptsetupStatus("/dev/mapper/foo is inactive.\n")
+	if err == nil {
+		t.Error("expected error for inactive mapping, but got none")
+	}
+}
+
+func readFixture(t *testing.T, fileName string) string {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return string(buf)
+}
@@ -0,0 +1,74 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//DiskStats contains the I/O counters of a block device from /proc/diskstats,
+//as described in the kernel documentation (Documentation/admin-guide/iostats.rst).
+type DiskStats struct {
+	ReadsCompleted  uint64
+	SectorsRead     uint64
+	WritesCompleted uint64
+	SectorsWritten  uint64
+	IOsInProgress   uint64
+	//TimeDoingIO is the number of milliseconds that the device had I/O requests
+	//in flight.
+	TimeDoingIO uint64
+}
+
+//ParseDiskStats parses the contents of /proc/diskstats, and returns the
+//counters of each device by its name (e.g. "sda" or "dm-3"). Sectors are
+//always 512 bytes in this file, regardless of the sector size of the device.
+func ParseDiskStats(buf string) (map[string]DiskStats, error) {
+	result := make(map[string]DiskStats)
+	for idx, line := range strings.Split(buf, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		//the first three fields are major, minor and name, followed by 11 fields
+		//(or more in newer kernels, which we do not need)
+		if len(fields) < 14 {
+			return nil, fmt.Errorf("line %d: expected at least 14 fields, got %d", idx+1, len(fields))
+		}
+		var values [11]uint64
+		for fieldIdx := range values {
+			value, err := strconv.ParseUint(fields[fieldIdx+3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+			}
+			values[fieldIdx] = value
+		}
+		result[fields[2]] = DiskStats{
+			ReadsCompleted:  values[0],
+			SectorsRead:     values[2],
+			WritesCompleted: values[4],
+			SectorsWritten:  values[6],
+			IOsInProgress:   values[8],
+			TimeDoingIO:     values[9],
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,46 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiskStats(t *testing.T) {
+	actual, err := ParseDiskStats(readFixture(t, "fixtures/diskstats.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]DiskStats{
+		"sda":  {40914, 3326628, 146197, 7592986, 0, 98712},
+		"sda1": {40790, 3320820, 146197, 7592986, 0, 98700},
+		"sdb":  {1201, 52318, 88, 9216, 2, 1790},
+		"dm-0": {1088, 46722, 100, 9216, 0, 1760},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, actual)
+	}
+
+	_, err = ParseDiskStats("   8       0 sda 40914 8707\n")
+	if err == nil {
+		t.Error("expected error for truncated line")
+	}
+}
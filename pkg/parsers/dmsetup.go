@@ -0,0 +1,43 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"regexp"
+	"strings"
+)
+
+//Each line in the output of `dmsetup ls` looks like "name\t(major, minor)" or,
+//with newer versions of dmsetup, "name\t(major:minor)".
+var dmsetupLsLineRx = regexp.MustCompile(`^(\S+)\s+\(\d+(?:,\s*|:)\d+\)$`)
+
+//ParseDmsetupLs parses output from `dmsetup ls` and returns the names of all
+//mappings listed therein. Lines that do not look like a mapping (e.g. the
+//message "No devices found", which may also be translated) are ignored.
+func ParseDmsetupLs(buf string) []string {
+	var names []string
+	for _, line := range strings.Split(buf, "\n") {
+		match := dmsetupLsLineRx.FindStringSubmatch(strings.TrimSpace(line))
+		if match != nil {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
@@ -0,0 +1,40 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDmsetupLs(t *testing.T) {
+	testCases := map[string][]string{
+		readFixture(t, "fixtures/dmsetup-ls.txt"): {"AHTHEI3O", "OHZ4ZOOX"},
+		"No devices found\n":                      nil,
+		"Keine Geräte gefunden\n":                 nil,
+		"foo\t(253, 1)\ngarbage\n\n":              {"foo"},
+	}
+	for input, expected := range testCases {
+		actual := ParseDmsetupLs(input)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected ParseDmsetupLs(%q) = %#v, but got %#v", input, expected, actual)
+		}
+	}
+}
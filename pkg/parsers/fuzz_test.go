@@ -0,0 +1,111 @@
+//go:build go1.18
+// +build go1.18
+
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//The fuzz targets in this file check that the parsers do not panic on
+//unexpected input (e.g. from a different version of the respective tool, or
+//with a different locale). Run them with e.g.
+//
+//	go test -fuzz=FuzzParseMountInfo ./pkg/parsers
+
+func addFixturesToCorpus(f *testing.F, pattern string) {
+	fileNames, err := filepath.Glob(pattern)
+	if err != nil {
+		f.Fatal(err.Error())
+	}
+	for _, fileName := range fileNames {
+		buf, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			f.Fatal(err.Error())
+		}
+		f.Add(string(buf))
+	}
+}
+
+func FuzzParseLsblkOutput(f *testing.F) {
+	addFixturesToCorpus(f, "fixtures/lsblk-*.json")
+	f.Add(`{"blockdevices":[{"name":"sda","type":"disk","rm":"1","children":[{"name":"foo","type":"crypt"}]}]}`)
+	f.Fuzz(func(t *testing.T, input string) {
+		output, err := ParseLsblkOutput(input)
+		if err != nil {
+			return
+		}
+		output.FindBackingDeviceForLUKS("foo")
+		output.FindSerialNumberForDevice("/dev/sda")
+		output.FindSerialNumberForDevice("")
+	})
+}
+
+func FuzzParseDmsetupLs(f *testing.F) {
+	addFixturesToCorpus(f, "fixtures/dmsetup-*.txt")
+	f.Add("No devices found\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		for _, name := range ParseDmsetupLs(input) {
+			if name == "" || strings.ContainsAny(name, " \t\n") {
+				t.Errorf("invalid mapping name %q", name)
+			}
+		}
+	})
+}
+
+func FuzzParseCryptsetupStatus(f *testing.F) {
+	addFixturesToCorpus(f, "fixtures/cryptsetup-*.txt")
+	f.Add("/dev/mapper/foo is active.\n  device:  (null)\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		status, err := ParseCryptsetupStatus(input)
+		if err == nil && (status.Device == "" || strings.ContainsAny(status.Device, " \t\n")) {
+			t.Errorf("invalid backing device %q", status.Device)
+		}
+	})
+}
+
+func FuzzParseLUKSDump(f *testing.F) {
+	addFixturesToCorpus(f, "fixtures/luksdump-*.txt")
+	f.Fuzz(func(t *testing.T, input string) {
+		dump, err := ParseLUKSDump(input)
+		if err == nil && len(dump.UsedKeyslots) > dump.TotalKeyslots && dump.Version == 1 {
+			t.Errorf("more used keyslots than keyslots in %#v", dump)
+		}
+	})
+}
+
+func FuzzParseMountInfo(f *testing.F) {
+	addFixturesToCorpus(f, "fixtures/mountinfo*.txt")
+	f.Add(`1 2 3:4 / /foo\ rw - ext4 /dev/sda rw` + "\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		for _, entry := range ParseMountInfo(input) {
+			for _, field := range entry.OptionalFields {
+				if field == "-" {
+					t.Errorf("separator included in optional fields of %#v", entry)
+				}
+			}
+		}
+	})
+}
@@ -39,6 +39,43 @@ type LsblkDevice struct {
 	Type       string        `json:"type"`
 	MountPoint *string       `json:"mountpoint"`
 	Children   []LsblkDevice `json:"children"`
+	//FSType and Label are only reported if requested with `lsblk -o`.
+	FSType *string `json:"fstype"`
+	Label  *string `json:"label"`
+}
+
+//UnmarshalJSON implements the json.Unmarshaler interface. Older versions of
+//lsblk (before util-linux 2.33) report boolean columns as strings ("0" or
+//"1"), so both representations are accepted.
+func (d *LsblkDevice) UnmarshalJSON(buf []byte) error {
+	type plainDevice LsblkDevice
+	var data struct {
+		plainDevice
+		Removable lsblkBool `json:"rm"`
+		ReadOnly  lsblkBool `json:"ro"`
+	}
+	err := json.Unmarshal(buf, &data)
+	if err != nil {
+		return err
+	}
+	*d = LsblkDevice(data.plainDevice)
+	d.Removable = bool(data.Removable)
+	d.ReadOnly = bool(data.ReadOnly)
+	return nil
+}
+
+type lsblkBool bool
+
+func (b *lsblkBool) UnmarshalJSON(buf []byte) error {
+	switch string(buf) {
+	case `true`, `"1"`, `"true"`:
+		*b = true
+	case `false`, `"0"`, `"false"`, `""`, `null`:
+		*b = false
+	default:
+		return fmt.Errorf("expected boolean value, got %s", string(buf))
+	}
+	return nil
 }
 
 //ParseLsblkOutput parses output from `lsblk -J`.
@@ -64,6 +101,9 @@ func (d LsblkDevice) findBackingDeviceForLUKSRecursively(mappingName string) *st
 	for _, child := range d.Children {
 		if child.Type == "crypt" && child.Name == mappingName {
 			devPath := d.devicePath()
+			if devPath == "" {
+				return nil
+			}
 			return &devPath
 		}
 	}
@@ -95,9 +135,32 @@ func (o LsblkOutput) FindSerialNumberForDevice(devicePath string) *string {
 	return &dev.Children[0].Name
 }
 
+//FindZFSPool returns whether any of the devices in the lsblk output (including
+//partitions and other children) is a member of a ZFS pool, and if so, the name
+//of that pool (empty if unknown). This needs `lsblk -o FSTYPE,LABEL`.
+func (o LsblkOutput) FindZFSPool() (poolName string, isMember bool) {
+	return findZFSPool(o.BlockDevices)
+}
+
+func findZFSPool(devices []LsblkDevice) (string, bool) {
+	for _, d := range devices {
+		if d.FSType != nil && *d.FSType == "zfs_member" {
+			if d.Label == nil {
+				return "", true
+			}
+			return *d.Label, true
+		}
+		poolName, isMember := findZFSPool(d.Children)
+		if isMember {
+			return poolName, true
+		}
+	}
+	return "", false
+}
+
 func findDeviceByPath(devices []LsblkDevice, devicePath string) *LsblkDevice {
 	for _, d := range devices {
-		if d.devicePath() == devicePath {
+		if devicePath != "" && d.devicePath() == devicePath {
 			return &d
 		}
 		childResult := findDeviceByPath(d.Children, devicePath)
@@ -108,13 +171,18 @@ func findDeviceByPath(devices []LsblkDevice, devicePath string) *LsblkDevice {
 	return nil
 }
 
+//Returns an empty string for device types that we do not know how to handle
+//(e.g. "lvm" or "raid1"), since we will never be asked about those anyway.
 func (d LsblkDevice) devicePath() string {
+	if d.Name == "" {
+		return ""
+	}
 	switch d.Type {
 	case "crypt", "mpath":
 		return "/dev/mapper/" + d.Name
 	case "disk", "part", "rom", "loop":
 		return "/dev/" + d.Name
 	default:
-		panic(fmt.Sprintf("do not know how to compute devicePath for %#v", d))
+		return ""
 	}
 }
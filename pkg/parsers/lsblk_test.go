@@ -20,7 +20,9 @@
 package parsers
 
 import (
+	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -38,6 +40,10 @@ func TestFindBackingDeviceForLUKS(t *testing.T) {
 			"usr":          "/dev/sda3",
 			"DOESNOTEXIST": "",
 		},
+		"fixtures/lsblk-old.json": {
+			"AHTHEI3O": "/dev/sdb",
+			"OHZ4ZOOX": "",
+		},
 	}
 	for fileName, testCases := range testCasesPerFile {
 		buf, err := ioutil.ReadFile(fileName)
@@ -74,6 +80,11 @@ func TestFindSerialNumberForDevice(t *testing.T) {
 			"/dev/sda3": "usr",
 			"/dev/null": "",
 		},
+		"fixtures/lsblk-old.json": {
+			"/dev/sdb":  "AHTHEI3O",
+			"/dev/sda1": "",
+			"/dev/md0":  "",
+		},
 	}
 	for fileName, testCases := range testCasesPerFile {
 		buf, err := ioutil.ReadFile(fileName)
@@ -94,9 +105,77 @@ func TestFindSerialNumberForDevice(t *testing.T) {
 	}
 }
 
+func TestFindZFSPool(t *testing.T) {
+	testCases := map[string]string{
+		"fixtures/lsblk-zfs.json":   "tank",
+		"fixtures/lsblk-plain.json": "",
+	}
+	for fileName, expectedPoolName := range testCases {
+		buf, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		output, err := ParseLsblkOutput(string(buf))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		poolName, isMember := output.FindZFSPool()
+		if poolName != expectedPoolName || isMember != (expectedPoolName != "") {
+			t.Errorf("%s: expected ZFS pool %q, but got %q (member = %t)", fileName, expectedPoolName, poolName, isMember)
+		}
+	}
+}
+
+//This measures the work done by RefreshLUKSMappings() on a node with many
+//drives, which looks up the backing device of every LUKS mapping.
+func BenchmarkFindBackingDeviceForLUKS(b *testing.B) {
+	for _, driveCount := range []int{100, 250, 500} {
+		devices := make([]string, driveCount)
+		mappingNames := make([]string, driveCount)
+		for idx := range devices {
+			mappingNames[idx] = fmt.Sprintf("SERIAL%04d", idx)
+			devices[idx] = fmt.Sprintf(
+				`{"name":"sd%04d","maj:min":"8:%d","rm":false,"size":"5.5T","ro":false,"type":"disk","mountpoint":null,`+
+					`"children":[{"name":%q,"maj:min":"253:%d","rm":false,"size":"5.5T","ro":false,"type":"crypt","mountpoint":"/srv/node/swift-%04d"}]}`,
+				idx, idx*16, mappingNames[idx], idx, idx)
+		}
+		buf := `{"blockdevices":[` + strings.Join(devices, ",") + `]}`
+
+		b.Run(fmt.Sprintf("drives=%d", driveCount), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				output, err := ParseLsblkOutput(buf)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+				for _, mappingName := range mappingNames {
+					if output.FindBackingDeviceForLUKS(mappingName) == nil {
+						b.Fatalf("no backing device found for %s", mappingName)
+					}
+				}
+			}
+		})
+	}
+}
+
 func emptyIfNil(val *string) string {
 	if val == nil {
 		return ""
 	}
 	return *val
 }
+
+func TestParseLsblkOutputWithStringBooleans(t *testing.T) {
+	buf, err := ioutil.ReadFile("fixtures/lsblk-old.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := ParseLsblkOutput(string(buf))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	md0 := output.BlockDevices[2]
+	if !md0.ReadOnly || md0.Removable {
+		t.Errorf("expected md0 to be read-only and not removable, but got ro = %t, rm = %t", md0.ReadOnly, md0.Removable)
+	}
+}
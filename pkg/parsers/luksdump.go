@@ -0,0 +1,182 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//LUKSDump contains the parsed output from `cryptsetup luksDump`.
+type LUKSDump struct {
+	//Version is 1 or 2.
+	Version int
+	//UsedKeyslots contains the numbers of all keyslots that contain a key, in
+	//ascending order.
+	UsedKeyslots []int
+	//TotalKeyslots is the number of keyslots that the header format supports.
+	TotalKeyslots int
+	UUID          string
+	//Segments and Digests count the data segments and the volume key digests.
+	//LUKS1 headers always have one of each, unless the respective fields are
+	//missing from the output.
+	Segments int
+	Digests  int
+	//Requirements lists the features that LUKS2 headers require from
+	//cryptsetup, e.g. "online-reencrypt-v2" while a reencryption is in progress.
+	Requirements []string
+}
+
+var (
+	//LUKS1 lists each keyslot like "Key Slot 0: ENABLED"
+	luks1KeyslotRx = regexp.MustCompile(`^Key Slot (\d+): (ENABLED|DISABLED)$`)
+	//LUKS2 lists used keyslots below "Keyslots:" like "  0: luks2" (and
+	//likewise the data segments and digests in their respective sections)
+	luks2KeyslotRx = regexp.MustCompile(`^\s+(\d+): \S+$`)
+)
+
+//ParseLUKSDump parses output from `cryptsetup luksDump`.
+func ParseLUKSDump(buf string) (LUKSDump, error) {
+	var (
+		result     LUKSDump
+		section    string
+		seenSlots  = make(map[int]bool)
+		hasVersion bool
+	)
+	for _, line := range strings.Split(buf, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			continue
+		}
+
+		//in LUKS2 output, the sections start with an unindented "Name:" line
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			fields := strings.SplitN(line, ":", 2)
+			section = fields[0]
+			if section == "Version" && len(fields) == 2 {
+				version, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+				if err != nil {
+					return LUKSDump{}, errors.New("malformed LUKS version: " + strings.TrimSpace(fields[1]))
+				}
+				result.Version = version
+				hasVersion = true
+			}
+			if len(fields) == 2 {
+				switch section {
+				case "UUID":
+					result.UUID = strings.TrimSpace(fields[1])
+				case "Payload offset":
+					result.Segments++
+				case "MK digest":
+					result.Digests++
+				case "Requirements":
+					result.Requirements = append(result.Requirements, strings.Fields(fields[1])...)
+				}
+			}
+		}
+
+		var match []string
+		switch {
+		case result.Version == 1:
+			match = luks1KeyslotRx.FindStringSubmatch(line)
+			if match != nil {
+				result.TotalKeyslots++
+				if match[2] == "DISABLED" {
+					continue
+				}
+			}
+		case result.Version == 2 && section == "Keyslots":
+			match = luks2KeyslotRx.FindStringSubmatch(line)
+		case result.Version == 2 && section == "Data segments":
+			if luks2KeyslotRx.MatchString(line) {
+				result.Segments++
+			}
+		case result.Version == 2 && section == "Digests":
+			if luks2KeyslotRx.MatchString(line) {
+				result.Digests++
+			}
+		}
+		if match == nil {
+			continue
+		}
+		slot, err := strconv.Atoi(match[1])
+		if err != nil || slot < 0 {
+			return LUKSDump{}, errors.New("malformed keyslot number: " + match[1])
+		}
+		if !seenSlots[slot] {
+			seenSlots[slot] = true
+			result.UsedKeyslots = append(result.UsedKeyslots, slot)
+		}
+	}
+
+	switch {
+	case !hasVersion:
+		return LUKSDump{}, errors.New("LUKS version not found")
+	case result.Version == 2:
+		//this is LUKS2_KEYSLOTS_MAX in cryptsetup
+		result.TotalKeyslots = 32
+	case result.Version != 1:
+		return LUKSDump{}, errors.New("unknown LUKS version: " + strconv.Itoa(result.Version))
+	}
+	sort.Ints(result.UsedKeyslots)
+	return result, nil
+}
+
+//ReencryptionInProgress returns whether the header records a reencryption
+//(or an in-place encryption) that has not finished yet.
+func (d LUKSDump) ReencryptionInProgress() bool {
+	for _, requirement := range d.Requirements {
+		if strings.HasPrefix(requirement, "online-reencrypt") {
+			return true
+		}
+	}
+	return false
+}
+
+//Problems returns a description of each inconsistency in this header that
+//would prevent the LUKS container from being opened, or an empty list if the
+//header looks sane.
+func (d LUKSDump) Problems() []string {
+	var problems []string
+	if d.UUID == "" {
+		problems = append(problems, "header has no UUID")
+	}
+	if d.Version == 1 && d.TotalKeyslots != 8 {
+		problems = append(problems, "header lists "+strconv.Itoa(d.TotalKeyslots)+" keyslots instead of 8")
+	}
+	if len(d.UsedKeyslots) == 0 {
+		problems = append(problems, "no keyslot contains a key")
+	}
+	for _, slot := range d.UsedKeyslots {
+		if slot >= d.TotalKeyslots {
+			problems = append(problems, "keyslot "+strconv.Itoa(slot)+" is out of range")
+		}
+	}
+	if d.Segments == 0 {
+		problems = append(problems, "header has no data segment")
+	}
+	if d.Digests == 0 {
+		problems = append(problems, "header has no volume key digest")
+	}
+	return problems
+}
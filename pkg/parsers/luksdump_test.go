@@ -0,0 +1,83 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLUKSDump(t *testing.T) {
+	testCases := map[string]LUKSDump{
+		"fixtures/luksdump-luks1.txt": {Version: 1, UsedKeyslots: []int{0, 2}, TotalKeyslots: 8,
+			UUID: "2b1f2f3c-8a4e-4f0a-9d3e-6f2a1c7d0b11", Segments: 1, Digests: 1},
+		"fixtures/luksdump-luks2.txt": {Version: 2, UsedKeyslots: []int{0, 3}, TotalKeyslots: 32,
+			UUID: "5f0c6b2e-1d3a-4c8e-a7f9-2e6b0d4c1a93", Segments: 1, Digests: 1},
+	}
+	for fileName, expected := range testCases {
+		actual, err := ParseLUKSDump(readFixture(t, fileName))
+		if err != nil {
+			t.Errorf("%s: %s", fileName, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %#v, but got %#v", fileName, expected, actual)
+		}
+		if problems := actual.Problems(); len(problems) > 0 {
+			t.Errorf("%s: expected no problems, but got %#v", fileName, problems)
+		}
+	}
+
+	reencrypting, err := ParseLUKSDump(readFixture(t, "fixtures/luksdump-luks2-reencrypt.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reencrypting.ReencryptionInProgress() {
+		t.Errorf("expected reencryption in progress, but got requirements %#v", reencrypting.Requirements)
+	}
+	regular, err := ParseLUKSDump(readFixture(t, "fixtures/luksdump-luks2.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if regular.ReencryptionInProgress() {
+		t.Error("expected no reencryption in progress for a regular header")
+	}
+
+	damaged, err := ParseLUKSDump(readFixture(t, "fixtures/luksdump-luks2-damaged.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectedProblems := []string{
+		"header has no UUID",
+		"no keyslot contains a key",
+		"header has no data segment",
+		"header has no volume key digest",
+	}
+	if problems := damaged.Problems(); !reflect.DeepEqual(problems, expectedProblems) {
+		t.Errorf("damaged header: expected problems %#v, but got %#v", expectedProblems, problems)
+	}
+
+	for _, input := range []string{"", "Device /dev/sdb is not a valid LUKS device.\n", "Version: 3\n", "Version: x\n"} {
+		_, err := ParseLUKSDump(input)
+		if err == nil {
+			t.Errorf("expected error for %q, but got none", input)
+		}
+	}
+}
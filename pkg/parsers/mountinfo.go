@@ -0,0 +1,96 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"strconv"
+	"strings"
+)
+
+//MountInfoEntry is a line from /proc/self/mountinfo, whose format is
+//documented at <https://www.kernel.org/doc/Documentation/filesystems/proc.txt>.
+type MountInfoEntry struct {
+	MountID    string
+	Root       string
+	MountPoint string
+	//MountOptions are the per-mount options (e.g. "rw" or "noatime").
+	MountOptions []string
+	//OptionalFields contains e.g. "shared:1" or "master:2".
+	OptionalFields []string
+	FilesystemType string
+	Source         string
+	//SuperOptions are the per-filesystem options (e.g. "logbufs=8" for XFS).
+	SuperOptions []string
+}
+
+//ParseMountInfo parses the contents of /proc/self/mountinfo. Malformed lines
+//are skipped.
+func ParseMountInfo(buf string) []MountInfoEntry {
+	var result []MountInfoEntry
+	for _, line := range strings.Split(buf, "\n") {
+		fields := strings.Fields(line)
+		//the separator "-" is mandatory and appears after at least 6 fields
+		sepIdx := -1
+		for idx := 6; idx < len(fields); idx++ {
+			if fields[idx] == "-" {
+				sepIdx = idx
+				break
+			}
+		}
+		if sepIdx < 0 || len(fields) < sepIdx+3 {
+			continue
+		}
+		entry := MountInfoEntry{
+			MountID:        fields[0],
+			Root:           unescapeMountInfo(fields[3]),
+			MountPoint:     unescapeMountInfo(fields[4]),
+			MountOptions:   strings.Split(fields[5], ","),
+			OptionalFields: fields[6:sepIdx],
+			FilesystemType: fields[sepIdx+1],
+			Source:         unescapeMountInfo(fields[sepIdx+2]),
+		}
+		if len(fields) > sepIdx+3 {
+			entry.SuperOptions = strings.Split(fields[sepIdx+3], ",")
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+//The kernel escapes space, tab, newline and backslash in paths as octal
+//sequences like "\040".
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for idx := 0; idx < len(field); idx++ {
+		if field[idx] == '\\' && idx+4 <= len(field) {
+			value, err := strconv.ParseUint(field[idx+1:idx+4], 8, 8)
+			if err == nil {
+				b.WriteByte(byte(value))
+				idx += 3
+				continue
+			}
+		}
+		b.WriteByte(field[idx])
+	}
+	return b.String()
+}
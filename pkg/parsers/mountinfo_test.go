@@ -0,0 +1,51 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package parsers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	entries := ParseMountInfo(readFixture(t, "fixtures/mountinfo.txt") + "garbage\n1 2 3 4 5 6 7\n")
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries, but got %d", len(entries))
+	}
+	expected := MountInfoEntry{
+		MountID:        "412",
+		Root:           "/srv",
+		MountPoint:     "/",
+		MountOptions:   []string{"rw", "relatime"},
+		OptionalFields: []string{"master:1"},
+		FilesystemType: "ext4",
+		Source:         "/dev/sda3",
+		SuperOptions:   []string{"rw"},
+	}
+	if !reflect.DeepEqual(entries[3], expected) {
+		t.Errorf("expected %#v, but got %#v", expected, entries[3])
+	}
+	if entries[1].SuperOptions[1] != "size=32g" {
+		t.Errorf("unexpected entry: %#v", entries[1])
+	}
+	if entries[4].MountPoint != "/var/lib/with space" || len(entries[4].OptionalFields) != 0 {
+		t.Errorf("unexpected entry: %#v", entries[4])
+	}
+}
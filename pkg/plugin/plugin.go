@@ -0,0 +1,226 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+//Package plugin implements support for external plugins. A plugin is a
+//separate executable that is started once for each request. It receives the
+//request as a JSON object on stdin, and writes the response as a JSON object
+//to stdout. To guard against accidentally configuring a program that is not a
+//plugin, the environment variable SWIFT_DRIVE_AUTOPILOT_PLUGIN is set to
+//MagicCookie, and the plugin must echo the cookie in its handshake response.
+//
+//Unlike with hashicorp/go-plugin, there is no long-running plugin process and
+//no gRPC transport. This keeps plugins easy to write in any language
+//(including shell scripts), and avoids pulling gRPC into the autopilot.
+//Plugins are executed through package command, without the chroot and with an
+//explicit environment.
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+)
+
+//ProtocolVersion is the version of the plugin protocol implemented by this
+//package.
+const ProtocolVersion = 1
+
+//MagicCookie is given to plugins in the environment variable
+//SWIFT_DRIVE_AUTOPILOT_PLUGIN.
+const MagicCookie = "7b0f0f5e-swift-drive-autopilot-plugin"
+
+//DefaultPath is the PATH given to plugins, unless their configured environment
+//contains a different one.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+//Capability is something that a plugin can provide.
+type Capability string
+
+const (
+	//KeySource plugins provide LUKS encryption keys.
+	KeySource Capability = "key-source"
+	//DriveFilter plugins decide which drives shall be managed.
+	DriveFilter Capability = "drive-filter"
+	//PostMountAction plugins are notified when a drive has been mounted below
+	///srv/node.
+	PostMountAction Capability = "post-mount"
+)
+
+//Plugin is a plugin that has completed the handshake.
+type Plugin struct {
+	Name         string
+	Command      []string
+	Env          []string
+	Timeout      time.Duration
+	Capabilities []Capability
+}
+
+//DriveInfo describes a drive in plugin requests.
+type DriveInfo struct {
+	DriveID           string `json:"id"`
+	DevicePath        string `json:"device_path"`
+	BackingDevicePath string `json:"backing_device_path,omitempty"`
+	FoundAtPath       string `json:"found_at_path,omitempty"`
+	SerialNumber      string `json:"serial_number,omitempty"`
+	MountPath         string `json:"mount_path,omitempty"`
+	SwiftID           string `json:"swift_id,omitempty"`
+	//Labels are taken from the configuration.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type request struct {
+	Method          string     `json:"method"`
+	ProtocolVersion int        `json:"protocol_version"`
+	Drive           *DriveInfo `json:"drive,omitempty"`
+}
+
+type response struct {
+	Error string `json:"error"`
+	//for "handshake"
+	Cookie          string       `json:"cookie"`
+	ProtocolVersion int          `json:"protocol_version"`
+	Capabilities    []Capability `json:"capabilities"`
+	//for "keys"
+	Keys []string `json:"keys"`
+	//for "filter-drive"
+	Accept bool `json:"accept"`
+}
+
+//Load starts the plugin with the given command line and performs the
+//handshake. The environment variables (in the form "KEY=value") are given to
+//the plugin in addition to PATH and the magic cookie. The timeout applies to
+//each request (30 seconds if zero).
+func Load(name string, cmd, env []string, timeout time.Duration) (*Plugin, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("no command given")
+	}
+	for _, variable := range env {
+		if !strings.Contains(variable, "=") {
+			return nil, errors.New("environment variables must have the form KEY=value")
+		}
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	p := &Plugin{Name: name, Command: cmd, Env: env, Timeout: timeout}
+
+	resp, err := p.call(request{Method: "handshake"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Cookie != MagicCookie {
+		return nil, errors.New("handshake failed: program does not look like a plugin")
+	}
+	if resp.ProtocolVersion != ProtocolVersion {
+		return nil, fmt.Errorf("handshake failed: plugin speaks protocol version %d, but expected version %d",
+			resp.ProtocolVersion, ProtocolVersion)
+	}
+	for _, c := range resp.Capabilities {
+		switch c {
+		case KeySource, DriveFilter, PostMountAction:
+			p.Capabilities = append(p.Capabilities, c)
+		default:
+			return nil, fmt.Errorf("handshake failed: unknown capability %q", c)
+		}
+	}
+	return p, nil
+}
+
+//Provides returns whether this plugin has the given capability.
+func (p *Plugin) Provides(c Capability) bool {
+	for _, provided := range p.Capabilities {
+		if provided == c {
+			return true
+		}
+	}
+	return false
+}
+
+//Keys asks a KeySource plugin for encryption keys.
+func (p *Plugin) Keys() ([]string, error) {
+	resp, err := p.call(request{Method: "keys"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+//FilterDrive asks a DriveFilter plugin whether the given drive shall be
+//managed.
+func (p *Plugin) FilterDrive(info DriveInfo) (bool, error) {
+	resp, err := p.call(request{Method: "filter-drive", Drive: &info})
+	if err != nil {
+		return false, err
+	}
+	return resp.Accept, nil
+}
+
+//PostMount notifies a PostMountAction plugin that the given drive has been
+//mounted.
+func (p *Plugin) PostMount(info DriveInfo) error {
+	_, err := p.call(request{Method: "post-mount", Drive: &info})
+	return err
+}
+
+//Runs the plugin once to handle the given request. The plugin's stdout is
+//never logged since it may contain secrets (e.g. for "keys"). Failures are
+//logged by package command, including the plugin's stderr.
+func (p *Plugin) call(req request) (response, error) {
+	req.ProtocolVersion = ProtocolVersion
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return response{}, err
+	}
+
+	stdout, ok := command.Command{
+		Stdin:        string(reqBytes),
+		NoChroot:     true,
+		NoNsenter:    true,
+		Env:          p.environment(),
+		CleanEnv:     true,
+		SecretOutput: true,
+		Timeout:      p.Timeout,
+		Retry:        &command.RetryPolicy{},
+	}.Run(p.Command...)
+	if !ok {
+		return response{}, fmt.Errorf("%s request failed", req.Method)
+	}
+
+	var resp response
+	err = json.Unmarshal([]byte(stdout), &resp)
+	if err != nil {
+		return response{}, fmt.Errorf("%s request returned malformed response: %s", req.Method, err.Error())
+	}
+	if resp.Error != "" {
+		return response{}, fmt.Errorf("%s request failed: %s", req.Method, resp.Error)
+	}
+	return resp, nil
+}
+
+//Plugins do not inherit the autopilot's environment (which may contain keys
+//or credentials). They only get a default PATH, the magic cookie and the
+//configured environment variables.
+func (p *Plugin) environment() []string {
+	env := []string{"PATH=" + DefaultPath, "SWIFT_DRIVE_AUTOPILOT_PLUGIN=" + MagicCookie}
+	return append(env, p.Env...)
+}
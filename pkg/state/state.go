@@ -0,0 +1,433 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//State is the part of the autopilot's knowledge that needs to survive a
+//reboot. It is persisted as a JSON file. Unlike the files in
+///run/swift-storage, this file must live on a persistent filesystem.
+//
+//The State is owned by the converger thread. It must not be accessed from
+//other threads.
+type State struct {
+	//Drives contains all drives that were ever seen by the autopilot on this
+	//node (and not forgotten explicitly), indexed by DriveID.
+	Drives map[string]*DriveState `json:"drives"`
+	//RetiredDrives contains the history of drives that have been forgotten,
+	//indexed by DriveID, so that they still count towards the lifecycle
+	//statistics. Only drives with a known model are retained.
+	RetiredDrives map[string]*DriveHistory `json:"retired_drives,omitempty"`
+
+	//KeepSnapshots is how many previous versions of the state file are retained
+	//by Save (see SnapshotPath). A snapshot is taken when the file is first
+	//replaced by this process, so there is one snapshot per run.
+	KeepSnapshots int `json:"-"`
+
+	//the serialization of the State when it was last loaded or saved, to avoid
+	//unnecessary writes
+	lastSaved []byte
+	//whether Save has already taken a snapshot
+	snapshotTaken bool
+	//the lock on the state file (see Lock)
+	lockFile *os.File
+}
+
+//DriveState contains the persistent state for a single drive.
+type DriveState struct {
+	//DevicePath is where the drive was last seen, and FoundAtPath is the path
+	//that matched the drive globs (before symlinks were expanded).
+	DevicePath  string `json:"device_path"`
+	FoundAtPath string `json:"found_at_path,omitempty"`
+	//SwiftID is the last valid swift-id that was read from this drive (empty
+	//if none has been seen yet).
+	SwiftID string `json:"swift_id,omitempty"`
+	//FilesystemUUID is the UUID of the filesystem that was last accepted on
+	//this drive (see core.DriveOptions.ExpectedFilesystemUUID).
+	FilesystemUUID string `json:"filesystem_uuid,omitempty"`
+	//Settings are the configurable settings that were last applied to this
+	//drive (nil if the drive has not been set up by a version of the autopilot
+	//that records settings).
+	Settings *DriveSettings `json:"settings,omitempty"`
+	//MissingSince is when the autopilot first noticed that the drive is gone
+	//(nil while the drive is present). Drives that have been missing for too
+	//long are forgotten (see Forget).
+	MissingSince *time.Time `json:"missing_since,omitempty"`
+	//EncryptionStartedAt is set while the drive's filesystem is being encrypted
+	//in place, so that an interrupted encryption is resumed after a reboot
+	//instead of mounting the half-encrypted filesystem.
+	EncryptionStartedAt *time.Time `json:"encryption_started_at,omitempty"`
+	//History contains health facts about this drive that help operators decide
+	//whether to trust it (nil if nothing has been recorded yet).
+	History *DriveHistory `json:"history,omitempty"`
+}
+
+//DriveHistory is a "last known good" record of a drive's health.
+type DriveHistory struct {
+	//LastMountedAt is when the drive was last mounted below /srv/node, at
+	//LastMountPath.
+	LastMountedAt *time.Time `json:"last_mounted_at,omitempty"`
+	LastMountPath string     `json:"last_mount_path,omitempty"`
+	//KernelErrorCount counts the errors for this drive that were seen in the
+	//kernel log. LastKernelError is the most recent of these log lines.
+	KernelErrorCount  int        `json:"kernel_error_count,omitempty"`
+	LastKernelErrorAt *time.Time `json:"last_kernel_error_at,omitempty"`
+	LastKernelError   string     `json:"last_kernel_error,omitempty"`
+	//BrokenCount counts how often the drive has been flagged as broken.
+	BrokenCount  int        `json:"broken_count,omitempty"`
+	LastBrokenAt *time.Time `json:"last_broken_at,omitempty"`
+	//FormatCount counts how often the autopilot has created a filesystem on
+	//this drive.
+	FormatCount     int        `json:"format_count,omitempty"`
+	LastFormattedAt *time.Time `json:"last_formatted_at,omitempty"`
+	//Model and FirmwareRevision identify the kind of drive, for lifecycle
+	//statistics (see the --fleet-report flag).
+	Model            string `json:"model,omitempty"`
+	FirmwareRevision string `json:"firmware_revision,omitempty"`
+	//PowerOnHours is the drive's power-on time according to SMART, as of
+	//PowerOnHoursAt.
+	PowerOnHours   int        `json:"power_on_hours,omitempty"`
+	PowerOnHoursAt *time.Time `json:"power_on_hours_at,omitempty"`
+}
+
+//RecordMount records that the drive was mounted at the given path and time,
+//unless a more recent mount has already been recorded.
+func (ds *DriveState) RecordMount(mountPath string, at time.Time) {
+	h := ds.history()
+	if h.LastMountedAt == nil || at.After(*h.LastMountedAt) {
+		at = at.UTC().Truncate(time.Second)
+		h.LastMountedAt = &at
+		h.LastMountPath = mountPath
+	}
+}
+
+//RecordKernelError records an error for this drive from the kernel log.
+func (ds *DriveState) RecordKernelError(logLine string, at time.Time) {
+	h := ds.history()
+	at = at.UTC().Truncate(time.Second)
+	h.KernelErrorCount++
+	h.LastKernelErrorAt = &at
+	h.LastKernelError = logLine
+}
+
+//RecordBroken records that the drive was flagged as broken at the given time,
+//unless this has already been recorded.
+func (ds *DriveState) RecordBroken(at time.Time) {
+	h := ds.history()
+	at = at.UTC().Truncate(time.Second)
+	if h.LastBrokenAt == nil || at.After(*h.LastBrokenAt) {
+		h.BrokenCount++
+		h.LastBrokenAt = &at
+	}
+}
+
+//RecordFormat records that a filesystem was created on the drive at the given
+//time, unless this has already been recorded.
+func (ds *DriveState) RecordFormat(at time.Time) {
+	h := ds.history()
+	at = at.UTC().Truncate(time.Second)
+	if h.LastFormattedAt == nil || at.After(*h.LastFormattedAt) {
+		h.FormatCount++
+		h.LastFormattedAt = &at
+	}
+}
+
+//RecordFirmware records the model and firmware revision of the drive.
+func (ds *DriveState) RecordFirmware(model, firmwareRevision string) {
+	if model == "" && firmwareRevision == "" {
+		return
+	}
+	h := ds.history()
+	h.Model = model
+	h.FirmwareRevision = firmwareRevision
+}
+
+//RecordPowerOnHours records the drive's power-on time as read from SMART at
+//the given time.
+func (ds *DriveState) RecordPowerOnHours(hours int, at time.Time) {
+	h := ds.history()
+	at = at.UTC().Truncate(time.Second)
+	h.PowerOnHours = hours
+	h.PowerOnHoursAt = &at
+}
+
+//PowerOnHoursDue returns whether the drive's power-on time should be read
+//again, i.e. if it has not been read within the given interval.
+func (ds *DriveState) PowerOnHoursDue(interval time.Duration) bool {
+	h := ds.History
+	return h == nil || h.PowerOnHoursAt == nil || time.Since(*h.PowerOnHoursAt) >= interval
+}
+
+func (ds *DriveState) history() *DriveHistory {
+	if ds.History == nil {
+		ds.History = &DriveHistory{}
+	}
+	return ds.History
+}
+
+//DriveSettings contains those parts of the configuration that affect how an
+//individual drive is set up. These are recorded for each drive, so that
+//configuration changes can be rolled out to a subset of drives first (see
+//the --canary flag). The FormatOptions are only recorded when the autopilot
+//creates the drive's filesystem, since they do not affect existing
+//filesystems.
+type DriveSettings struct {
+	MountOptions  []string `json:"mount_options,omitempty"`
+	FormatOptions []string `json:"format_options,omitempty"`
+}
+
+//Equal checks whether both settings are identical.
+func (s DriveSettings) Equal(other DriveSettings) bool {
+	return s.EqualMountOptions(other) && s.EqualFormatOptions(other)
+}
+
+//EqualMountOptions checks whether both settings have identical MountOptions.
+func (s DriveSettings) EqualMountOptions(other DriveSettings) bool {
+	return stringListsEqual(s.MountOptions, other.MountOptions)
+}
+
+//EqualFormatOptions checks whether both settings have identical FormatOptions.
+func (s DriveSettings) EqualFormatOptions(other DriveSettings) bool {
+	return stringListsEqual(s.FormatOptions, other.FormatOptions)
+}
+
+func stringListsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+//Load reads the State from the given path. If the file does not exist, an
+//empty State is returned. Like all paths in this program, the path refers to
+//inside the chroot (if any).
+func Load(path string) (*State, error) {
+	s := &State{Drives: make(map[string]*DriveState)}
+	buf, err := ioutil.ReadFile(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(buf, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Drives == nil {
+		s.Drives = make(map[string]*DriveState)
+	}
+	s.lastSaved = buf
+	return s, nil
+}
+
+//Lock takes an exclusive lock on the state file at the given path, and holds
+//it for as long as this process runs. While the lock is held, Rollback refuses
+//to replace the file underneath us. If the lock is not taken explicitly, Save
+//takes it before it first writes the file.
+func (s *State) Lock(path string) error {
+	if s.lockFile != nil {
+		return nil
+	}
+	path = strings.TrimPrefix(path, "/")
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	s.lockFile, err = lockStateFile(path)
+	return err
+}
+
+//Save writes the State to the given path if it has changed since it was last
+//loaded or saved. The file is replaced atomically, so that a crash while
+//writing cannot corrupt it.
+func (s *State) Save(path string) error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	if bytes.Equal(buf, s.lastSaved) {
+		return nil
+	}
+
+	err = s.Lock(path)
+	if err != nil {
+		return err
+	}
+	path = strings.TrimPrefix(path, "/")
+	if s.KeepSnapshots > 0 && !s.snapshotTaken {
+		err = rotateSnapshots(path, s.KeepSnapshots)
+		if err != nil {
+			return err
+		}
+		s.snapshotTaken = true
+	}
+	err = writeFileAtomically(path, buf)
+	if err != nil {
+		return err
+	}
+
+	s.lastSaved = buf
+	return nil
+}
+
+//Takes an exclusive lock on the state file at the given path (which is
+//relative to the working directory). Since the file is replaced on every save,
+//the lock is held on a separate file next to it. Closing the returned file
+//releases the lock.
+func lockStateFile(path string) (*os.File, error) {
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is locked by another process (is the autopilot still running?)", lockPath)
+		}
+		return nil, fmt.Errorf("cannot lock %s: %s", lockPath, err.Error())
+	}
+	return f, nil
+}
+
+func writeFileAtomically(path string, buf []byte) error {
+	tmpPath := path + ".new"
+	err := ioutil.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+//SnapshotPath returns the path of the n-th most recent snapshot of the state
+//file at the given path (counting from 1).
+func SnapshotPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+//Shifts the existing snapshots of the state file at the given path (which is
+//relative to the working directory), and makes the current file the most
+//recent snapshot. At most keep snapshots are retained.
+func rotateSnapshots(path string, keep int) error {
+	err := os.Remove(SnapshotPath(path, keep))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := keep - 1; n >= 1; n-- {
+		err := os.Rename(SnapshotPath(path, n), SnapshotPath(path, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	//a hard link keeps the current file in place until it is replaced
+	err = os.Link(path, SnapshotPath(path, 1))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//Rollback replaces the state file at the given path with its n-th most recent
+//snapshot, and returns the restored State. The previous contents of the file
+//become the most recent snapshot, so that the rollback can be undone. At least
+//keep snapshots are retained. The rollback is refused while the state file is
+//locked by another process (see State.Lock).
+func Rollback(path string, n, keep int) (*State, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid snapshot number: %d", n)
+	}
+	snapshotPath := SnapshotPath(path, n)
+	restored, err := Load(snapshotPath)
+	if err == nil && restored.lastSaved == nil {
+		err = fmt.Errorf("%s does not exist", snapshotPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read snapshot: %s", err.Error())
+	}
+
+	if keep < n {
+		keep = n
+	}
+	path = strings.TrimPrefix(path, "/")
+	lockFile, err := lockStateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer lockFile.Close()
+	err = rotateSnapshots(path, keep)
+	if err != nil {
+		return nil, err
+	}
+	return restored, writeFileAtomically(path, restored.lastSaved)
+}
+
+//Drive returns the DriveState for the given DriveID, creating it if
+//necessary.
+func (s *State) Drive(driveID string) *DriveState {
+	ds, exists := s.Drives[driveID]
+	if !exists {
+		ds = &DriveState{}
+		s.Drives[driveID] = ds
+	}
+	return ds
+}
+
+//Forget removes the given drive from this State. Its history is moved into
+//RetiredDrives if it is relevant for the lifecycle statistics.
+func (s *State) Forget(driveID string) {
+	if ds, exists := s.Drives[driveID]; exists && ds.History != nil && ds.History.Model != "" {
+		if s.RetiredDrives == nil {
+			s.RetiredDrives = make(map[string]*DriveHistory)
+		}
+		s.RetiredDrives[driveID] = ds.History
+	}
+	delete(s.Drives, driveID)
+}
+
+//DriveIDs returns the IDs of all drives in this State, in sorted order.
+func (s *State) DriveIDs() []string {
+	result := make([]string, 0, len(s.Drives))
+	for driveID := range s.Drives {
+		result = append(result, driveID)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,154 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+//The state file paths refer to inside the chroot, i.e. they are relative to
+//the working directory, so each test runs in an empty directory.
+func enterTempDir(t *testing.T) (leave func()) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	root, err := ioutil.TempDir("", "swift-drive-autopilot-test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.Chdir(root)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(root)
+	}
+}
+
+const testStatePath = "/var/lib/swift-drive-autopilot/state.json"
+
+//Simulates one run of the autopilot that saves a State containing only the
+//given drive ID. The lock is released afterwards, as if the process exited.
+func saveGeneration(t *testing.T, keep int, driveID string) {
+	t.Helper()
+	s := &State{Drives: map[string]*DriveState{driveID: {}}, KeepSnapshots: keep}
+	err := s.Save(testStatePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.lockFile.Close()
+}
+
+//Returns the drive IDs in the file at the given path, or "missing".
+func generationAt(t *testing.T, path string) string {
+	t.Helper()
+	if _, err := os.Stat(strings.TrimPrefix(path, "/")); os.IsNotExist(err) {
+		return "missing"
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return strings.Join(s.DriveIDs(), ",")
+}
+
+func expectGenerations(t *testing.T, expected ...string) {
+	t.Helper()
+	paths := []string{testStatePath}
+	for n := 1; n < len(expected); n++ {
+		paths = append(paths, SnapshotPath(testStatePath, n))
+	}
+	for idx, path := range paths {
+		if actual := generationAt(t, path); actual != expected[idx] {
+			t.Errorf("expected %s to contain %s, but got %s", path, expected[idx], actual)
+		}
+	}
+}
+
+func TestSnapshotRotation(t *testing.T) {
+	defer enterTempDir(t)()
+
+	for _, driveID := range []string{"gen1", "gen2", "gen3", "gen4"} {
+		saveGeneration(t, 2, driveID)
+	}
+	//the oldest generation has been dropped
+	expectGenerations(t, "gen4", "gen3", "gen2", "missing")
+}
+
+func TestRollback(t *testing.T) {
+	defer enterTempDir(t)()
+	for _, driveID := range []string{"gen1", "gen2", "gen3"} {
+		saveGeneration(t, 2, driveID)
+	}
+	expectGenerations(t, "gen3", "gen2", "gen1")
+
+	s, err := Rollback(testStatePath, 1, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if actual := strings.Join(s.DriveIDs(), ","); actual != "gen2" {
+		t.Errorf("expected to restore gen2, but got %s", actual)
+	}
+	expectGenerations(t, "gen2", "gen3", "gen2", "missing")
+
+	//when the oldest snapshot is restored, it is dropped from the snapshots
+	//while the previous file takes its place, but it is still restored
+	s, err = Rollback(testStatePath, 2, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if actual := strings.Join(s.DriveIDs(), ","); actual != "gen2" {
+		t.Errorf("expected to restore gen2, but got %s", actual)
+	}
+	expectGenerations(t, "gen2", "gen2", "gen3", "missing")
+}
+
+func TestRollbackRefusedWhileLocked(t *testing.T) {
+	defer enterTempDir(t)()
+	saveGeneration(t, 2, "gen1")
+	saveGeneration(t, 2, "gen2")
+
+	s, err := Load(testStatePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.Lock(testStatePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = Rollback(testStatePath, 1, 2)
+	if err == nil || !strings.Contains(err.Error(), "locked by another process") {
+		t.Errorf("expected rollback to be refused, but got error %v", err)
+	}
+	expectGenerations(t, "gen2", "gen1")
+
+	//once the lock is released, the rollback succeeds
+	s.lockFile.Close()
+	_, err = Rollback(testStatePath, 1, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectGenerations(t, "gen1", "gen2")
+}
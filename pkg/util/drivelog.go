@@ -0,0 +1,241 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DriveLogDirectory is where per-drive logs are written. Like all paths in this
+//program, it refers to inside the chroot (if any).
+const DriveLogDirectory = "/run/swift-storage/log"
+
+//DriveLogMaxSize is the size (in bytes) after which a per-drive log is rolled
+//over: The current file is renamed to "<driveID>.log.1" (replacing the
+//previous one), and a new file is started. This bounds the space used by each
+//per-drive log to twice this size.
+var DriveLogMaxSize int64 = 10 << 20
+
+//DriveLogFiles can be set to false to stop RegisterDriveLog from creating
+//per-drive log files. The identifiers are still registered for routing log
+//lines into work units. This is used by evaluations that must not touch the
+//filesystem.
+var DriveLogFiles = true
+
+type driveLog struct {
+	identifiers []string
+	path        string
+	file        *os.File
+	size        int64
+}
+
+//Lock order within this package: driveLogsMutex may be held while taking
+//workUnitsMutex, outputMutex or structuredFieldsMutex (since RegisterDriveLog
+//logs errors), but not the other way around. All other mutexes in this
+//package are never held while taking another one.
+var (
+	driveLogs      = make(map[string]*driveLog)
+	driveLogsMutex sync.Mutex
+)
+
+//RegisterDriveLog starts copying every log line and every command execution
+//that mentions one of the given identifiers (e.g. the device path) into the
+//file "<DriveLogDirectory>/<driveID>.log". When called multiple times for the
+//same driveID, the identifiers are merged. The first identifier should be the
+//drive's device path, which is reported in structured log lines (see
+//LogAsJSON).
+func RegisterDriveLog(driveID string, identifiers ...string) {
+	driveLogsMutex.Lock()
+	defer driveLogsMutex.Unlock()
+
+	dl, exists := driveLogs[driveID]
+	if !exists {
+		dl = &driveLog{path: driveLogPath(driveID)}
+		//if this fails, we still register the identifiers since they are also
+		//used for routing log lines into work units (see BeginWorkUnit)
+		if DriveLogFiles {
+			dl.open()
+		}
+		driveLogs[driveID] = dl
+	}
+
+	for _, ident := range identifiers {
+		if ident != "" && !containsString(dl.identifiers, ident) {
+			dl.identifiers = append(dl.identifiers, ident)
+		}
+	}
+	registerStructuredFields(driveID, append([]string(nil), dl.identifiers...))
+}
+
+//UnregisterDriveLog stops capturing log lines for the given drive.
+func UnregisterDriveLog(driveID string) {
+	driveLogsMutex.Lock()
+	defer driveLogsMutex.Unlock()
+
+	dl, exists := driveLogs[driveID]
+	if exists {
+		if dl.file != nil {
+			dl.file.Close()
+		}
+		delete(driveLogs, driveID)
+	}
+	unregisterStructuredFields(driveID)
+}
+
+//RemoveDriveLogFiles deletes the per-drive log files of the given drive
+//(including the rolled-over one). This is used when a drive is forgotten, so
+//that logs of drives that are long gone do not accumulate.
+func RemoveDriveLogFiles(driveID string) {
+	path := driveLogPath(driveID)
+	for _, p := range []string{path, path + ".1"} {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			LogError(err.Error())
+		}
+	}
+}
+
+func driveLogPath(driveID string) string {
+	return filepath.Join(strings.TrimPrefix(DriveLogDirectory, "/"), driveID+".log")
+}
+
+//Opens the log file for appending. Must be called with driveLogsMutex held.
+func (dl *driveLog) open() {
+	file, err := os.OpenFile(dl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		//cannot use LogError here since that would deadlock on driveLogsMutex
+		doLogWithoutCapture("ERROR: cannot open per-drive log: "+err.Error(), nil)
+		dl.file = nil
+		return
+	}
+	dl.file = file
+	dl.size = 0
+	if fi, err := file.Stat(); err == nil {
+		dl.size = fi.Size()
+	}
+}
+
+//Writes a line into the log file, and rolls the log over when it becomes too
+//large. Must be called with driveLogsMutex held.
+func (dl *driveLog) write(line string) {
+	if DriveLogMaxSize > 0 && dl.size > 0 && dl.size+int64(len(line)) > DriveLogMaxSize {
+		dl.file.Close()
+		err := os.Rename(dl.path, dl.path+".1")
+		if err != nil {
+			doLogWithoutCapture("ERROR: cannot roll over per-drive log: "+err.Error(), nil)
+		}
+		dl.open()
+		if dl.file == nil {
+			return
+		}
+		if err != nil {
+			dl.size = 0 //do not retry (and complain) on every line
+		}
+	}
+	n, _ := dl.file.WriteString(line)
+	dl.size += int64(n)
+}
+
+//CaptureForDrives copies the given line into the logs of all drives that it
+//mentions. It is called for every log line, and by Command.Run() for command
+//executions and their results (which are not always visible in the main log).
+func CaptureForDrives(line string) {
+	driveLogsMutex.Lock()
+	defer driveLogsMutex.Unlock()
+
+	if len(driveLogs) == 0 {
+		return
+	}
+	line = Redact(line)
+	timestamp := time.Now().Format("2006/01/02 15:04:05 ")
+	for _, dl := range driveLogs {
+		if dl.file != nil && dl.matches(line) {
+			dl.write(timestamp + line + "\n")
+		}
+	}
+}
+
+//Returns the IDs of all drives with a per-drive log that are mentioned in the
+//given line.
+func driveIDsMentionedIn(line string) []string {
+	driveLogsMutex.Lock()
+	defer driveLogsMutex.Unlock()
+
+	var result []string
+	for driveID, dl := range driveLogs {
+		if dl.matches(line) {
+			result = append(result, driveID)
+		}
+	}
+	return result
+}
+
+//Returns the identifiers registered for the given drive.
+func driveIdentifiers(driveID string) []string {
+	driveLogsMutex.Lock()
+	defer driveLogsMutex.Unlock()
+
+	dl, exists := driveLogs[driveID]
+	if !exists {
+		return []string{driveID}
+	}
+	return append([]string(nil), dl.identifiers...)
+}
+
+func (dl *driveLog) matches(line string) bool {
+	for _, ident := range dl.identifiers {
+		if containsIdentifier(line, ident) {
+			return true
+		}
+	}
+	return false
+}
+
+//Like strings.Contains, but requires the match to not continue with another
+//alphanumeric character (otherwise "/dev/sda" would match "/dev/sdaa").
+func containsIdentifier(line, ident string) bool {
+	for {
+		idx := strings.Index(line, ident)
+		if idx < 0 {
+			return false
+		}
+		line = line[idx+len(ident):]
+		if line == "" || !isAlphanumeric(line[0]) {
+			return true
+		}
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
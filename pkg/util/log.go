@@ -20,20 +20,63 @@
 package util
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
-var isDebug = os.Getenv("DEBUG") == "1"
+//LogLevel is the severity of a log message.
+type LogLevel int
+
+//Acceptable values for LogLevel, from the lowest to the highest severity.
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelError
+)
+
+//Messages below this level are discarded (fatal errors are always logged).
+//This must only be changed before any concurrent logging starts.
+var minLogLevel = LogLevelInfo
+
+//SetLogLevel sets the minimum level of messages that are logged. The level
+//is given as "debug", "info" or "error". Messages below this level are
+//discarded, including in the per-drive logs. This must be called before any
+//concurrent logging starts.
+func SetLogLevel(level string) error {
+	switch level {
+	case "debug":
+		minLogLevel = LogLevelDebug
+	case "info":
+		minLogLevel = LogLevelInfo
+	case "error":
+		minLogLevel = LogLevelError
+	default:
+		return fmt.Errorf("invalid log level %q (expected \"debug\", \"info\" or \"error\")", level)
+	}
+	return nil
+}
+
+//IsDebug returns whether debug messages are logged. Callers can use this to
+//skip preparing expensive debug output.
+func IsDebug() bool {
+	return minLogLevel <= LogLevelDebug
+}
 
 func init() {
 	log.SetOutput(os.Stdout)
+	if os.Getenv("DEBUG") == "1" {
+		minLogLevel = LogLevelDebug
+	}
 }
 
 //LogFatal logs a fatal error and terminates the program.
 func LogFatal(msg string, args ...interface{}) {
 	doLog("FATAL: "+msg, args)
+	flushAllWorkUnits()
 	os.Exit(1)
 }
 
@@ -42,24 +85,76 @@ func LogError(msg string, args ...interface{}) {
 	doLog("ERROR: "+msg, args)
 }
 
-//LogInfo logs an informational message.
+//LogInfo logs an informational message unless the log level is "error".
 func LogInfo(msg string, args ...interface{}) {
-	doLog("INFO: "+msg, args)
+	if minLogLevel <= LogLevelInfo {
+		doLog("INFO: "+msg, args)
+	}
 }
 
 //LogDebug logs a debug message if debug logging is enabled.
 func LogDebug(msg string, args ...interface{}) {
-	if isDebug {
+	if minLogLevel <= LogLevelDebug {
 		doLog("DEBUG: "+msg, args)
 	}
 }
 
 func doLog(msg string, args []interface{}) {
+	line := doLogWithoutCapture(msg, args)
+	if strings.HasPrefix(line, "ERROR: ") || strings.HasPrefix(line, "FATAL: ") {
+		recordError(line)
+	}
+	CaptureForDrives(line)
+}
+
+//LogEntry is a log line with its timestamp.
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+//How many errors are remembered for RecentErrors().
+const recentErrorsLimit = 20
+
+var (
+	recentErrors      []LogEntry
+	recentErrorsMutex sync.Mutex
+)
+
+func recordError(line string) {
+	recentErrorsMutex.Lock()
+	defer recentErrorsMutex.Unlock()
+	recentErrors = append(recentErrors, LogEntry{time.Now(), line})
+	if len(recentErrors) > recentErrorsLimit {
+		recentErrors = recentErrors[len(recentErrors)-recentErrorsLimit:]
+	}
+}
+
+//RecentErrors returns the most recent error messages that were logged.
+func RecentErrors() []LogEntry {
+	recentErrorsMutex.Lock()
+	defer recentErrorsMutex.Unlock()
+	return append([]LogEntry(nil), recentErrors...)
+}
+
+func doLogWithoutCapture(msg string, args []interface{}) string {
 	msg = strings.TrimPrefix(msg, "\n")
 	msg = strings.Replace(msg, "\n", "\\n", -1) //avoid multiline log messages
 	if len(args) > 0 {
-		log.Printf(msg+"\n", args...)
-	} else {
-		log.Println(msg)
+		msg = fmt.Sprintf(msg, args...)
+	}
+	msg = Redact(msg)
+	Print(msg)
+	return msg
+}
+
+//Print writes the given line to the log without any further processing
+//(except for buffering in work units, see BeginWorkUnit). This is for callers
+//that cannot use the LogXXX functions because they do not want the line to be
+//captured in per-drive logs.
+func Print(line string) {
+	line = Redact(line)
+	if !bufferInWorkUnit(line) {
+		printLines(time.Now(), []string{line})
 	}
 }
@@ -0,0 +1,167 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+//LogAsJSON selects structured log output: If set, each log line is written as
+//a JSON object with the timestamp, the log level, the message and, if it
+//concerns a single drive, the drive ID, device path and swift-id. The
+//per-drive logs are not affected.
+var LogAsJSON = false
+
+//LogLabels are reported in each structured log line (in the output and in the
+//log sink), but not in text output. This must only be set before any
+//concurrent logging starts.
+var LogLabels map[string]string
+
+//The fields that structured log lines report for each drive (in the output
+//and in the log sink). This is separate from the per-drive logs since
+//driveLogsMutex may be held while logging.
+//structuredFieldsMutex is never held while taking another mutex.
+type driveLogFields struct {
+	identifiers []string
+	devicePath  string
+	swiftID     string
+}
+
+var (
+	structuredFields      = make(map[string]*driveLogFields)
+	structuredFieldsMutex sync.Mutex
+)
+
+//Called by RegisterDriveLog. The first identifier is reported as the drive's
+//device path.
+func registerStructuredFields(driveID string, identifiers []string) {
+	structuredFieldsMutex.Lock()
+	defer structuredFieldsMutex.Unlock()
+	f, exists := structuredFields[driveID]
+	if !exists {
+		f = &driveLogFields{}
+		if len(identifiers) > 0 {
+			f.devicePath = identifiers[0]
+		}
+		structuredFields[driveID] = f
+	}
+	f.identifiers = identifiers
+}
+
+func unregisterStructuredFields(driveID string) {
+	structuredFieldsMutex.Lock()
+	defer structuredFieldsMutex.Unlock()
+	delete(structuredFields, driveID)
+}
+
+//SetDriveLogSwiftID records the swift-id of the given drive, to be reported
+//in structured log lines concerning this drive (see LogAsJSON).
+func SetDriveLogSwiftID(driveID, swiftID string) {
+	structuredFieldsMutex.Lock()
+	defer structuredFieldsMutex.Unlock()
+	if f, exists := structuredFields[driveID]; exists {
+		f.swiftID = swiftID
+	}
+}
+
+type structuredLogLine struct {
+	Time       time.Time         `json:"time"`
+	Level      string            `json:"level"`
+	DriveID    string            `json:"drive,omitempty"`
+	DevicePath string            `json:"device_path,omitempty"`
+	SwiftID    string            `json:"swift_id,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Message    string            `json:"message"`
+	//the line as given to parseLogLine (for text output)
+	raw string
+}
+
+//Splits a log line (which may have a "[driveID] " prefix from a work unit)
+//into its fields. The drive-related fields are only filled if structured
+//output is requested (they are not needed for text output, and finding the
+//drive is comparatively expensive). Must not be called with driveLogsMutex
+//held.
+func parseLogLine(t time.Time, line string) structuredLogLine {
+	s := structuredLogLine{Time: t, Level: "info", raw: line}
+	if !LogAsJSON && currentLogSink == nil {
+		return s
+	}
+	s.Labels = LogLabels
+
+	if strings.HasPrefix(line, "[") {
+		if idx := strings.Index(line, "] "); idx > 0 {
+			s.DriveID = line[1:idx]
+			line = line[idx+2:]
+		}
+	}
+	for _, level := range []string{"FATAL", "ERROR", "INFO", "DEBUG"} {
+		if strings.HasPrefix(line, level+": ") {
+			s.Level = strings.ToLower(level)
+			line = strings.TrimPrefix(line, level+": ")
+			break
+		}
+	}
+	s.Message = line
+
+	structuredFieldsMutex.Lock()
+	if s.DriveID == "" {
+		s.DriveID = singleDriveMentionedIn(line)
+	}
+	if f, exists := structuredFields[s.DriveID]; exists {
+		s.DevicePath = f.devicePath
+		s.SwiftID = f.swiftID
+	}
+	structuredFieldsMutex.Unlock()
+	return s
+}
+
+//Formats the log line for the standard output.
+func (s structuredLogLine) format() string {
+	if !LogAsJSON {
+		return formatLogTime(s.Time) + s.raw
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return formatLogTime(s.Time) + s.raw
+	}
+	return string(buf)
+}
+
+//Returns the ID of the drive that the given line mentions, or "" if it
+//mentions no drive or several drives. Must be called with
+//structuredFieldsMutex held.
+func singleDriveMentionedIn(line string) string {
+	result := ""
+	for driveID, f := range structuredFields {
+		for _, ident := range f.identifiers {
+			if containsIdentifier(line, ident) {
+				if result != "" {
+					return ""
+				}
+				result = driveID
+				break
+			}
+		}
+	}
+	return result
+}
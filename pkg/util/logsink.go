@@ -0,0 +1,199 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//SyslogIdentifier is the program name that log lines are tagged with in the
+//syslog and in the systemd journal.
+const SyslogIdentifier = "swift-drive-autopilot"
+
+//A logSink receives log lines instead of the standard output. If it fails to
+//deliver a line, that line is written to the standard output instead.
+type logSink interface {
+	write(s structuredLogLine) error
+}
+
+//Guarded by outputMutex, but only set before concurrent logging starts (so
+//parseLogLine may look at it without holding outputMutex).
+var currentLogSink logSink
+
+//UseLogSink sends all log lines to the given sink instead of the standard
+//output: "journald" for the systemd journal (with the priority as well as the
+//fields SWIFT_ID, DEVICE and SWIFT_DRIVE_ID for lines concerning a single
+//drive, and LABEL_<KEY> for each of the LogLabels), or "syslog" (with the
+//priority, and those fields appended to the message). The socket path is
+//relative to the working directory if it does not start with a slash. The
+//per-drive logs are not affected. This must be called before any concurrent
+//logging starts.
+func UseLogSink(kind, socketPath string) error {
+	var (
+		sink logSink
+		err  error
+	)
+	switch kind {
+	case "journald":
+		sink, err = newJournalSink(socketPath)
+	case "syslog":
+		sink, err = newSyslogSink(socketPath)
+	default:
+		err = fmt.Errorf("unknown log sink %q", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	currentLogSink = sink
+	return nil
+}
+
+//Maps the levels of structuredLogLine to syslog priorities.
+var syslogPriorities = map[string]syslog.Priority{
+	"fatal": syslog.LOG_CRIT,
+	"error": syslog.LOG_ERR,
+	"info":  syslog.LOG_INFO,
+	"debug": syslog.LOG_DEBUG,
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// journald
+
+//journalSink speaks the native protocol of systemd-journald: one datagram per
+//log line, with one field per line of the datagram.
+type journalSink struct {
+	socketPath string
+	conn       net.Conn
+}
+
+func newJournalSink(socketPath string) (*journalSink, error) {
+	j := &journalSink{socketPath: socketPath}
+	return j, j.connect()
+}
+
+func (j *journalSink) connect() error {
+	conn, err := net.Dial("unixgram", j.socketPath)
+	if err != nil {
+		return err
+	}
+	j.conn = conn
+	return nil
+}
+
+func (j *journalSink) write(s structuredLogLine) error {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", s.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(int(syslogPriorities[s.Level])))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", SyslogIdentifier)
+	if s.DriveID != "" {
+		writeJournalField(&buf, "SWIFT_DRIVE_ID", s.DriveID)
+	}
+	if s.DevicePath != "" {
+		writeJournalField(&buf, "DEVICE", s.DevicePath)
+	}
+	if s.SwiftID != "" {
+		writeJournalField(&buf, "SWIFT_ID", s.SwiftID)
+	}
+	for _, key := range sortedLabelKeys(s.Labels) {
+		writeJournalField(&buf, "LABEL_"+strings.ToUpper(key), s.Labels[key])
+	}
+
+	_, err := j.conn.Write(buf.Bytes())
+	if err != nil {
+		//journald may have been restarted -> reconnect once
+		j.conn.Close()
+		err = j.connect()
+		if err == nil {
+			_, err = j.conn.Write(buf.Bytes())
+		}
+	}
+	return err
+}
+
+//Values containing newlines need to be given with an explicit length.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.WriteString(key + "\n")
+	buf.Write(size[:])
+	buf.WriteString(value + "\n")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// syslog
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(socketPath string) (*syslogSink, error) {
+	w, err := syslog.Dial("unixgram", socketPath, syslog.LOG_DAEMON|syslog.LOG_INFO, SyslogIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w}, nil
+}
+
+func (s syslogSink) write(line structuredLogLine) error {
+	msg := line.Message
+	if line.SwiftID != "" {
+		msg += " SWIFT_ID=" + line.SwiftID
+	}
+	if line.DevicePath != "" {
+		msg += " DEVICE=" + line.DevicePath
+	}
+	for _, key := range sortedLabelKeys(line.Labels) {
+		msg += " LABEL_" + strings.ToUpper(key) + "=" + line.Labels[key]
+	}
+	switch syslogPriorities[line.Level] {
+	case syslog.LOG_CRIT:
+		return s.w.Crit(msg)
+	case syslog.LOG_ERR:
+		return s.w.Err(msg)
+	case syslog.LOG_DEBUG:
+		return s.w.Debug(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
+
+//Labels are reported in a stable order.
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//RedactedPlaceholder replaces redacted parts of log lines.
+const RedactedPlaceholder = "[REDACTED]"
+
+var (
+	redactionPatterns      []*regexp.Regexp
+	redactionPatternsMutex sync.RWMutex
+)
+
+//AddRedactionPattern registers a regex that is applied to every log line
+//(including the per-drive logs) before it is written. If the regex contains
+//capture groups, only the text matched by the groups is redacted (e.g.
+//`token=(\S+)` keeps the "token=" part); otherwise the entire match is
+//redacted. This is safe to call while other goroutines are logging (e.g. for
+//keys that are only fetched at runtime).
+func AddRedactionPattern(rx *regexp.Regexp) {
+	redactionPatternsMutex.Lock()
+	defer redactionPatternsMutex.Unlock()
+	redactionPatterns = append(redactionPatterns, rx)
+}
+
+//AddRedactedSecret registers a literal string (e.g. an encryption key) that
+//shall never appear in the log.
+func AddRedactedSecret(secret string) {
+	if secret != "" {
+		AddRedactionPattern(regexp.MustCompile(regexp.QuoteMeta(secret)))
+	}
+}
+
+//Redact applies all registered redaction patterns to the given line.
+func Redact(line string) string {
+	redactionPatternsMutex.RLock()
+	defer redactionPatternsMutex.RUnlock()
+	for _, rx := range redactionPatterns {
+		line = redactWith(rx, line)
+	}
+	return line
+}
+
+func redactWith(rx *regexp.Regexp, line string) string {
+	if rx.NumSubexp() == 0 {
+		return rx.ReplaceAllLiteralString(line, RedactedPlaceholder)
+	}
+
+	matches := rx.FindAllStringSubmatchIndex(line, -1)
+	if matches == nil {
+		return line
+	}
+	var (
+		result strings.Builder
+		offset int
+	)
+	for _, match := range matches {
+		//match[0:2] is the entire match, match[2:] are the groups
+		for idx := 2; idx+1 < len(match); idx += 2 {
+			start, end := match[idx], match[idx+1]
+			if start < offset || start < 0 {
+				continue //group did not participate, or overlaps with previous group
+			}
+			result.WriteString(line[offset:start])
+			result.WriteString(RedactedPlaceholder)
+			offset = end
+		}
+	}
+	result.WriteString(line[offset:])
+	return result.String()
+}
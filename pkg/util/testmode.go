@@ -48,7 +48,7 @@ func SetupTestMode() {
 	//TODO: This could be extended to properly shut down the converger by
 	//posting a ShutdownEvent or similar, and could then also be used for
 	//SIGINT/SIGTERM.
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGPIPE)
 	go func(c <-chan os.Signal) {
 		<-c
@@ -0,0 +1,190 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type phaseTiming struct {
+	total time.Duration
+	count int
+}
+
+//TimelineEntry describes a single operation in the timeline that is recorded
+//when EnableTimeline() has been called.
+type TimelineEntry struct {
+	Operation string    `json:"operation"`
+	Command   string    `json:"command"`
+	Drives    []string  `json:"drives,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Success   bool      `json:"success"`
+}
+
+//How many operations are recorded in the timeline at most. If storage never
+//becomes ready (e.g. because expected drives are missing), the timeline would
+//otherwise grow forever.
+const timelineLimit = 100000
+
+var (
+	timingsEnabled  bool
+	timelineEnabled bool
+	timings         = make(map[string]*phaseTiming)             //phase -> timing
+	driveTimings    = make(map[string]map[string]time.Duration) //drive ID -> phase -> duration
+	timeline        []TimelineEntry
+	timingsMutex    sync.Mutex
+)
+
+//EnableTimings activates the recording of timings with RecordTiming(). This
+//must be called before any timings are recorded.
+func EnableTimings() {
+	timingsEnabled = true
+}
+
+//EnableTimeline activates the recording of each operation that is given to
+//RecordTiming() in a timeline, until it is retrieved with TakeTimeline().
+//This must be called before any timings are recorded.
+func EnableTimeline() {
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+	timelineEnabled = true
+}
+
+//TakeTimeline returns the timeline that was recorded so far, and stops the
+//recording of the timeline.
+func TakeTimeline() []TimelineEntry {
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+	result := timeline
+	timeline = nil
+	timelineEnabled = false
+	return result
+}
+
+//RecordTiming records that an operation belonging to the given phase (e.g.
+//"luksOpen" or "mount") started at the given time and has just finished. The
+//duration is also attributed to all drives that are mentioned in the context
+//(usually the command line), using the same matching as for the per-drive
+//logs.
+func RecordTiming(phase, context string, startedAt time.Time, success bool) {
+	timingsMutex.Lock()
+	enabled := timingsEnabled || timelineEnabled
+	timingsMutex.Unlock()
+	if !enabled {
+		return
+	}
+	finishedAt := time.Now()
+	duration := finishedAt.Sub(startedAt)
+	driveIDs := driveIDsMentionedIn(context)
+	sort.Strings(driveIDs)
+
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+
+	if timelineEnabled && len(timeline) < timelineLimit {
+		timeline = append(timeline, TimelineEntry{
+			Operation: phase,
+			Command:   Redact(context),
+			Drives:    driveIDs,
+			Start:     startedAt,
+			End:       finishedAt,
+			Success:   success,
+		})
+	}
+	if !timingsEnabled {
+		return
+	}
+
+	t := timings[phase]
+	if t == nil {
+		t = &phaseTiming{}
+		timings[phase] = t
+	}
+	t.total += duration
+	t.count++
+
+	for _, driveID := range driveIDs {
+		if driveTimings[driveID] == nil {
+			driveTimings[driveID] = make(map[string]time.Duration)
+		}
+		driveTimings[driveID][phase] += duration
+	}
+}
+
+//ReportTimings logs a per-phase and per-drive breakdown of all timings
+//recorded so far, and then starts recording afresh.
+func ReportTimings() {
+	if !timingsEnabled {
+		return
+	}
+
+	timingsMutex.Lock()
+	phases := timings
+	drives := driveTimings
+	timings = make(map[string]*phaseTiming)
+	driveTimings = make(map[string]map[string]time.Duration)
+	timingsMutex.Unlock()
+
+	for _, phase := range sortedKeys(phases) {
+		t := phases[phase]
+		LogInfo("boot profile: phase %s took %s in total (%d operations)", phase, roundDuration(t.total), t.count)
+	}
+
+	driveIDs := make([]string, 0, len(drives))
+	for driveID := range drives {
+		driveIDs = append(driveIDs, driveID)
+	}
+	sort.Strings(driveIDs)
+	for _, driveID := range driveIDs {
+		var (
+			total time.Duration
+			parts []string
+		)
+		perPhase := drives[driveID]
+		phaseNames := make([]string, 0, len(perPhase))
+		for phase := range perPhase {
+			phaseNames = append(phaseNames, phase)
+		}
+		sort.Strings(phaseNames)
+		for _, phase := range phaseNames {
+			total += perPhase[phase]
+			parts = append(parts, fmt.Sprintf("%s %s", phase, roundDuration(perPhase[phase])))
+		}
+		LogInfo("boot profile: drive %s took %s in total (%s)", driveID, roundDuration(total), strings.Join(parts, ", "))
+	}
+}
+
+func sortedKeys(m map[string]*phaseTiming) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func roundDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
@@ -0,0 +1,219 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package util
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//When drives are processed concurrently, their log lines would interleave
+//and become unreadable. Therefore, while a work unit is active for a drive,
+//all log lines that mention this drive (and no other drive with an active work
+//unit) are buffered, and written out in one piece with a "[driveID]" prefix
+//when the work unit ends.
+type workUnit struct {
+	identifiers []string
+	lines       []bufferedLine
+}
+
+type bufferedLine struct {
+	time time.Time
+	line string
+}
+
+//How often StreamProgress() reports long-running operations.
+const progressInterval = 30 * time.Second
+
+var (
+	workUnits      = make(map[string]*workUnit)
+	workUnitsMutex sync.Mutex
+	//outputMutex ensures that the lines of a work unit are not interleaved
+	//with other log lines
+	outputMutex sync.Mutex
+)
+
+//BeginWorkUnit starts buffering log lines concerning the given drive. The
+//drive is recognized by the identifiers from its per-drive log (see
+//RegisterDriveLog).
+func BeginWorkUnit(driveID string) {
+	wu := &workUnit{identifiers: driveIdentifiers(driveID)}
+
+	workUnitsMutex.Lock()
+	defer workUnitsMutex.Unlock()
+	workUnits[driveID] = wu
+}
+
+//EndWorkUnit writes out all log lines that were buffered since
+//BeginWorkUnit() for the given drive.
+func EndWorkUnit(driveID string) {
+	workUnitsMutex.Lock()
+	wu, exists := workUnits[driveID]
+	delete(workUnits, driveID)
+	workUnitsMutex.Unlock()
+
+	if exists {
+		wu.flush(driveID)
+	}
+}
+
+//StreamProgress is called when a long-running operation starts. While work
+//units are active, it logs immediately (bypassing the work unit buffers) that
+//the operation has started, and then periodically that it is still running,
+//so that progress remains visible. The returned function must be called when
+//the operation has completed.
+func StreamProgress(description string) (stop func()) {
+	prefix := workUnitPrefixFor(description)
+	if prefix == "" {
+		return func() {}
+	}
+
+	startedAt := time.Now()
+	printLines(startedAt, []string{fmt.Sprintf("%sINFO: %s started", prefix, description)})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				printLines(now, []string{fmt.Sprintf("%sINFO: %s still running after %s",
+					prefix, description, now.Sub(startedAt).Round(time.Second).String())})
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+//Returns the "[driveID] " prefix for the single work unit matching the given
+//line, or "" if no work unit or multiple work units match.
+func workUnitPrefixFor(line string) string {
+	workUnitsMutex.Lock()
+	defer workUnitsMutex.Unlock()
+	driveID, _ := matchWorkUnit(line)
+	if driveID == "" {
+		return ""
+	}
+	return "[" + driveID + "] "
+}
+
+//Buffers the given line in the matching work unit, if any. Returns false if
+//the line shall be written to the log directly.
+func bufferInWorkUnit(line string) bool {
+	workUnitsMutex.Lock()
+	defer workUnitsMutex.Unlock()
+
+	_, wu := matchWorkUnit(line)
+	if wu == nil {
+		return false
+	}
+	wu.lines = append(wu.lines, bufferedLine{time.Now(), line})
+	return true
+}
+
+//Must be called with workUnitsMutex locked.
+func matchWorkUnit(line string) (driveID string, wu *workUnit) {
+	if len(workUnits) == 0 {
+		return "", nil
+	}
+	for id, candidate := range workUnits {
+		if !candidate.matches(line) {
+			continue
+		}
+		if wu != nil {
+			return "", nil //ambiguous
+		}
+		driveID, wu = id, candidate
+	}
+	return driveID, wu
+}
+
+func (wu *workUnit) matches(line string) bool {
+	for _, ident := range wu.identifiers {
+		if containsIdentifier(line, ident) {
+			return true
+		}
+	}
+	return false
+}
+
+func (wu *workUnit) flush(driveID string) {
+	if len(wu.lines) == 0 {
+		return
+	}
+	parsed := make([]structuredLogLine, len(wu.lines))
+	for idx, bl := range wu.lines {
+		parsed[idx] = parseLogLine(bl.time, fmt.Sprintf("[%s] %s", driveID, bl.line))
+	}
+	writeLines(parsed)
+}
+
+//Called before the program exits to make sure that no log lines are lost.
+func flushAllWorkUnits() {
+	workUnitsMutex.Lock()
+	units := workUnits
+	workUnits = make(map[string]*workUnit)
+	workUnitsMutex.Unlock()
+
+	driveIDs := make([]string, 0, len(units))
+	for driveID := range units {
+		driveIDs = append(driveIDs, driveID)
+	}
+	sort.Strings(driveIDs)
+	for _, driveID := range driveIDs {
+		units[driveID].flush(driveID)
+	}
+}
+
+//Writes the given lines to the log without interleaving them with other
+//lines.
+func printLines(t time.Time, lines []string) {
+	parsed := make([]structuredLogLine, len(lines))
+	for idx, line := range lines {
+		parsed[idx] = parseLogLine(t, line)
+	}
+	writeLines(parsed)
+}
+
+//Writes the given lines to the log sink (see UseLogSink) or, if none is
+//configured or it fails, to the standard output.
+func writeLines(lines []structuredLogLine) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	w := log.Writer()
+	for _, s := range lines {
+		if currentLogSink != nil && currentLogSink.write(s) == nil {
+			continue
+		}
+		fmt.Fprintln(w, s.format())
+	}
+}
+
+//Formats the timestamp in the same way as the log package does with its
+//default flags (which this program uses).
+func formatLogTime(t time.Time) string {
+	return t.Format("2006/01/02 15:04:05 ")
+}
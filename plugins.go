@@ -0,0 +1,115 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/plugin"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Plugins that were loaded by LoadPlugins(), and the encryption keys provided
+//by key source plugins. These are only written during startup, before the
+//converger thread starts.
+var (
+	loadedPlugins []*plugin.Plugin
+	pluginKeys    []os.LUKSKey
+)
+
+//LoadPlugins performs the handshake with all configured plugins, and fetches
+//the encryption keys from key source plugins.
+func LoadPlugins() {
+	for _, cfg := range Config.Plugins {
+		p, err := plugin.Load(cfg.Name, cfg.Command, cfg.Env, cfg.Timeout)
+		if err != nil {
+			util.LogFatal("cannot load plugin %s: %s", cfg.Name, err.Error())
+		}
+		util.LogInfo("loaded plugin %s with capabilities %v", p.Name, p.Capabilities)
+		loadedPlugins = append(loadedPlugins, p)
+
+		if p.Provides(plugin.KeySource) {
+			keys, err := p.Keys()
+			if err != nil {
+				util.LogFatal("cannot get encryption keys from plugin %s: %s", p.Name, err.Error())
+			}
+			for _, key := range keys {
+				util.AddRedactedSecret(key)
+				pluginKeys = append(pluginKeys, os.LUKSKey{Secret: key})
+			}
+		}
+	}
+}
+
+//Asks all drive filter plugins whether the given drive shall be managed.
+func acceptedByPlugins(e DriveAddedEvent) bool {
+	info := plugin.DriveInfo{
+		DriveID:           e.SerialNumber,
+		DevicePath:        e.DevicePath,
+		BackingDevicePath: e.BackingDevicePath,
+		FoundAtPath:       e.FoundAtPath,
+		SerialNumber:      e.SerialNumber,
+		Labels:            Config.Labels,
+	}
+	for _, p := range loadedPlugins {
+		if !p.Provides(plugin.DriveFilter) {
+			continue
+		}
+		accept, err := p.FilterDrive(info)
+		if err != nil {
+			util.LogError("ignoring %s since plugin %s could not decide whether to manage it (restart to try again): %s",
+				e.DevicePath, p.Name, err.Error())
+			return false
+		}
+		if !accept {
+			util.LogInfo("ignoring %s as requested by plugin %s", e.DevicePath, p.Name)
+			return false
+		}
+	}
+	return true
+}
+
+//Returns the post-mount actions for all post-mount action plugins.
+func pluginPostMountActions() []core.PostMountAction {
+	var result []core.PostMountAction
+	for _, p := range loadedPlugins {
+		if !p.Provides(plugin.PostMountAction) {
+			continue
+		}
+		p := p
+		result = append(result, func(d *core.Drive, mountPath string) {
+			info := plugin.DriveInfo{
+				DriveID:           d.DriveID,
+				DevicePath:        d.DevicePath,
+				BackingDevicePath: d.BackingDevicePath,
+				MountPath:         mountPath,
+				Labels:            Config.Labels,
+			}
+			if a := d.Assignment; a != nil && a.Error == "" {
+				info.SwiftID = a.SwiftID
+			}
+			err := p.PostMount(info)
+			if err != nil {
+				util.LogError("post-mount action of plugin %s failed for %s: %s", p.Name, d.DevicePath, err.Error())
+			}
+		})
+	}
+	return result
+}
@@ -0,0 +1,222 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	std_os "os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//StoragePolicy appears in type Configuration. It describes a group of drives
+//(usually those serving one Swift storage policy, e.g. an SSD tier and an HDD
+//tier) that gets its own ready marker, so that the failure of one group does
+//not hold back the other groups.
+type StoragePolicy struct {
+	Name string `yaml:"name"`
+	//SwiftIDs contains glob patterns (as in filepath.Match) that select the
+	//drives of this policy by their swift-id.
+	SwiftIDs []string `yaml:"swift-ids"`
+	//MinDrives is how many drives of this policy must be mounted below
+	///srv/node for the policy to be ready (default: 1).
+	MinDrives int `yaml:"min-drives"`
+}
+
+//Validate checks the storage policy configuration, and fills in defaults.
+func (p *StoragePolicy) Validate() string {
+	if p.Name == "" || strings.Contains(p.Name, "/") || p.Name == "." || p.Name == ".." {
+		return "name must be a plain file name"
+	}
+	if len(p.SwiftIDs) == 0 {
+		return "swift-ids may not be empty"
+	}
+	for _, pattern := range p.SwiftIDs {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return "invalid pattern " + pattern + " in swift-ids: " + err.Error()
+		}
+	}
+	if p.MinDrives < 0 {
+		return "min-drives may not be negative"
+	}
+	if p.MinDrives == 0 {
+		p.MinDrives = 1
+	}
+	return ""
+}
+
+//Matches returns whether the drive with the given swift-id belongs to this
+//policy.
+func (p StoragePolicy) Matches(swiftID string) bool {
+	for _, pattern := range p.SwiftIDs {
+		if matched, _ := filepath.Match(pattern, swiftID); matched {
+			return true
+		}
+	}
+	return false
+}
+
+//StoragePolicyDirectory contains one subdirectory for each storage policy,
+//which contains the policy's flag-ready once the policy is ready.
+const StoragePolicyDirectory = "/run/swift-storage/state/policies"
+
+func policyReadyFlagPath(name string) string {
+	path := filepath.Join(StoragePolicyDirectory, name, "flag-ready")
+	//make path relative to working directory to account for chrootPath
+	return strings.TrimPrefix(path, "/")
+}
+
+//StoragePolicyStatus appears in type StatusReport.
+type StoragePolicyStatus struct {
+	Name          string `json:"name"`
+	Ready         bool   `json:"ready"`
+	MountedDrives int    `json:"mounted_drives"`
+	MinDrives     int    `json:"min_drives"`
+}
+
+//StoragePolicyHealthReport is the response body of the health endpoint of a
+//storage policy.
+type StoragePolicyHealthReport struct {
+	SchemaVersion int `json:"schema_version"`
+	StoragePolicyStatus
+}
+
+var storagePolicyReadyGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "swift_drive_autopilot_storage_policy_ready",
+		Help: "Whether enough drives of a storage policy are mounted (1) or not (0).",
+	},
+	[]string{"policy"},
+)
+
+func init() {
+	prometheus.MustRegister(storagePolicyReadyGauge)
+}
+
+//UpdateStoragePolicies decides for each storage policy whether it is ready,
+//and creates or removes its flag-ready accordingly. Unlike the global
+//flag-ready, a policy's flag-ready is removed again when the policy stops
+//being ready.
+func (c *Converger) UpdateStoragePolicies() {
+	statuses := c.storagePolicyStatuses()
+	for _, status := range statuses {
+		flagPath := policyReadyFlagPath(status.Name)
+		wasReady, known := c.readyPolicies[status.Name]
+		switch {
+		case status.Ready && !wasReady:
+			err := std_os.MkdirAll(filepath.Dir(flagPath), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(flagPath, nil, 0644)
+			}
+			if err != nil {
+				util.LogError("cannot mark storage policy %s as ready: %s", status.Name, err.Error())
+				continue
+			}
+			util.LogInfo("storage policy %s is ready (%d drives mounted)", status.Name, status.MountedDrives)
+		case !status.Ready && (wasReady || !known):
+			//(when we do not know yet, the flag might be left over from before a restart)
+			err := std_os.Remove(flagPath)
+			if err != nil && !std_os.IsNotExist(err) {
+				util.LogError("cannot mark storage policy %s as not ready: %s", status.Name, err.Error())
+				continue
+			}
+			if wasReady {
+				util.LogError("storage policy %s is not ready anymore: only %d of %d required drives mounted",
+					status.Name, status.MountedDrives, status.MinDrives)
+			}
+		}
+		c.readyPolicies[status.Name] = status.Ready
+
+		ready := 0.0
+		if status.Ready {
+			ready = 1
+		}
+		storagePolicyReadyGauge.With(prometheus.Labels{"policy": status.Name}).Set(ready)
+	}
+}
+
+//Counts the healthy drives of each storage policy that are mounted below
+///srv/node.
+func (c *Converger) storagePolicyStatuses() []StoragePolicyStatus {
+	result := make([]StoragePolicyStatus, 0, len(Config.StoragePolicies))
+	for _, p := range Config.StoragePolicies {
+		status := StoragePolicyStatus{Name: p.Name, MinDrives: p.MinDrives}
+		for _, d := range c.Drives {
+			a := d.Assignment
+			if d.Broken || a == nil || a.Error != "" || !p.Matches(a.SwiftID) {
+				continue
+			}
+			if filepath.Dir(d.MountedPath()) == "/srv/node" {
+				status.MountedDrives++
+			}
+		}
+		status.Ready = status.MountedDrives >= p.MinDrives
+		result = append(result, status)
+	}
+	return result
+}
+
+//handleStoragePolicyHealthRequest answers requests to
+///api/v1/health/<policy> with 200 if the policy is ready, or 503 otherwise.
+//The response body is the policy's StoragePolicyStatus.
+func handleStoragePolicyHealthRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/health/")
+	var (
+		status StoragePolicyStatus
+		found  bool
+	)
+	currentStatusMutex.Lock()
+	for _, s := range currentStatus.StoragePolicies {
+		if s.Name == name {
+			status, found = s, true
+			break
+		}
+	}
+	currentStatusMutex.Unlock()
+	if !found {
+		http.Error(w, "no such storage policy", http.StatusNotFound)
+		return
+	}
+
+	buf, err := json.Marshal(StoragePolicyHealthReport{SchemaVersion, status})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(buf)
+}
@@ -0,0 +1,147 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	std_os "os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//ProfileOverrides appears in type Configuration. It contains the raw YAML of
+//a configuration profile: The special key "hostnames" contains a list of
+//hostname globs that select this profile, and all other keys override the
+//respective top-level configuration options.
+type ProfileOverrides map[string]interface{}
+
+//Hostnames returns the hostname globs from this profile.
+func (p ProfileOverrides) Hostnames() ([]string, error) {
+	raw, exists := p["hostnames"]
+	if !exists {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("hostnames must be a list of strings")
+	}
+	result := make([]string, len(list))
+	for idx, elem := range list {
+		str, ok := elem.(string)
+		if !ok {
+			return nil, fmt.Errorf("hostnames must be a list of strings")
+		}
+		if _, err := filepath.Match(str, ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname glob %q: %s", str, err.Error())
+		}
+		result[idx] = str
+	}
+	return result, nil
+}
+
+//ApplyProfile selects one of the configured profiles (either the one with the
+//given name, or if no name is given, the one whose hostname globs match this
+//machine's hostname), and applies its overrides to this configuration. It is
+//not an error if no profile matches the hostname; the base configuration is
+//used in this case.
+func (cfg *Configuration) ApplyProfile(name string) error {
+	if len(cfg.Profiles) == 0 {
+		if name != "" {
+			return fmt.Errorf("profile %q requested, but no profiles are configured", name)
+		}
+		return nil
+	}
+
+	if name == "" {
+		hostname, err := std_os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cannot select profile: %s", err.Error())
+		}
+		name, err = cfg.selectProfileByHostname(hostname)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			util.LogInfo("no configuration profile matches hostname %q, using base configuration", hostname)
+			return nil
+		}
+	}
+
+	profile, exists := cfg.Profiles[name]
+	if !exists {
+		return fmt.Errorf("no such profile: %q", name)
+	}
+	overrides := make(map[string]interface{}, len(profile))
+	for key, value := range profile {
+		switch key {
+		case "hostnames":
+			continue
+		case "profiles":
+			return fmt.Errorf("profile %q may not contain profiles", name)
+		}
+		overrides[key] = value
+	}
+
+	//apply overrides by decoding them on top of the base configuration
+	buf, err := yaml.Marshal(overrides)
+	if err == nil {
+		err = yaml.Unmarshal(buf, cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("in profile %q: %s", name, err.Error())
+	}
+	util.LogInfo("using configuration profile %q", name)
+	return nil
+}
+
+func (cfg Configuration) selectProfileByHostname(hostname string) (string, error) {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var matches []string
+	for _, name := range names {
+		globs, err := cfg.Profiles[name].Hostnames()
+		if err != nil {
+			return "", fmt.Errorf("in profile %q: %s", name, err.Error())
+		}
+		for _, glob := range globs {
+			if ok, _ := filepath.Match(glob, hostname); ok {
+				matches = append(matches, name)
+				break
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("hostname %q matches multiple profiles: %s", hostname, strings.Join(matches, ", "))
+	}
+}
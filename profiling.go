@@ -0,0 +1,148 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	std_os "os"
+	"path/filepath"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//Files that are written by the boot profiling, if configured.
+var (
+	cpuProfileFile *std_os.File
+	traceFile      *std_os.File
+)
+
+//StartBootProfiling starts collecting the profiling data that is reported by
+//FinishBootProfiling(), as far as configured. This must be called after the
+//working directory has been set to the chroot, since the paths in the
+//configuration refer to inside the chroot.
+func StartBootProfiling() {
+	if Config.Profiling.Report {
+		util.EnableTimings()
+	}
+	if Config.Profiling.Timeline != "" {
+		util.EnableTimeline()
+	}
+	if path := Config.Profiling.CPUProfile; path != "" {
+		cpuProfileFile = createProfilingFile(path)
+		err := pprof.StartCPUProfile(cpuProfileFile)
+		if err != nil {
+			util.LogFatal("cannot start CPU profile: %s", err.Error())
+		}
+	}
+	if path := Config.Profiling.Trace; path != "" {
+		traceFile = createProfilingFile(path)
+		err := trace.Start(traceFile)
+		if err != nil {
+			util.LogFatal("cannot start execution trace: %s", err.Error())
+		}
+	}
+}
+
+//FinishBootProfiling is called once storage is ready for the first time. It
+//prints the timing report and writes the operation timeline, and completes the
+//CPU profile and execution trace (if configured).
+func FinishBootProfiling(startedAt time.Time) {
+	if Config.Profiling.Report {
+		util.LogInfo("boot profile: storage became ready %s after startup",
+			time.Since(startedAt).Round(time.Millisecond).String())
+		util.ReportTimings()
+	}
+	if path := Config.Profiling.Timeline; path != "" {
+		writeTimeline(path, util.TakeTimeline())
+	}
+	if cpuProfileFile != nil {
+		pprof.StopCPUProfile()
+		closeProfilingFile(cpuProfileFile, "CPU profile")
+		cpuProfileFile = nil
+	}
+	if traceFile != nil {
+		trace.Stop()
+		closeProfilingFile(traceFile, "execution trace")
+		traceFile = nil
+	}
+}
+
+func createProfilingFile(path string) *std_os.File {
+	relPath := strings.TrimPrefix(path, "/")
+	err := std_os.MkdirAll(filepath.Dir(relPath), 0755)
+	if err == nil {
+		var file *std_os.File
+		file, err = std_os.Create(relPath)
+		if err == nil {
+			return file
+		}
+	}
+	util.LogFatal("cannot create %s: %s", path, err.Error())
+	return nil
+}
+
+func closeProfilingFile(file *std_os.File, description string) {
+	err := file.Close()
+	if err != nil {
+		util.LogError("cannot write %s: %s", description, err.Error())
+		return
+	}
+	util.LogInfo("boot profile: %s written to /%s", description, file.Name())
+}
+
+//Writes the timeline of all operations that were executed until storage
+//became ready. The format is CSV if the file name ends in ".csv", or JSON
+//otherwise.
+func writeTimeline(path string, timeline []util.TimelineEntry) {
+	file := createProfilingFile(path)
+	var err error
+	if strings.HasSuffix(path, ".csv") {
+		w := csv.NewWriter(file)
+		w.Write([]string{"operation", "command", "drives", "start", "end", "duration_seconds", "success"})
+		for _, e := range timeline {
+			w.Write([]string{
+				e.Operation,
+				e.Command,
+				strings.Join(e.Drives, " "),
+				e.Start.UTC().Format(time.RFC3339Nano),
+				e.End.UTC().Format(time.RFC3339Nano),
+				strconv.FormatFloat(e.End.Sub(e.Start).Seconds(), 'f', 3, 64),
+				strconv.FormatBool(e.Success),
+			})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		if timeline == nil {
+			timeline = []util.TimelineEntry{}
+		}
+		err = json.NewEncoder(file).Encode(TimelineReport{SchemaVersion, timeline})
+	}
+	if err != nil {
+		util.LogError("cannot write operation timeline: %s", err.Error())
+	}
+	closeProfilingFile(file, "operation timeline")
+}
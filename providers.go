@@ -0,0 +1,208 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//BlockDeviceProvider is a storage backend that makes block devices available
+//for use as drives, e.g. by attaching image files or by waiting for iSCSI
+//sessions. Drives that are attached locally do not need a provider since they
+//are found through the drive globs alone. Everything that a backend needs
+//during startup is behind this interface, so adding a backend means
+//implementing it and returning it from Configuration.BlockDeviceProviders().
+type BlockDeviceProvider interface {
+	//Name identifies the provider in log messages.
+	Name() string
+	//Binaries lists the binaries that the provider executes in the chroot (see
+	//VerifyChroot).
+	Binaries() []string
+	//KernelModules lists the kernel modules that the provider needs.
+	KernelModules() []string
+	//NeedsNetwork returns whether the provider needs network access.
+	NeedsNetwork() bool
+	//Attach is called during startup, before drives are discovered. It makes
+	//the provider's block devices available, and returns those device paths
+	//that shall be added to the drive globs.
+	Attach(osi os.Interface) (devicePaths []string, err error)
+	//ReadinessCheck returns the check that drive discovery waits for (see
+	//WaitForStorageServices), or nil if there is nothing to wait for.
+	ReadinessCheck(osi os.Interface) *storageServiceCheck
+}
+
+//BlockDeviceProviders returns the providers for all configured storage
+//backends, in the order in which they need to be set up (e.g. multipath maps
+//are set up on top of iSCSI sessions).
+func (c Configuration) BlockDeviceProviders() []BlockDeviceProvider {
+	var result []BlockDeviceProvider
+	for _, format := range []string{"raw", "qcow2"} {
+		var paths []string
+		for _, f := range c.ImageFiles {
+			if f.Format == format {
+				paths = append(paths, f.Path)
+			}
+		}
+		if len(paths) > 0 {
+			result = append(result, imageFileProvider{format, paths})
+		}
+	}
+	if c.StorageServices.ISCSISessions > 0 {
+		result = append(result, iscsiProvider{c.StorageServices.ISCSISessions})
+	}
+	if c.StorageServices.Multipath {
+		result = append(result, multipathProvider{})
+	}
+	return result
+}
+
+//AttachBlockDevices attaches the block devices of all storage backends, and
+//adds them to the drive globs. This needs to happen before drive discovery
+//starts.
+func AttachBlockDevices(osi os.Interface) {
+	for _, p := range Config.BlockDeviceProviders() {
+		devicePaths, err := p.Attach(osi)
+		if err != nil {
+			util.LogFatal(err.Error())
+		}
+		Config.DriveGlobs = append(Config.DriveGlobs, devicePaths...)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// image files
+
+//imageFileProvider attaches the image files of one format (see type
+//ImageFile) as loop devices (for raw images) or NBD devices (for qcow2
+//images).
+type imageFileProvider struct {
+	Format string
+	Paths  []string
+}
+
+func (p imageFileProvider) Name() string {
+	return p.Format + " image files"
+}
+
+func (p imageFileProvider) Binaries() []string {
+	if p.Format == "qcow2" {
+		return []string{"qemu-nbd"}
+	}
+	return []string{"losetup"}
+}
+
+func (p imageFileProvider) KernelModules() []string {
+	if p.Format == "qcow2" {
+		return []string{"nbd"}
+	}
+	return []string{"loop"}
+}
+
+func (p imageFileProvider) NeedsNetwork() bool {
+	return false
+}
+
+func (p imageFileProvider) Attach(osi os.Interface) ([]string, error) {
+	devicePaths := make([]string, 0, len(p.Paths))
+	for _, path := range p.Paths {
+		devicePath, ok := osi.AttachImageFile(path, p.Format)
+		if !ok {
+			return nil, fmt.Errorf("cannot attach image file %s", path)
+		}
+		devicePaths = append(devicePaths, devicePath)
+	}
+	return devicePaths, nil
+}
+
+func (p imageFileProvider) ReadinessCheck(osi os.Interface) *storageServiceCheck {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// iSCSI
+
+//iscsiProvider waits for iSCSI sessions to be logged in. The sessions
+//themselves are set up by iscsid, and their devices are found through the
+//drive globs.
+type iscsiProvider struct {
+	Sessions int
+}
+
+func (p iscsiProvider) Name() string {
+	return "iSCSI"
+}
+
+func (p iscsiProvider) Binaries() []string {
+	return []string{"iscsiadm"}
+}
+
+func (p iscsiProvider) KernelModules() []string {
+	return nil
+}
+
+func (p iscsiProvider) NeedsNetwork() bool {
+	return true
+}
+
+func (p iscsiProvider) Attach(osi os.Interface) ([]string, error) {
+	return nil, nil
+}
+
+func (p iscsiProvider) ReadinessCheck(osi os.Interface) *storageServiceCheck {
+	return &storageServiceCheck{"iscsid", func() (bool, string) {
+		return checkISCSISessions(osi, p.Sessions)
+	}}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// multipath
+
+//multipathProvider waits for multipathd to set up the multipath maps, whose
+//devices are found through the drive globs.
+type multipathProvider struct{}
+
+func (p multipathProvider) Name() string {
+	return "multipath"
+}
+
+func (p multipathProvider) Binaries() []string {
+	return []string{"multipathd"}
+}
+
+func (p multipathProvider) KernelModules() []string {
+	return nil
+}
+
+func (p multipathProvider) NeedsNetwork() bool {
+	return false
+}
+
+func (p multipathProvider) Attach(osi os.Interface) ([]string, error) {
+	return nil, nil
+}
+
+func (p multipathProvider) ReadinessCheck(osi os.Interface) *storageServiceCheck {
+	return &storageServiceCheck{"multipathd", func() (bool, string) {
+		return checkMultipath(osi)
+	}}
+}
@@ -0,0 +1,209 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	std_os "os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//RebootRequestDirectory is where administrators (or fleet rebooting tools)
+//place files to request the preparation of a reboot. The file name identifies
+//the requester. A file named "cancel" cancels the preparation.
+const RebootRequestDirectory = "/run/swift-storage/prepare-reboot"
+
+//SafeToRebootFlagPath is created once the preparation of a reboot is complete.
+const SafeToRebootFlagPath = "/run/swift-storage/state/flag-safe-to-reboot"
+
+//RebootPreparationStatus appears in type StatusReport while a reboot is being
+//prepared.
+type RebootPreparationStatus struct {
+	RequestedBy  string    `json:"requested_by"`
+	RequestedAt  time.Time `json:"requested_at"`
+	SafeToReboot bool      `json:"safe_to_reboot"`
+	//Problems lists the steps of the preparation that failed.
+	Problems []string `json:"problems,omitempty"`
+}
+
+//RebootPreparationReport is the response body of GET requests to the
+//prepare-reboot API.
+type RebootPreparationReport struct {
+	SchemaVersion int `json:"schema_version"`
+	RebootPreparationStatus
+}
+
+//PrepareRebootEvent is an Event that is emitted by CollectRequestFiles for
+//RebootRequestDirectory, and by the prepare-reboot API.
+type PrepareRebootEvent struct {
+	RequestedBy string
+	Cancel      bool
+}
+
+//LogMessage implements the Event interface.
+func (e PrepareRebootEvent) LogMessage() string {
+	if e.Cancel {
+		return "reboot preparation cancelled by " + e.RequestedBy
+	}
+	return "reboot preparation requested by " + e.RequestedBy
+}
+
+//EventType implements the Event interface.
+func (e PrepareRebootEvent) EventType() string {
+	return "prepare-reboot-requested"
+}
+
+//Handle implements the Event interface.
+func (e PrepareRebootEvent) Handle(c *Converger) {
+	if e.Cancel {
+		if c.rebootPreparation == nil {
+			util.LogInfo("no reboot is being prepared, nothing to cancel")
+			return
+		}
+		err := std_os.Remove(strings.TrimPrefix(SafeToRebootFlagPath, "/"))
+		if err != nil && !std_os.IsNotExist(err) {
+			util.LogError(err.Error())
+		}
+		c.rebootPreparation = nil
+		util.LogInfo("reboot preparation cancelled, resuming normal operation")
+		return
+	}
+
+	if p := c.rebootPreparation; p != nil && p.SafeToReboot {
+		util.LogInfo("reboot has already been prepared")
+		return
+	}
+	p := &RebootPreparationStatus{RequestedBy: e.RequestedBy, RequestedAt: time.Now()}
+	c.rebootPreparation = p
+
+	//tell Swift that storage is going away (this also stops Converge() from
+	//marking storage as ready again, see RunConverger)
+	err := std_os.Remove("run/swift-storage/state/flag-ready")
+	if err != nil && !std_os.IsNotExist(err) {
+		util.LogError(err.Error())
+		p.Problems = append(p.Problems, "cannot remove flag-ready")
+	}
+	c.IsReady = false
+	for name, ready := range c.readyPolicies {
+		if !ready {
+			continue
+		}
+		err := std_os.Remove(policyReadyFlagPath(name))
+		if err != nil && !std_os.IsNotExist(err) {
+			util.LogError(err.Error())
+			p.Problems = append(p.Problems, "cannot remove ready marker of storage policy "+name)
+			continue
+		}
+		c.readyPolicies[name] = false
+		storagePolicyReadyGauge.With(prometheus.Labels{"policy": name}).Set(0)
+	}
+
+	if cmd := Config.RebootPreparation.StopCommand; len(cmd) > 0 {
+		_, ok := command.Run(cmd...)
+		if !ok {
+			p.Problems = append(p.Problems, "stop command failed")
+		}
+	}
+
+	_, ok := command.Run("sync")
+	if !ok {
+		p.Problems = append(p.Problems, "sync failed")
+	}
+
+	if Config.RebootPreparation.Unmount {
+		for _, drive := range c.Drives {
+			drive.Teardown(c.OS)
+			if mountPath := drive.MountedPath(); mountPath != "" {
+				p.Problems = append(p.Problems, "cannot unmount "+mountPath)
+			}
+		}
+	}
+
+	if len(p.Problems) > 0 {
+		util.LogError("reboot preparation failed, request it again to retry (%d problems, see above)", len(p.Problems))
+		return
+	}
+	err = ioutil.WriteFile(strings.TrimPrefix(SafeToRebootFlagPath, "/"), nil, 0644)
+	if err != nil {
+		util.LogError("cannot write %s: %s", SafeToRebootFlagPath, err.Error())
+	}
+	p.SafeToReboot = true
+	util.LogInfo("reboot preparation complete: it is now safe to reboot")
+}
+
+var rebootRequests = make(chan PrepareRebootEvent, 1)
+
+//CollectRebootRequests is a collector job that forwards requests from the
+//prepare-reboot API into the converger queue.
+func CollectRebootRequests(queue chan []Event) {
+	for e := range rebootRequests {
+		queue <- []Event{e}
+	}
+}
+
+//handleRebootRequest answers requests to /api/v1/prepare-reboot. POST requests
+//the preparation of a reboot and DELETE cancels it. GET reports the
+//RebootPreparationStatus, with 200 once it is safe to reboot, 503 if the
+//preparation is not complete, or 404 if no reboot is being prepared.
+func handleRebootRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost, http.MethodDelete:
+		select {
+		case rebootRequests <- PrepareRebootEvent{RequestedBy: "API client " + r.RemoteAddr, Cancel: r.Method == http.MethodDelete}:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "another request is pending", http.StatusConflict)
+		}
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	currentStatusMutex.Lock()
+	status := currentStatus.RebootPreparation
+	currentStatusMutex.Unlock()
+	if status == nil {
+		http.Error(w, "no reboot is being prepared", http.StatusNotFound)
+		return
+	}
+
+	buf, err := json.Marshal(RebootPreparationReport{SchemaVersion, *status})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status.SafeToReboot {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(buf)
+}
@@ -0,0 +1,92 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/core"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//RotateKeys implements the --rotate-keys option. For each drive matching the
+//drive globs that has an open LUKS container, the preferred key (the first of
+//the configured keys) is added to the container, and all keyslots that are
+//unlocked by one of the luks.retired-keys are removed. Drives whose containers
+//are not open are skipped, since we cannot be sure that they belong to us.
+//Returns false if the rotation failed on any drive.
+func RotateKeys(osi os.Interface) bool {
+	keys := EncryptionKeys()
+	if len(keys) == 0 {
+		util.LogFatal("cannot rotate keys: no keys configured")
+	}
+	for idx, key := range Config.LUKS.RetiredKeys {
+		if key.KeyFile == "" {
+			continue
+		}
+		path := key.KeyFile
+		if key.KeyFileInChroot {
+			//make path relative to working directory to account for chrootPath
+			path = strings.TrimPrefix(path, "/")
+		}
+		if err := checkKeyFile(path); err != nil {
+			util.LogFatal("cannot use key file from entry #%d in luks.retired-keys: %s", idx+1, err.Error())
+		}
+	}
+
+	drives, _, err := osi.NewDriveScanner(Config.DriveGlobs).Scan()
+	if err != nil {
+		util.LogFatal("cannot rotate keys: %s", err.Error())
+	}
+	sort.Slice(drives, func(i, j int) bool {
+		return drives[i].DevicePath < drives[j].DevicePath
+	})
+	osi.RefreshLUKSMappings()
+
+	rotated, failed, failedOptional := 0, 0, 0
+	for _, drive := range drives {
+		if osi.GetLUKSMappingOf(drive.DevicePath) == "" {
+			util.LogDebug("skipping %s: no open LUKS container", drive.DevicePath)
+			continue
+		}
+		devicePath := core.LUKSHeaderDevicePath(Config.LUKS.HeaderDirectory, drive)
+		switch {
+		case core.RotateLUKSKeys(osi, devicePath, keys, RetiredEncryptionKeys(), Config.LUKS.FreeRetiredKeyslots):
+			rotated++
+		case Config.OptionalDrives.Matches(drive.SerialNumber, drive.FoundAtPath, drive.DevicePath):
+			failedOptional++
+		default:
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		util.LogError("rotated keys on %d LUKS containers, but failed on %d others (see above)", rotated, failed+failedOptional)
+		return false
+	}
+	if failedOptional > 0 {
+		util.LogError("rotated keys on %d LUKS containers, but failed on %d optional drives (see above)", rotated, failedOptional)
+		return true
+	}
+	util.LogInfo("rotated keys on %d LUKS containers", rotated)
+	return true
+}
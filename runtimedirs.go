@@ -0,0 +1,105 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	std_os "os"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//The directory whose ownership is set to Config.Owner.
+const swiftCachePath = "/var/cache/swift"
+
+//Returns the directories that the converger wants to write to (depending on
+//which features are enabled).
+func runtimeDirectories() []string {
+	dirs := []string{
+		"/run/swift-storage/broken",
+		util.DriveLogDirectory,
+		"/run/swift-storage/state/unmount-propagation",
+		swiftCachePath,
+	}
+	if Config.Migration.Enabled {
+		dirs = append(dirs, MigrationRequestDirectory)
+	}
+	if Config.EncryptionMigration.Enabled {
+		dirs = append(dirs, EncryptionRequestDirectory)
+	}
+	if Config.Evacuation.Enabled {
+		dirs = append(dirs, EvacuationRequestDirectory)
+	}
+	if Config.ReadOnlyExport.Enabled {
+		dirs = append(dirs, ExportRequestDirectory, UnexportRequestDirectory)
+	}
+	if Config.VerifyFilesystemUUID {
+		dirs = append(dirs, AdoptionRequestDirectory)
+	}
+	if Config.RebootPreparation.Enabled {
+		dirs = append(dirs, RebootRequestDirectory)
+	}
+	if Config.Flapping.MaxFlaps > 0 {
+		dirs = append(dirs, QuarantineDirectory)
+	}
+	return dirs
+}
+
+//CreateRuntimeDirectories creates all directories that the converger wants to
+//write to. This is called once during startup.
+func CreateRuntimeDirectories(osi os.Interface) {
+	command.Command{ExitOnError: true}.Run(append([]string{"mkdir", "-p"}, runtimeDirectories()...)...)
+	if Config.SELinuxRelabel {
+		command.Command{ExitOnError: true}.Run(append([]string{"restorecon"}, runtimeDirectories()...)...)
+	}
+	//swift cache path must be accesible from user swift
+	osi.Chown(swiftCachePath, Config.Owner.User, Config.Owner.Group)
+}
+
+//RecreateRuntimeDirectories recreates those directories from
+//runtimeDirectories() that have gone missing since startup (e.g. because
+//someone cleaned up /run), so that the convergence does not fail on them.
+func (c *Converger) RecreateRuntimeDirectories() {
+	for _, dir := range runtimeDirectories() {
+		//make path relative to working directory to account for chrootPath
+		_, err := std_os.Stat(strings.TrimPrefix(dir, "/"))
+		if err == nil {
+			continue
+		}
+		if !std_os.IsNotExist(err) {
+			util.LogError(err.Error())
+			continue
+		}
+
+		util.LogInfo("recreating missing directory %s", dir)
+		_, ok := command.Run("mkdir", "-p", dir)
+		if !ok {
+			continue
+		}
+		if Config.SELinuxRelabel {
+			command.Run("restorecon", dir)
+		}
+		if dir == swiftCachePath {
+			c.OS.Chown(dir, Config.Owner.User, Config.Owner.Group)
+		}
+	}
+}
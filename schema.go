@@ -0,0 +1,88 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//SchemaVersion is the version of all JSON documents that the autopilot emits
+//(the status report, the state dump, the operation timeline, the readiness
+//report, the health endpoints of storage policies, the reboot preparation,
+//drive event and bulk endpoints, and the output of --diff and --evaluate),
+//except for drive.recon whose format is defined by Swift. Each of these
+//documents has a "schema_version" field, and its format is pinned by a golden
+//file in fixtures/schema. Within one schema version, fields may be added, but
+//existing fields are never removed, renamed, or changed in meaning. Any such
+//change requires a new schema version.
+const SchemaVersion = 1
+
+//ReadinessReportPath is where the ReadinessReport is written once storage is
+//ready.
+const ReadinessReportPath = "/run/swift-storage/state/ready.json"
+
+//ReadinessReport is written next to flag-ready when storage becomes ready.
+//It describes the situation at that point in time (the status API also
+//reports later changes).
+type ReadinessReport struct {
+	SchemaVersion int               `json:"schema_version"`
+	ReadySince    time.Time         `json:"ready_since"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Drives        int               `json:"drives"`
+	BrokenDrives  int               `json:"broken_drives"`
+	MountedDrives int               `json:"mounted_drives"`
+}
+
+//TimelineReport is the JSON format of the operation timeline (see
+//`profiling.timeline`).
+type TimelineReport struct {
+	SchemaVersion int                  `json:"schema_version"`
+	Operations    []util.TimelineEntry `json:"operations"`
+}
+
+func (c *Converger) writeReadinessReport() {
+	report := ReadinessReport{
+		SchemaVersion: SchemaVersion,
+		ReadySince:    time.Now(),
+		Labels:        Config.Labels,
+		Drives:        len(c.Drives),
+	}
+	for _, d := range c.Drives {
+		switch {
+		case d.Broken:
+			report.BrokenDrives++
+		case d.MountedPath() != "":
+			report.MountedDrives++
+		}
+	}
+
+	buf, err := json.Marshal(report)
+	if err == nil {
+		err = ioutil.WriteFile(strings.TrimPrefix(ReadinessReportPath, "/"), append(buf, '\n'), 0644)
+	}
+	if err != nil {
+		util.LogError("cannot write %s: %s", ReadinessReportPath, err.Error())
+	}
+}
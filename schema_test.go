@@ -0,0 +1,218 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/autopilot"
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//The JSON documents that the autopilot emits are compared with the golden
+//files in fixtures/schema, so that every change to their format shows up in
+//review (see SchemaVersion). After an intentional change, the golden files can
+//be rewritten with `go test -run TestSchema -update-golden .`.
+var updateGoldenFlag = flag.Bool("update-golden", false, "rewrite the golden files in fixtures/schema")
+
+var schemaTestTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func checkGoldenJSON(t *testing.T, name string, document interface{}) {
+	t.Helper()
+	actual, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	actual = append(actual, '\n')
+
+	path := "fixtures/schema/" + name + ".json"
+	if *updateGoldenFlag {
+		err := ioutil.WriteFile(path, actual, 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(actual) != string(expected) {
+		t.Errorf("%s does not match %s:\n%s", name, path, string(actual))
+	}
+}
+
+func sampleStatusReport() StatusReport {
+	return StatusReport{
+		SchemaVersion: SchemaVersion,
+		Ready:         true,
+		Labels:        map[string]string{"rack": "r1"},
+		Drives: []DriveStatus{
+			{
+				DriveID:        "SERIAL1",
+				DevicePath:     "/dev/sda",
+				MountPath:      "/srv/node/swift1",
+				SwiftID:        "swift1",
+				Layers:         []string{"luks", "xfs"},
+				LayoutVersion:  1,
+				FilesystemUUID: "0b3f5d6e-8f0a-4c7e-9d2b-1a2b3c4d5e6f",
+			},
+			{
+				DriveID:         "SERIAL2",
+				DevicePath:      "/dev/sdb",
+				AssignmentError: "no swift-id file found on device",
+				Broken:          true,
+			},
+		},
+	}
+}
+
+func TestSchemaStatusReport(t *testing.T) {
+	checkGoldenJSON(t, "status", sampleStatusReport())
+}
+
+func TestSchemaStateDump(t *testing.T) {
+	checkGoldenJSON(t, "statedump", StateDump{
+		SchemaVersion: SchemaVersion,
+		Time:          schemaTestTime,
+		Converger:     ConvergerActivity{Description: "idle", Since: schemaTestTime},
+		IsLive:        true,
+		Status:        sampleStatusReport(),
+		MountPoints: map[os.MountScope][]os.MountPoint{
+			os.HostScope: {{DevicePath: "/dev/mapper/SERIAL1", MountPath: "/srv/node/swift1", Options: map[string]bool{"rw": true}}},
+		},
+		Keys:         KeySourceStatus{Configured: 1},
+		RecentErrors: []util.LogEntry{{Time: schemaTestTime, Message: "ERROR: something went wrong"}},
+		Goroutines:   12,
+	})
+}
+
+func TestSchemaTimelineReport(t *testing.T) {
+	checkGoldenJSON(t, "timeline", TimelineReport{
+		SchemaVersion: SchemaVersion,
+		Operations: []util.TimelineEntry{{
+			Operation: "luksOpen",
+			Command:   "cryptsetup luksOpen /dev/sda SERIAL1",
+			Drives:    []string{"SERIAL1"},
+			Start:     schemaTestTime,
+			End:       schemaTestTime.Add(2 * time.Second),
+			Success:   true,
+		}},
+	})
+}
+
+func TestSchemaReadinessReport(t *testing.T) {
+	checkGoldenJSON(t, "ready", ReadinessReport{
+		SchemaVersion: SchemaVersion,
+		ReadySince:    schemaTestTime,
+		Labels:        map[string]string{"rack": "r1"},
+		Drives:        2,
+		BrokenDrives:  1,
+		MountedDrives: 1,
+	})
+}
+
+func TestSchemaStoragePolicyHealthReport(t *testing.T) {
+	checkGoldenJSON(t, "policy-health", StoragePolicyHealthReport{
+		SchemaVersion: SchemaVersion,
+		StoragePolicyStatus: StoragePolicyStatus{
+			Name:          "ssd",
+			Ready:         true,
+			MountedDrives: 3,
+			MinDrives:     2,
+		},
+	})
+}
+
+func TestSchemaRebootPreparationReport(t *testing.T) {
+	checkGoldenJSON(t, "prepare-reboot", RebootPreparationReport{
+		SchemaVersion: SchemaVersion,
+		RebootPreparationStatus: RebootPreparationStatus{
+			RequestedBy:  "api",
+			RequestedAt:  schemaTestTime,
+			SafeToReboot: false,
+			Problems:     []string{"cannot unmount /srv/node/swift1"},
+		},
+	})
+}
+
+func TestSchemaStateDifferenceReport(t *testing.T) {
+	checkGoldenJSON(t, "diff", StateDifferenceReport{
+		SchemaVersion: SchemaVersion,
+		Differences: []StateDifference{{
+			Kind:       MissingMountDifference,
+			DevicePath: "/dev/sda",
+			MountPath:  "/srv/node/swift1",
+			Message:    "/dev/sda is not mounted at /srv/node/swift1",
+		}},
+	})
+}
+
+func TestSchemaEvaluationReport(t *testing.T) {
+	checkGoldenJSON(t, "evaluate", EvaluationReport{
+		SchemaVersion: SchemaVersion,
+		Plan: autopilot.Plan{
+			Actions: []autopilot.PlannedAction{
+				{Action: "format", Path: "/dev/sda"},
+				{Action: "mount", Path: "/dev/sda", Target: "/srv/node/swift1"},
+			},
+			Drives: []autopilot.DriveStatus{{
+				DriveID:    "SERIAL1",
+				DevicePath: "/dev/sda",
+				MountPath:  "/srv/node/swift1",
+				SwiftID:    "swift1",
+				Layers:     []string{"xfs"},
+			}},
+		},
+	})
+}
+
+func TestSchemaDriveEvents(t *testing.T) {
+	events := []DriveEvent{
+		{ID: 1, Time: schemaTestTime, Type: DriveAppearedEvent, DriveID: "SERIAL1", Drive: &sampleStatusReport().Drives[0]},
+		{ID: 2, Time: schemaTestTime, Type: DriveVanishedEvent, DriveID: "SERIAL2"},
+	}
+	checkGoldenJSON(t, "events", DriveEventList{SchemaVersion, events})
+	checkGoldenJSON(t, "event-message", DriveEventMessage{SchemaVersion, events[0]})
+}
+
+func TestSchemaBulkResponse(t *testing.T) {
+	checkGoldenJSON(t, "bulk", BulkResponse{
+		SchemaVersion: SchemaVersion,
+		DryRun:        true,
+		Results: []BulkItemResult{
+			{Action: "evacuate", Drive: "swift1", OK: true},
+			{Action: "evacuate", Drive: "swift9", Error: "no such drive"},
+		},
+	})
+}
+
+func TestSchemaBulkResponsePending(t *testing.T) {
+	checkGoldenJSON(t, "bulk-pending", BulkResponse{
+		SchemaVersion: SchemaVersion,
+		Results:       []BulkItemResult{},
+		Pending:       true,
+	})
+}
@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	std_os "os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//StateDump is written on SIGUSR1 to help with debugging a daemon that appears
+//to be stuck. The drive information is obtained from the converger thread
+//(using QueryConverger). If the converger does not respond (because it is the
+//thing that is stuck), the status report that the converger published after
+//its last convergence is used instead, and IsLive is false.
+type StateDump struct {
+	SchemaVersion int                               `json:"schema_version"`
+	Time          time.Time                         `json:"time"`
+	Converger     ConvergerActivity                 `json:"converger"`
+	IsLive        bool                              `json:"is_live"`
+	Status        StatusReport                      `json:"status"`
+	MountPoints   map[os.MountScope][]os.MountPoint `json:"mount_points"`
+	Keys          KeySourceStatus                   `json:"keys"`
+	RecentErrors  []util.LogEntry                   `json:"recent_errors"`
+	Goroutines    int                               `json:"goroutines"`
+}
+
+//KeySourceStatus appears in type StateDump. (The keys themselves are never
+//included in the dump.)
+type KeySourceStatus struct {
+	Configured int `json:"configured"`
+	Empty      int `json:"empty"`
+}
+
+//HandleStateDumpSignals runs in a separate goroutine and writes a StateDump
+//whenever SIGUSR1 is received. This function does not return.
+func HandleStateDumpSignals(osi os.Interface, queue chan []Event) {
+	signals := make(chan std_os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		dump := buildStateDump(osi, queue)
+		buf, err := json.Marshal(dump)
+		if err != nil {
+			util.LogError("cannot serialize state dump: %s", err.Error())
+			continue
+		}
+
+		path := Config.StateDumpPath
+		if path == "" {
+			util.LogInfo("state dump: %s", string(buf))
+			continue
+		}
+		relPath := strings.TrimPrefix(path, "/")
+		err = std_os.MkdirAll(filepath.Dir(relPath), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(relPath, append(buf, '\n'), 0600)
+		}
+		if err == nil {
+			util.LogInfo("state dump written to %s", path)
+		} else {
+			util.LogError("cannot write state dump to %s: %s", path, err.Error())
+		}
+	}
+}
+
+//How long buildStateDump() waits for the converger thread.
+const stateDumpQueryTimeout = 5 * time.Second
+
+func buildStateDump(osi os.Interface, queue chan []Event) StateDump {
+	dump := StateDump{
+		SchemaVersion: SchemaVersion,
+		Time:          time.Now(),
+		MountPoints:   make(map[os.MountScope][]os.MountPoint),
+		RecentErrors:  util.RecentErrors(),
+		Goroutines:    runtime.NumGoroutine(),
+	}
+
+	currentStatusMutex.Lock()
+	dump.Converger = currentActivity
+	dump.Status = currentStatus
+	currentStatusMutex.Unlock()
+
+	var liveStatus StatusReport
+	dump.IsLive = QueryConverger(queue, stateDumpQueryTimeout, func(c *Converger) {
+		liveStatus = c.BuildStatusReport()
+	})
+	if dump.IsLive {
+		dump.Status = liveStatus
+	}
+
+	os.ForeachMountScope(func(scope os.MountScope) bool {
+		dump.MountPoints[scope] = osi.GetMountPointsIn("/", scope)
+		return true
+	})
+
+	for _, key := range EncryptionKeys() {
+		dump.Keys.Configured++
+		if key.Secret == "" && key.KeyFile == "" {
+			dump.Keys.Empty++
+		}
+	}
+	return dump
+}
@@ -0,0 +1,231 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+)
+
+//StatusReport is the response body for GET /api/v1/status.
+type StatusReport struct {
+	SchemaVersion int  `json:"schema_version"`
+	Ready         bool `json:"ready"`
+	//Recovery is set when the autopilot runs in recovery mode (see
+	//Configuration.Recovery).
+	Recovery bool `json:"recovery,omitempty"`
+	//Labels are taken from Configuration.Labels.
+	Labels map[string]string `json:"labels,omitempty"`
+	Drives []DriveStatus     `json:"drives"`
+	//QuarantinedDrives contains the serial numbers (or device names) of drives
+	//that are ignored because they kept flapping.
+	QuarantinedDrives []string `json:"quarantined_drives,omitempty"`
+	//StorageServices is filled by WaitForStorageServices().
+	StorageServices []StorageServiceStatus `json:"storage_services,omitempty"`
+	//StoragePolicies is only filled if storage policies are configured.
+	StoragePolicies []StoragePolicyStatus `json:"storage_policies,omitempty"`
+	//MissingManifestDrives contains the IDs of drives that are listed in the
+	//drive manifest, but have not been found.
+	MissingManifestDrives []string `json:"missing_manifest_drives,omitempty"`
+	//ForeignDrives contains the IDs of drives with a LUKS container that none
+	//of the configured keys can open (see core.Drive.Foreign).
+	ForeignDrives []string `json:"foreign_drives,omitempty"`
+	//RebootPreparation is only filled while a reboot is being prepared.
+	RebootPreparation *RebootPreparationStatus `json:"reboot_preparation,omitempty"`
+}
+
+//DriveStatus appears in type StatusReport.
+type DriveStatus struct {
+	DriveID           string             `json:"id"`
+	DeviceName        string             `json:"device_name,omitempty"`
+	DevicePath        string             `json:"device_path"`
+	BackingDevicePath string             `json:"backing_device_path,omitempty"`
+	MountPath         string             `json:"mount_path,omitempty"`
+	SwiftID           string             `json:"swift_id,omitempty"`
+	AssignmentError   string             `json:"assignment_error,omitempty"`
+	Broken            bool               `json:"broken"`
+	Foreign           bool               `json:"foreign,omitempty"`
+	Optional          bool               `json:"optional,omitempty"`
+	Layers            []string           `json:"layers,omitempty"`
+	Topology          *os.TopologyHints  `json:"topology,omitempty"`
+	Firmware          *os.FirmwareInfo   `json:"firmware,omitempty"`
+	BadFirmware       string             `json:"bad_firmware,omitempty"`
+	LUKSHeader        *os.LUKSHeaderInfo `json:"luks_header,omitempty"`
+	KeyslotsExhausted bool               `json:"keyslots_exhausted,omitempty"`
+	LayoutVersion     int                `json:"layout_version,omitempty"`
+	FilesystemUUID    string             `json:"filesystem_uuid,omitempty"`
+	NeedsAdoption     bool               `json:"needs_adoption,omitempty"`
+	Evacuation        *EvacuationStatus  `json:"evacuation,omitempty"`
+	//ReadOnlyExport is the mount path of the read-only export of this broken
+	//drive, if any.
+	ReadOnlyExport string `json:"read_only_export,omitempty"`
+	//EncryptionStartedAt is set while the filesystem of this drive is being
+	//encrypted in place.
+	EncryptionStartedAt *time.Time `json:"encryption_started_at,omitempty"`
+	//ZFSPoolMember is set if the drive belongs to a ZFS pool, and is thus left
+	//alone.
+	ZFSPoolMember bool `json:"zfs_pool_member,omitempty"`
+}
+
+//The status report is assembled by the converger thread after each
+//convergence, and read by the HTTP handler from other goroutines.
+var (
+	currentStatus      = StatusReport{SchemaVersion: SchemaVersion}
+	currentActivity    ConvergerActivity
+	currentStatusMutex sync.Mutex
+)
+
+//ConvergerActivity describes what the converger is doing right now.
+type ConvergerActivity struct {
+	Description string    `json:"description"`
+	Since       time.Time `json:"since"`
+}
+
+//setConvergerActivity is called by the converger thread whenever it starts
+//doing something else, so that a state dump can show where it is stuck.
+func setConvergerActivity(description string) {
+	currentStatusMutex.Lock()
+	defer currentStatusMutex.Unlock()
+	currentActivity = ConvergerActivity{description, time.Now()}
+}
+
+//PublishStatus updates the status report that is served by the status API.
+func (c *Converger) PublishStatus() {
+	report := c.BuildStatusReport()
+	emitDriveEvents(report)
+
+	currentStatusMutex.Lock()
+	defer currentStatusMutex.Unlock()
+	report.StorageServices = currentStatus.StorageServices
+	currentStatus = report
+}
+
+//BuildStatusReport describes the current state of the converger. The result
+//does not share any memory with the converger's state, so it can be handed
+//to other goroutines.
+func (c *Converger) BuildStatusReport() StatusReport {
+	report := StatusReport{
+		SchemaVersion:     SchemaVersion,
+		Ready:             c.IsReady,
+		Recovery:          Config.Recovery,
+		Labels:            Config.Labels,
+		Drives:            make([]DriveStatus, 0, len(c.Drives)),
+		QuarantinedDrives: c.flaps.QuarantinedDrives(),
+	}
+	if len(Config.StoragePolicies) > 0 {
+		report.StoragePolicies = c.storagePolicyStatuses()
+	}
+	report.MissingManifestDrives = c.MissingManifestDriveIDs()
+	if p := c.rebootPreparation; p != nil {
+		preparation := *p
+		preparation.Problems = append([]string(nil), p.Problems...)
+		report.RebootPreparation = &preparation
+	}
+	for _, drive := range c.Drives {
+		ds := DriveStatus{
+			DriveID:           drive.DriveID,
+			DevicePath:        drive.DevicePath,
+			BackingDevicePath: drive.BackingDevicePath,
+			MountPath:         drive.MountedPath(),
+			Broken:            drive.Broken,
+			Foreign:           drive.Foreign,
+			Optional:          drive.Optional,
+			Layers:            drive.DeviceLayers(),
+			ZFSPoolMember:     drive.ZFSPoolMember,
+		}
+		if drive.Foreign {
+			report.ForeignDrives = append(report.ForeignDrives, drive.DriveID)
+		}
+		if drive.DeviceName != drive.DriveID {
+			ds.DeviceName = drive.DeviceName
+		}
+		if drive.Topology != nil {
+			topology := *drive.Topology
+			topology.IRQs = append([]os.IRQHint(nil), topology.IRQs...)
+			ds.Topology = &topology
+		}
+		if drive.Firmware != nil {
+			firmware := *drive.Firmware
+			ds.Firmware = &firmware
+			ds.BadFirmware = badFirmwareReason(drive)
+		}
+		if drive.LUKSHeader != nil {
+			header := *drive.LUKSHeader
+			header.UsedKeyslots = append([]int(nil), header.UsedKeyslots...)
+			ds.LUKSHeader = &header
+			ds.KeyslotsExhausted = header.KeyslotsExhausted()
+		}
+		ds.LayoutVersion = drive.LayoutVersion
+		ds.FilesystemUUID = drive.FilesystemUUID
+		ds.NeedsAdoption = drive.NeedsAdoption()
+		if status, exists := c.evacuations[drive.DriveID]; exists {
+			ds.Evacuation = &status
+		}
+		if drive.Export != nil {
+			ds.ReadOnlyExport = drive.Export.MountPath
+		}
+		if saved, exists := c.State.Drives[drive.DriveID]; exists && drive.Encrypting {
+			ds.EncryptionStartedAt = saved.EncryptionStartedAt
+		}
+		if a := drive.Assignment; a != nil {
+			if a.Error == "" {
+				ds.SwiftID = a.SwiftID
+			} else {
+				ds.AssignmentError = a.ErrorMessage(drive)
+			}
+		}
+		report.Drives = append(report.Drives, ds)
+	}
+	return report
+}
+
+func handleConvergeRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	RequestConvergence("requested via API by " + r.RemoteAddr)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	currentStatusMutex.Lock()
+	buf, err := json.Marshal(currentStatus)
+	currentStatusMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
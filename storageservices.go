@@ -0,0 +1,151 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//StorageServiceStatus describes whether a storage service that drives depend
+//on (multipathd or iscsid) was ready when drive discovery started. It appears
+//in type StatusReport.
+type StorageServiceStatus struct {
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Message string `json:"message"`
+	//WaitedSecs is how long we waited for the service to become ready.
+	WaitedSecs float64 `json:"waited_secs"`
+}
+
+//WaitForStorageServices waits until iSCSI sessions are logged in and
+//multipathd has settled, if configured. Otherwise, drive discovery would race
+//with these services, and we might end up using single paths instead of the
+//multipath devices on top of them. Exits with an error if the services do not
+//become ready within the configured timeout.
+func WaitForStorageServices(osi os.Interface) {
+	cfg := Config.StorageServices
+	deadline := time.Now().Add(cfg.Timeout)
+
+	//the providers are ordered such that e.g. iSCSI goes first, since
+	//multipath maps are set up on top of the sessions
+	var checks []storageServiceCheck
+	for _, p := range Config.BlockDeviceProviders() {
+		if check := p.ReadinessCheck(osi); check != nil {
+			checks = append(checks, *check)
+		}
+	}
+	if len(checks) == 0 {
+		return
+	}
+
+	statuses := make([]StorageServiceStatus, len(checks))
+	for idx, check := range checks {
+		statuses[idx] = StorageServiceStatus{Name: check.Name, Message: "not checked yet"}
+	}
+	publishStorageServiceStatus(statuses)
+
+	for idx, check := range checks {
+		statuses[idx] = waitForStorageService(check, deadline, func(status StorageServiceStatus) {
+			statuses[idx] = status
+			publishStorageServiceStatus(statuses)
+		})
+		publishStorageServiceStatus(statuses)
+		if !statuses[idx].Ready {
+			util.LogFatal("%s did not become ready within %s: %s", check.Name, cfg.Timeout, statuses[idx].Message)
+		}
+	}
+}
+
+type storageServiceCheck struct {
+	Name  string
+	Check func() (ready bool, message string)
+}
+
+//Polls the given check until it reports readiness or the deadline expires.
+//The callback is invoked whenever the status message changes.
+func waitForStorageService(check storageServiceCheck, deadline time.Time, update func(StorageServiceStatus)) StorageServiceStatus {
+	startedAt := time.Now()
+	status := StorageServiceStatus{Name: check.Name}
+	for {
+		ready, message := check.Check()
+		changed := message != status.Message
+		status.Ready = ready
+		status.Message = message
+		status.WaitedSecs = time.Since(startedAt).Seconds()
+
+		if ready {
+			util.LogInfo("%s is ready: %s", check.Name, message)
+			util.RecordTiming("storage-services", check.Name, startedAt, true)
+			return status
+		}
+		if changed {
+			util.LogInfo("waiting for %s: %s", check.Name, message)
+			update(status)
+		}
+		if time.Now().After(deadline) {
+			util.RecordTiming("storage-services", check.Name, startedAt, false)
+			return status
+		}
+		time.Sleep(util.GetJobInterval(2*time.Second, 100*time.Millisecond))
+	}
+}
+
+func checkISCSISessions(osi os.Interface, expected int) (bool, string) {
+	states := osi.GetISCSISessionStates()
+	loggedIn := 0
+	for _, state := range states {
+		if state == "LOGGED_IN" {
+			loggedIn++
+		}
+	}
+	message := fmt.Sprintf("%d of %d expected sessions logged in", loggedIn, expected)
+	if len(states) > loggedIn {
+		message += fmt.Sprintf(" (%d sessions in other states)", len(states)-loggedIn)
+	}
+	return loggedIn >= expected, message
+}
+
+func checkMultipath(osi os.Interface) (bool, string) {
+	status := osi.GetMultipathStatus()
+	if status.DaemonState == "" {
+		return false, "multipathd is not reachable"
+	}
+	if status.DaemonState != "idle" {
+		return false, "multipathd is in state " + status.DaemonState
+	}
+	message := fmt.Sprintf("%d multipath maps", status.Maps)
+	if len(status.MapsWithoutActivePaths) > 0 {
+		//not a reason to wait longer (this can also be a broken drive), but worth
+		//pointing out
+		message += fmt.Sprintf(", of which %s have no active paths", strings.Join(status.MapsWithoutActivePaths, ", "))
+	}
+	return true, message
+}
+
+func publishStorageServiceStatus(statuses []StorageServiceStatus) {
+	currentStatusMutex.Lock()
+	defer currentStatusMutex.Unlock()
+	currentStatus.StorageServices = append([]StorageServiceStatus(nil), statuses...)
+}
@@ -0,0 +1,121 @@
+#!/bin/bash
+cd "$(dirname "$(readlink -f $0)")"
+source ./lib/common.sh
+source ./lib/cleanup.sh
+
+make_disk_images  1
+make_loop_devices 1
+
+DEV1="$(readlink -f "${DIR}/loop1")"
+HASH1="$(echo -n "${DEV1}" | md5sum | cut -d' ' -f1)"
+HEADER1="${DIR}/luks-headers/${HASH1}.luks-header"
+
+# the test covers the in-place encryption of an existing unencrypted drive; set
+# up the device as plain XFS with swift-id
+if [[ "${DEV1}" != /dev/loop* ]]; then
+    # double-check that we won't overwrite a system partition or something
+    echo "expected loop device to be called '/dev/loopX', but is actually '${DEV1}'" >&2
+    exit 1
+fi
+as_root mkfs.xfs "${DEV1}" >/dev/null
+mkdir -p "${DIR}/mount"
+as_root mount "${DEV1}" "${DIR}/mount"
+echo swift1 | as_root tee "${DIR}/mount/swift-id" > /dev/null
+as_root umount "${DIR}/mount"
+mkdir -p "${DIR}/luks-headers"
+
+with_config <<-EOF
+    drives: [ '${DIR}/loop?' ]
+    state-file: ${DIR}/state.json
+    keys:
+        - secret: supersecretpassword
+    luks:
+        header-directory: ${DIR}/luks-headers
+    encryption-migration:
+        enabled: true
+EOF
+
+################################################################################
+# phase 1: request the encryption, but make it fail before it starts (a
+# directory in place of the LUKS header cannot be read by cryptsetup), so that
+# the drive is left behind like after an interrupted encryption
+
+run_and_expect <<-EOF
+> INFO: event received: new device found: ${DIR}/loop1 -> ${DEV1}
+> ERROR: cannot determine serial number for ${DEV1}, will use device ID {{hash1}} instead
+> INFO: mounted ${DEV1} to /run/swift-storage/{{hash1}} in host mount namespace
+> INFO: mounted ${DEV1} to /run/swift-storage/{{hash1}} in local mount namespace
+> INFO: unmounted /run/swift-storage/{{hash1}} in host mount namespace
+> INFO: unmounted /run/swift-storage/{{hash1}} in local mount namespace
+> INFO: mounted ${DEV1} to /srv/node/swift1 in host mount namespace
+> INFO: mounted ${DEV1} to /srv/node/swift1 in local mount namespace
+
+$ source lib/common.sh; expect_open_luks_count 0; expect_mountpoint /srv/node/swift1; as_root mkdir "${HEADER1}"; as_root touch /run/swift-storage/encrypt-filesystem/swift1
+> INFO: event received: filesystem encryption requested for swift1
+> INFO: encrypting filesystem of ${DEV1} (swift-id swift1) in place
+> INFO: unmounted /srv/node/swift1 in host mount namespace
+> INFO: unmounted /srv/node/swift1 in local mount namespace
+> INFO: event received: filesystem encryption failed for ${DEV1}
+> ERROR: encryption of ${DEV1} failed: will not set up the drive until the encryption has been resumed by restarting the autopilot
+EOF
+
+expect_open_luks_count 0
+expect_no_mountpoint   /srv/node/swift1
+expect_symlink         /run/swift-storage/state/unmount-propagation/swift1 "${DEV1}"
+if ! grep -qF '"encryption_started_at"' "${DIR}/state.json"; then
+    echo "expected ${DIR}/state.json to record the encryption of ${DEV1} as started, but it doesn't" >&2
+    exit 1
+fi
+
+# leave the LUKS header in the state that a reboot during the encryption would
+# leave behind (the reencryption is recorded in the header, but not finished)
+as_root rmdir "${HEADER1}"
+echo supersecretpassword | as_root cryptsetup reencrypt --encrypt --init-only --batch-mode --header "${HEADER1}" "${DEV1}"
+
+################################################################################
+# phase 2: on restart, the encryption is resumed, and the drive is set up once
+# it is complete
+
+run_and_expect <<-EOF
+> INFO: event received: new device found: ${DIR}/loop1 -> ${DEV1}
+> ERROR: cannot determine serial number for ${DEV1}, will use device ID {{hash1}} instead
+> INFO: resuming interrupted encryption of ${DEV1}
+> INFO: event received: filesystem encryption finished for ${DEV1}
+> ERROR: cannot determine serial number for ${DEV1}, will use device ID {{hash1}} instead
+> INFO: LUKS container at ${DEV1} opened as /dev/mapper/{{hash1}}
+> INFO: mounted /dev/mapper/{{hash1}} to /run/swift-storage/{{hash1}} in host mount namespace
+> INFO: mounted /dev/mapper/{{hash1}} to /run/swift-storage/{{hash1}} in local mount namespace
+> INFO: unmounted /run/swift-storage/{{hash1}} in host mount namespace
+> INFO: unmounted /run/swift-storage/{{hash1}} in local mount namespace
+> INFO: mounted /dev/mapper/{{hash1}} to /srv/node/swift1 in host mount namespace
+> INFO: mounted /dev/mapper/{{hash1}} to /srv/node/swift1 in local mount namespace
+EOF
+
+expect_open_luks_count   1
+expect_mountpoint        /srv/node/swift1
+expect_file_with_content /srv/node/swift1/swift-id 'swift1'
+expect_deleted           /run/swift-storage/state/unmount-propagation/*
+
+# check that /srv/node/swift1 is really backed by the new LUKS container
+MOUNTED_DEVICE="$(awk '$2~/srv\/node\/swift1/{print$1}' /proc/mounts)"
+if [[ "${MOUNTED_DEVICE}" != /dev/mapper/* ]]; then
+    echo "expected mountpoint /srv/node/swift1 to be backed by LUKS container, but actually backed by '${MOUNTED_DEVICE}'" >&2
+    exit 1
+fi
+if grep -qF '"encryption_started_at"' "${DIR}/state.json"; then
+    echo "expected ${DIR}/state.json to record the encryption of ${DEV1} as finished, but it doesn't" >&2
+    exit 1
+fi
+
+################################################################################
+# phase 3: check that the finished encryption is not resumed again on restart
+
+run_and_expect <<-EOF
+> INFO: event received: new device found: ${DIR}/loop1 -> ${DEV1}
+> ERROR: cannot determine serial number for ${DEV1}, will use device ID {{hash1}} instead
+> INFO: discovered ${DEV1} to be mapped to /dev/mapper/{{hash1}} already
+> INFO: discovered /dev/mapper/{{hash1}} to be mounted at /srv/node/swift1 already in host mount namespace
+EOF
+
+expect_open_luks_count 1
+expect_mountpoint      /srv/node/swift1
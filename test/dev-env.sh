@@ -0,0 +1,142 @@
+#!/bin/bash
+set -euo pipefail
+
+# This script sets up a development environment with file-backed drives, and
+# runs the autopilot on it. Usage:
+#
+#     ./test/dev-env.sh create N [--luks]   # create N drives and set them up
+#     ./test/dev-env.sh run                 # run the autopilot in the foreground
+#     ./test/dev-env.sh destroy             # tear everything down again
+#
+# The assets are placed in a different directory than those of the testcases,
+# so that a dev environment survives test runs.
+
+THISDIR="$(dirname "$(readlink -f $0)")"
+REPODIR="$(dirname "${THISDIR}")"
+DIR="${DEV_ENV_DIR:-${TMPDIR:-/tmp}/swift-drive-autopilot-dev}"
+BINARY="${REPODIR}/build/swift-drive-autopilot"
+
+function as_root {
+    if [ "${EUID}" == 0 ]; then
+        "$@"
+    else
+        sudo "$@"
+    fi
+}
+
+function usage {
+    echo "Usage: $0 create <count> [--luks] | run | destroy" >&2
+    exit 1
+}
+
+function create {
+    local COUNT="${1:-}"
+    local LUKS="${2:-}"
+    if ! [[ "${COUNT}" =~ ^[1-9][0-9]*$ ]]; then
+        usage
+    fi
+    if [ -e "${DIR}/config.yaml" ]; then
+        echo "A dev environment already exists in ${DIR}. Run \`$0 destroy\` first." >&2
+        exit 1
+    fi
+
+    make -C "${REPODIR}" build/swift-drive-autopilot
+    mkdir -p "${DIR}"
+
+    echo ">> Allocating ${COUNT} disk images in ${DIR}"
+    for IDX in $(seq 1 "${COUNT}"); do
+        fallocate -l 100M "${DIR}/image${IDX}"
+    done
+
+    # the autopilot attaches the images as loop devices by itself (see
+    # `image-files` in the README)
+    echo ">> Writing ${DIR}/config.yaml"
+    {
+        echo "drives: []"
+        echo "image-files:"
+        for IDX in $(seq 1 "${COUNT}"); do
+            echo "  - path: ${DIR}/image${IDX}"
+        done
+        echo "swift-id-pool: [ $(seq -s ', ' -f 'swift%g' 1 "${COUNT}") ]"
+        echo "metrics-listen-address: \"127.0.0.1:9102\""
+        if [ "${LUKS}" = --luks ]; then
+            echo "keys:"
+            echo "  - secret: \"dev-env-secret\""
+        fi
+    } > "${DIR}/config.yaml"
+
+    echo ">> Running the autopilot until storage is ready (log output goes to ${DIR}/log)"
+    as_root "${BINARY}" "${DIR}/config.yaml" > "${DIR}/log" 2>&1 &
+    local PID=$!
+    local READY=0
+    for _ in $(seq 1 120); do
+        if [ -e /run/swift-storage/state/flag-ready ]; then
+            READY=1
+            break
+        fi
+        if ! kill -0 "${PID}" 2>/dev/null; then
+            break
+        fi
+        sleep 1
+    done
+    as_root kill "${PID}" 2>/dev/null || true
+    wait "${PID}" 2>/dev/null || true
+
+    if [ "${READY}" != 1 ]; then
+        echo "Storage did not become ready. Log output follows:" >&2
+        cat "${DIR}/log" >&2
+        exit 1
+    fi
+    local MOUNTED="$(mount | grep -c ' on /srv/node/swift' || true)"
+    echo ">> Storage is ready: ${MOUNTED} of ${COUNT} drives mounted below /srv/node"
+    if [ "${MOUNTED}" != "${COUNT}" ]; then
+        exit 1
+    fi
+    echo ">> Run \`$0 run\` to start the autopilot again, or \`$0 destroy\` to clean up."
+}
+
+function run {
+    if [ ! -e "${DIR}/config.yaml" ]; then
+        echo "No dev environment found in ${DIR}. Run \`$0 create <count>\` first." >&2
+        exit 1
+    fi
+    make -C "${REPODIR}" build/swift-drive-autopilot
+    exec as_root "${BINARY}" "${DIR}/config.yaml"
+}
+
+function destroy {
+    echo ">> Unmounting drives"
+    mount | grep -E " on (/run/swift-storage|/srv/node)/" | cut -d' ' -f3 | while read MOUNTPOINT; do
+        as_root umount "${MOUNTPOINT}"
+    done
+    echo ">> Closing LUKS containers and detaching loop devices"
+    for IMAGE in "${DIR}"/image*; do
+        [ -e "${IMAGE}" ] || continue
+        as_root losetup -j "${IMAGE}" | cut -d: -f1 | while read DEVICE; do
+            MAPPING="$(lsblk -nlo NAME,TYPE "${DEVICE}" | awk '$2=="crypt"{print $1}')"
+            if [ -n "${MAPPING}" ]; then
+                as_root cryptsetup close "${MAPPING}"
+            fi
+            as_root losetup -d "${DEVICE}"
+        done
+    done
+    echo ">> Removing ${DIR}, /run/swift-storage and /srv/node"
+    rm -rf -- "${DIR}"
+    as_root rm -rf -- /run/swift-storage /srv/node
+}
+
+case "${1:-}" in
+    create)
+        shift
+        create "$@"
+        ;;
+    run)
+        run
+        ;;
+    destroy)
+        destroy
+        ;;
+    *)
+        usage
+        ;;
+esac
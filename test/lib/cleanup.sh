@@ -41,3 +41,5 @@ log_debug "Cleanup: disk images in ${DIR}"
 ( cd "${DIR}"; rm -f -- image? )
 log_debug "Cleanup: loop device links in ${DIR}"
 ( cd "${DIR}"; rm -f -- loop? )
+log_debug "Cleanup: state file and LUKS headers in ${DIR}"
+( cd "${DIR}"; as_root rm -rf -- state.json* luks-headers )
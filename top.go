@@ -0,0 +1,284 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/parsers"
+)
+
+//How often the terminal status viewer (see RunTop) refreshes its display, and
+//how many recent events it shows.
+const (
+	topRefreshInterval = 2 * time.Second
+	topEventCount      = 10
+)
+
+//RunTop implements the --top option. It shows a continuously updated view of
+//the drives managed by the running autopilot (as reported by its status and
+//events API) together with their I/O statistics from /proc/diskstats, until
+//interrupted with Ctrl-C. It is meant for operators working directly on the
+//node, e.g. during an incident.
+func RunTop(w io.Writer) error {
+	baseURL, err := localAPIBaseURL()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	token := topAPIToken()
+	get := func(path string, data interface{}) error {
+		req, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s returned %s", path, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(data)
+	}
+
+	var (
+		events        []DriveEvent
+		lastStats     map[string]parsers.DiskStats
+		lastStatsTime time.Time
+	)
+	for {
+		var (
+			report    StatusReport
+			newEvents DriveEventList
+			problem   string
+		)
+		err := get("/api/v1/status", &report)
+		if err == nil {
+			path := "/api/v1/events"
+			if len(events) > 0 {
+				path += fmt.Sprintf("?since=%d", events[len(events)-1].ID)
+			}
+			err = get(path, &newEvents)
+		}
+		if err != nil {
+			problem = err.Error()
+		}
+		events = append(events, newEvents.Events...)
+		if len(events) > topEventCount {
+			events = events[len(events)-topEventCount:]
+		}
+
+		stats, err := readDiskStats()
+		if err != nil && problem == "" {
+			problem = err.Error()
+		}
+		now := time.Now()
+		renderTop(w, report, events, topRates(lastStats, stats, now.Sub(lastStatsTime)), problem)
+		lastStats, lastStatsTime = stats, now
+
+		time.Sleep(topRefreshInterval)
+	}
+}
+
+//Returns the base URL of the autopilot's HTTP API, as configured in
+//metrics-listen-address(es). Wildcard addresses are replaced by the loopback
+//address.
+func localAPIBaseURL() (string, error) {
+	addr := Config.MetricsListenAddress
+	if addr == "" && len(Config.MetricsListenAddresses) > 0 {
+		addr = Config.MetricsListenAddresses[0]
+	}
+	if addr == "" {
+		return "", fmt.Errorf("no metrics-listen-address configured")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+//Returns the token that RunTop uses for the API. Since it only reads, a
+//read-only token is preferred, so that the admin token is not sent around
+//needlessly. An admin token is only used if it is the only one configured.
+func topAPIToken() string {
+	var token string
+	for _, t := range Config.APITokens {
+		if t.Role == ReadOnlyRole {
+			return string(t.Token)
+		}
+		if token == "" {
+			token = string(t.Token)
+		}
+	}
+	return token
+}
+
+func readDiskStats() (map[string]parsers.DiskStats, error) {
+	buf, err := ioutil.ReadFile("proc/diskstats")
+	if err != nil {
+		return nil, err
+	}
+	return parsers.ParseDiskStats(string(buf))
+}
+
+//topRate is the I/O throughput of a device between two refreshes of RunTop.
+type topRate struct {
+	ReadBytesPerSecond  float64
+	WriteBytesPerSecond float64
+	//Utilization is the fraction of time (between 0 and 1) during which the
+	//device had I/O requests in flight.
+	Utilization float64
+}
+
+//The sector counts in /proc/diskstats are always in units of 512 bytes.
+const diskStatsSectorSize = 512
+
+func topRates(previous, current map[string]parsers.DiskStats, elapsed time.Duration) map[string]topRate {
+	result := make(map[string]topRate)
+	seconds := elapsed.Seconds()
+	if previous == nil || seconds <= 0 {
+		return result
+	}
+	for name, cur := range current {
+		prev, exists := previous[name]
+		//counters start over when a device is removed and added again
+		if !exists || cur.SectorsRead < prev.SectorsRead || cur.SectorsWritten < prev.SectorsWritten || cur.TimeDoingIO < prev.TimeDoingIO {
+			continue
+		}
+		result[name] = topRate{
+			ReadBytesPerSecond:  float64((cur.SectorsRead-prev.SectorsRead)*diskStatsSectorSize) / seconds,
+			WriteBytesPerSecond: float64((cur.SectorsWritten-prev.SectorsWritten)*diskStatsSectorSize) / seconds,
+			Utilization:         float64(cur.TimeDoingIO-prev.TimeDoingIO) / 1000 / seconds,
+		}
+	}
+	return result
+}
+
+//Returns the kernel name of the given device (e.g. "sdb" for /dev/sdb, or
+//"dm-3" for /dev/mapper/foo), which is how it appears in /proc/diskstats.
+func kernelDeviceName(devicePath string) string {
+	resolved, err := resolveInChroot(".", strings.TrimPrefix(devicePath, "/"))
+	if err != nil {
+		return filepath.Base(devicePath)
+	}
+	return filepath.Base(resolved)
+}
+
+//Returns a short description of the state of the given drive for RunTop.
+func topDriveState(d DriveStatus) string {
+	switch {
+	case d.Broken:
+		return "broken"
+	case d.Foreign:
+		return "foreign"
+	case d.Evacuation != nil:
+		return "evacuating"
+	case d.AssignmentError != "":
+		return "unassigned"
+	case d.SwiftID == "":
+		return "spare"
+	case d.MountPath == "":
+		return "unmounted"
+	}
+	return "ok"
+}
+
+func renderTop(w io.Writer, report StatusReport, events []DriveEvent, rates map[string]topRate, problem string) {
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J") //move cursor to top left and clear screen
+
+	broken := 0
+	for _, d := range report.Drives {
+		if d.Broken {
+			broken++
+		}
+	}
+	fmt.Fprintf(&out, "swift-drive-autopilot - %s - ready: %t - drives: %d (%d broken)\n",
+		time.Now().Format("15:04:05"), report.Ready, len(report.Drives), broken)
+	if problem != "" {
+		fmt.Fprintf(&out, "ERROR: %s\n", problem)
+	}
+	out.WriteString("\n")
+
+	format := "%-22s %-12s %-11s %-24s %10s %10s %5s\n"
+	fmt.Fprintf(&out, format, "DEVICE", "SWIFT-ID", "STATE", "MOUNTPOINT", "READ/s", "WRITE/s", "UTIL")
+	for _, d := range report.Drives {
+		readRate, writeRate, util := "-", "-", "-"
+		devicePath := d.DevicePath
+		if d.BackingDevicePath != "" {
+			devicePath = d.BackingDevicePath
+		}
+		if rate, exists := rates[kernelDeviceName(devicePath)]; exists {
+			readRate = formatByteRate(rate.ReadBytesPerSecond)
+			writeRate = formatByteRate(rate.WriteBytesPerSecond)
+			util = fmt.Sprintf("%.0f%%", rate.Utilization*100)
+		}
+		fmt.Fprintf(&out, format, d.DevicePath, orDash(d.SwiftID), topDriveState(d), orDash(d.MountPath), readRate, writeRate, util)
+	}
+
+	out.WriteString("\nRECENT EVENTS\n")
+	if len(events) == 0 {
+		out.WriteString("(none)\n")
+	}
+	for idx := len(events) - 1; idx >= 0; idx-- {
+		e := events[idx]
+		fmt.Fprintf(&out, "%s %-15s %s\n", e.Time.Local().Format("15:04:05"), e.Type, e.DriveID)
+	}
+	out.WriteString("\nPress Ctrl-C to quit.\n")
+
+	_, _ = io.WriteString(w, out.String())
+}
+
+func formatByteRate(bytesPerSecond float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	unit := 0
+	for bytesPerSecond >= 1024 && unit < len(units)-1 {
+		bytesPerSecond /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", bytesPerSecond, units[unit])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/sapcc/go-bits/secrets"
+	"github.com/sapcc/swift-drive-autopilot/pkg/command"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//TPM2KeySource appears in type Configuration. It references an encryption
+//key that is sealed into the TPM2 of this machine, so that it can only be
+//unsealed here (and, if the sealed object has a PCR policy, only while the
+//PCRs have the values that the policy expects).
+type TPM2KeySource struct {
+	//Either Handle (the persistent handle of the sealed object, e.g.
+	//"0x81000001") or ContextFile (inside the chroot) is given.
+	Handle      string `yaml:"handle"`
+	ContextFile string `yaml:"context-file"`
+	//PCRs is the PCR selection of the policy that the sealed object is bound
+	//to, e.g. "sha256:0,2,4,7".
+	PCRs string `yaml:"pcrs"`
+}
+
+var (
+	tpm2HandleRx = regexp.MustCompile(`^0x81[0-9a-fA-F]{6}$`)
+	tpm2PCRsRx   = regexp.MustCompile(`^[a-z0-9]+:[0-9]+(,[0-9]+)*(\+[a-z0-9]+:[0-9]+(,[0-9]+)*)*$`)
+)
+
+//Validate checks the key source configuration.
+func (t TPM2KeySource) Validate() error {
+	switch {
+	case (t.Handle == "") == (t.ContextFile == ""):
+		return errors.New("exactly one of handle and context-file must be given")
+	case t.Handle != "" && !tpm2HandleRx.MatchString(t.Handle):
+		return errors.New("handle must be a persistent handle like 0x81000001")
+	case t.ContextFile != "" && !strings.HasPrefix(t.ContextFile, "/"):
+		return errors.New("context-file must be an absolute path")
+	case t.PCRs != "" && !tpm2PCRsRx.MatchString(t.PCRs):
+		return errors.New("pcrs must be a PCR selection like sha256:0,2,4,7")
+	}
+	return nil
+}
+
+//String returns a description of the key source for log messages.
+func (t TPM2KeySource) String() string {
+	if t.Handle != "" {
+		return "TPM2 object " + t.Handle
+	}
+	return "TPM2 object " + t.ContextFile
+}
+
+//Unseal asks the TPM2 for the sealed key, using tpm2_unseal(1) in the chroot.
+func (t TPM2KeySource) Unseal() (string, error) {
+	cmd := []string{"tpm2_unseal", "-c", t.Handle}
+	if t.ContextFile != "" {
+		cmd[2] = t.ContextFile
+	}
+	if t.PCRs != "" {
+		cmd = append(cmd, "-p", "pcr:"+t.PCRs)
+	}
+	//stdout contains the key, so it must not be logged
+	stdout, ok := command.Command{SecretOutput: true}.Run(cmd...)
+	if !ok {
+		return "", errors.New("tpm2_unseal failed (do the PCRs still have the expected values?)")
+	}
+	secret := strings.TrimSuffix(strings.TrimSuffix(stdout, "\n"), "\r")
+	if secret == "" {
+		return "", errors.New("key is empty")
+	}
+	return secret, nil
+}
+
+//UnsealTPM2Keys unseals those encryption keys that are sealed into the TPM2
+//of this machine. This happens once during startup, before the converger
+//thread starts, but after StartHelpers() since the TPM may only be reachable
+//through a helper (e.g. a resource manager). Since the helpers are logging by
+//then, this relies on util.AddRedactedSecret() being safe for concurrent use.
+func UnsealTPM2Keys() {
+	for idx := range Config.Keys {
+		key := &Config.Keys[idx]
+		if key.TPM2 == nil {
+			continue
+		}
+		secret, err := key.TPM2.Unseal()
+		if err != nil {
+			util.LogFatal("cannot unseal encryption key #%d from %s: %s", idx+1, key.TPM2.String(), err.Error())
+		}
+		util.AddRedactedSecret(secret)
+		key.Secret = secrets.AuthPassword(secret)
+	}
+}
@@ -0,0 +1,191 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//VaultKeySource appears in type Configuration. It references an encryption
+//key that is stored in HashiCorp Vault (in a KV secrets engine of version 1
+//or 2).
+type VaultKeySource struct {
+	Address string `yaml:"addr"`
+	Path    string `yaml:"path"`
+	Field   string `yaml:"field"`
+	//To authenticate, either a token is read from TokenFile (e.g. as written
+	//by Vault Agent), or a short-lived token is obtained with the AppRole
+	//credentials (and revoked after use).
+	TokenFile    string `yaml:"token-file"`
+	RoleID       string `yaml:"role-id"`
+	SecretIDFile string `yaml:"secret-id-file"`
+}
+
+//How long each request to Vault may take.
+const vaultRequestTimeout = 30 * time.Second
+
+//Validate checks the key source configuration.
+func (v VaultKeySource) Validate() error {
+	u, err := url.Parse(v.Address)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid addr %q: expected a URL like https://vault.example.com:8200", v.Address)
+	}
+	if v.Path == "" || v.Field == "" {
+		return errors.New("path and field must be given")
+	}
+	useAppRole := v.RoleID != "" || v.SecretIDFile != ""
+	switch {
+	case v.TokenFile != "" && useAppRole:
+		return errors.New("token-file cannot be combined with role-id and secret-id-file")
+	case v.TokenFile == "" && !useAppRole:
+		return errors.New("either token-file or role-id and secret-id-file must be given")
+	case useAppRole && (v.RoleID == "" || v.SecretIDFile == ""):
+		return errors.New("role-id and secret-id-file must be given together")
+	}
+	return nil
+}
+
+//Describes the key source in log messages.
+func (v VaultKeySource) String() string {
+	return "Vault at " + strings.TrimSuffix(v.Address, "/") + "/v1/" + v.Path
+}
+
+//Fetch reads the encryption key from Vault.
+func (v VaultKeySource) Fetch(client *http.Client) (string, error) {
+	token, err := v.token(client)
+	if err != nil {
+		return "", err
+	}
+	if v.TokenFile == "" {
+		defer v.revokeToken(client, token)
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = v.request(client, http.MethodGet, v.Path, token, nil, &resp)
+	if err != nil {
+		return "", err
+	}
+	data := resp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested //KV version 2
+	}
+	value, ok := data[v.Field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("secret at %s does not have a field %q", v.Path, v.Field)
+	}
+	return value, nil
+}
+
+func (v VaultKeySource) token(client *http.Client) (string, error) {
+	if v.TokenFile != "" {
+		buf, err := ioutil.ReadFile(v.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(buf)), nil
+	}
+
+	buf, err := ioutil.ReadFile(v.SecretIDFile)
+	if err != nil {
+		return "", err
+	}
+	body := map[string]string{"role_id": v.RoleID, "secret_id": strings.TrimSpace(string(buf))}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err = v.request(client, http.MethodPost, "auth/approle/login", "", body, &resp)
+	if err != nil {
+		return "", fmt.Errorf("AppRole login failed: %s", err.Error())
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+//Revokes a token that was obtained by AppRole login. Failures are not fatal
+//since the token expires by itself.
+func (v VaultKeySource) revokeToken(client *http.Client, token string) {
+	err := v.request(client, http.MethodPost, "auth/token/revoke-self", token, nil, nil)
+	if err != nil {
+		util.LogError("cannot revoke token obtained from %s: %s", v.String(), err.Error())
+	}
+}
+
+//Sends a request to the Vault API (the path is relative to /v1/) and decodes
+//the response body into `result` (unless nil).
+func (v VaultKeySource) request(client *http.Client, method, path, token string, body, result interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+	reqURL := strings.TrimSuffix(v.Address, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(respBody, &errResp) == nil && len(errResp.Errors) > 0 {
+			return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.Join(errResp.Errors, ", "))
+		}
+		return fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
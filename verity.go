@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sapcc/swift-drive-autopilot/pkg/os"
+	"github.com/sapcc/swift-drive-autopilot/pkg/util"
+)
+
+//VerityVolume appears in type Configuration. It describes a read-only volume
+//with static content (e.g. software images) that is protected by dm-verity,
+//and mounted next to the Swift drives.
+type VerityVolume struct {
+	Name       string `yaml:"name"`
+	DataDevice string `yaml:"data-device"`
+	HashDevice string `yaml:"hash-device"`
+	RootHash   string `yaml:"root-hash"`
+	//MountPath defaults to /srv/verity/<name>.
+	MountPath string `yaml:"mount-path"`
+}
+
+var verityVolumeNameRx = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+//Validate checks the verity volume configuration, and fills in the default
+//mount path.
+func (v *VerityVolume) Validate() string {
+	if !verityVolumeNameRx.MatchString(v.Name) {
+		return "name must consist of letters, digits, dashes and underscores only"
+	}
+	if !strings.HasPrefix(v.DataDevice, "/") || !strings.HasPrefix(v.HashDevice, "/") {
+		return "data-device and hash-device must be absolute paths"
+	}
+	if buf, err := hex.DecodeString(v.RootHash); err != nil || len(buf) < 16 {
+		return "root-hash must be a hex-encoded hash"
+	}
+	if v.MountPath == "" {
+		v.MountPath = "/srv/verity/" + v.Name
+	}
+	mountPath := filepath.Clean(v.MountPath)
+	if !strings.HasPrefix(mountPath, "/") || mountPath == "/srv/node" || strings.HasPrefix(mountPath, "/srv/node/") {
+		return "mount-path must be an absolute path outside of /srv/node"
+	}
+	return ""
+}
+
+//MappingName returns the name of the dm-verity mapping for this volume.
+func (v VerityVolume) MappingName() string {
+	return "verity-" + v.Name
+}
+
+//The canonical device paths of all data and hash devices of verity volumes
+//(filled by SetupVerityVolumes). These devices are not set up as Swift
+//drives, even if they match the drive globs. This is only written before the
+//converger starts.
+var verityDevicePaths = make(map[string]bool)
+
+//SetupVerityVolumes opens the dm-verity mappings of all configured verity
+//volumes, and mounts them read-only. Since the volumes are not required by
+//Swift, failures are logged, but do not prevent the drive setup.
+func SetupVerityVolumes(osi os.Interface) {
+	for _, v := range Config.VerityVolumes {
+		for _, devicePath := range []string{v.DataDevice, v.HashDevice} {
+			verityDevicePaths[canonicalDevicePath(devicePath)] = true
+		}
+
+		mappedDevicePath, ok := osi.OpenVerityDevice(v.DataDevice, v.HashDevice, v.MappingName(), v.RootHash)
+		if !ok {
+			util.LogError("cannot open verity volume %s", v.Name)
+			continue
+		}
+		ok = os.ForeachMountScope(func(scope os.MountScope) bool {
+			return osi.MountDevice(mappedDevicePath, v.MountPath, []string{"ro"}, scope)
+		})
+		if !ok {
+			util.LogError("cannot mount verity volume %s at %s", v.Name, v.MountPath)
+		}
+	}
+}
+
+//isVerityDevice returns whether the given device belongs to a verity volume.
+func isVerityDevice(devicePath string) bool {
+	if len(verityDevicePaths) == 0 {
+		return false
+	}
+	return verityDevicePaths[canonicalDevicePath(devicePath)]
+}
+
+//Resolves symlinks (e.g. below /dev/disk) in the given device path. If that
+//fails, the path is returned unchanged.
+func canonicalDevicePath(devicePath string) string {
+	resolved, err := resolveInChroot(".", strings.TrimPrefix(devicePath, "/"))
+	if err != nil {
+		return devicePath
+	}
+	return "/" + resolved
+}
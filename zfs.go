@@ -0,0 +1,42 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+//Characters that are replaced when deriving a drive ID from a zvol name (the
+//same ones that are replaced in serial numbers).
+var zvolNameRx = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+//Zvols do not have serial numbers, and their /dev/zdN device names can change
+//across reboots, so drives that were found below /dev/zvol are identified by
+//the zvol's name instead (e.g. "zvol-tank-swift1" for /dev/zvol/tank/swift1).
+//Returns an empty string for other drives.
+func zvolSerialNumber(foundAtPath string) string {
+	const prefix = "/dev/zvol/"
+	if !strings.HasPrefix(foundAtPath, prefix) {
+		return ""
+	}
+	name := strings.TrimPrefix(foundAtPath, prefix)
+	return "zvol-" + zvolNameRx.ReplaceAllString(name, "-")
+}